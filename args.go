@@ -17,10 +17,50 @@ var civAddress byte
 var serialTCPPort uint16
 var enableSerialDevice bool
 var rigctldPort uint16
+var flrigPort uint16
+var tciPort uint16
 var runCmd string
 var runCmdOnSerialPortCreated string
 var statusLogInterval time.Duration
 var setDataModeOnTx bool
+var disableTUI bool
+var bandStackFile string
+var keymapFile string
+var scriptDir string
+var scheduleFile string
+var hooksFile string
+var bandDataBCDOut string
+var bandDataCATPTY string
+var bandDataBroadcast string
+var radioInfoAddress string
+var captureFile string
+var jitterBufferMin time.Duration
+var jitterBufferMax time.Duration
+var txRedundancy string
+var txSeqBufLength time.Duration
+var rxSeqBufLength time.Duration
+var bufferAutoTune bool
+var reconnectMinWait time.Duration
+var reconnectMaxWait time.Duration
+var reconnectProbe bool
+var replayFile string
+var decodeFile string
+var decodeLuaDissector bool
+var scanFreqs string
+var scanMems string
+var scanStep uint
+var scanPriorityFreq string
+var scanStopSLevel string
+var scanStopOnSquelch bool
+var scanResume string
+var scanTimeout time.Duration
+var scanLogFile string
+var sweepFreqs string
+var sweepStep uint
+var sweepInterval time.Duration
+var sweepCount int
+var sweepCSVFile string
+var sweepPNGFile string
 
 func parseArgs() {
 	h := getopt.BoolLong("help", 'h', "display help")
@@ -33,19 +73,107 @@ func parseArgs() {
 	t := getopt.Uint16Long("serial-tcp-port", 't', 4531, "Expose radio's serial port on this TCP port")
 	s := getopt.BoolLong("enable-serial-device", 's', "Expose radio's serial port as a virtual serial port")
 	r := getopt.Uint16Long("rigctld-port", 'r', 4532, "Use this TCP port for the internal rigctld")
+	fp := getopt.Uint16Long("flrig-port", 0, 12345, "Use this TCP port for the flrig compatible XML-RPC server, 0 to disable")
+	tp := getopt.Uint16Long("tci-port", 0, 40001, "Use this TCP port for the TCI server, 0 to disable")
 	e := getopt.StringLong("exec", 'e', "", "Exec cmd when connected")
 	o := getopt.StringLong("exec-serial", 'o', "socat /tmp/kappanhang-IC-705.pty /tmp/vmware.pty", "Exec cmd when virtual serial port is created, set to - to disable")
 	i := getopt.Uint16Long("log-interval", 'i', 100, "Status bar/log interval in milliseconds")
 	d := getopt.BoolLong("set-data-tx", 'd', "Automatically enable data mode on TX")
+	nt := getopt.BoolLong("no-tui", 0, "Use the status bar instead of the full-screen terminal UI")
+	km := getopt.StringLong("keymap-file", 0, getDefaultKeymapFile(), "Load key bindings from this file, set to - to disable")
+	pk := getopt.BoolLong("print-keymap", 0, "Print the default key bindings and the available actions, then exit")
+	sd := getopt.StringLong("script-dir", 0, getDefaultScriptDir(), "Load scripts from this directory, set to - to disable")
+	sc := getopt.StringLong("schedule-file", 0, getDefaultScheduleFile(), "Store scheduled actions in this file, set to - to disable")
+	hf := getopt.StringLong("hooks-file", 0, getDefaultHooksFile(), "Load event hook commands from this file, set to - to disable")
+	bo := getopt.StringLong("band-bcd-out", 0, "", "Write the Yaesu style BCD band code to this file, or to 4 comma separated GPIO value files")
+	bp := getopt.StringLong("band-cat-pty", 0, "", "Echo the frequency in Kenwood CAT format (for amplifiers) on a pty symlinked to this path")
+	bb := getopt.StringLong("band-broadcast", 0, "", "Send band changes to udp:host:port, or serve them on tcp:[host]:port")
+	cf := getopt.StringLong("capture", 0, "", "Capture all RS-BA1 packets to this pcapng file")
+	jn := getopt.Uint16Long("jitter-buffer-min", 0, 20, "Minimum RX jitter buffer depth in milliseconds")
+	jx := getopt.Uint16Long("jitter-buffer-max", 0, 200, "Maximum RX jitter buffer depth in milliseconds")
+	tb := getopt.Uint16Long("tx-buffer", 0, 300, "Radio side TX buffer length in milliseconds (50-500)")
+	rb := getopt.Uint16Long("rx-buffer", 0, 100, "Initial RX buffer length in milliseconds, between the jitter buffer bounds")
+	ba := getopt.BoolLong("buffer-auto-tune", 0, "Tune buffer lengths from the latency and loss during the first minute")
+	tr := getopt.StringLong("tx-redundancy", 0, "off", "Send TX audio packets twice: off, on, or auto (after retransmit requests)")
+	rn := getopt.UintLong("reconnect-min-wait", 0, 1, "Wait this many seconds before the first reconnect attempt")
+	rx := getopt.UintLong("reconnect-max-wait", 0, 65, "Max. seconds to wait between reconnect attempts")
+	np := getopt.BoolLong("no-reconnect-probe", 0, "Don't check if the radio is reachable before reconnect attempts")
+	ri := getopt.StringLong("radioinfo", 0, "", "Send N1MM style RadioInfo UDP packets to this host[:port] (default port 12060)")
+	bs := getopt.StringLong("band-stack-file", 0, getDefaultBandStackFile(), "Store band stacking registers in this file, set to - to disable")
+	sf := getopt.StringLong("scan-freqs", 0, "", "Scan these frequencies in MHz, ranges are also accepted (example: 145.5,146.52,7.0-7.2)")
+	sm := getopt.StringLong("scan-mems", 0, "", "Scan these memory channels, ranges are also accepted (example: 1-10,15)")
+	ss := getopt.UintLong("scan-step", 0, 5000, "Scan range step in Hz")
+	sp := getopt.StringLong("scan-priority", 0, "", "Priority channel frequency in MHz, checked every 5 seconds while scanning")
+	sl := getopt.StringLong("scan-s-level", 0, "", "Stop scanning if the S meter is at least this value (example: S5, S9+10)")
+	sq := getopt.BoolLong("scan-sql", 0, "Stop scanning if the squelch is open (default if no S level is given)")
+	sr := getopt.StringLong("scan-resume", 0, "carrier", "Scan resume rule: carrier, hold, or seconds to wait")
+	st := getopt.UintLong("scan-timeout", 0, 0, "Stop scanning after this many seconds, 0 to disable")
+	sg := getopt.StringLong("scan-log", 0, "", "Append scan hits to this CSV file")
+	wf := getopt.StringLong("sweep-freqs", 0, "", "Sweep these frequency ranges in MHz and log the S meter (example: 7.0-7.2)")
+	ws := getopt.UintLong("sweep-step", 0, 5000, "Sweep step in Hz")
+	wi := getopt.UintLong("sweep-interval", 0, 60, "Start a new sweep in this many seconds")
+	wn := getopt.IntLong("sweep-count", 0, 0, "Stop after this many sweeps, 0 to sweep until stopped")
+	wc := getopt.StringLong("sweep-csv", 0, "", "Append sweep results to this CSV file")
+	wp := getopt.StringLong("sweep-png", 0, "", "Write sweep results as a heatmap to this PNG file")
 
+	getopt.SetParameters("[replay|decode capture.pcapng] [decode --lua-dissector]")
 	getopt.Parse()
 
-	if *h || *a == "" || (*q && *v) {
+	var badArgs bool
+	if args := getopt.Args(); len(args) > 0 {
+		switch args[0] {
+		case "replay":
+			if len(args) != 2 {
+				badArgs = true
+			} else {
+				replayFile = args[1]
+			}
+		case "decode":
+			switch {
+			case len(args) != 2:
+				badArgs = true
+			case args[1] == "--lua-dissector":
+				decodeLuaDissector = true
+			default:
+				decodeFile = args[1]
+			}
+		default:
+			badArgs = true
+		}
+	}
+
+	if *jn == 0 || *jn > *jx {
+		badArgs = true
+	}
+	if time.Duration(*tb)*time.Millisecond < minTxSeqBufLength || time.Duration(*tb)*time.Millisecond > maxTxSeqBufLength {
+		badArgs = true
+	}
+	if *rb < *jn || *rb > *jx {
+		badArgs = true
+	}
+	if *sf != "" && *sm != "" {
+		badArgs = true
+	}
+	if *rn == 0 || *rn > *rx {
+		badArgs = true
+	}
+	switch *tr {
+	case "off", "on", "auto":
+	default:
+		badArgs = true
+	}
+
+	if *h || *a == "" || (*q && *v) || badArgs {
 		fmt.Println(getAboutStr())
 		getopt.Usage()
 		os.Exit(1)
 	}
 
+	if *pk {
+		keymap.printDefaults()
+		os.Exit(0)
+	}
+
 	verboseLog = *v
 	quietLog = *q
 	connectAddress = *a
@@ -55,8 +183,60 @@ func parseArgs() {
 	serialTCPPort = *t
 	enableSerialDevice = *s
 	rigctldPort = *r
+	flrigPort = *fp
+	tciPort = *tp
 	runCmd = *e
 	runCmdOnSerialPortCreated = *o
 	statusLogInterval = time.Duration(*i) * time.Millisecond
 	setDataModeOnTx = *d
+	disableTUI = *nt
+	keymapFile = *km
+	scriptDir = *sd
+	scheduleFile = *sc
+	hooksFile = *hf
+	bandDataBCDOut = *bo
+	bandDataCATPTY = *bp
+	bandDataBroadcast = *bb
+	radioInfoAddress = *ri
+	captureFile = *cf
+	jitterBufferMin = time.Duration(*jn) * time.Millisecond
+	jitterBufferMax = time.Duration(*jx) * time.Millisecond
+	txRedundancy = *tr
+	txSeqBufLength = time.Duration(*tb) * time.Millisecond
+	rxSeqBufLength = time.Duration(*rb) * time.Millisecond
+	bufferAutoTune = *ba
+	reconnectMinWait = time.Duration(*rn) * time.Second
+	reconnectMaxWait = time.Duration(*rx) * time.Second
+	reconnectProbe = !*np
+	bandStackFile = *bs
+	scanFreqs = *sf
+	scanMems = *sm
+	scanStep = *ss
+	scanPriorityFreq = *sp
+	scanStopSLevel = *sl
+	scanStopOnSquelch = *sq
+	scanResume = *sr
+	scanTimeout = time.Duration(*st) * time.Second
+	scanLogFile = *sg
+	sweepFreqs = *wf
+	sweepStep = *ws
+	sweepInterval = time.Duration(*wi) * time.Second
+	sweepCount = *wn
+	sweepCSVFile = *wc
+	sweepPNGFile = *wp
+	if keymapFile == "-" {
+		keymapFile = ""
+	}
+	if scriptDir == "-" {
+		scriptDir = ""
+	}
+	if scheduleFile == "-" {
+		scheduleFile = ""
+	}
+	if hooksFile == "-" {
+		hooksFile = ""
+	}
+	if bandStackFile == "-" {
+		bandStackFile = ""
+	}
 }
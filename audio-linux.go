@@ -19,7 +19,11 @@ const audioSampleBytes = 2
 const pulseAudioBufferLength = 100 * time.Millisecond
 const audioFrameLength = 20 * time.Millisecond
 const audioFrameSize = int((audioSampleRate * audioSampleBytes * audioFrameLength) / time.Second)
-const maxPlayBufferSize = audioFrameSize*5 + int((audioSampleRate*audioSampleBytes*audioRxSeqBufLength)/time.Second)
+
+// The RX seqbufs can hold back up to jitterBufferMax of audio, which is played at once when it's released.
+func maxPlayBufferSize() int {
+	return audioFrameSize*5 + int((audioSampleRate*audioSampleBytes*jitterBufferMax)/time.Second)
+}
 
 type audioStruct struct {
 	devName string
@@ -32,6 +36,11 @@ type audioStruct struct {
 	// Read from this channel for audio.
 	rec chan []byte
 
+	capture struct {
+		mutex  sync.Mutex
+		writer *wavWriter
+	}
+
 	virtualSoundcardStream struct {
 		source papipes.Source
 		sink   papipes.Sink
@@ -122,6 +131,91 @@ func (a *audioStruct) toggleRecFromDefaultSoundcard() {
 	}
 }
 
+func (a *audioStruct) setRecFromDefaultSoundcard(enable bool) {
+	if enable != (a.defaultSoundcardStream.recStream != nil) {
+		a.toggleRecFromDefaultSoundcard()
+	}
+}
+
+// Transmits the audio of the given WAV file with PTT on. Returns when the whole file has been sent,
+// or when stopChan gets closed.
+func (a *audioStruct) transmitFile(path string, stopChan chan bool) error {
+	d, err := readWAVFile(path)
+	if err != nil {
+		return err
+	}
+
+	civControl.state.mutex.Lock()
+	err = civControl.setPTT(true)
+	civControl.state.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		civControl.state.mutex.Lock()
+		if err := civControl.setPTT(false); err != nil {
+			log.Error("can't turn off ptt: ", err)
+		}
+		civControl.state.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(audioFrameLength)
+	defer ticker.Stop()
+
+	for len(d) > 0 {
+		// The last frame gets padded with silence.
+		b := make([]byte, audioFrameSize)
+		n := copy(b, d)
+		d = d[n:]
+
+		select {
+		case a.rec <- b:
+		case <-stopChan:
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Writes the received audio to the given WAV file for the given duration, or until stopChan gets closed.
+func (a *audioStruct) captureToFile(path string, d time.Duration, stopChan chan bool) error {
+	w, err := newWAVWriter(path)
+	if err != nil {
+		return err
+	}
+
+	a.capture.mutex.Lock()
+	if a.capture.writer != nil {
+		a.capture.mutex.Unlock()
+		_ = w.Close()
+		_ = os.Remove(path)
+		return errors.New("audio capture is already running")
+	}
+	a.capture.writer = w
+	a.capture.mutex.Unlock()
+	log.Print("capturing audio to ", path)
+
+	select {
+	case <-time.After(d):
+	case <-stopChan:
+	}
+
+	a.capture.mutex.Lock()
+	defer a.capture.mutex.Unlock()
+	// The writer is cleared on write errors.
+	if a.capture.writer != w {
+		return errors.New("audio capture failed")
+	}
+	a.capture.writer = nil
+	log.Print("audio capture to ", path, " finished")
+	return w.Close()
+}
+
 func (a *audioStruct) doTogglePlaybackToDefaultSoundcard() {
 	if a.defaultSoundcardStream.playStream == nil {
 		log.Print("turned on audio playback")
@@ -356,8 +450,20 @@ func (a *audioStruct) loop() {
 			return
 		}
 
+		a.capture.mutex.Lock()
+		if a.capture.writer != nil {
+			if _, err := a.capture.writer.Write(d); err != nil {
+				log.Error("can't write audio capture: ", err)
+				_ = a.capture.writer.Close()
+				a.capture.writer = nil
+			}
+		}
+		a.capture.mutex.Unlock()
+
+		tci.reportRxAudio(d)
+
 		a.virtualSoundcardStream.mutex.Lock()
-		free := maxPlayBufferSize - a.virtualSoundcardStream.playBuf.Len()
+		free := maxPlayBufferSize() - a.virtualSoundcardStream.playBuf.Len()
 		if free < len(d) {
 			b := make([]byte, len(d)-free)
 			_, _ = a.virtualSoundcardStream.playBuf.Read(b)
@@ -373,7 +479,7 @@ func (a *audioStruct) loop() {
 
 		if a.defaultSoundcardStream.playStream != nil {
 			a.defaultSoundcardStream.mutex.Lock()
-			free := maxPlayBufferSize - a.defaultSoundcardStream.playBuf.Len()
+			free := maxPlayBufferSize() - a.defaultSoundcardStream.playBuf.Len()
 			if free < len(d) {
 				b := make([]byte, len(d)-free)
 				_, _ = a.defaultSoundcardStream.playBuf.Read(b)
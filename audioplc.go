@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Packet loss concealment for the RX audio stream. Missing packets are replaced by repeating the last pitch
+// period of the received audio, fading out to silence, and the next received packet is crossfaded with the
+// repeated waveform, so the audio stays continuous and there are no clicks at the gaps.
+
+const audioPLCHistoryLength = 20 * time.Millisecond
+const audioPLCMinPitchPeriod = 2500 * time.Microsecond
+const audioPLCMaxPitchPeriod = 15 * time.Millisecond
+const audioPLCFadeOutLength = 60 * time.Millisecond
+const audioPLCCrossfadeLength = 2500 * time.Microsecond
+const audioPLCMaxConcealedPkts = 10
+
+// The length of an RX audio packet. The actual length is tracked, as the radio sends packets of different
+// lengths.
+const audioPLCDefaultPktLength = 10 * time.Millisecond
+
+type audioPLCStruct struct {
+	history []int16
+	pktLen  int // Smoothed length of the received packets in samples.
+
+	// State of the waveform repetition.
+	concealing   bool
+	pitchPeriod  int
+	pos          int
+	gain         float64
+	gainDecrease float64
+}
+
+func (p *audioPLCStruct) samplesFor(d time.Duration) int {
+	return int((audioSampleRate * d) / time.Second)
+}
+
+// Returns the autocorrelation based pitch period of the history in samples.
+func (p *audioPLCStruct) findPitchPeriod() int {
+	minPeriod := p.samplesFor(audioPLCMinPitchPeriod)
+	maxPeriod := p.samplesFor(audioPLCMaxPitchPeriod)
+	if maxPeriod > len(p.history)/2 {
+		maxPeriod = len(p.history) / 2
+	}
+	if maxPeriod < minPeriod {
+		return len(p.history)
+	}
+
+	// Correlating the last maxPeriod samples with the preceding ones.
+	end := len(p.history)
+	matchLen := maxPeriod
+	bestPeriod := minPeriod
+	var bestCorr float64
+	for period := minPeriod; period <= maxPeriod; period++ {
+		var corr, energy float64
+		for i := end - matchLen; i < end; i++ {
+			a := float64(p.history[i])
+			b := float64(p.history[i-period])
+			corr += a * b
+			energy += b * b
+		}
+		if energy == 0 {
+			continue
+		}
+		if c := corr / energy; c > bestCorr {
+			bestCorr = c
+			bestPeriod = period
+		}
+	}
+	return bestPeriod
+}
+
+// Returns the next sample of the repeated waveform.
+func (p *audioPLCStruct) nextSample() int16 {
+	if p.gain <= 0 || len(p.history) == 0 {
+		return 0
+	}
+	v := float64(p.history[len(p.history)-p.pitchPeriod+p.pos]) * p.gain
+	p.pos = (p.pos + 1) % p.pitchPeriod
+	p.gain -= p.gainDecrease
+	return int16(v)
+}
+
+// Returns the audio data to play instead of the given number of missing packets.
+func (p *audioPLCStruct) conceal(missingPkts int) []byte {
+	if len(p.history) == 0 || missingPkts <= 0 {
+		return nil
+	}
+	if missingPkts > audioPLCMaxConcealedPkts {
+		missingPkts = audioPLCMaxConcealedPkts
+	}
+
+	if !p.concealing {
+		p.concealing = true
+		p.pitchPeriod = p.findPitchPeriod()
+		p.pos = 0
+		p.gain = 1
+		p.gainDecrease = 1 / float64(p.samplesFor(audioPLCFadeOutLength))
+	}
+
+	d := make([]byte, missingPkts*p.pktLen*audioSampleBytes)
+	for i := 0; i < len(d); i += audioSampleBytes {
+		binary.LittleEndian.PutUint16(d[i:], uint16(p.nextSample()))
+	}
+	return d
+}
+
+// Has to be called with every received packet. Returns the data to play.
+func (p *audioPLCStruct) received(d []byte) []byte {
+	samples := make([]int16, len(d)/audioSampleBytes)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(d[i*audioSampleBytes:]))
+	}
+
+	if p.pktLen == 0 {
+		p.pktLen = p.samplesFor(audioPLCDefaultPktLength)
+	}
+	p.pktLen += (len(samples) - p.pktLen) / 8
+
+	if p.concealing {
+		p.concealing = false
+		d = make([]byte, len(d))
+		crossfadeLen := p.samplesFor(audioPLCCrossfadeLength)
+		for i := range samples {
+			if i < crossfadeLen {
+				w := float64(i) / float64(crossfadeLen)
+				samples[i] = int16(float64(samples[i])*w + float64(p.nextSample())*(1-w))
+			}
+			binary.LittleEndian.PutUint16(d[i*audioSampleBytes:], uint16(samples[i]))
+		}
+	}
+
+	p.history = append(p.history, samples...)
+	if maxLen := p.samplesFor(audioPLCHistoryLength); len(p.history) > maxLen {
+		p.history = p.history[len(p.history)-maxLen:]
+	}
+	return d
+}
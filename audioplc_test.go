@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+const testPLCAmplitude = 10000
+
+// Returns a packet of a 200Hz sine wave, starting at the given sample position.
+func getTestPLCPkt(p *audioPLCStruct, pos int) []byte {
+	d := make([]byte, p.samplesFor(audioPLCDefaultPktLength)*audioSampleBytes)
+	for i := 0; i < len(d)/audioSampleBytes; i++ {
+		v := testPLCAmplitude * math.Sin(2*math.Pi*200*float64(pos+i)/audioSampleRate)
+		binary.LittleEndian.PutUint16(d[i*audioSampleBytes:], uint16(int16(v)))
+	}
+	return d
+}
+
+func getTestPLCSamples(d []byte) []int16 {
+	samples := make([]int16, len(d)/audioSampleBytes)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(d[i*audioSampleBytes:]))
+	}
+	return samples
+}
+
+// Feeds the PLC with a few received packets, returns the sample position after them.
+func receiveTestPLCPkts(t *testing.T, p *audioPLCStruct) (pos int) {
+	for i := 0; i < 3; i++ {
+		d := getTestPLCPkt(p, pos)
+		if res := p.received(d); string(res) != string(d) {
+			t.Fatal("received packet has been changed without packet loss")
+		}
+		pos += len(d) / audioSampleBytes
+	}
+	return
+}
+
+func TestAudioPLCConcealLength(t *testing.T) {
+	var p audioPLCStruct
+	if d := p.conceal(1); d != nil {
+		t.Errorf("got %d bytes without history", len(d))
+	}
+
+	receiveTestPLCPkts(t, &p)
+	pktBytes := p.samplesFor(audioPLCDefaultPktLength) * audioSampleBytes
+	for _, tt := range []struct {
+		missingPkts int
+		pkts        int
+	}{
+		{0, 0},
+		{1, 1},
+		{3, 3},
+		{audioPLCMaxConcealedPkts, audioPLCMaxConcealedPkts},
+		{audioPLCMaxConcealedPkts + 15, audioPLCMaxConcealedPkts},
+	} {
+		if d := p.conceal(tt.missingPkts); len(d) != tt.pkts*pktBytes {
+			t.Errorf("conceal(%d) returned %d bytes, want %d", tt.missingPkts, len(d), tt.pkts*pktBytes)
+		}
+	}
+}
+
+func TestAudioPLCFadeOut(t *testing.T) {
+	var p audioPLCStruct
+	receiveTestPLCPkts(t, &p)
+
+	if period := p.findPitchPeriod(); period != p.samplesFor(5*time.Millisecond) {
+		t.Errorf("got pitch period %d, want %d", period, p.samplesFor(5*time.Millisecond))
+	}
+
+	// More packets than the fade out length.
+	samples := getTestPLCSamples(p.conceal(audioPLCMaxConcealedPkts + 1))
+	fadeOutLen := p.samplesFor(audioPLCFadeOutLength)
+	for i, v := range samples {
+		if math.Abs(float64(v)) > testPLCAmplitude {
+			t.Fatalf("sample %d is out of bounds: %d", i, v)
+		}
+		if i >= fadeOutLen {
+			if v != 0 {
+				t.Fatalf("sample %d is not silent after the fade out: %d", i, v)
+			}
+			continue
+		}
+		// The gain decreases linearly.
+		if limit := testPLCAmplitude*(1-float64(i)/float64(fadeOutLen)) + 1; math.Abs(float64(v)) > limit {
+			t.Fatalf("sample %d has not been faded: %d > %v", i, v, limit)
+		}
+	}
+	// The repeated waveform continues the sine wave, so its first peak is at the quarter of the period.
+	if v := samples[p.pitchPeriod/4]; v < testPLCAmplitude*0.9 {
+		t.Errorf("got %d at the first peak of the concealment", v)
+	}
+
+	// Concealing continues with silence.
+	for i, v := range getTestPLCSamples(p.conceal(1)) {
+		if v != 0 {
+			t.Fatalf("sample %d is not silent: %d", i, v)
+		}
+	}
+}
+
+func TestAudioPLCCrossfade(t *testing.T) {
+	var p audioPLCStruct
+	pos := receiveTestPLCPkts(t, &p)
+	concealed := getTestPLCSamples(p.conceal(1))
+	pos += len(concealed)
+
+	// The first sample of the received packet continues the repeated waveform.
+	next := p
+	want := next.nextSample()
+
+	d := getTestPLCPkt(&p, pos)
+	in := getTestPLCSamples(d)
+	out := getTestPLCSamples(p.received(d))
+	if len(out) != len(in) {
+		t.Fatalf("got %d samples, want %d", len(out), len(in))
+	}
+	if out[0] != want {
+		t.Errorf("first sample is %d, want %d", out[0], want)
+	}
+	crossfadeLen := p.samplesFor(audioPLCCrossfadeLength)
+	for i := range in {
+		if math.Abs(float64(out[i])) > testPLCAmplitude {
+			t.Fatalf("sample %d is out of bounds: %d", i, out[i])
+		}
+		if i >= crossfadeLen && out[i] != in[i] {
+			t.Fatalf("sample %d after the crossfade is %d, want %d", i, out[i], in[i])
+		}
+	}
+	if p.concealing {
+		t.Error("still concealing after a received packet")
+	}
+
+	// Without packet loss, the next packet is played as it is.
+	pos += len(in)
+	d = getTestPLCPkt(&p, pos)
+	if res := p.received(d); string(res) != string(d) {
+		t.Error("received packet has been changed without packet loss")
+	}
+}
+
+// Concealing is limited to audioPLCMaxConcealedPkts packets at once, which is longer than the fade out.
+func TestAudioPLCMaxConcealedPkts(t *testing.T) {
+	var p audioPLCStruct
+	receiveTestPLCPkts(t, &p)
+
+	pktSamples := p.samplesFor(audioPLCDefaultPktLength)
+	samples := getTestPLCSamples(p.conceal(audioPLCMaxConcealedPkts * 3))
+	if len(samples) != audioPLCMaxConcealedPkts*pktSamples {
+		t.Fatalf("got %d samples, want %d", len(samples), audioPLCMaxConcealedPkts*pktSamples)
+	}
+	if !p.concealing {
+		t.Error("concealing has been stopped")
+	}
+	for i, v := range getTestPLCSamples(p.conceal(1)) {
+		if v != 0 {
+			t.Fatalf("sample %d after %d concealed packets is not silent: %d", i, audioPLCMaxConcealedPkts, v)
+		}
+	}
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"time"
 )
 
 const audioTimeoutDuration = 5 * time.Second
-const audioRxSeqBufLength = 100 * time.Millisecond
+
+// In auto TX redundancy mode, redundancy is active for this long after the radio requested a retransmit.
+const audioTxRedundancyHoldTime = 30 * time.Second
 
 type audioStream struct {
 	common streamCommon
@@ -17,43 +16,81 @@ type audioStream struct {
 	deinitNeededChan   chan bool
 	deinitFinishedChan chan bool
 
-	timeoutTimer    *time.Timer
+	timeoutTimer    clockTimer
 	receivedAudio   bool
 	lastReceivedSeq uint16
 	serverAudioTime time.Time
 
 	rxSeqBuf          seqBuf
 	rxSeqBufEntryChan chan seqBufEntry
+	plc               audioPLCStruct
 
 	audioSendSeq uint16
+
+	// Packets of the last sent audio frame, resent with the next frame if TX redundancy is active.
+	lastFramePkts         [][]byte
+	txRedundancyWasActive bool
 }
 
-// sendPart1 expects 1364 bytes of PCM data.
-func (s *audioStream) sendPart1(pcmData []byte) error {
-	err := s.common.pkt0.sendTrackedPacket(&s.common,
-		append([]byte{0x6c, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			byte(s.common.localSID >> 24), byte(s.common.localSID >> 16), byte(s.common.localSID >> 8), byte(s.common.localSID),
-			byte(s.common.remoteSID >> 24), byte(s.common.remoteSID >> 16), byte(s.common.remoteSID >> 8), byte(s.common.remoteSID),
-			0x80, 0x00, byte((s.audioSendSeq - 1) >> 8), byte(s.audioSendSeq - 1), 0x00, 0x00, byte(len(pcmData) >> 8), byte(len(pcmData))},
-			pcmData...))
+// The 1920 bytes of PCM data got from the audio device are sent in a 1364 and a 556 bytes long part.
+func (s *audioStream) sendPart(pcmData []byte) error {
+	p := pktAudio{pktHeader: newPktHeader(&s.common, pktTypeData, 0), ident: pktAudioIdent, sendSeq: s.audioSendSeq - 1,
+		data: pcmData}
+	d, err := p.MarshalBinary()
 	if err != nil {
 		return err
 	}
+	// The seqnum is written into d by sendTrackedPacket(), so it can be resent as it is.
+	if err := s.common.pkt0.sendTrackedPacket(&s.common, d); err != nil {
+		return err
+	}
+	s.lastFramePkts = append(s.lastFramePkts, d)
 	s.audioSendSeq++
 	return nil
 }
 
-// sendPart2 expects 556 bytes of PCM data.
-func (s *audioStream) sendPart2(pcmData []byte) error {
-	err := s.common.pkt0.sendTrackedPacket(&s.common, append([]byte{0x44, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		byte(s.common.localSID >> 24), byte(s.common.localSID >> 16), byte(s.common.localSID >> 8), byte(s.common.localSID),
-		byte(s.common.remoteSID >> 24), byte(s.common.remoteSID >> 16), byte(s.common.remoteSID >> 8), byte(s.common.remoteSID),
-		0x80, 0x00, byte((s.audioSendSeq - 1) >> 8), byte(s.audioSendSeq - 1), 0x00, 0x00, byte(len(pcmData) >> 8), byte(len(pcmData))},
-		pcmData...))
-	if err != nil {
+func (s *audioStream) isTxRedundancyActive() bool {
+	switch txRedundancy {
+	case "on":
+		return true
+	case "auto":
+		t := s.common.pkt0.getLastRetransmitRequestAt()
+		return !t.IsZero() && clock.since(t) < audioTxRedundancyHoldTime
+	}
+	return false
+}
+
+// If TX redundancy is active, the packets of the previous frame are sent again after the packets of the
+// current frame. This way a packet lost in a short burst gets to the radio 20ms later, without waiting for a
+// retransmit request, and the radio side buffer length does not have to be raised.
+func (s *audioStream) sendFrame(d []byte) error {
+	prevFramePkts := s.lastFramePkts
+	s.lastFramePkts = nil
+
+	if err := s.sendPart(d[:1364]); err != nil {
 		return err
 	}
-	s.audioSendSeq++
+	if err := s.sendPart(d[1364:1920]); err != nil {
+		return err
+	}
+
+	active := s.isTxRedundancyActive()
+	if active != s.txRedundancyWasActive {
+		if active {
+			log.Print("tx redundancy on")
+		} else {
+			log.Print("tx redundancy off")
+		}
+		s.txRedundancyWasActive = active
+	}
+	if !active {
+		return nil
+	}
+	for _, p := range prevFramePkts {
+		if err := s.common.send(p); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -77,21 +114,26 @@ func (s *audioStream) handleRxSeqBufEntry(e seqBufEntry) {
 			netstat.reportLoss(missingPkts)
 			log.Error("lost ", missingPkts, " audio packets")
 			s.serverAudioTime = s.serverAudioTime.Add(time.Duration(10*missingPkts) * time.Millisecond)
+
+			if d := s.plc.conceal(missingPkts); d != nil {
+				audio.play <- d
+			}
 		}
 		s.serverAudioTime = s.serverAudioTime.Add(10 * time.Millisecond)
 	} else {
-		s.serverAudioTime = time.Now()
+		s.serverAudioTime = clock.now()
 	}
 	s.lastReceivedSeq = gotSeq
 	s.receivedAudio = true
+	statusLog.reportJitterBufferDepth(s.rxSeqBuf.getDepth())
 
-	audio.play <- e.data
+	audio.play <- s.plc.received(e.data)
 }
 
 // var drop int
 
-func (s *audioStream) handleAudioPacket(r []byte) error {
-	gotSeq := binary.LittleEndian.Uint16(r[6:8])
+func (s *audioStream) handleAudioPacket(p *pktAudio) error {
+	gotSeq := p.seq
 
 	// if drop == 0 && time.Now().UnixNano()%10 == 0 {
 	// 	log.Print("drop start - ", gotSeq)
@@ -108,16 +150,16 @@ func (s *audioStream) handleAudioPacket(r []byte) error {
 	// }
 
 	if s.timeoutTimer != nil {
-		s.timeoutTimer.Stop()
-		s.timeoutTimer.Reset(audioTimeoutDuration)
+		s.timeoutTimer.stop()
+		s.timeoutTimer.reset(audioTimeoutDuration)
 	}
 
-	return s.rxSeqBuf.add(seqNum(gotSeq), r[24:])
+	return s.rxSeqBuf.add(seqNum(gotSeq), p.data)
 }
 
-func (s *audioStream) handleRead(r []byte) error {
-	if len(r) >= 580 && (bytes.Equal(r[:6], []byte{0x6c, 0x05, 0x00, 0x00, 0x00, 0x00}) || bytes.Equal(r[:6], []byte{0x44, 0x02, 0x00, 0x00, 0x00, 0x00})) {
-		return s.handleAudioPacket(r)
+func (s *audioStream) handleRead(r receivedPkt) error {
+	if p, ok := r.pkt.(*pktAudio); ok {
+		return s.handleAudioPacket(p)
 	}
 	return nil
 }
@@ -127,19 +169,17 @@ func (s *audioStream) loop() {
 		select {
 		case r := <-s.common.readChan:
 			if err := s.handleRead(r); err != nil {
-				reportError(err)
+				s.common.reportError(err)
 			}
-		case <-s.timeoutTimer.C:
-			reportError(errors.New(fmt.Sprint("audio stream timeout after ",
-				time.Since(statusLog.data.startTime), ", try rebooting the radio")))
+		case <-s.timeoutTimer.c():
+			events.fire("audio-timeout")
+			s.common.reportError(fmt.Errorf("audio stream %w after %v", errTimeout,
+				clock.since(statusLog.data.startTime)))
 		case e := <-s.rxSeqBufEntryChan:
 			s.handleRxSeqBufEntry(e)
 		case d := <-audio.rec:
-			if err := s.sendPart1(d[:1364]); err != nil {
-				reportError(err)
-			}
-			if err := s.sendPart2(d[1364:1920]); err != nil {
-				reportError(err)
+			if err := s.sendFrame(d); err != nil {
+				s.common.reportError(err)
 			}
 		case <-s.deinitNeededChan:
 			s.deinitFinishedChan <- true
@@ -168,9 +208,9 @@ func (s *audioStream) init(devName string) error {
 	log.Print("stream started")
 
 	s.rxSeqBufEntryChan = make(chan seqBufEntry)
-	s.rxSeqBuf.init(audioRxSeqBufLength, 0xffff, 0, s.rxSeqBufEntryChan, s.common.requestRetransmit)
+	s.rxSeqBuf.init(getRxSeqBufLength(), 0xffff, 0, s.rxSeqBufEntryChan, s.common.requestRetransmit)
 
-	s.timeoutTimer = time.NewTimer(audioTimeoutDuration)
+	s.timeoutTimer = clock.newTimer(audioTimeoutDuration)
 
 	s.deinitNeededChan = make(chan bool)
 	s.deinitFinishedChan = make(chan bool)
@@ -184,7 +224,7 @@ func (s *audioStream) deinit() {
 		<-s.deinitFinishedChan
 	}
 	if s.timeoutTimer != nil {
-		s.timeoutTimer.Stop()
+		s.timeoutTimer.stop()
 	}
 	s.common.deinit()
 	s.rxSeqBuf.deinit()
@@ -0,0 +1,117 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/goterm/term"
+)
+
+// Echoes the frequency in Kenwood CAT format (FA00014074000;), which is understood by amplifiers like the
+// Elecraft KPA500 and the ACOM series.
+type bandDataCATStruct struct {
+	mutex   sync.Mutex
+	pty     *term.PTY
+	symlink string
+	freq    uint
+}
+
+func (s *bandDataCATStruct) getFreqCmd() []byte {
+	return []byte(fmt.Sprintf("FA%011d;", s.freq))
+}
+
+func (s *bandDataCATStruct) reportFrequency(freq uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pty == nil || freq == s.freq {
+		return
+	}
+	s.freq = freq
+	if _, err := s.pty.Master.Write(s.getFreqCmd()); err != nil {
+		log.Error("can't write band data cat pty: ", err)
+	}
+}
+
+// Answers frequency queries of the amplifier.
+func (s *bandDataCATStruct) readLoop(pty *term.PTY) {
+	var cmd string
+	b := make([]byte, 64)
+	for {
+		n, err := pty.Master.Read(b)
+		if err != nil {
+			return
+		}
+		cmd += string(b[:n])
+
+		for {
+			i := strings.Index(cmd, ";")
+			if i < 0 {
+				break
+			}
+			c := strings.ToUpper(strings.TrimSpace(cmd[:i]))
+			cmd = cmd[i+1:]
+
+			if c == "FA" {
+				s.mutex.Lock()
+				if s.pty != nil {
+					_, _ = s.pty.Master.Write(s.getFreqCmd())
+				}
+				s.mutex.Unlock()
+			}
+		}
+		if len(cmd) > 64 {
+			cmd = ""
+		}
+	}
+}
+
+func (s *bandDataCATStruct) init(symlink string) (err error) {
+	pty, err := term.OpenPTY()
+	if err != nil {
+		return err
+	}
+
+	var t term.Termios
+	t.Raw()
+	if err = t.Set(pty.Master); err != nil {
+		return err
+	}
+	if err = t.Set(pty.Slave); err != nil {
+		return err
+	}
+
+	n, err := pty.PTSName()
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(symlink)
+	if err := os.Symlink(n, symlink); err != nil {
+		return err
+	}
+	log.Print("opened ", n, " as ", symlink, " for band data")
+
+	s.mutex.Lock()
+	s.pty = pty
+	s.symlink = symlink
+	s.mutex.Unlock()
+
+	go s.readLoop(pty)
+	return nil
+}
+
+func (s *bandDataCATStruct) deinit() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pty == nil {
+		return
+	}
+	s.pty.Close()
+	_ = os.Remove(s.symlink)
+	s.pty = nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Yaesu style band data codes, indexed the same way as civBands. Bands not listed have the code 0.
+var bandDataBCDCodes = []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+type bandDataMsg struct {
+	Band string `json:"band"`
+	BCD  byte   `json:"bcd"`
+	Freq uint   `json:"freq"`
+}
+
+type bandDataStruct struct {
+	mutex   sync.Mutex
+	freq    uint
+	bandIdx int
+
+	// Signals the output loop that the frequency has changed.
+	changedChan chan bool
+
+	bcdFiles    []string
+	udpConn     net.Conn
+	tcpListener net.Listener
+	tcpClients  map[net.Conn]bool
+
+	cat bandDataCATStruct
+
+	deinitNeededChan   chan bool
+	deinitFinishedChan chan bool
+}
+
+var bandData bandDataStruct
+
+func (s *bandDataStruct) getBCDCode(bandIdx int) byte {
+	if bandIdx < len(bandDataBCDCodes) {
+		return bandDataBCDCodes[bandIdx]
+	}
+	return 0
+}
+
+// Can be called with the civcontrol state mutex held.
+func (s *bandDataStruct) reportFrequency(freq uint, bandIdx int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.changedChan == nil || (freq == s.freq && bandIdx == s.bandIdx) {
+		return
+	}
+	s.freq = freq
+	s.bandIdx = bandIdx
+
+	// Non-blocking notify.
+	select {
+	case s.changedChan <- true:
+	default:
+	}
+}
+
+func (s *bandDataStruct) getMsg() []byte {
+	s.mutex.Lock()
+	msg := bandDataMsg{
+		Band: civBands[s.bandIdx].name,
+		BCD:  s.getBCDCode(s.bandIdx),
+		Freq: s.freq,
+	}
+	s.mutex.Unlock()
+
+	b, _ := json.Marshal(msg)
+	return append(b, '\n')
+}
+
+// A single file gets the code as a decimal number, four files (GPIO values) get the A, B, C and D bits.
+func (s *bandDataStruct) writeBCD(code byte) {
+	if len(s.bcdFiles) == 1 {
+		if err := ioutil.WriteFile(s.bcdFiles[0], []byte(fmt.Sprintln(code)), 0644); err != nil {
+			log.Error("can't write band data: ", err)
+		}
+		return
+	}
+	for i, f := range s.bcdFiles {
+		v := "0"
+		if code&(1<<uint(i)) != 0 {
+			v = "1"
+		}
+		if err := ioutil.WriteFile(f, []byte(v), 0644); err != nil {
+			log.Error("can't write band data: ", err)
+		}
+	}
+}
+
+func (s *bandDataStruct) broadcast(msg []byte) {
+	if s.udpConn != nil {
+		if _, err := s.udpConn.Write(msg); err != nil {
+			log.Error("can't send band data: ", err)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.tcpClients {
+		if _, err := c.Write(msg); err != nil {
+			c.Close()
+			delete(s.tcpClients, c)
+		}
+	}
+}
+
+func (s *bandDataStruct) acceptLoop() {
+	for {
+		c, err := s.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		log.Print("band data client ", c.RemoteAddr().String(), " connected")
+
+		s.mutex.Lock()
+		s.tcpClients[c] = true
+		gotFreq := s.freq != 0
+		s.mutex.Unlock()
+
+		// Sending the current state to the new client.
+		if gotFreq {
+			_, _ = c.Write(s.getMsg())
+		}
+	}
+}
+
+func (s *bandDataStruct) loop() {
+	lastBandIdx := -1
+	for {
+		select {
+		case <-s.changedChan:
+		case <-s.deinitNeededChan:
+			s.deinitFinishedChan <- true
+			return
+		}
+
+		s.mutex.Lock()
+		freq := s.freq
+		bandIdx := s.bandIdx
+		s.mutex.Unlock()
+
+		s.cat.reportFrequency(freq)
+
+		if bandIdx == lastBandIdx {
+			continue
+		}
+		lastBandIdx = bandIdx
+
+		if len(s.bcdFiles) > 0 {
+			s.writeBCD(s.getBCDCode(bandIdx))
+		}
+		s.broadcast(s.getMsg())
+	}
+}
+
+// The address is in the udp:host:port or tcp:[host]:port format.
+func (s *bandDataStruct) openBroadcast(addr string) (err error) {
+	a := strings.SplitN(addr, ":", 2)
+	if len(a) != 2 {
+		return errors.New("invalid band data broadcast address " + addr)
+	}
+	switch a[0] {
+	case "udp":
+		s.udpConn, err = net.Dial("udp", a[1])
+		return
+	case "tcp":
+		if s.tcpListener, err = net.Listen("tcp", a[1]); err != nil {
+			return
+		}
+		log.Print("band data server listening on ", s.tcpListener.Addr().String())
+		go s.acceptLoop()
+		return nil
+	}
+	return errors.New("invalid band data broadcast protocol " + a[0])
+}
+
+func (s *bandDataStruct) init() {
+	if bandDataBCDOut == "" && bandDataCATPTY == "" && bandDataBroadcast == "" {
+		return
+	}
+
+	if bandDataBCDOut != "" {
+		s.bcdFiles = strings.Split(bandDataBCDOut, ",")
+		if len(s.bcdFiles) != 1 && len(s.bcdFiles) != 4 {
+			log.Error("band data bcd output needs one file or four gpio value files")
+			s.bcdFiles = nil
+		}
+	}
+	if bandDataCATPTY != "" {
+		if err := s.cat.init(bandDataCATPTY); err != nil {
+			log.Error("can't open band data cat pty: ", err)
+		}
+	}
+	s.tcpClients = make(map[net.Conn]bool)
+	if bandDataBroadcast != "" {
+		if err := s.openBroadcast(bandDataBroadcast); err != nil {
+			log.Error("can't open band data broadcast: ", err)
+		}
+	}
+
+	s.mutex.Lock()
+	s.changedChan = make(chan bool, 1)
+	s.mutex.Unlock()
+
+	s.deinitNeededChan = make(chan bool)
+	s.deinitFinishedChan = make(chan bool)
+	go s.loop()
+}
+
+func (s *bandDataStruct) deinit() {
+	if s.deinitNeededChan == nil {
+		return
+	}
+	s.deinitNeededChan <- true
+	<-s.deinitFinishedChan
+
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	s.mutex.Lock()
+	for c := range s.tcpClients {
+		c.Close()
+	}
+	s.mutex.Unlock()
+	s.cat.deinit()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Each band remembers this many operating states, like the band stacking register on the front panel.
+const bandStackSize = 3
+
+type bandStackEntry struct {
+	Freq       uint `json:"freq"`
+	ModeCode   byte `json:"mode"`
+	FilterCode byte `json:"filter"`
+	DataMode   bool `json:"data"`
+	// These are nil if they were unknown when the entry was stored, and are not restored then.
+	PwrPercent *int `json:"pwr,omitempty"`
+	Preamp     *int `json:"preamp,omitempty"`
+	AGC        *int `json:"agc,omitempty"`
+}
+
+type bandStackStruct struct {
+	mutex  sync.Mutex
+	loaded bool
+
+	// Indexed the same way as civBands. The most recently used entry is stored as the 0th entry.
+	bands [][]bandStackEntry
+}
+
+var bandStack bandStackStruct
+
+// Checks if the entry can be restored on the given band.
+func (e *bandStackEntry) validate(bandIdx int) error {
+	if e.Freq == 0 || getBandIdx(e.Freq) != bandIdx {
+		return fmt.Errorf("frequency %s MHz is not on the band", formatFreqMHz(e.Freq))
+	}
+	if e.FilterCode == 0 {
+		return nil
+	}
+	validMode := false
+	for _, m := range civOperatingModes {
+		if m.code == e.ModeCode {
+			validMode = true
+			break
+		}
+	}
+	if !validMode {
+		return fmt.Errorf("invalid mode code %d", e.ModeCode)
+	}
+	validFilter := false
+	for _, f := range civFilters {
+		if f.code == e.FilterCode {
+			validFilter = true
+			break
+		}
+	}
+	if !validFilter {
+		return fmt.Errorf("invalid filter code %d", e.FilterCode)
+	}
+	if e.PwrPercent != nil && (*e.PwrPercent < 0 || *e.PwrPercent > 100) {
+		return fmt.Errorf("invalid power %d%%", *e.PwrPercent)
+	}
+	if e.Preamp != nil && (*e.Preamp < 0 || *e.Preamp > 2) {
+		return fmt.Errorf("invalid preamp %d", *e.Preamp)
+	}
+	if e.AGC != nil && (*e.AGC < 1 || *e.AGC > 3) {
+		return fmt.Errorf("invalid agc %d", *e.AGC)
+	}
+	return nil
+}
+
+func (s *bandStackStruct) loadIfNeeded() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	s.bands = make([][]bandStackEntry, len(civBands))
+
+	if bandStackFile == "" {
+		return
+	}
+	d, err := ioutil.ReadFile(bandStackFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("can't load band stack: ", err)
+		}
+		return
+	}
+
+	// The file is keyed by the band names, so it stays valid if the band list changes.
+	var bands map[string][]bandStackEntry
+	if err := json.Unmarshal(d, &bands); err != nil {
+		log.Error("can't parse band stack file ", bandStackFile, ": ", err)
+		return
+	}
+	for i := range civBands {
+		for _, e := range bands[civBands[i].name] {
+			if err := e.validate(i); err != nil {
+				log.Error("ignoring band stack entry on ", civBands[i].name, ": ", err)
+				continue
+			}
+			if len(s.bands[i]) < bandStackSize {
+				s.bands[i] = append(s.bands[i], e)
+			}
+		}
+		delete(bands, civBands[i].name)
+	}
+	for name := range bands {
+		log.Error("ignoring band stack entries of unknown band ", name)
+	}
+}
+
+func (s *bandStackStruct) store(bandIdx int, e bandStackEntry, replaceFirst bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.loadIfNeeded()
+
+	if bandIdx < 0 || bandIdx >= len(s.bands) || e.Freq == 0 {
+		return
+	}
+
+	prevEntries := s.bands[bandIdx]
+	if replaceFirst && len(prevEntries) > 0 {
+		prevEntries = prevEntries[1:]
+	}
+	entries := []bandStackEntry{e}
+	for _, v := range prevEntries {
+		if v.Freq != e.Freq && len(entries) < bandStackSize {
+			entries = append(entries, v)
+		}
+	}
+	s.bands[bandIdx] = entries
+}
+
+// Stores the given entry as a new most recently used one for the band. Entries with the same frequency
+// are replaced.
+func (s *bandStackStruct) push(bandIdx int, e bandStackEntry) {
+	s.store(bandIdx, e, false)
+}
+
+// Overwrites the most recently used entry of the band, so it always follows the current operating state.
+func (s *bandStackStruct) update(bandIdx int, e bandStackEntry) {
+	s.store(bandIdx, e, true)
+}
+
+// Returns the most recently used entry for the band.
+func (s *bandStackStruct) get(bandIdx int) (e bandStackEntry, found bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.loadIfNeeded()
+
+	if bandIdx < 0 || bandIdx >= len(s.bands) || len(s.bands[bandIdx]) == 0 {
+		return
+	}
+	return s.bands[bandIdx][0], true
+}
+
+// Moves the next stored entry of the band to the top of the stack and returns it.
+func (s *bandStackStruct) rotate(bandIdx int) (e bandStackEntry, found bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.loadIfNeeded()
+
+	if bandIdx < 0 || bandIdx >= len(s.bands) || len(s.bands[bandIdx]) < 2 {
+		return
+	}
+	entries := s.bands[bandIdx]
+	s.bands[bandIdx] = append(entries[1:len(entries):len(entries)], entries[0])
+	return s.bands[bandIdx][0], true
+}
+
+func (s *bandStackStruct) save() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.loaded || bandStackFile == "" {
+		return
+	}
+
+	bands := make(map[string][]bandStackEntry)
+	for i, entries := range s.bands {
+		if len(entries) > 0 {
+			bands[civBands[i].name] = entries
+		}
+	}
+	d, err := json.MarshalIndent(bands, "", "\t")
+	if err != nil {
+		log.Error("can't encode band stack: ", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(bandStackFile), 0755); err != nil {
+		log.Error("can't save band stack: ", err)
+		return
+	}
+	if err := ioutil.WriteFile(bandStackFile, d, 0644); err != nil {
+		log.Error("can't save band stack: ", err)
+	}
+}
+
+func getDefaultBandStackFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kappanhang", "bandstack.json")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func useTestBandStackFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "kappanhang-bandstack-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevBandStackFile := bandStackFile
+	bandStackFile = filepath.Join(dir, "bandstack.json")
+	t.Cleanup(func() {
+		bandStackFile = prevBandStackFile
+		os.RemoveAll(dir)
+	})
+	if content != "" {
+		if err := ioutil.WriteFile(bandStackFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bandStackFile
+}
+
+func TestBandStackLoad(t *testing.T) {
+	logs := observeLog(t)
+	useTestBandStackFile(t, `{
+	"20m": [
+		{"freq": 14074000, "mode": 1, "filter": 1, "data": true, "pwr": 10, "preamp": 1, "agc": 2},
+		{"freq": 7074000, "mode": 1, "filter": 1},
+		{"freq": 14200000, "mode": 85, "filter": 1},
+		{"freq": 14200000, "mode": 1, "filter": 9},
+		{"freq": 14200000, "mode": 1, "filter": 1, "agc": 0},
+		{"freq": 14200000, "mode": 1, "filter": 1, "pwr": 101},
+		{"freq": 14010000},
+		{"freq": 14300000, "mode": 3, "filter": 2},
+		{"freq": 14400000, "mode": 3, "filter": 2}
+	],
+	"GENE": [
+		{"freq": 14074000},
+		{"freq": 5000000}
+	],
+	"11m": [
+		{"freq": 27555000}
+	]
+}`)
+
+	var s bandStackStruct
+	e, found := s.get(getBandIdx(14074000))
+	pwr, preamp, agc := 10, 1, 2
+	want := bandStackEntry{Freq: 14074000, ModeCode: 1, FilterCode: 1, DataMode: true, PwrPercent: &pwr,
+		Preamp: &preamp, AGC: &agc}
+	if !found || !reflect.DeepEqual(e, want) {
+		t.Errorf("got entry %+v, want %+v", e, want)
+	}
+	var freqs []uint
+	for _, e := range s.bands[getBandIdx(14074000)] {
+		freqs = append(freqs, e.Freq)
+	}
+	if !reflect.DeepEqual(freqs, []uint{14074000, 14010000, 14300000}) {
+		t.Errorf("got 20m entries %v", freqs)
+	}
+	if e, found := s.get(getBandIdx(5000000)); !found || e.Freq != 5000000 || len(s.bands[len(civBands)-1]) != 1 {
+		t.Errorf("got GENE entries %+v", s.bands[len(civBands)-1])
+	}
+
+	for _, str := range []string{
+		"ignoring band stack entry on 20m: frequency 7.074000 MHz is not on the band",
+		"ignoring band stack entry on 20m: invalid mode code 85",
+		"ignoring band stack entry on 20m: invalid filter code 9",
+		"ignoring band stack entry on 20m: invalid agc 0",
+		"ignoring band stack entry on 20m: invalid power 101%",
+		"ignoring band stack entry on GENE: frequency 14.074000 MHz is not on the band",
+		"ignoring band stack entries of unknown band 11m",
+	} {
+		if countLogs(logs, str) != 1 {
+			t.Errorf("missing log %q", str)
+		}
+	}
+}
+
+func TestBandStackSave(t *testing.T) {
+	useTestBandStackFile(t, "")
+
+	var s bandStackStruct
+	pwr := 50
+	s.push(getBandIdx(7074000), bandStackEntry{Freq: 7074000, ModeCode: 1, FilterCode: 1, PwrPercent: &pwr})
+	s.push(getBandIdx(7074000), bandStackEntry{Freq: 7030000})
+	s.push(getBandIdx(144800000), bandStackEntry{Freq: 144800000, ModeCode: 5, FilterCode: 1})
+	s.save()
+
+	d, err := ioutil.ReadFile(bandStackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(d, []byte(`"40m"`)) || !bytes.Contains(d, []byte(`"2m"`)) ||
+		bytes.Contains(d, []byte(`"preamp"`)) {
+		t.Errorf("unexpected band stack file:\n%s", d)
+	}
+
+	var loaded bandStackStruct
+	loaded.loadIfNeeded()
+	if !reflect.DeepEqual(loaded.bands, s.bands) {
+		t.Errorf("loaded %+v, saved %+v", loaded.bands, s.bands)
+	}
+}
+
+func TestCivControlBandStackEntry(t *testing.T) {
+	s, radio := newTestCivControl(t)
+
+	// Unknown settings are not stored.
+	s.state.agc = 0
+	e := s.getBandStackEntry(14074000)
+	if e.PwrPercent != nil || e.Preamp != nil || e.AGC != nil {
+		t.Errorf("got entry %+v with unknown settings", e)
+	}
+	s.state.pwrPercentKnown, s.state.pwrPercent = true, 0
+	s.state.preampKnown, s.state.preamp = true, 0
+	s.state.agc = 3
+	e = s.getBandStackEntry(14074000)
+	if e.PwrPercent == nil || *e.PwrPercent != 0 || e.Preamp == nil || *e.Preamp != 0 || e.AGC == nil || *e.AGC != 3 {
+		t.Errorf("got entry %+v, want known settings", e)
+	}
+
+	// Returns the codes of the commands sent by restoreBandStackEntry.
+	restore := func(e bandStackEntry) (cmds [][2]byte) {
+		if err := s.restoreBandStackEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.getVd(); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			p, ok := readTestPkt(t, radio).(*pktSerialData)
+			if !ok {
+				t.Fatalf("expected a serial data packet, got %#v", p)
+			}
+			if bytes.Equal(p.data, s.state.getVd.cmd) {
+				return
+			}
+			cmds = append(cmds, [2]byte{p.data[4], p.data[5]})
+		}
+	}
+	setPwr := [2]byte{0x14, 0x0a}
+	setPreamp := [2]byte{0x16, 0x02}
+	setAGC := [2]byte{0x16, 0x12}
+	contains := func(cmds [][2]byte, cmd [2]byte) bool {
+		for _, c := range cmds {
+			if c == cmd {
+				return true
+			}
+		}
+		return false
+	}
+
+	cmds := restore(bandStackEntry{Freq: 14074000, ModeCode: 1, FilterCode: 1})
+	if len(cmds) == 0 || contains(cmds, setPwr) || contains(cmds, setPreamp) || contains(cmds, setAGC) {
+		t.Errorf("unknown settings restored: %x", cmds)
+	}
+	pwr, preamp, agc := 10, 1, 2
+	cmds = restore(bandStackEntry{Freq: 14074000, ModeCode: 1, FilterCode: 1, PwrPercent: &pwr, Preamp: &preamp,
+		AGC: &agc})
+	if !contains(cmds, setPwr) || !contains(cmds, setPreamp) || !contains(cmds, setAGC) {
+		t.Errorf("settings have not been restored: %x", cmds)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The length of the radio side TX buffer and the initial length of the RX seqbufs. These can be set with
+// command line arguments, or tuned automatically from the roundtrip latency and the packet loss measured
+// during the first minute of a session. A tuned RX length is applied to the running RX seqbufs. The TX buffer
+// length is sent to the radio when the serial and audio streams are requested, so the radio only uses a tuned
+// value after the next login.
+
+const minTxSeqBufLength = 50 * time.Millisecond
+
+// According to my observations, if the TX buffer length is set to larger than 500-600ms then audio TX won't
+// work (small radio memory?)
+const maxTxSeqBufLength = 500 * time.Millisecond
+
+const bufferAutoTuneAfter = time.Minute
+
+var bufferLengthsMutex sync.Mutex
+
+func getTxSeqBufLength() time.Duration {
+	bufferLengthsMutex.Lock()
+	defer bufferLengthsMutex.Unlock()
+	return txSeqBufLength
+}
+
+func getRxSeqBufLength() time.Duration {
+	bufferLengthsMutex.Lock()
+	defer bufferLengthsMutex.Unlock()
+	return rxSeqBufLength
+}
+
+// Longer buffers are needed if the roundtrip latency is high, as a retransmitted packet arrives after at
+// least one roundtrip, and if there was packet loss, as retransmit requests have to be repeated then. The TX
+// buffer length depends on the retransmits the radio requested from us, the RX length on the retransmits we
+// requested and the packets we lost.
+func autoTuneBufferLengths() {
+	rtt := controlStreamLatency
+	lost, servedRetransmits, requestedRetransmits := netstat.getTotals()
+
+	tx := 100*time.Millisecond + 4*rtt
+	rx := 50*time.Millisecond + 2*rtt
+	if servedRetransmits > 0 {
+		tx += 100 * time.Millisecond
+	}
+	if requestedRetransmits > 0 {
+		rx += 50 * time.Millisecond
+	}
+	if lost > 0 {
+		rx += 50 * time.Millisecond
+	}
+
+	if tx < minTxSeqBufLength {
+		tx = minTxSeqBufLength
+	}
+	if tx > maxTxSeqBufLength {
+		tx = maxTxSeqBufLength
+	}
+	if rx < jitterBufferMin {
+		rx = jitterBufferMin
+	}
+	if rx > jitterBufferMax {
+		rx = jitterBufferMax
+	}
+
+	bufferLengthsMutex.Lock()
+	txSeqBufLength = tx
+	rxSeqBufLength = rx
+	bufferLengthsMutex.Unlock()
+
+	log.Print("buffer lengths tuned to tx ", tx.Milliseconds(), "ms (from the next login) rx ", rx.Milliseconds(),
+		"ms (rtt ", rtt.Milliseconds(), "ms, ", servedRetransmits, " retransmitted to and ", requestedRetransmits,
+		" requested from the radio, ", lost, " lost pkts)")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoTuneBufferLengths(t *testing.T) {
+	prevTxSeqBufLength, prevRxSeqBufLength := txSeqBufLength, rxSeqBufLength
+	prevJitterBufferMin, prevJitterBufferMax := jitterBufferMin, jitterBufferMax
+	prevControlStreamLatency := controlStreamLatency
+	defer func() {
+		txSeqBufLength, rxSeqBufLength = prevTxSeqBufLength, prevRxSeqBufLength
+		jitterBufferMin, jitterBufferMax = prevJitterBufferMin, prevJitterBufferMax
+		controlStreamLatency = prevControlStreamLatency
+		netstat.reset()
+	}()
+	jitterBufferMin = 50 * time.Millisecond
+	jitterBufferMax = time.Second
+	controlStreamLatency = 10 * time.Millisecond
+
+	ms := time.Millisecond
+	tests := []struct {
+		name                 string
+		lost                 int
+		servedRetransmits    int
+		requestedRetransmits int
+		tx, rx               time.Duration
+	}{
+		{"no loss", 0, 0, 0, 140 * ms, 70 * ms},
+		{"retransmits to the radio", 0, 2, 0, 240 * ms, 70 * ms},
+		{"retransmits from the radio", 0, 0, 2, 140 * ms, 120 * ms},
+		{"lost packets", 3, 0, 2, 140 * ms, 170 * ms},
+	}
+	for _, tt := range tests {
+		netstat.reset()
+		if tt.lost > 0 {
+			netstat.reportLoss(tt.lost)
+		}
+		if tt.servedRetransmits > 0 {
+			netstat.reportRetransmit(tt.servedRetransmits)
+		}
+		if tt.requestedRetransmits > 0 {
+			netstat.reportRetransmitRequest(tt.requestedRetransmits)
+		}
+
+		autoTuneBufferLengths()
+		if tx, rx := getTxSeqBufLength(), getRxSeqBufLength(); tx != tt.tx || rx != tt.rx {
+			t.Errorf("%s: tuned to tx %v rx %v, expected tx %v rx %v", tt.name, tx, rx, tt.tx, tt.rx)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packets are captured in pcapng format, so captures can also be opened with Wireshark. Every datagram gets
+// an IPv4 and UDP header, the stream name is stored in the packet comment, the direction in the packet flags.
+
+const (
+	pcapngBlockSHB = 0x0a0d0d0a
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngLinkTypeRaw    = 101
+
+	pcapngOptEnd       = 0
+	pcapngOptComment   = 1
+	pcapngOptFlags     = 2
+	pcapngOptIfTSResol = 9
+
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+)
+
+const (
+	pcapMagic          = 0xa1b2c3d4
+	pcapMagicNs        = 0xa1b23c4d
+	pcapMagicSwapped   = 0xd4c3b2a1
+	pcapMagicNsSwapped = 0x4d3cb2a1
+)
+
+const (
+	captureLinkTypeEthernet = 1
+	captureLinkTypeLinuxSLL = 113
+	captureLinkTypeIPv4     = 228
+)
+
+const captureIPHeaderLength = 20
+const captureUDPHeaderLength = 8
+
+type capturedPacket struct {
+	t        time.Time
+	stream   string
+	outbound bool
+	srcIP    net.IP
+	srcPort  int
+	dstPort  int
+	data     []byte
+
+	gotDirection bool
+}
+
+type packetCaptureStruct struct {
+	mutex sync.Mutex
+	f     *os.File
+}
+
+var packetCapture packetCaptureStruct
+
+func pcapngPad(n int) int {
+	return (4 - n%4) % 4
+}
+
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	l := 12 + len(body)
+	b := make([]byte, 8, l)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(l))
+	b = append(b, body...)
+	var t [4]byte
+	binary.LittleEndian.PutUint32(t[:], uint32(l))
+	return append(b, t[:]...)
+}
+
+func pcapngOption(code uint16, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value)+pcapngPad(len(value)))
+	binary.LittleEndian.PutUint16(b[0:], code)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pcapngPad(len(value)))...)
+}
+
+func captureIPv4(addr net.Addr) (ip net.IP, port int) {
+	ip = net.IPv4(127, 0, 0, 1).To4()
+	if a, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			ip = ip4
+		}
+		port = a.Port
+	}
+	return
+}
+
+func captureIPChecksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// Returns the datagram wrapped in an IPv4 and UDP header.
+func captureWrapUDP(src, dst net.Addr, d []byte) []byte {
+	srcIP, srcPort := captureIPv4(src)
+	dstIP, dstPort := captureIPv4(dst)
+
+	b := make([]byte, captureIPHeaderLength+captureUDPHeaderLength, captureIPHeaderLength+captureUDPHeaderLength+len(d))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)+len(d)))
+	b[6] = 0x40 // Don't fragment.
+	b[8] = 64   // TTL
+	b[9] = 17   // UDP
+	copy(b[12:], srcIP)
+	copy(b[16:], dstIP)
+	binary.BigEndian.PutUint16(b[10:], captureIPChecksum(b[:captureIPHeaderLength]))
+
+	u := b[captureIPHeaderLength:]
+	binary.BigEndian.PutUint16(u[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(u[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(u[4:], uint16(captureUDPHeaderLength+len(d)))
+	// The UDP checksum is optional for IPv4.
+	return append(b, d...)
+}
+
+func (s *packetCaptureStruct) add(st *streamCommon, d []byte, outbound bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.f == nil || st.conn == nil {
+		return
+	}
+
+	var p []byte
+	flags := make([]byte, 4)
+	if outbound {
+		p = captureWrapUDP(st.conn.LocalAddr(), st.conn.RemoteAddr(), d)
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	} else {
+		p = captureWrapUDP(st.conn.RemoteAddr(), st.conn.LocalAddr(), d)
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	}
+
+	ts := uint64(clock.now().UnixNano() / int64(time.Microsecond))
+	body := make([]byte, 20, 20+len(p)+32)
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(p)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(p)))
+	body = append(body, p...)
+	body = append(body, make([]byte, pcapngPad(len(p)))...)
+	body = append(body, pcapngOption(pcapngOptComment, []byte(st.name))...)
+	body = append(body, pcapngOption(pcapngOptFlags, flags)...)
+	body = append(body, pcapngOption(pcapngOptEnd, nil)...)
+
+	if _, err := s.f.Write(pcapngBlock(pcapngBlockEPB, body)); err != nil {
+		log.Error("can't write packet capture: ", err)
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+func (s *packetCaptureStruct) init() {
+	if captureFile == "" {
+		return
+	}
+
+	f, err := os.Create(captureFile)
+	if err != nil {
+		log.Error("can't create packet capture: ", err)
+		return
+	}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	// Section length is not specified.
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff)
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+
+	d := append(pcapngBlock(pcapngBlockSHB, shb), pcapngBlock(pcapngBlockIDB, idb)...)
+	if _, err := f.Write(d); err != nil {
+		log.Error("can't write packet capture: ", err)
+		f.Close()
+		return
+	}
+	log.Print("capturing packets to ", captureFile)
+
+	s.mutex.Lock()
+	s.f = f
+	s.mutex.Unlock()
+}
+
+func (s *packetCaptureStruct) deinit() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+// Returns the IPv4 packet carried in the given link layer frame, or nil.
+func captureGetIPv4(linkType uint16, d []byte) []byte {
+	switch linkType {
+	case captureLinkTypeEthernet:
+		if len(d) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(d[12:])
+		d = d[14:]
+		if etherType == 0x8100 && len(d) >= 4 { // VLAN tag.
+			etherType = binary.BigEndian.Uint16(d[2:])
+			d = d[4:]
+		}
+		if etherType != 0x0800 {
+			return nil
+		}
+	case captureLinkTypeLinuxSLL:
+		if len(d) < 16 || binary.BigEndian.Uint16(d[14:]) != 0x0800 {
+			return nil
+		}
+		d = d[16:]
+	case pcapngLinkTypeRaw, captureLinkTypeIPv4:
+	default:
+		return nil
+	}
+	if len(d) == 0 || d[0]>>4 != 4 {
+		return nil
+	}
+	return d
+}
+
+func parseCapturedUDP(p *capturedPacket, d []byte) error {
+	if len(d) < captureIPHeaderLength+captureUDPHeaderLength || d[9] != 17 {
+		return errors.New("not an ipv4 udp packet")
+	}
+	ihl := int(d[0]&0x0f) * 4
+	if ihl < captureIPHeaderLength || len(d) < ihl+captureUDPHeaderLength {
+		return errors.New("invalid ip header")
+	}
+	p.srcIP = net.IP(d[12:16])
+	u := d[ihl:]
+	p.srcPort = int(binary.BigEndian.Uint16(u[0:]))
+	p.dstPort = int(binary.BigEndian.Uint16(u[2:]))
+	l := int(binary.BigEndian.Uint16(u[4:]))
+	if l < captureUDPHeaderLength || l > len(u) {
+		l = len(u)
+	}
+	p.data = u[captureUDPHeaderLength:l]
+	return nil
+}
+
+func parseCapturedEPB(body []byte, linkType uint16, tsResolution time.Duration) (p capturedPacket, err error) {
+	if len(body) < 20 {
+		return p, errors.New("short packet block")
+	}
+	ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+	p.t = time.Unix(0, int64(ts)*int64(tsResolution))
+	capLen := int(binary.LittleEndian.Uint32(body[12:]))
+	if 20+capLen > len(body) {
+		return p, errors.New("invalid packet length")
+	}
+	d := body[20 : 20+capLen]
+
+	if o := 20 + capLen + pcapngPad(capLen); o <= len(body) {
+		pcapngParseOptions(body[o:], func(code uint16, v []byte) {
+			switch code {
+			case pcapngOptComment:
+				p.stream = string(v)
+			case pcapngOptFlags:
+				if len(v) == 4 && binary.LittleEndian.Uint32(v)&3 != 0 {
+					p.outbound = binary.LittleEndian.Uint32(v)&3 == pcapngFlagOutbound
+					p.gotDirection = true
+				}
+			}
+		})
+	}
+
+	ip := captureGetIPv4(linkType, d)
+	if ip == nil {
+		return p, errors.New("not an ipv4 packet")
+	}
+	return p, parseCapturedUDP(&p, ip)
+}
+
+func pcapngParseOptions(o []byte, cb func(code uint16, value []byte)) {
+	for len(o) >= 4 {
+		code := binary.LittleEndian.Uint16(o[0:])
+		l := int(binary.LittleEndian.Uint16(o[2:]))
+		if code == pcapngOptEnd || 4+l > len(o) {
+			return
+		}
+		cb(code, o[4:4+l])
+		l += pcapngPad(l)
+		if 4+l > len(o) {
+			return
+		}
+		o = o[4+l:]
+	}
+}
+
+func readPcapng(d []byte) (res []capturedPacket, err error) {
+	type iface struct {
+		linkType     uint16
+		tsResolution time.Duration
+	}
+	var ifaces []iface
+
+	for len(d) > 0 {
+		if len(d) < 12 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		blockType := binary.LittleEndian.Uint32(d[0:])
+		l := int(binary.LittleEndian.Uint32(d[4:]))
+		if l < 12 || l > len(d) {
+			return nil, fmt.Errorf("invalid block length %d", l)
+		}
+		body := d[8 : l-4]
+		d = d[l:]
+
+		switch blockType {
+		case pcapngBlockSHB:
+			if len(body) < 4 || binary.LittleEndian.Uint32(body) != pcapngByteOrderMagic {
+				return nil, errors.New("not a little endian pcapng file")
+			}
+			ifaces = nil
+		case pcapngBlockIDB:
+			if len(body) < 8 {
+				return nil, errors.New("invalid interface block")
+			}
+			i := iface{linkType: binary.LittleEndian.Uint16(body), tsResolution: time.Microsecond}
+			pcapngParseOptions(body[8:], func(code uint16, v []byte) {
+				if code == pcapngOptIfTSResol && len(v) == 1 && v[0] < 10 {
+					i.tsResolution = time.Second
+					for n := byte(0); n < v[0]; n++ {
+						i.tsResolution /= 10
+					}
+				}
+			})
+			ifaces = append(ifaces, i)
+		case pcapngBlockEPB:
+			if len(body) < 4 {
+				return nil, errors.New("invalid packet block")
+			}
+			ifID := int(binary.LittleEndian.Uint32(body))
+			if ifID >= len(ifaces) {
+				return nil, errors.New("packet block for unknown interface")
+			}
+			p, err := parseCapturedEPB(body, ifaces[ifID].linkType, ifaces[ifID].tsResolution)
+			if err != nil {
+				continue
+			}
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func readPcap(d []byte) (res []capturedPacket, err error) {
+	if len(d) < 24 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	switch binary.BigEndian.Uint32(d) {
+	case pcapMagic, pcapMagicNs:
+		bo = binary.BigEndian
+	}
+	tsResolution := time.Microsecond
+	if bo.Uint32(d) == pcapMagicNs {
+		tsResolution = time.Nanosecond
+	}
+	linkType := uint16(bo.Uint32(d[20:]))
+	d = d[24:]
+
+	for len(d) > 0 {
+		if len(d) < 16 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var p capturedPacket
+		p.t = time.Unix(int64(bo.Uint32(d[0:])), int64(bo.Uint32(d[4:]))*int64(tsResolution))
+		l := int(bo.Uint32(d[8:]))
+		if 16+l > len(d) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		pd := d[16 : 16+l]
+		d = d[16+l:]
+
+		if ip := captureGetIPv4(linkType, pd); ip != nil && parseCapturedUDP(&p, ip) == nil {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func captureGetStreamName(port int) string {
+	switch port {
+	case controlStreamPort:
+		return "control"
+	case serialStreamPort:
+		return "serial"
+	case audioStreamPort:
+		return "audio"
+	}
+	return ""
+}
+
+// Reads the captured RS-BA1 packets from the given pcapng or pcap file. Captures made by other tools
+// don't contain our stream names and packet directions, so these are guessed from the UDP ports, and from
+// the source address of the first packet, which is always sent by the PC.
+func readPacketCapture(path string) (res []capturedPacket, err error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var pkts []capturedPacket
+	switch binary.LittleEndian.Uint32(d) {
+	case pcapngBlockSHB:
+		pkts, err = readPcapng(d)
+	case pcapMagic, pcapMagicNs, pcapMagicSwapped, pcapMagicNsSwapped:
+		pkts, err = readPcap(d)
+	default:
+		return nil, errors.New("unknown capture file format")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pcIP net.IP
+	for _, p := range pkts {
+		if p.stream == "" {
+			if p.stream = captureGetStreamName(p.srcPort); p.stream == "" {
+				p.stream = captureGetStreamName(p.dstPort)
+			}
+			if p.stream == "" {
+				continue
+			}
+		}
+		if !p.gotDirection {
+			if pcIP == nil {
+				pcIP = p.srcIP
+			}
+			p.outbound = p.srcIP.Equal(pcIP)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
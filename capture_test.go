@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useTestCaptureFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kappanhang-capture-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevCaptureFile := captureFile
+	captureFile = filepath.Join(dir, "capture.pcapng")
+	t.Cleanup(func() {
+		captureFile = prevCaptureFile
+		os.RemoveAll(dir)
+	})
+	return captureFile
+}
+
+func TestPacketCaptureRoundTrip(t *testing.T) {
+	c := useFakeClock(t)
+	path := useTestCaptureFile(t)
+	conn, radio := newTestStreamConn(t)
+	st := &streamCommon{name: "serial", conn: conn}
+
+	var s packetCaptureStruct
+	s.init()
+	start := c.now()
+	// Lengths which need padding in the pcapng blocks.
+	pkts := [][]byte{{1, 2, 3}, {4, 5, 6, 7, 8}, make([]byte, 1388)}
+	for i, d := range pkts {
+		s.add(st, d, i%2 == 0)
+		c.advance(1500 * time.Microsecond)
+	}
+	s.deinit()
+	// Packets are not added after deinit.
+	s.add(st, []byte{9}, true)
+
+	res, err := readPacketCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(pkts) {
+		t.Fatalf("got %d packets, want %d", len(res), len(pkts))
+	}
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	radioPort := radio.LocalAddr().(*net.UDPAddr).Port
+	for i, p := range res {
+		outbound := i%2 == 0
+		if !bytes.Equal(p.data, pkts[i]) {
+			t.Errorf("packet %d data %x, want %x", i, p.data, pkts[i])
+		}
+		if p.stream != "serial" || p.outbound != outbound || !p.gotDirection {
+			t.Errorf("packet %d stream %q outbound %v, want serial outbound %v", i, p.stream, p.outbound, outbound)
+		}
+		srcPort, dstPort := localPort, radioPort
+		if !outbound {
+			srcPort, dstPort = radioPort, localPort
+		}
+		if p.srcPort != srcPort || p.dstPort != dstPort || !p.srcIP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("packet %d from %v:%d to port %d, want 127.0.0.1:%d to port %d", i, p.srcIP, p.srcPort,
+				p.dstPort, srcPort, dstPort)
+		}
+		if want := start.Add(time.Duration(i) * 1500 * time.Microsecond); !p.t.Equal(want) {
+			t.Errorf("packet %d time %v, want %v", i, p.t, want)
+		}
+	}
+}
+
+// Captures of other tools don't have stream names and directions.
+func TestReadPcap(t *testing.T) {
+	path := useTestCaptureFile(t)
+
+	pc := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 40000}
+	radio := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: controlStreamPort}
+	other := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 53}
+	d := make([]byte, 24)
+	binary.LittleEndian.PutUint32(d[0:], pcapMagic)
+	binary.LittleEndian.PutUint32(d[20:], captureLinkTypeIPv4)
+	for i, p := range [][]byte{captureWrapUDP(pc, radio, []byte{1}), captureWrapUDP(pc, other, []byte{2}),
+		captureWrapUDP(radio, pc, []byte{3})} {
+		h := make([]byte, 16)
+		binary.LittleEndian.PutUint32(h[0:], uint32(1600000000+i))
+		binary.LittleEndian.PutUint32(h[8:], uint32(len(p)))
+		binary.LittleEndian.PutUint32(h[12:], uint32(len(p)))
+		d = append(append(d, h...), p...)
+	}
+	if err := ioutil.WriteFile(path, d, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := readPacketCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("got %d packets, want 2", len(res))
+	}
+	for i, want := range []struct {
+		data     byte
+		outbound bool
+		t        time.Time
+	}{
+		{1, true, time.Unix(1600000000, 0)},
+		{3, false, time.Unix(1600000002, 0)},
+	} {
+		p := res[i]
+		if p.stream != "control" || p.outbound != want.outbound || len(p.data) != 1 || p.data[0] != want.data ||
+			!p.t.Equal(want.t) {
+			t.Errorf("packet %d got %+v, want control packet %d outbound %v", i, p, want.data, want.outbound)
+		}
+	}
+}
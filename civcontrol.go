@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -44,27 +46,37 @@ var civFilters = []civFilter{
 }
 
 type civBand struct {
+	name     string
 	freqFrom uint
 	freqTo   uint
-	freq     uint
 }
 
 var civBands = []civBand{
-	{freqFrom: 1800000, freqTo: 1999999},     // 1.9
-	{freqFrom: 3400000, freqTo: 4099999},     // 3.5
-	{freqFrom: 6900000, freqTo: 7499999},     // 7
-	{freqFrom: 9900000, freqTo: 10499999},    // 10
-	{freqFrom: 13900000, freqTo: 14499999},   // 14
-	{freqFrom: 17900000, freqTo: 18499999},   // 18
-	{freqFrom: 20900000, freqTo: 21499999},   // 21
-	{freqFrom: 24400000, freqTo: 25099999},   // 24
-	{freqFrom: 28000000, freqTo: 29999999},   // 28
-	{freqFrom: 50000000, freqTo: 54000000},   // 50
-	{freqFrom: 74800000, freqTo: 107999999},  // WFM
-	{freqFrom: 108000000, freqTo: 136999999}, // AIR
-	{freqFrom: 144000000, freqTo: 148000000}, // 144
-	{freqFrom: 420000000, freqTo: 450000000}, // 430
-	{freqFrom: 0, freqTo: 0},                 // GENE
+	{name: "160m", freqFrom: 1800000, freqTo: 1999999},     // 1.9
+	{name: "80m", freqFrom: 3400000, freqTo: 4099999},      // 3.5
+	{name: "40m", freqFrom: 6900000, freqTo: 7499999},      // 7
+	{name: "30m", freqFrom: 9900000, freqTo: 10499999},     // 10
+	{name: "20m", freqFrom: 13900000, freqTo: 14499999},    // 14
+	{name: "17m", freqFrom: 17900000, freqTo: 18499999},    // 18
+	{name: "15m", freqFrom: 20900000, freqTo: 21499999},    // 21
+	{name: "12m", freqFrom: 24400000, freqTo: 25099999},    // 24
+	{name: "10m", freqFrom: 28000000, freqTo: 29999999},    // 28
+	{name: "6m", freqFrom: 50000000, freqTo: 54000000},     // 50
+	{name: "WFM", freqFrom: 74800000, freqTo: 107999999},   // WFM
+	{name: "AIR", freqFrom: 108000000, freqTo: 136999999},  // AIR
+	{name: "2m", freqFrom: 144000000, freqTo: 148000000},   // 144
+	{name: "70cm", freqFrom: 420000000, freqTo: 450000000}, // 430
+	{name: "GENE", freqFrom: 0, freqTo: 0},                 // GENE
+}
+
+// Returns the index of the band of the frequency in civBands, frequencies outside the bands belong to GENE.
+func getBandIdx(freq uint) int {
+	for i := range civBands {
+		if freq >= civBands[i].freqFrom && freq <= civBands[i].freqTo {
+			return i
+		}
+	}
+	return len(civBands) - 1
 }
 
 type splitMode int
@@ -76,6 +88,29 @@ const (
 	splitModeDUPPlus
 )
 
+type civScopeSpan struct {
+	name string
+	hz   uint
+}
+
+// Spans are given as the distance from the center frequency to the edges.
+var civScopeSpans = []civScopeSpan{
+	{name: "±2.5k", hz: 2500},
+	{name: "±5k", hz: 5000},
+	{name: "±10k", hz: 10000},
+	{name: "±25k", hz: 25000},
+	{name: "±50k", hz: 50000},
+	{name: "±100k", hz: 100000},
+	{name: "±250k", hz: 250000},
+	{name: "±500k", hz: 500000},
+	{name: "±1M", hz: 1000000},
+}
+
+var civScopeSpeeds = []string{"FAST", "MID", "SLOW"}
+
+// The reference level can be set between -20dB and +20dB in 0.5dB steps.
+const civScopeRefMax = 40
+
 type civCmd struct {
 	pending bool
 	sentAt  time.Time
@@ -96,6 +131,7 @@ type civControlStruct struct {
 
 		getPwr            civCmd
 		getS              civCmd
+		getSquelchStatus  civCmd
 		getOVF            civCmd
 		getSWR            civCmd
 		getTransmitStatus civCmd
@@ -136,15 +172,25 @@ type civControlStruct struct {
 		setTS          civCmd
 		setVFO         civCmd
 		setSplit       civCmd
-
-		pttTimeoutTimer  *time.Timer
-		tuneTimeoutTimer *time.Timer
+		setMemory      civCmd
+		setScope       civCmd
+		setScopeOutput civCmd
+		setScopeSpan   civCmd
+		setScopeRef    civCmd
+		setScopeSpeed  civCmd
+		getScopeSpan   civCmd
+		getScopeRef    civCmd
+		getScopeSpeed  civCmd
+
+		pttTimeoutTimer  clockTimer
+		tuneTimeoutTimer clockTimer
 
 		freq                uint
 		subFreq             uint
 		ptt                 bool
 		tune                bool
 		pwrPercent          int
+		pwrPercentKnown     bool
 		rfGainPercent       int
 		sqlPercent          int
 		nrPercent           int
@@ -157,11 +203,19 @@ type civControlStruct struct {
 		subFilterIdx        int
 		bandIdx             int
 		preamp              int
-		agc                 int
+		preampKnown         bool
+		agc                 int // 0 if unknown, 1-3 otherwise.
+		sValue              int
+		swr                 float64
+		squelchOpen         bool
 		tsValue             byte
 		ts                  uint
 		vfoBActive          bool
 		splitMode           splitMode
+		scopeEnabled        bool
+		scopeSpanIdx        int
+		scopeRef            int // In 0.5dB steps.
+		scopeSpeed          int
 	}
 }
 
@@ -193,6 +247,8 @@ func (s *civControlStruct) decode(d []byte) bool {
 		return s.decodeMode(payload)
 	case 0x07:
 		return s.decodeVFO(payload)
+	case 0x08:
+		return s.decodeMemory(payload)
 	case 0x0f:
 		return s.decodeSplit(payload)
 	case 0x10:
@@ -211,6 +267,8 @@ func (s *civControlStruct) decode(d []byte) bool {
 		return s.decodeVFOFreq(payload)
 	case 0x26:
 		return s.decodeVFOMode(payload)
+	case 0x27:
+		return s.decodeScope(payload)
 	}
 	return true
 }
@@ -282,6 +340,11 @@ func (s *civControlStruct) decodeMode(d []byte) bool {
 	}
 	statusLog.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode,
 		civFilters[s.state.filterIdx].name)
+	events.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode,
+		civFilters[s.state.filterIdx].name)
+	radioInfo.reportMode(civOperatingModes[s.state.operatingModeIdx].name)
+	tci.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode)
+	s.updateBandStack()
 
 	if s.state.setMode.pending {
 		s.removePendingCmd(&s.state.setMode)
@@ -298,9 +361,11 @@ func (s *civControlStruct) decodeVFO(d []byte) bool {
 	if d[0] == 1 {
 		s.state.vfoBActive = true
 		log.Print("active vfo: B")
+		statusLog.reportVFO(true)
 	} else {
 		s.state.vfoBActive = false
 		log.Print("active vfo: A")
+		statusLog.reportVFO(false)
 	}
 
 	if s.state.setVFO.pending {
@@ -312,6 +377,21 @@ func (s *civControlStruct) decodeVFO(d []byte) bool {
 	return true
 }
 
+func (s *civControlStruct) decodeMemory(d []byte) bool {
+	if len(d) < 2 {
+		return !s.state.setMemory.pending
+	}
+
+	if s.state.setMemory.pending {
+		// The radio does not send frequencies automatically.
+		_ = s.getBothVFOFreq()
+		_ = s.getBothVFOMode()
+		s.removePendingCmd(&s.state.setMemory)
+		return false
+	}
+	return true
+}
+
 func (s *civControlStruct) decodeSplit(d []byte) bool {
 	if len(d) < 1 {
 		return !s.state.getSplit.pending && !s.state.setSplit.pending
@@ -332,6 +412,8 @@ func (s *civControlStruct) decodeSplit(d []byte) bool {
 		str = "DUP+"
 	}
 	statusLog.reportSplit(s.state.splitMode, str)
+	radioInfo.reportSplit(s.state.splitMode == splitModeOn)
+	tci.reportSplit(s.state.splitMode == splitModeOn)
 
 	if s.state.getSplit.pending {
 		s.removePendingCmd(&s.state.getSplit)
@@ -409,6 +491,11 @@ func (s *civControlStruct) decodeDataModeAndOVF(d []byte) bool {
 
 		statusLog.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode,
 			civFilters[s.state.filterIdx].name)
+		events.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode,
+			civFilters[s.state.filterIdx].name)
+		radioInfo.reportMode(civOperatingModes[s.state.operatingModeIdx].name)
+		tci.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode)
+		s.updateBandStack()
 
 		if s.state.setDataMode.pending {
 			s.removePendingCmd(&s.state.setDataMode)
@@ -420,10 +507,12 @@ func (s *civControlStruct) decodeDataModeAndOVF(d []byte) bool {
 		}
 		if d[1] != 0 {
 			statusLog.reportOVF(true)
+			sweeper.reportOVF(true)
 		} else {
 			statusLog.reportOVF(false)
+			sweeper.reportOVF(false)
 		}
-		s.state.lastOVFReceivedAt = time.Now()
+		s.state.lastOVFReceivedAt = clock.now()
 		if s.state.getOVF.pending {
 			s.removePendingCmd(&s.state.getOVF)
 			return false
@@ -485,7 +574,9 @@ func (s *civControlStruct) decodePowerRFGainSQLNRPwr(d []byte) bool {
 		}
 		hex := uint16(d[1])<<8 | uint16(d[2])
 		s.state.pwrPercent = int(math.Round((float64(hex) / 0x0255) * 100))
+		s.state.pwrPercentKnown = true
 		statusLog.reportTxPower(s.state.pwrPercent)
+		s.updateBandStack()
 		if s.state.getPwr.pending {
 			s.removePendingCmd(&s.state.getPwr)
 			return false
@@ -511,12 +602,15 @@ func (s *civControlStruct) decodeTransmitStatus(d []byte) bool {
 			if s.state.ptt { // PTT released?
 				s.state.ptt = false
 				if s.state.pttTimeoutTimer != nil {
-					s.state.pttTimeoutTimer.Stop()
+					s.state.pttTimeoutTimer.stop()
 				}
 				_ = s.getVd()
 			}
 		}
 		statusLog.reportPTT(s.state.ptt, s.state.tune)
+		events.reportPTT(s.state.ptt)
+		radioInfo.reportPTT(s.state.ptt || s.state.tune)
+		tci.reportPTT(s.state.ptt, s.state.tune)
 		if s.state.setPTT.pending {
 			s.removePendingCmd(&s.state.setPTT)
 			return false
@@ -526,18 +620,20 @@ func (s *civControlStruct) decodeTransmitStatus(d []byte) bool {
 			s.state.tune = true
 
 			// The transceiver does not send the tune state after it's finished.
-			time.AfterFunc(time.Second, func() {
+			clock.afterFunc(time.Second, func() {
 				_ = s.getTransmitStatus()
 			})
 		} else {
 			if s.state.tune { // Tune finished?
 				s.state.tune = false
-				s.state.tuneTimeoutTimer.Stop()
+				s.state.tuneTimeoutTimer.stop()
 				_ = s.getVd()
 			}
 		}
 
 		statusLog.reportPTT(s.state.ptt, s.state.tune)
+		radioInfo.reportPTT(s.state.ptt || s.state.tune)
+		tci.reportPTT(s.state.ptt, s.state.tune)
 		if s.state.setTune.pending {
 			s.removePendingCmd(&s.state.setTune)
 			return false
@@ -555,44 +651,90 @@ func (s *civControlStruct) decodeTransmitStatus(d []byte) bool {
 	return true
 }
 
+func formatSValue(sValue int) string {
+	sStr := "S"
+	if sValue <= 9 {
+		sStr += fmt.Sprint(sValue)
+	} else {
+		sStr += "9+"
+
+		switch sValue {
+		case 10:
+			sStr += "10"
+		case 11:
+			sStr += "20"
+		case 12:
+			sStr += "30"
+		case 13:
+			sStr += "40"
+		case 14:
+			sStr += "40"
+		case 15:
+			sStr += "40"
+		case 16:
+			sStr += "40"
+		case 17:
+			sStr += "50"
+		case 18:
+			sStr += "50"
+		default:
+			sStr += "60"
+		}
+	}
+	return sStr
+}
+
+// Converts S meter strings like S5 or S9+20 to the S values used by formatSValue.
+func parseSValue(sStr string) (int, error) {
+	str := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(sStr)), "S")
+	if !strings.HasPrefix(str, "9+") {
+		v, err := strconv.Atoi(str)
+		if err != nil || v < 0 || v > 9 {
+			return 0, fmt.Errorf("invalid S meter value %s", sStr)
+		}
+		return v, nil
+	}
+	switch str[2:] {
+	case "10":
+		return 10, nil
+	case "20":
+		return 11, nil
+	case "30":
+		return 12, nil
+	case "40":
+		return 13, nil
+	case "50":
+		return 17, nil
+	case "60":
+		return 19, nil
+	}
+	return 0, fmt.Errorf("invalid S meter value %s", sStr)
+}
+
 func (s *civControlStruct) decodeVdSWRS(d []byte) bool {
 	switch d[0] {
+	case 0x01:
+		if len(d) < 2 {
+			return !s.state.getSquelchStatus.pending
+		}
+		s.state.squelchOpen = d[1] == 1
+		scanner.reportSquelch(s.state.squelchOpen)
+		if s.state.getSquelchStatus.pending {
+			s.removePendingCmd(&s.state.getSquelchStatus)
+			return false
+		}
 	case 0x02:
 		if len(d) < 3 {
 			return !s.state.getS.pending
 		}
 		sValue := (int(math.Round(((float64(int(d[1])<<8) + float64(d[2])) / 0x0241) * 18)))
-		sStr := "S"
-		if sValue <= 9 {
-			sStr += fmt.Sprint(sValue)
-		} else {
-			sStr += "9+"
-
-			switch sValue {
-			case 10:
-				sStr += "10"
-			case 11:
-				sStr += "20"
-			case 12:
-				sStr += "30"
-			case 13:
-				sStr += "40"
-			case 14:
-				sStr += "40"
-			case 15:
-				sStr += "40"
-			case 16:
-				sStr += "40"
-			case 17:
-				sStr += "50"
-			case 18:
-				sStr += "50"
-			default:
-				sStr += "60"
-			}
-		}
-		s.state.lastSReceivedAt = time.Now()
-		statusLog.reportS(sStr)
+		sStr := formatSValue(sValue)
+		s.state.sValue = sValue
+		s.state.lastSReceivedAt = clock.now()
+		statusLog.reportS(sValue, sStr)
+		scanner.reportS(sValue)
+		sweeper.reportS(sValue)
+		scriptEngine.reportS(sValue)
 		if s.state.getS.pending {
 			s.removePendingCmd(&s.state.getS)
 			return false
@@ -601,8 +743,11 @@ func (s *civControlStruct) decodeVdSWRS(d []byte) bool {
 		if len(d) < 3 {
 			return !s.state.getSWR.pending
 		}
-		s.state.lastSWRReceivedAt = time.Now()
-		statusLog.reportSWR(((float64(int(d[1])<<8)+float64(d[2]))/0x0120)*2 + 1)
+		s.state.lastSWRReceivedAt = clock.now()
+		swr := ((float64(int(d[1])<<8)+float64(d[2]))/0x0120)*2 + 1
+		s.state.swr = swr
+		statusLog.reportSWR(swr)
+		events.reportSWR(swr)
 		if s.state.getSWR.pending {
 			s.removePendingCmd(&s.state.getSWR)
 			return false
@@ -627,7 +772,9 @@ func (s *civControlStruct) decodePreampAGCNREnabled(d []byte) bool {
 			return !s.state.getPreamp.pending && !s.state.setPreamp.pending
 		}
 		s.state.preamp = int(d[1])
+		s.state.preampKnown = true
 		statusLog.reportPreamp(s.state.preamp)
+		s.updateBandStack()
 		if s.state.getPreamp.pending {
 			s.removePendingCmd(&s.state.getPreamp)
 			return false
@@ -651,6 +798,7 @@ func (s *civControlStruct) decodePreampAGCNREnabled(d []byte) bool {
 			agc = "S"
 		}
 		statusLog.reportAGC(agc)
+		s.updateBandStack()
 		if s.state.getAGC.pending {
 			s.removePendingCmd(&s.state.getAGC)
 			return false
@@ -689,16 +837,27 @@ func (s *civControlStruct) decodeVFOFreq(d []byte) bool {
 	f := s.decodeFreqData(d[1:])
 	switch d[0] {
 	default:
+		prevFreq := s.state.freq
+		prevBandIdx := s.state.bandIdx
+
 		s.state.freq = f
 		statusLog.reportFrequency(s.state.freq)
-
-		s.state.bandIdx = len(civBands) - 1 // Set the band idx to GENE by default.
-		for i := range civBands {
-			if s.state.freq >= civBands[i].freqFrom && s.state.freq <= civBands[i].freqTo {
-				s.state.bandIdx = i
-				civBands[s.state.bandIdx].freq = s.state.freq
-				break
+		radioInfo.reportFrequency(s.state.freq)
+		tci.reportFrequency(s.state.freq)
+
+		s.state.bandIdx = getBandIdx(s.state.freq)
+		events.reportFrequency(s.state.freq, s.state.bandIdx)
+		bandData.reportFrequency(s.state.freq, s.state.bandIdx)
+
+		// The top entry of the band we've just left already holds its last state, so we only have to
+		// start a new entry for the band we've arrived to.
+		if prevFreq == 0 || prevBandIdx != s.state.bandIdx {
+			bandStack.push(s.state.bandIdx, s.getBandStackEntry(s.state.freq))
+			if prevFreq != 0 {
+				bandStack.save()
 			}
+		} else {
+			s.updateBandStack()
 		}
 
 		if s.state.getMainVFOFreq.pending {
@@ -712,6 +871,8 @@ func (s *civControlStruct) decodeVFOFreq(d []byte) bool {
 	case 0x01:
 		s.state.subFreq = f
 		statusLog.reportSubFrequency(s.state.subFreq)
+		radioInfo.reportSubFrequency(s.state.subFreq)
+		tci.reportSubFrequency(s.state.subFreq)
 		if s.state.getSubVFOFreq.pending {
 			s.removePendingCmd(&s.state.getSubVFOFreq)
 			return false
@@ -754,6 +915,11 @@ func (s *civControlStruct) decodeVFOMode(d []byte) bool {
 		}
 		statusLog.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode,
 			civFilters[s.state.filterIdx].name)
+		events.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode,
+			civFilters[s.state.filterIdx].name)
+		radioInfo.reportMode(civOperatingModes[s.state.operatingModeIdx].name)
+		tci.reportMode(civOperatingModes[s.state.operatingModeIdx].name, s.state.dataMode)
+		s.updateBandStack()
 
 		if s.state.getMainVFOMode.pending {
 			s.removePendingCmd(&s.state.getMainVFOMode)
@@ -778,6 +944,107 @@ func (s *civControlStruct) decodeVFOMode(d []byte) bool {
 	return true
 }
 
+func decodeBCDByte(b byte) int {
+	return int(b>>4)*10 + int(b&0x0f)
+}
+
+func encodeBCDByte(v int) byte {
+	return byte((v/10)%10)<<4 | byte(v%10)
+}
+
+func (s *civControlStruct) reportScopeSettings() {
+	var refSign string
+	if s.state.scopeRef >= 0 {
+		refSign = "+"
+	}
+	statusLog.reportScope(s.state.scopeEnabled, fmt.Sprint(civScopeSpans[s.state.scopeSpanIdx].name, " ref",
+		refSign, fmt.Sprintf("%.1f", float64(s.state.scopeRef)/2), "dB ", civScopeSpeeds[s.state.scopeSpeed]))
+}
+
+func (s *civControlStruct) decodeScope(d []byte) bool {
+	if len(d) < 1 {
+		return true
+	}
+
+	switch d[0] {
+	case 0x00:
+		scope.addWaveformData(d[1:])
+	case 0x10:
+		if len(d) < 2 {
+			return !s.state.setScope.pending
+		}
+		s.state.scopeEnabled = d[1] == 1
+		s.reportScopeSettings()
+		if s.state.setScope.pending {
+			s.removePendingCmd(&s.state.setScope)
+			return false
+		}
+	case 0x11:
+		if len(d) < 2 {
+			return !s.state.setScopeOutput.pending
+		}
+		if s.state.setScopeOutput.pending {
+			s.removePendingCmd(&s.state.setScopeOutput)
+			return false
+		}
+	case 0x15:
+		if len(d) < 7 {
+			return !s.state.getScopeSpan.pending && !s.state.setScopeSpan.pending
+		}
+		span := s.decodeFreqData(d[2:7])
+		for i := range civScopeSpans {
+			if civScopeSpans[i].hz == span {
+				s.state.scopeSpanIdx = i
+				break
+			}
+		}
+		s.reportScopeSettings()
+		if s.state.getScopeSpan.pending {
+			s.removePendingCmd(&s.state.getScopeSpan)
+			return false
+		}
+		if s.state.setScopeSpan.pending {
+			s.removePendingCmd(&s.state.setScopeSpan)
+			return false
+		}
+	case 0x19:
+		if len(d) < 5 {
+			return !s.state.getScopeRef.pending && !s.state.setScopeRef.pending
+		}
+		// The level is sent in 0.01dB units.
+		s.state.scopeRef = (decodeBCDByte(d[2])*100 + decodeBCDByte(d[3])) / 50
+		if d[4] == 1 {
+			s.state.scopeRef = -s.state.scopeRef
+		}
+		s.reportScopeSettings()
+		if s.state.getScopeRef.pending {
+			s.removePendingCmd(&s.state.getScopeRef)
+			return false
+		}
+		if s.state.setScopeRef.pending {
+			s.removePendingCmd(&s.state.setScopeRef)
+			return false
+		}
+	case 0x1a:
+		if len(d) < 3 {
+			return !s.state.getScopeSpeed.pending && !s.state.setScopeSpeed.pending
+		}
+		if int(d[2]) < len(civScopeSpeeds) {
+			s.state.scopeSpeed = int(d[2])
+		}
+		s.reportScopeSettings()
+		if s.state.getScopeSpeed.pending {
+			s.removePendingCmd(&s.state.getScopeSpeed)
+			return false
+		}
+		if s.state.setScopeSpeed.pending {
+			s.removePendingCmd(&s.state.setScopeSpeed)
+			return false
+		}
+	}
+	return true
+}
+
 func (s *civControlStruct) initCmd(cmd *civCmd, name string, data []byte) {
 	*cmd = civCmd{}
 	cmd.name = name
@@ -810,7 +1077,7 @@ func (s *civControlStruct) sendCmd(cmd *civCmd) error {
 	}
 
 	cmd.pending = true
-	cmd.sentAt = time.Now()
+	cmd.sentAt = clock.now()
 	if s.getPendingCmdIndex(cmd) < 0 {
 		s.state.pendingCmds = append(s.state.pendingCmds, cmd)
 		select {
@@ -1007,7 +1274,7 @@ func (s *civControlStruct) setPTT(enable bool) error {
 	var b byte
 	if enable {
 		b = 1
-		s.state.pttTimeoutTimer = time.AfterFunc(pttTimeout, func() {
+		s.state.pttTimeoutTimer = clock.afterFunc(pttTimeout, func() {
 			_ = s.setPTT(false)
 		})
 	}
@@ -1023,7 +1290,7 @@ func (s *civControlStruct) setTune(enable bool) error {
 	var b byte
 	if enable {
 		b = 2
-		s.state.tuneTimeoutTimer = time.AfterFunc(tuneTimeout, func() {
+		s.state.tuneTimeoutTimer = clock.afterFunc(tuneTimeout, func() {
 			_ = s.setTune(false)
 		})
 	} else {
@@ -1038,11 +1305,15 @@ func (s *civControlStruct) toggleTune() error {
 }
 
 func (s *civControlStruct) setDataMode(enable bool) error {
+	return s.setDataModeAndFilter(enable, 1)
+}
+
+func (s *civControlStruct) setDataModeAndFilter(enable bool, filterCode byte) error {
 	var b byte
 	var f byte
 	if enable {
 		b = 1
-		f = 1
+		f = filterCode
 	} else {
 		b = 0
 		f = 0
@@ -1055,16 +1326,84 @@ func (s *civControlStruct) toggleDataMode() error {
 	return s.setDataMode(!s.state.dataMode)
 }
 
+// Returns the current operating state to be stored in the band stack. Settings which have not been received
+// from the radio yet are left out.
+func (s *civControlStruct) getBandStackEntry(freq uint) bandStackEntry {
+	e := bandStackEntry{
+		Freq:     freq,
+		DataMode: s.state.dataMode,
+	}
+	if s.state.pwrPercentKnown {
+		pwrPercent := s.state.pwrPercent
+		e.PwrPercent = &pwrPercent
+	}
+	if s.state.preampKnown {
+		preamp := s.state.preamp
+		e.Preamp = &preamp
+	}
+	if s.state.agc >= 1 && s.state.agc <= 3 {
+		agc := s.state.agc
+		e.AGC = &agc
+	}
+	if s.state.operatingModeIdx >= 0 && s.state.operatingModeIdx < len(civOperatingModes) {
+		e.ModeCode = civOperatingModes[s.state.operatingModeIdx].code
+	}
+	if s.state.filterIdx >= 0 && s.state.filterIdx < len(civFilters) {
+		e.FilterCode = civFilters[s.state.filterIdx].code
+	}
+	return e
+}
+
+func (s *civControlStruct) updateBandStack() {
+	if s.state.freq == 0 {
+		return
+	}
+	bandStack.update(s.state.bandIdx, s.getBandStackEntry(s.state.freq))
+}
+
+func (s *civControlStruct) restoreBandStackEntry(e bandStackEntry) error {
+	if err := s.setMainVFOFreq(e.Freq); err != nil {
+		return err
+	}
+	if e.FilterCode == 0 { // Entries without a stored mode only contain the frequency.
+		return nil
+	}
+	if err := s.setOperatingModeAndFilter(e.ModeCode, e.FilterCode); err != nil {
+		return err
+	}
+	if err := s.setDataModeAndFilter(e.DataMode, e.FilterCode); err != nil {
+		return err
+	}
+	if e.PwrPercent != nil {
+		if err := s.setPwr(*e.PwrPercent); err != nil {
+			return err
+		}
+	}
+	if e.Preamp != nil {
+		if err := s.setPreamp(*e.Preamp); err != nil {
+			return err
+		}
+	}
+	if e.AGC != nil {
+		return s.setAGC(*e.AGC)
+	}
+	return nil
+}
+
+func (s *civControlStruct) changeBand(i int, defaultFreq uint) error {
+	e, found := bandStack.get(i)
+	if !found {
+		return s.setMainVFOFreq(defaultFreq)
+	}
+	return s.restoreBandStackEntry(e)
+}
+
 func (s *civControlStruct) incBand() error {
 	i := s.state.bandIdx + 1
 	if i >= len(civBands) {
 		i = 0
 	}
-	f := civBands[i].freq
-	if f == 0 {
-		f = (civBands[i].freqFrom + civBands[i].freqTo) / 2
-	}
-	return s.setMainVFOFreq(f)
+	return s.changeBand(i, (civBands[i].freqFrom+civBands[i].freqTo)/2)
 }
 
 func (s *civControlStruct) decBand() error {
@@ -1072,29 +1411,42 @@ func (s *civControlStruct) decBand() error {
 	if i < 0 {
 		i = len(civBands) - 1
 	}
-	f := civBands[i].freq
-	if f == 0 {
-		f = civBands[i].freqFrom
+	return s.changeBand(i, civBands[i].freqFrom)
+}
+
+// Recalls the next stored operating state of the current band.
+func (s *civControlStruct) cycleBandStack() error {
+	e, found := bandStack.rotate(s.state.bandIdx)
+	if !found {
+		return nil
 	}
-	return s.setMainVFOFreq(f)
+	return s.restoreBandStackEntry(e)
+}
+
+func (s *civControlStruct) setPreamp(v int) error {
+	s.initCmd(&s.state.setPreamp, "setPreamp", []byte{254, 254, civAddress, 224, 0x16, 0x02, byte(v), 253})
+	return s.sendCmd(&s.state.setPreamp)
 }
 
 func (s *civControlStruct) togglePreamp() error {
-	b := byte(s.state.preamp + 1)
-	if b > 2 {
-		b = 0
+	v := s.state.preamp + 1
+	if v > 2 {
+		v = 0
 	}
-	s.initCmd(&s.state.setPreamp, "setPreamp", []byte{254, 254, civAddress, 224, 0x16, 0x02, b, 253})
-	return s.sendCmd(&s.state.setPreamp)
+	return s.setPreamp(v)
+}
+
+func (s *civControlStruct) setAGC(v int) error {
+	s.initCmd(&s.state.setAGC, "setAGC", []byte{254, 254, civAddress, 224, 0x16, 0x12, byte(v), 253})
+	return s.sendCmd(&s.state.setAGC)
 }
 
 func (s *civControlStruct) toggleAGC() error {
-	b := byte(s.state.agc + 1)
-	if b > 3 {
-		b = 1
+	v := s.state.agc + 1
+	if v > 3 {
+		v = 1
 	}
-	s.initCmd(&s.state.setAGC, "setAGC", []byte{254, 254, civAddress, 224, 0x16, 0x12, b, 253})
-	return s.sendCmd(&s.state.setAGC)
+	return s.setAGC(v)
 }
 
 func (s *civControlStruct) toggleNR() error {
@@ -1147,6 +1499,16 @@ func (s *civControlStruct) toggleVFO() error {
 	return s.setVFO(b)
 }
 
+// Selects the given memory channel, channels 100 and 101 are the P1 and P2 program scan edges.
+func (s *civControlStruct) setMemory(ch int) error {
+	if ch < 1 || ch > 101 {
+		return fmt.Errorf("invalid memory channel %d", ch)
+	}
+	s.initCmd(&s.state.setMemory, "setMemory", []byte{254, 254, civAddress, 224, 0x08,
+		encodeBCDByte(ch / 100), encodeBCDByte(ch % 100), 253})
+	return s.sendCmd(&s.state.setMemory)
+}
+
 func (s *civControlStruct) setSplit(mode splitMode) error {
 	var b byte
 	switch mode {
@@ -1178,6 +1540,89 @@ func (s *civControlStruct) toggleSplit() error {
 	return s.setSplit(mode)
 }
 
+// Enables the spectrum scope and its waveform data output on the CI-V port.
+func (s *civControlStruct) setScope(enable bool) error {
+	var b byte
+	if enable {
+		b = 1
+		s.initCmd(&s.state.setScope, "setScope", []byte{254, 254, civAddress, 224, 0x27, 0x10, b, 253})
+		if err := s.sendCmd(&s.state.setScope); err != nil {
+			return err
+		}
+	}
+	// On disable only the data output is turned off, the scope stays on the radio's screen.
+	s.initCmd(&s.state.setScopeOutput, "setScopeOutput", []byte{254, 254, civAddress, 224, 0x27, 0x11, b, 253})
+	if err := s.sendCmd(&s.state.setScopeOutput); err != nil {
+		return err
+	}
+	s.state.scopeEnabled = enable
+	s.reportScopeSettings()
+	if !enable {
+		return nil
+	}
+	return s.getScopeSettings()
+}
+
+func (s *civControlStruct) toggleScope() error {
+	return s.setScope(!s.state.scopeEnabled)
+}
+
+func (s *civControlStruct) setScopeSpan(idx int) error {
+	b := s.encodeFreqData(civScopeSpans[idx].hz)
+	s.initCmd(&s.state.setScopeSpan, "setScopeSpan", []byte{254, 254, civAddress, 224, 0x27, 0x15, 0x00,
+		b[0], b[1], b[2], b[3], b[4], 253})
+	return s.sendCmd(&s.state.setScopeSpan)
+}
+
+func (s *civControlStruct) incScopeSpan() error {
+	if s.state.scopeSpanIdx == len(civScopeSpans)-1 {
+		return nil
+	}
+	return s.setScopeSpan(s.state.scopeSpanIdx + 1)
+}
+
+func (s *civControlStruct) decScopeSpan() error {
+	if s.state.scopeSpanIdx == 0 {
+		return nil
+	}
+	return s.setScopeSpan(s.state.scopeSpanIdx - 1)
+}
+
+// The reference level is given in 0.5dB steps.
+func (s *civControlStruct) setScopeRef(ref int) error {
+	if ref > civScopeRefMax {
+		ref = civScopeRefMax
+	} else if ref < -civScopeRefMax {
+		ref = -civScopeRefMax
+	}
+	var sign byte
+	if ref < 0 {
+		sign = 1
+		ref = -ref
+	}
+	v := ref * 50
+	s.initCmd(&s.state.setScopeRef, "setScopeRef", []byte{254, 254, civAddress, 224, 0x27, 0x19, 0x00,
+		encodeBCDByte(v / 100), encodeBCDByte(v % 100), sign, 253})
+	return s.sendCmd(&s.state.setScopeRef)
+}
+
+func (s *civControlStruct) incScopeRef() error {
+	return s.setScopeRef(s.state.scopeRef + 1)
+}
+
+func (s *civControlStruct) decScopeRef() error {
+	return s.setScopeRef(s.state.scopeRef - 1)
+}
+
+func (s *civControlStruct) setScopeSpeed(v int) error {
+	s.initCmd(&s.state.setScopeSpeed, "setScopeSpeed", []byte{254, 254, civAddress, 224, 0x27, 0x1a, 0x00, byte(v), 253})
+	return s.sendCmd(&s.state.setScopeSpeed)
+}
+
+func (s *civControlStruct) cycleScopeSpeed() error {
+	return s.setScopeSpeed((s.state.scopeSpeed + 1) % len(civScopeSpeeds))
+}
+
 // func (s *civControlStruct) getFreq() error {
 // 	s.initCmd(&s.state.getFreq, "getFreq", []byte{254, 254, civAddress, 224, 3, 253})
 // 	return s.sendCmd(&s.state.getFreq)
@@ -1227,6 +1672,11 @@ func (s *civControlStruct) getS() error {
 	return s.sendCmd(&s.state.getS)
 }
 
+func (s *civControlStruct) getSquelchStatus() error {
+	s.initCmd(&s.state.getSquelchStatus, "getSquelchStatus", []byte{254, 254, civAddress, 224, 0x15, 0x01, 253})
+	return s.sendCmd(&s.state.getSquelchStatus)
+}
+
 func (s *civControlStruct) getOVF() error {
 	s.initCmd(&s.state.getOVF, "getOVF", []byte{254, 254, civAddress, 224, 0x1a, 0x09, 253})
 	return s.sendCmd(&s.state.getOVF)
@@ -1285,18 +1735,31 @@ func (s *civControlStruct) getBothVFOMode() error {
 	return s.sendCmd(&s.state.getSubVFOMode)
 }
 
+func (s *civControlStruct) getScopeSettings() error {
+	s.initCmd(&s.state.getScopeSpan, "getScopeSpan", []byte{254, 254, civAddress, 224, 0x27, 0x15, 0x00, 253})
+	if err := s.sendCmd(&s.state.getScopeSpan); err != nil {
+		return err
+	}
+	s.initCmd(&s.state.getScopeRef, "getScopeRef", []byte{254, 254, civAddress, 224, 0x27, 0x19, 0x00, 253})
+	if err := s.sendCmd(&s.state.getScopeRef); err != nil {
+		return err
+	}
+	s.initCmd(&s.state.getScopeSpeed, "getScopeSpeed", []byte{254, 254, civAddress, 224, 0x27, 0x1a, 0x00, 253})
+	return s.sendCmd(&s.state.getScopeSpeed)
+}
+
 func (s *civControlStruct) loop() {
 	for {
 		s.state.mutex.Lock()
 		nextPendingCmdTimeout := time.Hour
 		for i := range s.state.pendingCmds {
-			diff := time.Since(s.state.pendingCmds[i].sentAt)
+			diff := clock.since(s.state.pendingCmds[i].sentAt)
 			if diff >= commandRetryTimeout {
 				nextPendingCmdTimeout = 0
 				break
 			}
-			if diff < nextPendingCmdTimeout {
-				nextPendingCmdTimeout = diff
+			if wait := commandRetryTimeout - diff; wait < nextPendingCmdTimeout {
+				nextPendingCmdTimeout = wait
 			}
 		}
 		s.state.mutex.Unlock()
@@ -1305,29 +1768,29 @@ func (s *civControlStruct) loop() {
 		case <-s.deinitNeeded:
 			s.deinitFinished <- true
 			return
-		case <-time.After(statusPollInterval):
+		case <-clock.after(statusPollInterval):
 			if s.state.ptt || s.state.tune {
-				if !s.state.getSWR.pending && time.Since(s.state.lastSWRReceivedAt) >= statusPollInterval {
+				if !s.state.getSWR.pending && clock.since(s.state.lastSWRReceivedAt) >= statusPollInterval {
 					_ = s.getSWR()
 				}
 			} else {
-				if !s.state.getS.pending && time.Since(s.state.lastSReceivedAt) >= statusPollInterval {
+				if !s.state.getS.pending && clock.since(s.state.lastSReceivedAt) >= statusPollInterval {
 					_ = s.getS()
 				}
-				if !s.state.getOVF.pending && time.Since(s.state.lastOVFReceivedAt) >= statusPollInterval {
+				if !s.state.getOVF.pending && clock.since(s.state.lastOVFReceivedAt) >= statusPollInterval {
 					_ = s.getOVF()
 				}
 			}
 			if !s.state.getMainVFOFreq.pending && !s.state.getSubVFOFreq.pending &&
-				time.Since(s.state.lastVFOFreqReceivedAt) >= statusPollInterval {
+				clock.since(s.state.lastVFOFreqReceivedAt) >= statusPollInterval {
 				_ = s.getBothVFOFreq()
 			}
 		case <-s.resetSReadTimer:
 		case <-s.newPendingCmdAdded:
-		case <-time.After(nextPendingCmdTimeout):
+		case <-clock.after(nextPendingCmdTimeout):
 			s.state.mutex.Lock()
 			for _, cmd := range s.state.pendingCmds {
-				if time.Since(cmd.sentAt) >= commandRetryTimeout {
+				if clock.since(cmd.sentAt) >= commandRetryTimeout {
 					log.Debug("retrying cmd send ", cmd.name)
 					_ = s.sendCmd(cmd)
 				}
@@ -1337,9 +1800,8 @@ func (s *civControlStruct) loop() {
 	}
 }
 
-func (s *civControlStruct) init(st *serialStream) error {
-	s.st = st
-
+// Queries the whole radio state. The mutex has to be locked by the caller.
+func (s *civControlStruct) queryState() error {
 	if err := s.getBothVFOFreq(); err != nil {
 		return err
 	}
@@ -1385,7 +1847,21 @@ func (s *civControlStruct) init(st *serialStream) error {
 	if err := s.getNREnabled(); err != nil {
 		return err
 	}
-	if err := s.getSplit(); err != nil {
+	return s.getSplit()
+}
+
+// The same civControl is used for all serial streams, as others (rigctld, the scanner, scripts etc.) can use
+// its mutex and cached state at any time, even while the serial stream is restarted. The state is queried
+// again using the new stream.
+func (s *civControlStruct) init(st *serialStream) error {
+	s.state.mutex.Lock()
+	s.st = st
+	err := s.queryState()
+	if err != nil {
+		s.st = nil
+	}
+	s.state.mutex.Unlock()
+	if err != nil {
 		return err
 	}
 
@@ -1405,5 +1881,10 @@ func (s *civControlStruct) deinit() {
 	s.deinitNeeded <- true
 	<-s.deinitFinished
 	s.deinitNeeded = nil
+
+	s.state.mutex.Lock()
 	s.st = nil
+	s.state.mutex.Unlock()
+
+	bandStack.save()
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// Returns a civControl which sends to the returned radio socket, without starting its loop.
+func newTestCivControl(t testing.TB) (s *civControlStruct, radio *net.UDPConn) {
+	conn, radio := newTestStreamConn(t)
+	s = &civControlStruct{st: &serialStream{}}
+	s.st.common.conn = conn
+	return s, radio
+}
+
+func expectTestCivCmd(t testing.TB, radio *net.UDPConn, cmd []byte) {
+	t.Helper()
+	p, ok := readTestPkt(t, radio).(*pktSerialData)
+	if !ok {
+		t.Fatalf("expected a serial data packet, got %#v", p)
+	}
+	if !bytes.Equal(p.data, cmd) {
+		t.Fatalf("sent cmd %x, expected %x", p.data, cmd)
+	}
+}
+
+func TestCivControlCommandRetry(t *testing.T) {
+	c := useFakeClock(t)
+	s, radio := newTestCivControl(t)
+	s.deinitNeeded = make(chan bool)
+	s.deinitFinished = make(chan bool)
+	s.resetSReadTimer = make(chan bool)
+	s.newPendingCmdAdded = make(chan bool)
+	go s.loop()
+	defer func() {
+		s.deinitNeeded <- true
+		<-s.deinitFinished
+	}()
+
+	s.state.mutex.Lock()
+	if err := s.getVd(); err != nil {
+		t.Fatal(err)
+	}
+	s.state.mutex.Unlock()
+	cmd := s.state.getVd.cmd
+	expectTestCivCmd(t, radio, cmd)
+
+	// The cmd is sent again until it's answered.
+	for i := 0; i < 2; i++ {
+		c.waitForTimer(t, c.now().Add(commandRetryTimeout))
+		c.advance(commandRetryTimeout)
+		expectTestCivCmd(t, radio, cmd)
+	}
+
+	s.decode([]byte{254, 254, 224, civAddress, 0x15, 0x15, 0x00, 0x50, 253})
+	s.state.mutex.Lock()
+	if s.state.getVd.pending || len(s.state.pendingCmds) != 0 {
+		t.Error("cmd still pending after reply")
+	}
+	s.state.mutex.Unlock()
+}
+
+func TestCivControlPTTTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	s, radio := newTestCivControl(t)
+
+	if err := s.setPTT(true); err != nil {
+		t.Fatal(err)
+	}
+	expectTestCivCmd(t, radio, []byte{254, 254, civAddress, 224, 0x1c, 0, 1, 253})
+
+	c.advance(pttTimeout)
+	expectTestCivCmd(t, radio, []byte{254, 254, civAddress, 224, 0x1c, 0, 0, 253})
+
+	// Waiting for the timer function to finish sending, so it won't use the clock after the test.
+	s.st.common.pkt0.mutex.Lock()
+	s.st.common.pkt0.mutex.Unlock()
+}
+
+func TestCivControlSerialRestart(t *testing.T) {
+	useFakeClock(t)
+	old, oldRadio := newTestCivControl(t)
+	restarted, radio := newTestCivControl(t)
+	getMainVFOFreq := []byte{254, 254, civAddress, 224, 0x25, 0, 253}
+
+	if err := civControl.init(old.st); err != nil {
+		t.Fatal(err)
+	}
+	defer civControl.deinit()
+	expectTestCivCmd(t, oldRadio, getMainVFOFreq)
+
+	civControl.state.mutex.Lock()
+	civControl.state.freq = 7074000
+	held := make(chan bool)
+	release := make(chan bool)
+	go func() {
+		// Others like rigctld can hold the mutex while the serial stream is restarted.
+		civControl.state.mutex.Lock()
+		held <- true
+		<-release
+		civControl.state.freq++
+		civControl.state.mutex.Unlock()
+	}()
+	civControl.state.mutex.Unlock()
+	<-held
+
+	restartFinished := make(chan error)
+	go func() {
+		// This is what the serial stream's deinit and init does on a restart.
+		civControl.deinit()
+		civControl.deinit()
+		restartFinished <- civControl.init(restarted.st)
+	}()
+	release <- true
+	if err := <-restartFinished; err != nil {
+		t.Fatal(err)
+	}
+	expectTestCivCmd(t, radio, getMainVFOFreq)
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	if civControl.st != restarted.st {
+		t.Error("civControl is not using the restarted stream")
+	}
+	if civControl.state.freq != 7074001 {
+		t.Error("cached state lost on restart, freq is ", civControl.state.freq)
+	}
+}
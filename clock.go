@@ -0,0 +1,83 @@
+package main
+
+import "time"
+
+// The stream code gets the current time and its timers from the clock, so timeouts and retries can be
+// simulated in the tests by replacing it with a fakeClock, which only advances when asked to.
+
+type clockTimer interface {
+	// Returns the channel the timer fires to. It's nil for timers created with afterFunc().
+	c() <-chan time.Time
+	stop() bool
+	reset(d time.Duration) bool
+}
+
+type clockTicker interface {
+	c() <-chan time.Time
+	stop()
+}
+
+type clockType interface {
+	now() time.Time
+	since(t time.Time) time.Duration
+	newTimer(d time.Duration) clockTimer
+	afterFunc(d time.Duration, f func()) clockTimer
+	after(d time.Duration) <-chan time.Time
+	newTicker(d time.Duration) clockTicker
+}
+
+var clock clockType = realClock{}
+
+type realClock struct{}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) c() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) stop() bool {
+	return t.t.Stop()
+}
+
+func (t realTimer) reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) c() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) stop() {
+	t.t.Stop()
+}
+
+func (realClock) now() time.Time {
+	return time.Now()
+}
+
+func (realClock) since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) newTimer(d time.Duration) clockTimer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+func (realClock) afterFunc(d time.Duration, f func()) clockTimer {
+	return realTimer{t: time.AfterFunc(d, f)}
+}
+
+func (realClock) after(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) newTicker(d time.Duration) clockTicker {
+	return realTicker{t: time.NewTicker(d)}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex   sync.Mutex
+	current time.Time
+	timers  []*fakeTimer
+}
+
+// Tickers are fakeTimers with a non-zero period.
+type fakeTimer struct {
+	clock  *fakeClock
+	ch     chan time.Time
+	f      func()
+	at     time.Time
+	period time.Duration
+	active bool
+	queued bool
+}
+
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+func newFakeClock(t time.Time) *fakeClock {
+	return &fakeClock{current: t}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current
+}
+
+func (c *fakeClock) since(t time.Time) time.Duration {
+	return c.now().Sub(t)
+}
+
+// Has to be called with the mutex locked.
+func (c *fakeClock) fire(t *fakeTimer) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.ch <- c.current:
+	default:
+	}
+}
+
+// Has to be called with the mutex locked. Timers (but not tickers) with zero duration fire immediately, as
+// the stream code waits for them to fire right after creation.
+func (c *fakeClock) schedule(t *fakeTimer, d time.Duration) (wasActive bool) {
+	wasActive = t.active
+	if d <= 0 && t.period == 0 {
+		t.active = false
+		c.fire(t)
+		return
+	}
+	t.at = c.current.Add(d)
+	t.active = true
+	if !t.queued {
+		c.timers = append(c.timers, t)
+		t.queued = true
+	}
+	return
+}
+
+func (c *fakeClock) newFakeTimer(d, period time.Duration, f func()) *fakeTimer {
+	t := &fakeTimer{clock: c, f: f, period: period}
+	if f == nil {
+		t.ch = make(chan time.Time, 1)
+	}
+	c.mutex.Lock()
+	c.schedule(t, d)
+	c.mutex.Unlock()
+	return t
+}
+
+func (c *fakeClock) newTimer(d time.Duration) clockTimer {
+	return c.newFakeTimer(d, 0, nil)
+}
+
+func (c *fakeClock) afterFunc(d time.Duration, f func()) clockTimer {
+	return c.newFakeTimer(d, 0, f)
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	return c.newFakeTimer(d, 0, nil).ch
+}
+
+func (c *fakeClock) newTicker(d time.Duration) clockTicker {
+	return fakeTicker{t: c.newFakeTimer(d, d, nil)}
+}
+
+// Moves the clock forward by d, firing the timers which expire meanwhile in the order of their expiry.
+// Like with real timers, functions of afterFunc() timers run in their own goroutine, and a timer tick is
+// dropped if the previous one has not been read from the channel yet.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	end := c.current.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		if next.at.After(c.current) {
+			c.current = next.at
+		}
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+		} else {
+			next.active = false
+		}
+
+		c.fire(next)
+	}
+	c.current = end
+
+	var timers []*fakeTimer
+	for _, t := range c.timers {
+		if t.active {
+			timers = append(timers, t)
+		} else {
+			t.queued = false
+		}
+	}
+	c.timers = timers
+}
+
+func (t *fakeTimer) c() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.schedule(t, d)
+}
+
+func (t fakeTicker) c() <-chan time.Time {
+	return t.t.ch
+}
+
+func (t fakeTicker) stop() {
+	t.t.stop()
+}
+
+// Replaces the clock with a fakeClock until the end of the test.
+func useFakeClock(t testing.TB) *fakeClock {
+	c := newFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	prevClock := clock
+	clock = c
+	t.Cleanup(func() {
+		clock = prevClock
+	})
+	return c
+}
+
+// Waits until a timer is set to fire at the given time, so the clock is not advanced before another goroutine
+// has set up its timer.
+func (c *fakeClock) waitForTimer(t testing.TB, at time.Time) {
+	t.Helper()
+	for deadline := time.Now().Add(testWaitTimeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.mutex.Lock()
+		for _, timer := range c.timers {
+			if timer.active && timer.at.Equal(at) {
+				c.mutex.Unlock()
+				return
+			}
+		}
+		c.mutex.Unlock()
+	}
+	t.Fatal("no timer set to ", at)
+}
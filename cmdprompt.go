@@ -0,0 +1,537 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+const cmdPromptHistoryLength = 100
+
+type cmdPromptCmd struct {
+	name  string
+	usage string
+	// Completion candidates for the first argument.
+	args []string
+}
+
+var cmdPromptCmds = []cmdPromptCmd{
+	{name: "freq", usage: "freq <freq> (in MHz, kHz or Hz)"},
+	{name: "mode", usage: "mode <mode>[d] [fil1-3]", args: getCmdPromptModeArgs()},
+	{name: "pwr", usage: "pwr <percent>"},
+	{name: "split", usage: "split <on|off|dup-|dup+|+-offset|freq>", args: []string{"on", "off", "dup-", "dup+"}},
+	{name: "mem", usage: "mem <channel>"},
+	{name: "vfo", usage: "vfo <a|b>", args: []string{"a", "b"}},
+	{name: "record", usage: "record <start|stop>", args: []string{"start", "stop"}},
+	{name: "schedule", usage: "schedule <add <when> <action>|list|cancel <id>>", args: []string{"add", "list", "cancel"}},
+	{name: "script", usage: "script <name|stop [name]|list|reload>", args: []string{"stop", "list", "reload"}},
+	{name: "help", usage: "help"},
+}
+
+type cmdPromptStruct struct {
+	mutex  sync.Mutex
+	active bool
+	line   []rune
+	cursor int
+
+	history    []string
+	historyIdx int
+	// The edited line is stored here while browsing the history.
+	editedLine []rune
+
+	cursorColor *color.Color
+}
+
+var cmdPrompt cmdPromptStruct
+
+func getCmdPromptModeArgs() (res []string) {
+	for _, m := range civOperatingModes {
+		res = append(res, strings.ToLower(m.name))
+	}
+	return append(res, "lsbd", "usbd", "amd", "fmd")
+}
+
+func (s *cmdPromptStruct) isActive() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.active
+}
+
+func (s *cmdPromptStruct) open() {
+	s.mutex.Lock()
+	if s.cursorColor == nil {
+		s.cursorColor = color.New(color.ReverseVideo)
+	}
+	s.active = true
+	s.line = nil
+	s.cursor = 0
+	s.historyIdx = len(s.history)
+	s.mutex.Unlock()
+
+	s.redraw()
+}
+
+// Returns the prompt line with the cursor, or an empty string if the prompt is not active.
+func (s *cmdPromptStruct) render() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.active {
+		return ""
+	}
+	cursorChar := " "
+	var after string
+	if s.cursor < len(s.line) {
+		cursorChar = string(s.line[s.cursor])
+		after = string(s.line[s.cursor+1:])
+	}
+	return "> " + string(s.line[:s.cursor]) + s.cursorColor.Sprint(cursorChar) + after
+}
+
+func (s *cmdPromptStruct) redraw() {
+	if statusLog.isActive() {
+		statusLog.print()
+	}
+}
+
+func (s *cmdPromptStruct) addHistory(line string) {
+	if line == "" || (len(s.history) > 0 && s.history[len(s.history)-1] == line) {
+		return
+	}
+	s.history = append(s.history, line)
+	if len(s.history) > cmdPromptHistoryLength {
+		s.history = s.history[len(s.history)-cmdPromptHistoryLength:]
+	}
+}
+
+func (s *cmdPromptStruct) browseHistory(d int) {
+	i := s.historyIdx + d
+	if i < 0 || i > len(s.history) {
+		return
+	}
+	if s.historyIdx == len(s.history) {
+		s.editedLine = s.line
+	}
+	s.historyIdx = i
+	if i == len(s.history) {
+		s.line = s.editedLine
+	} else {
+		s.line = []rune(s.history[i])
+	}
+	s.cursor = len(s.line)
+}
+
+func (s *cmdPromptStruct) insert(r []rune) {
+	line := append([]rune{}, s.line[:s.cursor]...)
+	line = append(line, r...)
+	s.line = append(line, s.line[s.cursor:]...)
+	s.cursor += len(r)
+}
+
+func (s *cmdPromptStruct) deleteWord() {
+	i := s.cursor
+	for i > 0 && s.line[i-1] == ' ' {
+		i--
+	}
+	for i > 0 && s.line[i-1] != ' ' {
+		i--
+	}
+	s.line = append(s.line[:i], s.line[s.cursor:]...)
+	s.cursor = i
+}
+
+// Completes the word before the cursor, returns the candidates if there are more than one.
+func (s *cmdPromptStruct) complete() []string {
+	text := string(s.line[:s.cursor])
+	fields := strings.Fields(text)
+	if len(fields) == 0 || strings.HasSuffix(text, " ") {
+		fields = append(fields, "")
+	}
+
+	var options []string
+	switch len(fields) {
+	case 1:
+		for _, c := range cmdPromptCmds {
+			options = append(options, c.name)
+		}
+	case 2:
+		for _, c := range cmdPromptCmds {
+			if c.name == strings.ToLower(fields[0]) {
+				options = c.args
+			}
+		}
+	}
+
+	prefix := strings.ToLower(fields[len(fields)-1])
+	var matches []string
+	for _, o := range options {
+		if strings.HasPrefix(o, prefix) {
+			matches = append(matches, o)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	s.insert([]rune(common[len(prefix):]))
+	if len(matches) == 1 {
+		s.insert([]rune{' '})
+		return nil
+	}
+	return matches
+}
+
+func (s *cmdPromptStruct) handleKey(k string) {
+	var execute bool
+	var cmd string
+	var candidates []string
+
+	s.mutex.Lock()
+	switch k {
+	case "\n", "\r":
+		cmd = strings.TrimSpace(string(s.line))
+		s.addHistory(cmd)
+		s.active = false
+		execute = true
+	case "\x1b", "\x07": // Esc, Ctrl+G
+		s.active = false
+	case "\x7f", "\x08": // Backspace
+		if s.cursor > 0 {
+			s.line = append(s.line[:s.cursor-1], s.line[s.cursor:]...)
+			s.cursor--
+		}
+	case "\x1b[3~", "\x04": // Delete, Ctrl+D
+		if s.cursor < len(s.line) {
+			s.line = append(s.line[:s.cursor], s.line[s.cursor+1:]...)
+		}
+	case "\x1b[D", "\x1bOD", "\x02": // Left, Ctrl+B
+		if s.cursor > 0 {
+			s.cursor--
+		}
+	case "\x1b[C", "\x1bOC", "\x06": // Right, Ctrl+F
+		if s.cursor < len(s.line) {
+			s.cursor++
+		}
+	case "\x1b[H", "\x1bOH", "\x1b[1~", "\x01": // Home, Ctrl+A
+		s.cursor = 0
+	case "\x1b[F", "\x1bOF", "\x1b[4~", "\x05": // End, Ctrl+E
+		s.cursor = len(s.line)
+	case "\x1b[A", "\x1bOA", "\x10": // Up, Ctrl+P
+		s.browseHistory(-1)
+	case "\x1b[B", "\x1bOB", "\x0e": // Down, Ctrl+N
+		s.browseHistory(1)
+	case "\x15": // Ctrl+U
+		s.line = s.line[s.cursor:]
+		s.cursor = 0
+	case "\x0b": // Ctrl+K
+		s.line = s.line[:s.cursor]
+	case "\x17": // Ctrl+W
+		s.deleteWord()
+	case "\t":
+		candidates = s.complete()
+	default:
+		if k[0] >= 0x20 && k[0] != 0x7f {
+			s.insert([]rune(k))
+		}
+	}
+	s.mutex.Unlock()
+
+	if len(candidates) > 0 {
+		log.Print(strings.Join(candidates, " "))
+	}
+	if execute && cmd != "" {
+		if err := s.execute(cmd); err != nil {
+			log.Error("can't run command: ", err)
+		}
+	}
+	s.redraw()
+}
+
+func (s *cmdPromptStruct) usageError(name string) error {
+	for _, c := range cmdPromptCmds {
+		if c.name == name {
+			return errors.New("usage: " + c.usage)
+		}
+	}
+	return nil
+}
+
+// Frequencies can be entered in MHz, kHz or Hz, the unit is guessed from the value.
+func (s *cmdPromptStruct) parseFreq(str string) (uint, error) {
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid frequency %s", str)
+	}
+	switch {
+	case v < 1000:
+		v *= 1000000
+	case v < 1000000:
+		v *= 1000
+	}
+	return uint(math.Round(v)), nil
+}
+
+func (s *cmdPromptStruct) runFreq(args []string) error {
+	if len(args) != 1 {
+		return s.usageError("freq")
+	}
+	f, err := s.parseFreq(args[0])
+	if err != nil {
+		return err
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	return civControl.setMainVFOFreq(f)
+}
+
+func (s *cmdPromptStruct) runMode(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return s.usageError("mode")
+	}
+
+	modeIdx := -1
+	var dataMode bool
+	name := strings.ToUpper(args[0])
+	for i := range civOperatingModes {
+		switch name {
+		case civOperatingModes[i].name:
+			modeIdx = i
+		case civOperatingModes[i].name + "D", civOperatingModes[i].name + "-D":
+			modeIdx = i
+			dataMode = true
+		}
+	}
+	if modeIdx < 0 {
+		return fmt.Errorf("unknown mode %s", args[0])
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	filterIdx := civControl.state.filterIdx
+	if len(args) > 1 {
+		filterIdx = -1
+		f := strings.ToUpper(args[1])
+		for i := range civFilters {
+			if f == civFilters[i].name || f == strings.TrimPrefix(civFilters[i].name, "FIL") {
+				filterIdx = i
+			}
+		}
+		if filterIdx < 0 {
+			return fmt.Errorf("unknown filter %s", args[1])
+		}
+	}
+
+	if err := civControl.setOperatingModeAndFilter(civOperatingModes[modeIdx].code,
+		civFilters[filterIdx].code); err != nil {
+		return err
+	}
+	return civControl.setDataModeAndFilter(dataMode, civFilters[filterIdx].code)
+}
+
+func (s *cmdPromptStruct) runPwr(args []string) error {
+	if len(args) != 1 {
+		return s.usageError("pwr")
+	}
+	v, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+	if err != nil || v < 0 || v > 100 {
+		return fmt.Errorf("invalid power %s", args[0])
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	return civControl.setPwr(v)
+}
+
+func (s *cmdPromptStruct) runSplit(args []string) error {
+	if len(args) != 1 {
+		return s.usageError("split")
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	switch strings.ToLower(args[0]) {
+	case "off":
+		return civControl.setSplit(splitModeOff)
+	case "on":
+		return civControl.setSplit(splitModeOn)
+	case "dup-":
+		return civControl.setSplit(splitModeDUPMinus)
+	case "dup+":
+		return civControl.setSplit(splitModeDUPPlus)
+	}
+
+	var f uint
+	if strings.HasPrefix(args[0], "+") || strings.HasPrefix(args[0], "-") {
+		offset, err := parseFreqOffset(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid offset %s", args[0])
+		}
+		f = uint(int(civControl.state.freq) + offset)
+	} else {
+		var err error
+		if f, err = s.parseFreq(args[0]); err != nil {
+			return err
+		}
+	}
+	if err := civControl.setSubVFOFreq(f); err != nil {
+		return err
+	}
+	return civControl.setSplit(splitModeOn)
+}
+
+func (s *cmdPromptStruct) runMem(args []string) error {
+	if len(args) != 1 {
+		return s.usageError("mem")
+	}
+	ch, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid memory channel %s", args[0])
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	return civControl.setMemory(ch)
+}
+
+func (s *cmdPromptStruct) runVFO(args []string) error {
+	if len(args) != 1 {
+		return s.usageError("vfo")
+	}
+	var nr byte
+	switch strings.ToLower(args[0]) {
+	case "a":
+	case "b":
+		nr = 1
+	default:
+		return fmt.Errorf("invalid vfo %s", args[0])
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	return civControl.setVFO(nr)
+}
+
+func (s *cmdPromptStruct) runRecord(args []string) error {
+	if len(args) != 1 {
+		return s.usageError("record")
+	}
+	switch strings.ToLower(args[0]) {
+	case "start":
+		audio.setRecFromDefaultSoundcard(true)
+	case "stop":
+		audio.setRecFromDefaultSoundcard(false)
+	default:
+		return s.usageError("record")
+	}
+	return nil
+}
+
+func (s *cmdPromptStruct) runScript(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return s.usageError("script")
+	}
+	switch strings.ToLower(args[0]) {
+	case "stop":
+		if len(args) == 1 {
+			scriptEngine.stopAll()
+			// Hooks are only running again after reloading the scripts.
+			scriptEngine.load()
+			return nil
+		}
+		return scriptEngine.stop(args[1])
+	case "list":
+		log.Print("scripts: ", strings.Join(scriptEngine.list(), ", "))
+		return nil
+	case "reload":
+		scriptEngine.load()
+		return nil
+	}
+	if len(args) != 1 {
+		return s.usageError("script")
+	}
+	return scriptEngine.run(args[0])
+}
+
+// The rest of the command line is also given, as the actions have to be added unsplit.
+func (s *cmdPromptStruct) runSchedule(args []string, line string) error {
+	if len(args) < 1 {
+		return s.usageError("schedule")
+	}
+	switch strings.ToLower(args[0]) {
+	case "add":
+		e, err := scheduler.add(skipFields(line, 2))
+		if err != nil {
+			return err
+		}
+		log.Print("scheduled ", e)
+		return nil
+	case "list":
+		entries := scheduler.list()
+		if len(entries) == 0 {
+			log.Print("no scheduled actions")
+		}
+		for _, e := range entries {
+			log.Print(e)
+		}
+		return nil
+	case "cancel":
+		if len(args) != 2 {
+			return s.usageError("schedule")
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil {
+			return fmt.Errorf("invalid schedule id %s", args[1])
+		}
+		return scheduler.cancel(id)
+	}
+	return s.usageError("schedule")
+}
+
+func (s *cmdPromptStruct) execute(line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "freq":
+		return s.runFreq(args[1:])
+	case "mode":
+		return s.runMode(args[1:])
+	case "pwr":
+		return s.runPwr(args[1:])
+	case "split":
+		return s.runSplit(args[1:])
+	case "mem":
+		return s.runMem(args[1:])
+	case "vfo":
+		return s.runVFO(args[1:])
+	case "record":
+		return s.runRecord(args[1:])
+	case "schedule":
+		return s.runSchedule(args[1:], line)
+	case "script":
+		return s.runScript(args[1:])
+	case "help":
+		for _, c := range cmdPromptCmds {
+			log.Print(c.usage)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %s", args[0])
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
-	"encoding/binary"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
@@ -15,6 +15,26 @@ const audioStreamPort = 50003
 const reauthInterval = time.Minute
 const reauthTimeout = 3 * time.Second
 
+// After sending the deauth, the radio can still send retransmit requests for this long.
+const deauthWait = 500 * time.Millisecond
+
+// If a stream fails again within this interval after it has been restarted, a relogin is done.
+const streamRestartMinInterval = 10 * time.Second
+
+type streamRestartState struct {
+	restartedAt time.Time
+	running     bool
+	// The instance of the stream which is running. Errors of older instances are ignored, as they were
+	// reported before the restart.
+	instance uint32
+}
+
+type streamRestartResult struct {
+	name     string
+	instance uint32
+	err      error
+}
+
 type controlStream struct {
 	common streamCommon
 	serial serialStream
@@ -33,9 +53,21 @@ type controlStream struct {
 
 	serialAndAudioStreamOpened bool
 	deinitializing             bool
+	deinitializingMutex        sync.Mutex
+
+	// Stream restarts run in their own goroutine, so the loop keeps reading control packets meanwhile.
+	devName             string
+	serialRestart       streamRestartState
+	audioRestart        streamRestartState
+	restartFinishedChan chan streamRestartResult
+
+	requestSerialAndAudioTimeout clockTimer
+	reauthTimeoutTimer           clockTimer
+}
 
-	requestSerialAndAudioTimeout *time.Timer
-	reauthTimeoutTimer           *time.Timer
+func (s *controlStream) newPktControlHeader(reqType byte) pktControlHeader {
+	return pktControlHeader{pktHeader: newPktHeader(&s.common, pktTypeData, 0), reqReply: pktControlRequest,
+		reqType: reqType, innerSeq: s.authInnerSendSeq}
 }
 
 func (s *controlStream) sendPktLogin() error {
@@ -44,30 +76,11 @@ func (s *controlStream) sendPktLogin() error {
 	if _, err := rand.Read(authStartID[:]); err != nil {
 		return err
 	}
-	usernameEncoded := passcode(username)
-	passwordEncoded := passcode(password)
-	p := []byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		byte(s.common.localSID >> 24), byte(s.common.localSID >> 16), byte(s.common.localSID >> 8), byte(s.common.localSID),
-		byte(s.common.remoteSID >> 24), byte(s.common.remoteSID >> 16), byte(s.common.remoteSID >> 8), byte(s.common.remoteSID),
-		0x00, 0x00, 0x00, 0x70, 0x01, 0x00, 0x00, byte(s.authInnerSendSeq),
-		byte(s.authInnerSendSeq >> 8), 0x00, authStartID[0], authStartID[1], 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		usernameEncoded[0], usernameEncoded[1], usernameEncoded[2], usernameEncoded[3],
-		usernameEncoded[4], usernameEncoded[5], usernameEncoded[6], usernameEncoded[7],
-		usernameEncoded[8], usernameEncoded[9], usernameEncoded[10], usernameEncoded[11],
-		usernameEncoded[12], usernameEncoded[13], usernameEncoded[14], usernameEncoded[15],
-		passwordEncoded[0], passwordEncoded[1], passwordEncoded[2], passwordEncoded[3],
-		passwordEncoded[4], passwordEncoded[5], passwordEncoded[6], passwordEncoded[7],
-		passwordEncoded[8], passwordEncoded[9], passwordEncoded[10], passwordEncoded[11],
-		passwordEncoded[12], passwordEncoded[13], passwordEncoded[14], passwordEncoded[15],
-		0x69, 0x63, 0x6f, 0x6d, 0x2d, 0x70, 0x63, 0x00, // icom-pc in plain text
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	if err := s.common.pkt0.sendTrackedPacket(&s.common, p); err != nil {
+	p := pktLogin{pktControlHeader: s.newPktControlHeader(0x00), name: "icom-pc"}
+	copy(p.authID[:], authStartID[:])
+	copy(p.username[:], passcode(username))
+	copy(p.password[:], passcode(password))
+	if err := s.common.sendTrackedPkt(&p); err != nil {
 		return err
 	}
 
@@ -93,16 +106,9 @@ func (s *controlStream) sendPktAuth(magic byte) error {
 	//                           0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 	//                           0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00
 
-	p := []byte{0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		byte(s.common.localSID >> 24), byte(s.common.localSID >> 16), byte(s.common.localSID >> 8), byte(s.common.localSID),
-		byte(s.common.remoteSID >> 24), byte(s.common.remoteSID >> 16), byte(s.common.remoteSID >> 8), byte(s.common.remoteSID),
-		0x00, 0x00, 0x00, 0x30, 0x01, magic, 0x00, byte(s.authInnerSendSeq),
-		byte(s.authInnerSendSeq >> 8), 0x00, s.authID[0], s.authID[1], s.authID[2], s.authID[3], s.authID[4], s.authID[5],
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	if err := s.common.pkt0.sendTrackedPacket(&s.common, p); err != nil {
+	p := pktAuth{pktControlHeader: s.newPktControlHeader(magic)}
+	p.authID = s.authID
+	if err := s.common.sendTrackedPkt(&p); err != nil {
 		return err
 	}
 	s.authInnerSendSeq++
@@ -112,32 +118,26 @@ func (s *controlStream) sendPktAuth(magic byte) error {
 func (s *controlStream) sendRequestSerialAndAudio() error {
 	log.Debug("requesting serial and audio stream")
 
-	txSeqBufLengthMs := uint16(txSeqBufLength.Milliseconds())
-
-	usernameEncoded := passcode(username)
-	p := []byte{0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		byte(s.common.localSID >> 24), byte(s.common.localSID >> 16), byte(s.common.localSID >> 8), byte(s.common.localSID),
-		byte(s.common.remoteSID >> 24), byte(s.common.remoteSID >> 16), byte(s.common.remoteSID >> 8), byte(s.common.remoteSID),
-		0x00, 0x00, 0x00, 0x80, 0x01, 0x03, 0x00, byte(s.authInnerSendSeq),
-		byte(s.authInnerSendSeq >> 8), 0x00, s.authID[0], s.authID[1], s.authID[2], s.authID[3], s.authID[4], s.authID[5],
-		s.a8replyID[0], s.a8replyID[1], s.a8replyID[2], s.a8replyID[3], s.a8replyID[4], s.a8replyID[5], s.a8replyID[6], s.a8replyID[7],
-		s.a8replyID[8], s.a8replyID[9], s.a8replyID[10], s.a8replyID[11], s.a8replyID[12], s.a8replyID[13], s.a8replyID[14], s.a8replyID[15],
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x49, 0x43, 0x2d, 0x37, 0x30, 0x35, 0x00, 0x00, // IC-705 in plain text
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		usernameEncoded[0], usernameEncoded[1], usernameEncoded[2], usernameEncoded[3],
-		usernameEncoded[4], usernameEncoded[5], usernameEncoded[6], usernameEncoded[7],
-		usernameEncoded[8], usernameEncoded[9], usernameEncoded[10], usernameEncoded[11],
-		usernameEncoded[12], usernameEncoded[13], usernameEncoded[14], usernameEncoded[15],
-		0x01, 0x01, 0x04, 0x04, 0x00, 0x00, byte(audioSampleRate >> 8), byte(audioSampleRate & 0xff),
-		0x00, 0x00, byte(audioSampleRate >> 8), byte(audioSampleRate & 0xff),
-		0x00, 0x00, byte(serialStreamPort >> 8), byte(serialStreamPort & 0xff),
-		0x00, 0x00, byte(audioStreamPort >> 8), byte(audioStreamPort & 0xff), 0x00, 0x00,
-		byte(txSeqBufLengthMs >> 8), byte(txSeqBufLengthMs & 0xff), 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	if err := s.common.pkt0.sendTrackedPacket(&s.common, p); err != nil {
+	// The radio uses this as it's RX buf length.
+	txSeqBufLengthMs := uint32(getTxSeqBufLength().Milliseconds())
+
+	p := pktConnInfo{
+		pktControlHeader: s.newPktControlHeader(0x03),
+		replyID:          s.a8replyID,
+		radioName:        "IC-705",
+		rxEnable:         0x01,
+		txEnable:         0x01,
+		rxCodec:          0x04,
+		txCodec:          0x04,
+		rxSampleRate:     audioSampleRate,
+		txSampleRate:     audioSampleRate,
+		serialPort:       serialStreamPort,
+		audioPort:        audioStreamPort,
+		txBufLenMs:       txSeqBufLengthMs,
+	}
+	p.authID = s.authID
+	copy(p.username[:], passcode(username))
+	if err := s.common.sendTrackedPkt(&p); err != nil {
 		return err
 	}
 
@@ -154,80 +154,76 @@ func (s *controlStream) sendRequestSerialAndAudioIfPossible() {
 	}
 }
 
-func (s *controlStream) handleRead(r []byte) error {
-	switch len(r) {
-	case 168:
-		if bytes.Equal(r[:6], []byte{0xa8, 0x00, 0x00, 0x00, 0x00, 0x00}) {
-			// Example answer from radio:
-			// 0xa8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00,
-			// 0x01, 0x13, 0x11, 0x18, 0x38, 0xff, 0x55, 0x7d,
-			// 0x00, 0x00, 0x00, 0x98, 0x02, 0x02, 0x00, 0x07,
-			// 0x00, 0x00, 0x7f, 0x91, 0x00, 0x00, 0x4f, 0x0d,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x01, 0x93, 0x8a, 0x01, 0x24, 0x17, 0x64,
-			// 0xbc, 0x4b, 0xa3, 0xa0, 0x13, 0x58, 0x41, 0x04,
-			// 0x58, 0x2d, 0x49, 0x43, 0x2d, 0x37, 0x30, 0x35,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x49, 0x43, 0x4f, 0x4d, 0x5f, 0x56,
-			// 0x41, 0x55, 0x44, 0x49, 0x4f, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x3f, 0x3f, 0xa4, 0x01, 0xff, 0x01,
-			// 0xff, 0x01, 0x01, 0x01, 0x00, 0x00, 0x4b, 0x00,
-			// 0x01, 0x50, 0x00, 0xb8, 0x0b, 0x00, 0x00, 0x00
-			copy(s.a8replyID[:], r[66:82])
-			s.gotA8ReplyID = true
+func (s *controlStream) handleRead(r receivedPkt) error {
+	// Unknown packets are ignored.
+	switch p := r.pkt.(type) {
+	case *pktCapabilities:
+		// Example answer from radio:
+		// 0xa8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00,
+		// 0x01, 0x13, 0x11, 0x18, 0x38, 0xff, 0x55, 0x7d,
+		// 0x00, 0x00, 0x00, 0x98, 0x02, 0x02, 0x00, 0x07,
+		// 0x00, 0x00, 0x7f, 0x91, 0x00, 0x00, 0x4f, 0x0d,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x01, 0x93, 0x8a, 0x01, 0x24, 0x17, 0x64,
+		// 0xbc, 0x4b, 0xa3, 0xa0, 0x13, 0x58, 0x41, 0x04,
+		// 0x58, 0x2d, 0x49, 0x43, 0x2d, 0x37, 0x30, 0x35,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x49, 0x43, 0x4f, 0x4d, 0x5f, 0x56,
+		// 0x41, 0x55, 0x44, 0x49, 0x4f, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x3f, 0x3f, 0xa4, 0x01, 0xff, 0x01,
+		// 0xff, 0x01, 0x01, 0x01, 0x00, 0x00, 0x4b, 0x00,
+		// 0x01, 0x50, 0x00, 0xb8, 0x0b, 0x00, 0x00, 0x00
+		s.a8replyID = p.replyID
+		s.gotA8ReplyID = true
+	case *pktAuth:
+		// Example answer from radio:   0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00,
+		// 0x33, 0x60, 0xd4, 0xe5, 0xf4, 0x67, 0x86, 0xe1,
+		// 0x00, 0x00, 0x00, 0x30, 0x02, 0x05, 0x00, 0x02,
+		// 0x00, 0x00, 0x35, 0x34, 0x76, 0x11, 0xb9, 0xd0,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00
+
+		s.reauthTimeoutTimer.stop()
+
+		log.Debug("auth ok")
+
+		if p.reqType == 0x05 { // Answer for our second auth?
+			s.authOk = true
+			s.sendRequestSerialAndAudioIfPossible()
 		}
-	case 64:
-		if bytes.Equal(r[:6], []byte{0x40, 0x00, 0x00, 0x00, 0x00, 0x00}) {
-			// Example answer from radio:   0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00,
-			// 0x33, 0x60, 0xd4, 0xe5, 0xf4, 0x67, 0x86, 0xe1,
-			// 0x00, 0x00, 0x00, 0x30, 0x02, 0x05, 0x00, 0x02,
-			// 0x00, 0x00, 0x35, 0x34, 0x76, 0x11, 0xb9, 0xd0,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00
-
-			s.reauthTimeoutTimer.Stop()
-
-			log.Debug("auth ok")
-
-			if r[21] == 0x05 { // Answer for our second auth?
-				s.authOk = true
-				s.sendRequestSerialAndAudioIfPossible()
+	case *pktStatus:
+		// Example answer from radio: 0x50, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00,
+		//							  0x86, 0x1f, 0x2f, 0xcc, 0x03, 0x03, 0x89, 0x29,
+		//							  0x00, 0x00, 0x00, 0x40, 0x02, 0x03, 0x00, 0x52,
+		//							  0x00, 0x00, 0xf8, 0xad, 0x06, 0x8d, 0xda, 0x7b,
+		//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10,
+		//							  0x80, 0x00, 0x00, 0x90, 0xc7, 0x0e, 0x86, 0x01,
+		//							  0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00,
+		//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00
+
+		if p.authFailed() {
+			events.fire("auth-failure")
+			if !s.serialAndAudioStreamOpened {
+				return errors.New("auth failed, try rebooting the radio")
 			}
+			return errors.New("auth failed")
 		}
-	case 80:
-		if bytes.Equal(r[:6], []byte{0x50, 0x00, 0x00, 0x00, 0x00, 0x00}) {
-			// Example answer from radio: 0x50, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00,
-			//							  0x86, 0x1f, 0x2f, 0xcc, 0x03, 0x03, 0x89, 0x29,
-			//							  0x00, 0x00, 0x00, 0x40, 0x02, 0x03, 0x00, 0x52,
-			//							  0x00, 0x00, 0xf8, 0xad, 0x06, 0x8d, 0xda, 0x7b,
-			//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10,
-			//							  0x80, 0x00, 0x00, 0x90, 0xc7, 0x0e, 0x86, 0x01,
-			//							  0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00,
-			//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-			//							  0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00
-
-			if bytes.Equal(r[48:51], []byte{0xff, 0xff, 0xff}) {
-				if !s.serialAndAudioStreamOpened {
-					return errors.New("auth failed, try rebooting the radio")
-				}
-				return errors.New("auth failed")
-			}
-			if bytes.Equal(r[48:51], []byte{0x00, 0x00, 0x00}) && r[64] == 0x01 {
-				return errors.New("got radio disconnected")
-			}
+		if p.disconnected {
+			return errRadioDisconnected
 		}
-	case 144:
-		if !s.serialAndAudioStreamOpened && bytes.Equal(r[:6], []byte{0x90, 0x00, 0x00, 0x00, 0x00, 0x00}) && r[96] == 1 {
+	case *pktConnInfoReply:
+		if !s.serialAndAudioStreamOpened && p.opened {
 			// Example answer:
 			// 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x19, 0x00,
 			// 0xc6, 0x5f, 0x6f, 0x0c, 0x5f, 0x8b, 0x1e, 0x89,
@@ -248,66 +244,176 @@ func (s *controlStream) handleRead(r []byte) error {
 			// 0x00, 0x00, 0x00, 0x00, 0xc0, 0xa8, 0x03, 0x03,
 			// 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00
 
-			s.requestSerialAndAudioTimeout.Stop()
+			s.requestSerialAndAudioTimeout.stop()
 
-			devName := parseNullTerminatedString(r[64:])
+			devName := p.radioName
 			log.Print("got serial and audio request success, device name: ", devName)
+			s.devName = devName
 
 			// Stuff can change in the meantime because of a previous login...
-			s.common.remoteSID = binary.BigEndian.Uint32(r[8:12])
-			s.common.localSID = binary.BigEndian.Uint32(r[12:16])
-			copy(s.authID[:], r[26:32])
+			s.common.remoteSID = p.sentID
+			s.common.localSID = p.rcvdID
+			s.authID = p.authID
 			s.gotAuthID = true
 
 			statusLog.startPeriodicPrint()
 
 			if err := s.serial.init(devName); err != nil {
-				return errors.New("serial/" + err.Error())
+				return fmt.Errorf("serial/%w", err)
 			}
 
 			if err := s.audio.init(devName); err != nil {
-				return errors.New("audio/" + err.Error())
+				return fmt.Errorf("audio/%w", err)
 			}
+			s.serialRestart.instance = s.serial.common.instance
+			s.audioRestart.instance = s.audio.common.instance
 
 			s.serialAndAudioStreamOpened = true
 
 			runCmdRunner.startIfNeeded(runCmd)
+			events.reportConnected()
+			reconnect.reportConnected()
+			scanner.startIfNeeded()
+			sweeper.startIfNeeded()
 			if enableSerialDevice {
 				serialCmdRunner.startIfNeeded(runCmdOnSerialPortCreated)
 			}
 			if err := rigctld.initIfNeeded(); err != nil {
 				return err
 			}
+			if err := flrig.initIfNeeded(); err != nil {
+				return err
+			}
+			if err := tci.initIfNeeded(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+func (s *controlStream) setDeinitializing() {
+	s.deinitializingMutex.Lock()
+	defer s.deinitializingMutex.Unlock()
+	s.deinitializing = true
+}
+
+func (s *controlStream) isDeinitializing() bool {
+	s.deinitializingMutex.Lock()
+	defer s.deinitializingMutex.Unlock()
+	return s.deinitializing
+}
+
+func (s *controlStream) getStreamRestartState(name string) *streamRestartState {
+	switch name {
+	case "serial":
+		return &s.serialRestart
+	case "audio":
+		return &s.audioRestart
+	}
+	return nil
+}
+
+// Only the failed stream is restarted, the control session is kept. If the restart fails, or the stream
+// fails again shortly after it has been restarted, a relogin is done.
+func (s *controlStream) handleStreamError(e streamError) {
+	r := s.getStreamRestartState(e.name)
+	if r == nil || !s.serialAndAudioStreamOpened || e.instance < r.instance {
+		return
+	}
+	if r.running {
+		// The old instance can report errors while it's being stopped, but the new one should not fail.
+		if e.instance > r.instance {
+			reportError(fmt.Errorf("%s/%w", e.name, errStreamFailedAgain))
+		}
+		return
+	}
+	if !r.restartedAt.IsZero() && clock.since(r.restartedAt) < streamRestartMinInterval {
+		reportError(fmt.Errorf("%s/%w", e.name, errStreamFailedAgain))
+		return
+	}
+	r.restartedAt = clock.now()
+	r.running = true
+
+	log.Print("restarting ", e.name, " stream")
+	go s.restartStream(e.name)
+}
+
+func (s *controlStream) restartStream(name string) {
+	res := streamRestartResult{name: name}
+	switch name {
+	case "serial":
+		s.serial.deinit()
+		s.serial = serialStream{}
+		res.err = s.serial.init(s.devName)
+		res.instance = s.serial.common.instance
+	case "audio":
+		s.audio.deinit()
+		s.audio = audioStream{}
+		res.err = s.audio.init(s.devName)
+		res.instance = s.audio.common.instance
+	}
+	s.restartFinishedChan <- res
+}
+
+func (s *controlStream) handleStreamRestartFinished(res streamRestartResult) {
+	r := s.getStreamRestartState(res.name)
+	r.running = false
+	r.instance = res.instance
+	if res.err != nil && !s.isDeinitializing() {
+		reportError(fmt.Errorf("%s/%w: %v", res.name, errStreamRestartFailed, res.err))
+	}
+}
+
 func (s *controlStream) loop() {
 	netstat.reset()
 
-	s.reauthTimeoutTimer = time.NewTimer(0)
-	<-s.reauthTimeoutTimer.C
+	s.reauthTimeoutTimer = clock.newTimer(0)
+	<-s.reauthTimeoutTimer.c()
+
+	reauthTicker := clock.newTicker(reauthInterval)
 
-	reauthTicker := time.NewTicker(reauthInterval)
+	autoTuneTimer := clock.newTimer(bufferAutoTuneAfter)
+	if !bufferAutoTune {
+		autoTuneTimer.stop()
+	}
 
 	for {
 		select {
 		case r := <-s.common.readChan:
-			if !s.deinitializing {
+			if !s.isDeinitializing() {
 				if err := s.handleRead(r); err != nil {
 					reportError(err)
 				}
 			}
-		case <-reauthTicker.C:
+		case <-reauthTicker.c():
 			log.Debug("sending auth")
-			s.reauthTimeoutTimer.Reset(reauthTimeout)
+			s.reauthTimeoutTimer.reset(reauthTimeout)
 			if err := s.sendPktAuth(0x05); err != nil {
 				reportError(err)
 			}
-		case <-s.reauthTimeoutTimer.C:
+		case <-s.reauthTimeoutTimer.c():
 			log.Error("auth timeout, audio/serial stream may stop")
+		case <-autoTuneTimer.c():
+			autoTuneBufferLengths()
+			// Restarted streams get the new length when they are initialized.
+			if !s.serialRestart.running {
+				s.serial.rxSeqBuf.setLength(getRxSeqBufLength())
+			}
+			if !s.audioRestart.running {
+				s.audio.rxSeqBuf.setLength(getRxSeqBufLength())
+			}
+		case e := <-gotStreamErrChan:
+			if !s.isDeinitializing() {
+				s.handleStreamError(e)
+			}
+		case res := <-s.restartFinishedChan:
+			s.handleStreamRestartFinished(res)
 		case <-s.deinitNeededChan:
+			// The streams can only be deinitialized after their restarts have finished.
+			for s.serialRestart.running || s.audioRestart.running {
+				s.handleStreamRestartFinished(<-s.restartFinishedChan)
+			}
 			s.deinitFinishedChan <- true
 			return
 		}
@@ -347,13 +453,18 @@ func (s *controlStream) init() error {
 	if err != nil {
 		return err
 	}
-	if bytes.Equal(r[48:52], []byte{0xff, 0xff, 0xff, 0xfe}) {
+	var reply pktLoginReply
+	if err := reply.UnmarshalBinary(r); err != nil {
+		return err
+	}
+	if reply.errorCode == pktLoginErrorInvalidCredentials {
+		events.fire("auth-failure")
 		return errors.New("invalid username/password")
 	}
 
 	s.common.pkt7.startPeriodicSend(&s.common, 2, false)
 
-	copy(s.authID[:], r[26:32])
+	s.authID = reply.authID
 	s.gotAuthID = true
 	if err := s.sendPktAuth(0x02); err != nil {
 		return err
@@ -367,35 +478,35 @@ func (s *controlStream) init() error {
 	}
 	log.Debug("second auth sent...")
 
-	s.requestSerialAndAudioTimeout = time.AfterFunc(5*time.Second, func() {
-		reportError(errors.New("login/serial/audio request timeout"))
+	s.requestSerialAndAudioTimeout = clock.afterFunc(5*time.Second, func() {
+		reportError(fmt.Errorf("login/serial/audio request %w", errTimeout))
 	})
 
 	s.deinitNeededChan = make(chan bool)
 	s.deinitFinishedChan = make(chan bool)
+	s.restartFinishedChan = make(chan streamRestartResult)
 	go s.loop()
 	return nil
 }
 
 func (s *controlStream) deinit() {
-	s.deinitializing = true
-	s.serialAndAudioStreamOpened = false
+	s.setDeinitializing()
 	statusLog.stopPeriodicPrint()
 
 	if s.deinitNeededChan != nil {
 		s.deinitNeededChan <- true
 		<-s.deinitFinishedChan
 	}
+	s.serialAndAudioStreamOpened = false
 	if s.requestSerialAndAudioTimeout != nil {
-		s.requestSerialAndAudioTimeout.Stop()
+		s.requestSerialAndAudioTimeout.stop()
 		s.requestSerialAndAudioTimeout = nil
 	}
 
 	if s.gotAuthID && s.common.gotRemoteSID && s.common.conn != nil {
 		log.Debug("sending deauth")
 		_ = s.sendPktAuth(0x01)
-		// Waiting a little bit to make sure the radio can send retransmit requests.
-		time.Sleep(500 * time.Millisecond)
+		<-clock.after(deauthWait)
 	}
 
 	s.common.deinit()
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestControlStreamReauthTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	logs := observeLog(t)
+
+	var s controlStream
+	conn, radio := newTestStreamConn(t)
+	s.common.conn = conn
+	s.common.readChan = make(chan receivedPkt)
+	s.deinitNeededChan = make(chan bool)
+	s.deinitFinishedChan = make(chan bool)
+	go s.loop()
+	defer func() {
+		s.deinitNeededChan <- true
+		<-s.deinitFinishedChan
+	}()
+
+	// The loop reads this ignored packet only after it has handled the previous one.
+	waitForLoop := func() {
+		s.common.readChan <- receivedPkt{}
+	}
+
+	reauthAt := c.now().Add(reauthInterval)
+	for _, replied := range []bool{true, false} {
+		c.waitForTimer(t, reauthAt)
+		c.advance(reauthAt.Sub(c.now()))
+		reauthAt = reauthAt.Add(reauthInterval)
+
+		p, ok := readTestPkt(t, radio).(*pktAuth)
+		if !ok || p.reqType != 0x05 {
+			t.Fatalf("expected an auth packet, got %#v", p)
+		}
+		c.waitForTimer(t, c.now().Add(reauthTimeout))
+
+		if replied {
+			p.reqReply = pktControlReply
+			r, err := p.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.common.readChan <- receivedPkt{raw: r, pkt: p}
+			waitForLoop()
+		}
+		c.advance(reauthTimeout)
+	}
+
+	if n := waitForLog(t, logs, "auth timeout"); n != 1 {
+		t.Error("got ", n, " auth timeouts, expected 1")
+	}
+	waitForLoop()
+	if !s.authOk {
+		t.Error("auth reply not handled")
+	}
+}
+
+func TestControlStreamStreamErrors(t *testing.T) {
+	c := useFakeClock(t)
+	logs := observeLog(t)
+
+	s := controlStream{serialAndAudioStreamOpened: true}
+	s.serialRestart = streamRestartState{restartedAt: c.now(), running: true, instance: 5}
+
+	// Errors of the instance being stopped are ignored while it's restarted.
+	s.handleStreamError(streamError{name: "serial", instance: 5})
+	if n := countLogs(logs, "failed again"); n != 0 {
+		t.Fatal("error of the old instance caused a relogin")
+	}
+	// But the new instance should not fail.
+	s.handleStreamError(streamError{name: "serial", instance: 6})
+	if n := countLogs(logs, "failed again"); n != 1 {
+		t.Fatal("error of the new instance did not cause a relogin")
+	}
+
+	s.handleStreamRestartFinished(streamRestartResult{name: "serial", instance: 6})
+	if s.serialRestart.running || s.serialRestart.instance != 6 {
+		t.Fatalf("restart state not updated: %+v", s.serialRestart)
+	}
+
+	// Errors queued by the old instance are ignored after the restart.
+	s.handleStreamError(streamError{name: "serial", instance: 5})
+	if n := countLogs(logs, "failed again"); n != 1 || s.serialRestart.running {
+		t.Fatal("error of the old instance handled after the restart")
+	}
+	s.handleStreamError(streamError{name: "serial", instance: 6})
+	if n := countLogs(logs, "failed again"); n != 2 {
+		t.Fatal("stream failing shortly after its restart did not cause a relogin")
+	}
+
+	s.audioRestart = streamRestartState{running: true, instance: 3}
+	s.handleStreamRestartFinished(streamRestartResult{name: "audio", instance: 4, err: errors.New("no answer")})
+	if n := countLogs(logs, "audio/restart failed"); n != 1 {
+		t.Fatal("failed restart did not cause a relogin")
+	}
+}
+
+func TestControlStreamDeinitWaitsAfterDeauth(t *testing.T) {
+	c := useFakeClock(t)
+
+	var s controlStream
+	conn, radio := newTestStreamConn(t)
+	s.common.conn = conn
+	s.gotAuthID = true
+	s.common.gotRemoteSID = true
+
+	finished := make(chan bool)
+	go func() {
+		s.deinit()
+		finished <- true
+	}()
+
+	p, ok := readTestPkt(t, radio).(*pktAuth)
+	if !ok || p.reqType != 0x01 {
+		t.Fatalf("expected a deauth packet, got %#v", p)
+	}
+	c.waitForTimer(t, c.now().Add(deauthWait))
+	select {
+	case <-finished:
+		t.Fatal("deinit finished before the radio could send retransmit requests")
+	default:
+	}
+	c.advance(deauthWait)
+	<-finished
+}
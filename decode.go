@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Decodes captured RS-BA1 packets to a human readable form, using the packet types in packets.go.
+
+var decodeCIVCmdNames = map[byte]string{
+	0x00: "transceive freq",
+	0x01: "transceive mode",
+	0x03: "read freq",
+	0x04: "read mode",
+	0x05: "set freq",
+	0x06: "set mode",
+	0x07: "vfo",
+	0x08: "memory",
+	0x0f: "split",
+	0x10: "tuning step",
+	0x11: "attenuator",
+	0x14: "level",
+	0x15: "meter",
+	0x16: "function",
+	0x1a: "misc",
+	0x1c: "ptt/tune",
+	0x25: "vfo freq",
+	0x26: "vfo mode",
+	0x27: "scope",
+	0xfa: "NG",
+	0xfb: "OK",
+}
+
+func decodeHex(d []byte) string {
+	var b strings.Builder
+	for i, v := range d {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%.2x", v)
+	}
+	return b.String()
+}
+
+func decodeFreq(d []byte) string {
+	var c civControlStruct
+	return fmt.Sprintf("%.6f MHz", float64(c.decodeFreqData(d))/1000000)
+}
+
+// Returns the decoded CI-V frames found in d.
+func decodeCIV(d []byte) (res []string) {
+	for len(d) > 0 {
+		start := bytes.Index(d, []byte{0xfe, 0xfe})
+		if start < 0 {
+			break
+		}
+		d = d[start:]
+		end := bytes.IndexByte(d, 0xfd)
+		if end < 0 {
+			res = append(res, "civ incomplete: "+decodeHex(d))
+			break
+		}
+		f := d[:end+1]
+		d = d[end+1:]
+		if len(f) < 6 {
+			res = append(res, "civ short: "+decodeHex(f))
+			continue
+		}
+
+		cmd := f[4]
+		payload := f[5 : len(f)-1]
+		s := fmt.Sprintf("civ %.2x->%.2x cmd %.2x", f[3], f[2], cmd)
+		if name, ok := decodeCIVCmdNames[cmd]; ok {
+			s += " (" + name + ")"
+		}
+		switch cmd {
+		case 0x00, 0x03, 0x05:
+			if len(payload) == 5 {
+				s += " " + decodeFreq(payload)
+			}
+		case 0x25:
+			if len(payload) == 6 {
+				vfo := "main"
+				if payload[0] == 1 {
+					vfo = "sub"
+				}
+				s += " " + vfo + " " + decodeFreq(payload[1:])
+			}
+		}
+		if len(payload) > 0 {
+			s += ": " + decodeHex(payload)
+		}
+		res = append(res, s)
+	}
+	return
+}
+
+func decodeControlHeader(h *pktControlHeader) string {
+	s := fmt.Sprintf("reqtype %.2x innerseq %d authid %s", h.reqType, h.innerSeq, decodeHex(h.authID[:]))
+	switch h.reqReply {
+	case pktControlRequest:
+		return "request " + s
+	case pktControlReply:
+		return "reply " + s
+	}
+	return s
+}
+
+// Returns a one line description of the given packet, and the decoded CI-V frames it carries.
+func decodePacket(stream string, outbound bool, d []byte) (desc string, civ []string) {
+	pkt, err := demuxPkt(d)
+	if err != nil {
+		return fmt.Sprint(err, ": ", decodeHex(d)), nil
+	}
+	// The PC and the radio send different packets with the same length.
+	if _, ok := pkt.(*pktConnInfoReply); ok && outbound {
+		var p pktConnInfo
+		if err := p.UnmarshalBinary(d); err == nil {
+			pkt = &p
+		}
+	}
+
+	var h pktHeader
+	_ = h.UnmarshalBinary(d)
+	hdr := fmt.Sprintf("seq %d sid %.8x->%.8x", h.seq, h.sentID, h.rcvdID)
+	if l := binary.LittleEndian.Uint32(d[0:4]); int(l) != len(d) {
+		hdr += fmt.Sprintf(" len %d (got %d)", l, len(d))
+	}
+
+	switch p := pkt.(type) {
+	case *pktHeader:
+		switch p.typ {
+		case pktTypeData:
+			return "pkt0 idle " + hdr, nil
+		case pktTypeAreYouThere:
+			return "pkt3 are you there " + hdr, nil
+		case pktTypeIAmHere:
+			return "pkt4 i am here " + hdr, nil
+		case pktTypeDisconnect:
+			return "disconnect " + hdr, nil
+		case pktTypeAreYouReady:
+			return "pkt6 are you ready " + hdr, nil
+		}
+		return fmt.Sprintf("unknown type %.4x %s", p.typ, hdr), nil
+	case *pktRetransmitRequest:
+		if len(p.ranges) == 0 {
+			return fmt.Sprint("pkt0 retransmit request #", p.seq, " ", hdr), nil
+		}
+		var r []string
+		for _, rr := range p.ranges {
+			r = append(r, fmt.Sprint(rr[0], "-", rr[1]))
+		}
+		return "pkt0 retransmit request for ranges " + strings.Join(r, ",") + " " + hdr, nil
+	case *pktPing:
+		if p.reply {
+			return "pkt7 ping reply id " + decodeHex(p.id[:]) + " " + hdr, nil
+		}
+		return "pkt7 ping request id " + decodeHex(p.id[:]) + " " + hdr, nil
+	case *pktLogin:
+		return fmt.Sprint("login ", decodeControlHeader(&p.pktControlHeader), " name ", p.name, " ", hdr), nil
+	case *pktLoginReply:
+		s := "login " + decodeControlHeader(&p.pktControlHeader)
+		if p.errorCode == pktLoginErrorInvalidCredentials {
+			return s + " invalid username/password " + hdr, nil
+		}
+		return s + " ok, connection " + p.connection + " " + hdr, nil
+	case *pktAuth:
+		return "auth " + decodeControlHeader(&p.pktControlHeader) + " " + hdr, nil
+	case *pktStatus:
+		s := "status " + decodeControlHeader(&p.pktControlHeader)
+		if p.authFailed() {
+			s += " auth failed"
+		} else if p.disconnected {
+			s += " radio disconnected"
+		}
+		return s + " " + hdr, nil
+	case *pktCapabilities:
+		return fmt.Sprintf("capabilities %s replyid %s radio %s audio %s civ address %.2x %s",
+			decodeControlHeader(&p.pktControlHeader), decodeHex(p.replyID[:]), p.radioName, p.audioName, p.civAddress, hdr), nil
+	case *pktConnInfo:
+		return fmt.Sprintf("conninfo %s radio %s rx %d tx %d codec %.2x/%.2x samplerate %d/%d serial port %d audio port %d txbuf %d ms %s",
+			decodeControlHeader(&p.pktControlHeader), p.radioName, p.rxEnable, p.txEnable, p.rxCodec, p.txCodec, p.rxSampleRate,
+			p.txSampleRate, p.serialPort, p.audioPort, p.txBufLenMs, hdr), nil
+	case *pktConnInfoReply:
+		return fmt.Sprint("conninfo ", decodeControlHeader(&p.pktControlHeader), " radio ", p.radioName, " streams opened ",
+			p.opened, " ", hdr), nil
+	case *pktSerialData:
+		return fmt.Sprintf("serial data len %d sendseq %d %s", len(p.data), p.sendSeq, hdr), decodeCIV(p.data)
+	case *pktSerialOpenClose:
+		if p.open {
+			return "serial open " + hdr, nil
+		}
+		return "serial close " + hdr, nil
+	case *pktAudio:
+		return fmt.Sprintf("audio ident %.2x sendseq %d datalen %d %s", p.ident, p.sendSeq, len(p.data), hdr), nil
+	}
+	return fmt.Sprintf("%s data %s: %s", stream, hdr, decodeHex(d[pktHeaderLength:])), nil
+}
+
+// Writes the decoded packets, with times relative to the first packet.
+func writeDecodedPackets(w io.Writer, pkts []capturedPacket) {
+	for _, p := range pkts {
+		dir := "<-"
+		if p.outbound {
+			dir = "->"
+		}
+		desc, civ := decodePacket(p.stream, p.outbound, p.data)
+		fmt.Fprintf(w, "%11.6f %-7s %s %s\n", p.t.Sub(pkts[0].t).Seconds(), p.stream, dir, desc)
+		for _, c := range civ {
+			fmt.Fprintf(w, "%11s %-7s    %s\n", "", "", c)
+		}
+	}
+}
+
+func runDecode(path string) error {
+	pkts, err := readPacketCapture(path)
+	if err != nil {
+		return err
+	}
+	if len(pkts) == 0 {
+		return fmt.Errorf("no RS-BA1 packets found in %s", path)
+	}
+
+	writeDecodedPackets(os.Stdout, pkts)
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// The capture contains a packet of each type, made with the packet types in packets.go.
+func TestDecodeGolden(t *testing.T) {
+	pkts, err := readPacketCapture("testdata/decode.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	writeDecodedPackets(&b, pkts)
+
+	if *updateGolden {
+		if err := ioutil.WriteFile("testdata/decode.golden", b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile("testdata/decode.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("decoded packets differ from testdata/decode.golden, got:\n%s", b.Bytes())
+	}
+}
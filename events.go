@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The high-swr event is fired when the SWR reaches this value.
+const eventHighSWR = 3.0
+
+var eventNames = []string{
+	"connect",
+	"reconnect",
+	"disconnect",
+	"auth-failure",
+	"ptt-on",
+	"ptt-off",
+	"freq",
+	"band",
+	"mode",
+	"high-swr",
+	"audio-timeout",
+}
+
+type eventHook struct {
+	event string
+	cmd   string
+}
+
+type eventsStruct struct {
+	mutex sync.Mutex
+	hooks []eventHook
+
+	connected     bool
+	connectedOnce bool
+
+	// The last known radio state, passed to the hooks as environment variables.
+	freq     uint
+	bandIdx  int
+	mode     string
+	filter   string
+	swr      float64
+	highSWR  bool
+	ptt      bool
+	gotState bool
+}
+
+var events eventsStruct
+
+func isEventName(name string) bool {
+	for _, n := range eventNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Hooks are loaded from lines like: band /usr/local/bin/switch-antenna $KAPPANHANG_BAND
+func (s *eventsStruct) load() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hooks = nil
+	if hooksFile == "" {
+		return
+	}
+	d, err := ioutil.ReadFile(hooksFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("can't load hooks: ", err)
+		}
+		return
+	}
+
+	for i, line := range strings.Split(string(d), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.SplitN(line, " ", 2)
+		if !isEventName(f[0]) {
+			log.Error("can't parse hooks file ", hooksFile, " line ", i+1, ": unknown event ", f[0])
+			continue
+		}
+		if len(f) < 2 || strings.TrimSpace(f[1]) == "" {
+			log.Error("can't parse hooks file ", hooksFile, " line ", i+1, ": missing command")
+			continue
+		}
+		s.hooks = append(s.hooks, eventHook{event: f[0], cmd: strings.TrimSpace(f[1])})
+	}
+}
+
+// Logs the output of an external command line by line, so it won't mess up the status bar or the terminal UI.
+func logCmdOutput(name string, out []byte) {
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			log.Print(name, ": ", line)
+		}
+	}
+}
+
+func (s *eventsStruct) runHook(h eventHook, env []string) {
+	cmd := exec.Command("sh", "-c", h.cmd)
+	cmd.Env = env
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	logCmdOutput(h.event+" hook", out.Bytes())
+	if err != nil {
+		log.Error(h.event, " hook ", h.cmd, " error: ", err)
+	}
+}
+
+// Mutex must be held.
+func (s *eventsStruct) getEnv(event string, vars []string) []string {
+	env := append(os.Environ(), "KAPPANHANG_EVENT="+event)
+	if s.gotState {
+		env = append(env,
+			fmt.Sprint("KAPPANHANG_FREQ=", s.freq),
+			"KAPPANHANG_BAND="+civBands[s.bandIdx].name,
+			"KAPPANHANG_MODE="+s.mode,
+			"KAPPANHANG_FILTER="+s.filter)
+		if s.ptt {
+			env = append(env, "KAPPANHANG_PTT=on")
+		} else {
+			env = append(env, "KAPPANHANG_PTT=off")
+		}
+	}
+	if s.swr > 0 {
+		env = append(env, fmt.Sprintf("KAPPANHANG_SWR=%.1f", s.swr))
+	}
+	return append(env, vars...)
+}
+
+// Mutex must be held. Additional environment variables can be given in the KEY=value format.
+func (s *eventsStruct) fireInternal(event string, vars ...string) {
+	log.Debug("event: ", event)
+
+	var env []string
+	for _, h := range s.hooks {
+		if h.event != event {
+			continue
+		}
+		if env == nil {
+			env = s.getEnv(event, vars)
+		}
+		go s.runHook(h, env)
+	}
+	scriptEngine.fire(event)
+}
+
+// Runs the hooks of the given event. Can be called with the civcontrol state mutex held.
+func (s *eventsStruct) fire(event string, vars ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.fireInternal(event, vars...)
+}
+
+func (s *eventsStruct) reportConnected() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.connected = true
+	s.fireInternal("connect")
+	if s.connectedOnce {
+		s.fireInternal("reconnect", reconnect.getEnv()...)
+	}
+	s.connectedOnce = true
+}
+
+func (s *eventsStruct) reportDisconnected(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.connected {
+		return
+	}
+	s.connected = false
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+	s.fireInternal("disconnect", "KAPPANHANG_ERROR="+errStr)
+}
+
+func (s *eventsStruct) reportFrequency(freq uint, bandIdx int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prevFreq := s.freq
+	prevBandIdx := s.bandIdx
+	s.freq = freq
+	s.bandIdx = bandIdx
+	if !s.gotState {
+		// Not firing events for the initial state.
+		s.gotState = s.mode != ""
+		return
+	}
+
+	if freq != prevFreq {
+		s.fireInternal("freq")
+	}
+	if bandIdx != prevBandIdx {
+		s.fireInternal("band", "KAPPANHANG_PREV_BAND="+civBands[prevBandIdx].name)
+	}
+}
+
+func (s *eventsStruct) reportMode(mode string, dataMode bool, filter string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if dataMode {
+		mode += "-D"
+	}
+	prevMode := s.mode
+	prevFilter := s.filter
+	s.mode = mode
+	s.filter = filter
+	if !s.gotState {
+		s.gotState = s.freq != 0
+		return
+	}
+
+	if mode != prevMode || filter != prevFilter {
+		s.fireInternal("mode", "KAPPANHANG_PREV_MODE="+prevMode)
+	}
+}
+
+func (s *eventsStruct) reportPTT(ptt bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ptt == s.ptt {
+		return
+	}
+	s.ptt = ptt
+	if ptt {
+		s.fireInternal("ptt-on")
+	} else {
+		s.fireInternal("ptt-off")
+	}
+}
+
+func (s *eventsStruct) reportSWR(swr float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.swr = swr
+	highSWR := swr >= eventHighSWR
+	if highSWR && !s.highSWR {
+		s.fireInternal("high-swr")
+	}
+	s.highSWR = highSWR
+}
+
+func getDefaultHooksFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kappanhang", "hooks.conf")
+}
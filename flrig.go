@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The version we report to clients, some of them check it to decide which methods they can use.
+const flrigVersion = "1.4.7"
+
+// Filter widths reported for FIL1, FIL2 and FIL3. These can be queried with a CIV command for accurate values.
+var flrigBandwidths = []string{"3000", "2400", "1800"}
+
+type flrigValue struct {
+	String  *string `xml:"string"`
+	Int     *string `xml:"int"`
+	I4      *string `xml:"i4"`
+	Double  *string `xml:"double"`
+	Boolean *string `xml:"boolean"`
+	Text    string  `xml:",chardata"`
+}
+
+type flrigMethodCall struct {
+	MethodName string       `xml:"methodName"`
+	Params     []flrigValue `xml:"params>param>value"`
+}
+
+type flrigMethod struct {
+	name string
+	// Can return a string, an int, a float64, a []interface{} or nil.
+	run func(params []string) (interface{}, error)
+}
+
+type flrigStruct struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+var flrig flrigStruct
+
+var flrigMethods = []flrigMethod{
+	{"main.get_version", func(params []string) (interface{}, error) { return flrigVersion, nil }},
+	{"rig.get_xcvr", func(params []string) (interface{}, error) { return "IC-705", nil }},
+	{"rig.get_info", flrigGetInfo},
+	{"rig.get_vfo", flrigGetVFO},
+	{"rig.set_vfo", flrigSetVFO},
+	{"rig.set_frequency", flrigSetVFO},
+	{"rig.get_vfoA", flrigGetVFOA},
+	{"rig.get_vfoB", flrigGetVFOB},
+	{"rig.set_vfoA", flrigSetVFOA},
+	{"rig.set_vfoB", flrigSetVFOB},
+	{"rig.get_AB", flrigGetAB},
+	{"rig.set_AB", flrigSetAB},
+	{"rig.get_mode", flrigGetMode},
+	{"rig.get_modeA", flrigGetMode},
+	{"rig.get_modeB", flrigGetModeB},
+	{"rig.set_mode", flrigSetMode},
+	{"rig.get_modes", flrigGetModes},
+	{"rig.get_bw", flrigGetBW},
+	{"rig.get_bws", flrigGetBWs},
+	{"rig.set_bw", flrigSetBW},
+	{"rig.get_ptt", flrigGetPTT},
+	{"rig.set_ptt", flrigSetPTT},
+	{"rig.get_split", flrigGetSplit},
+	{"rig.set_split", flrigSetSplit},
+	{"rig.get_power", flrigGetPower},
+	{"rig.set_power", flrigSetPower},
+	{"rig.get_smeter", flrigGetSMeter},
+	{"rig.get_pwrmeter", flrigGetPwrMeter},
+	{"rig.get_swrmeter", flrigGetSWRMeter},
+	{"kappanhang.run_script", flrigRunScript},
+	{"kappanhang.stop_script", flrigStopScript},
+	{"kappanhang.list_scripts", flrigListScripts},
+}
+
+func (v *flrigValue) str() string {
+	for _, p := range []*string{v.String, v.Int, v.I4, v.Double, v.Boolean} {
+		if p != nil {
+			return strings.TrimSpace(*p)
+		}
+	}
+	return strings.TrimSpace(v.Text)
+}
+
+func flrigParamInt(params []string) (int, error) {
+	if len(params) < 1 {
+		return 0, errors.New("missing parameter")
+	}
+	f, err := strconv.ParseFloat(params[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid parameter %s", params[0])
+	}
+	return int(f), nil
+}
+
+func flrigParamFreq(params []string) (uint, error) {
+	f, err := flrigParamInt(params)
+	if err != nil {
+		return 0, err
+	}
+	if f <= 0 {
+		return 0, fmt.Errorf("invalid frequency %d", f)
+	}
+	return uint(f), nil
+}
+
+func flrigGetModeName(modeIdx int, dataMode bool) string {
+	mode := civOperatingModes[modeIdx].name
+	if dataMode {
+		mode += "-D"
+	}
+	return mode
+}
+
+func flrigGetBWForFilterIdx(filterIdx int) string {
+	if filterIdx >= 0 && filterIdx < len(flrigBandwidths) {
+		return flrigBandwidths[filterIdx]
+	}
+	return flrigBandwidths[0]
+}
+
+func flrigGetFilterCodeForBW(width int) byte {
+	if width <= 1800 {
+		return civFilters[2].code
+	} else if width <= 2400 {
+		return civFilters[1].code
+	}
+	return civFilters[0].code
+}
+
+func flrigGetInfo(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	t := "R"
+	if civControl.state.ptt || civControl.state.tune {
+		t = "X"
+	}
+	return fmt.Sprint("R:IC-705\nT:", t, "\nFA:", civControl.state.freq,
+		"\nM:", flrigGetModeName(civControl.state.operatingModeIdx, civControl.state.dataMode),
+		"\nL:", civFilters[civControl.state.filterIdx].name), nil
+}
+
+func flrigGetVFO(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	return fmt.Sprint(civControl.state.freq), nil
+}
+
+func flrigSetVFO(params []string) (interface{}, error) {
+	f, err := flrigParamFreq(params)
+	if err != nil {
+		return nil, err
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	return nil, civControl.setMainVFOFreq(f)
+}
+
+// The main VFO frequency is the frequency of the active VFO, the sub VFO is the other one.
+func flrigGetVFOFreq(b bool) interface{} {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if b == civControl.state.vfoBActive {
+		return fmt.Sprint(civControl.state.freq)
+	}
+	return fmt.Sprint(civControl.state.subFreq)
+}
+
+func flrigGetVFOA(params []string) (interface{}, error) {
+	return flrigGetVFOFreq(false), nil
+}
+
+func flrigGetVFOB(params []string) (interface{}, error) {
+	return flrigGetVFOFreq(true), nil
+}
+
+func flrigSetVFOFreq(b bool, params []string) (interface{}, error) {
+	f, err := flrigParamFreq(params)
+	if err != nil {
+		return nil, err
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if b == civControl.state.vfoBActive {
+		return nil, civControl.setMainVFOFreq(f)
+	}
+	return nil, civControl.setSubVFOFreq(f)
+}
+
+func flrigSetVFOA(params []string) (interface{}, error) {
+	return flrigSetVFOFreq(false, params)
+}
+
+func flrigSetVFOB(params []string) (interface{}, error) {
+	return flrigSetVFOFreq(true, params)
+}
+
+func flrigGetAB(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if civControl.state.vfoBActive {
+		return "B", nil
+	}
+	return "A", nil
+}
+
+func flrigSetAB(params []string) (interface{}, error) {
+	if len(params) < 1 {
+		return nil, errors.New("missing parameter")
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if strings.ToUpper(params[0]) == "B" {
+		return nil, civControl.setVFO(1)
+	}
+	return nil, civControl.setVFO(0)
+}
+
+func flrigGetMode(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	return flrigGetModeName(civControl.state.operatingModeIdx, civControl.state.dataMode), nil
+}
+
+func flrigGetModeB(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if civControl.state.subOperatingModeIdx < 0 {
+		return "", nil
+	}
+	return flrigGetModeName(civControl.state.subOperatingModeIdx, civControl.state.subDataMode), nil
+}
+
+func flrigSetMode(params []string) (interface{}, error) {
+	if len(params) < 1 {
+		return nil, errors.New("missing parameter")
+	}
+	name := strings.ToUpper(params[0])
+	dataMode := strings.HasSuffix(name, "-D")
+	name = strings.TrimSuffix(name, "-D")
+
+	modeIdx := -1
+	for i := range civOperatingModes {
+		if civOperatingModes[i].name == name {
+			modeIdx = i
+			break
+		}
+	}
+	if modeIdx < 0 {
+		return nil, fmt.Errorf("unknown mode %s", params[0])
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	filterCode := civFilters[civControl.state.filterIdx].code
+	if err := civControl.setOperatingModeAndFilter(civOperatingModes[modeIdx].code, filterCode); err != nil {
+		return nil, err
+	}
+	return nil, civControl.setDataModeAndFilter(dataMode, filterCode)
+}
+
+func flrigGetModes(params []string) (interface{}, error) {
+	var res []interface{}
+	for _, m := range civOperatingModes {
+		res = append(res, m.name)
+	}
+	for _, m := range []string{"LSB", "USB", "AM", "FM"} {
+		res = append(res, m+"-D")
+	}
+	return res, nil
+}
+
+func flrigGetBW(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	return []interface{}{flrigGetBWForFilterIdx(civControl.state.filterIdx), ""}, nil
+}
+
+func flrigGetBWs(params []string) (interface{}, error) {
+	bws := []interface{}{"Bandwidth"}
+	for _, bw := range flrigBandwidths {
+		bws = append(bws, bw)
+	}
+	return []interface{}{bws}, nil
+}
+
+func flrigSetBW(params []string) (interface{}, error) {
+	width, err := flrigParamInt(params)
+	if err != nil {
+		return nil, err
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	filterCode := flrigGetFilterCodeForBW(width)
+	if err := civControl.setOperatingModeAndFilter(civOperatingModes[civControl.state.operatingModeIdx].code,
+		filterCode); err != nil {
+		return nil, err
+	}
+	if civControl.state.dataMode {
+		return nil, civControl.setDataModeAndFilter(true, filterCode)
+	}
+	return nil, nil
+}
+
+func flrigGetPTT(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if civControl.state.ptt || civControl.state.tune {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func flrigSetPTT(params []string) (interface{}, error) {
+	v, err := flrigParamInt(params)
+	if err != nil {
+		return nil, err
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if v != 0 {
+		if setDataModeOnTx {
+			if err := civControl.setDataMode(true); err != nil {
+				log.Error("can't enable data mode: ", err)
+			}
+		}
+		return nil, civControl.setPTT(true)
+	}
+	return nil, civControl.setPTT(false)
+}
+
+func flrigGetSplit(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if civControl.state.splitMode == splitModeOn {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func flrigSetSplit(params []string) (interface{}, error) {
+	v, err := flrigParamInt(params)
+	if err != nil {
+		return nil, err
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if v != 0 {
+		return nil, civControl.setSplit(splitModeOn)
+	}
+	return nil, civControl.setSplit(splitModeOff)
+}
+
+func flrigGetPower(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	return civControl.state.pwrPercent, nil
+}
+
+func flrigSetPower(params []string) (interface{}, error) {
+	v, err := flrigParamInt(params)
+	if err != nil {
+		return nil, err
+	}
+	if v < 0 || v > 100 {
+		return nil, fmt.Errorf("invalid power %d", v)
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	return nil, civControl.setPwr(v)
+}
+
+// Returns the S meter on a 0-100 scale, S9 is 50.
+func flrigGetSMeter(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	return civControl.state.sValue * 100 / 18, nil
+}
+
+// The PO meter is not polled, so we return the set power while transmitting.
+func flrigGetPwrMeter(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if civControl.state.ptt || civControl.state.tune {
+		return civControl.state.pwrPercent, nil
+	}
+	return 0, nil
+}
+
+func flrigGetSWRMeter(params []string) (interface{}, error) {
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	return civControl.state.swr, nil
+}
+
+func flrigRunScript(params []string) (interface{}, error) {
+	if len(params) < 1 {
+		return nil, errors.New("missing script name")
+	}
+	return nil, scriptEngine.run(params[0])
+}
+
+func flrigStopScript(params []string) (interface{}, error) {
+	if len(params) < 1 {
+		return nil, errors.New("missing script name")
+	}
+	return nil, scriptEngine.stop(params[0])
+}
+
+func flrigListScripts(params []string) (interface{}, error) {
+	var res []interface{}
+	for _, name := range scriptEngine.list() {
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+func (s *flrigStruct) writeValue(b *bytes.Buffer, v interface{}) {
+	b.WriteString("<value>")
+	switch v := v.(type) {
+	case string:
+		b.WriteString("<string>")
+		_ = xml.EscapeText(b, []byte(v))
+		b.WriteString("</string>")
+	case int:
+		fmt.Fprint(b, "<i4>", v, "</i4>")
+	case float64:
+		fmt.Fprintf(b, "<double>%.1f</double>", v)
+	case []interface{}:
+		b.WriteString("<array><data>")
+		for _, e := range v {
+			s.writeValue(b, e)
+		}
+		b.WriteString("</data></array>")
+	}
+	b.WriteString("</value>")
+}
+
+func (s *flrigStruct) getResponse(v interface{}) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString("<methodResponse><params><param>")
+	s.writeValue(&b, v)
+	b.WriteString("</param></params></methodResponse>\n")
+	return b.Bytes()
+}
+
+func (s *flrigStruct) getFaultResponse(err error) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString("<methodResponse><fault><value><struct>")
+	b.WriteString("<member><name>faultCode</name><value><i4>1</i4></value></member>")
+	b.WriteString("<member><name>faultString</name>")
+	s.writeValue(&b, err.Error())
+	b.WriteString("</member></struct></value></fault></methodResponse>\n")
+	return b.Bytes()
+}
+
+func (s *flrigStruct) processCall(call *flrigMethodCall) (interface{}, error) {
+	var params []string
+	for i := range call.Params {
+		params = append(params, call.Params[i].str())
+	}
+
+	if call.MethodName == "system.listMethods" {
+		var res []interface{}
+		for _, m := range flrigMethods {
+			res = append(res, m.name)
+		}
+		return res, nil
+	}
+	for _, m := range flrigMethods {
+		if m.name == call.MethodName {
+			return m.run(params)
+		}
+	}
+	return nil, fmt.Errorf("unknown method %s", call.MethodName)
+}
+
+func (s *flrigStruct) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	d, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	var call flrigMethodCall
+	var res []byte
+	if err := xml.Unmarshal(d, &call); err != nil {
+		res = s.getFaultResponse(err)
+	} else if v, err := s.processCall(&call); err != nil {
+		log.Error("flrig ", call.MethodName, " error: ", err)
+		res = s.getFaultResponse(err)
+	} else {
+		log.Debug("flrig ", call.MethodName, " ", v)
+		res = s.getResponse(v)
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write(res)
+}
+
+// Started once like the internal rigctld, so clients won't have issues with the server going down on reconnects.
+func (s *flrigStruct) initIfNeeded() (err error) {
+	if s.listener != nil || flrigPort == 0 {
+		return
+	}
+
+	s.listener, err = net.Listen("tcp", fmt.Sprint(":", flrigPort))
+	if err != nil {
+		return
+	}
+
+	log.Print("starting flrig compatible xml-rpc server on tcp port ", flrigPort)
+
+	s.server = &http.Server{Handler: s}
+	go func() {
+		_ = s.server.Serve(s.listener)
+	}()
+	return
+}
+
+func (s *flrigStruct) deinit() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFlrigServeHTTP(t *testing.T) {
+	conn, radio := newTestStreamConn(t)
+	civControl.state.mutex.Lock()
+	civControl.st = &serialStream{}
+	civControl.st.common.conn = conn
+	civControl.state.freq = 14074000
+	civControl.state.subFreq = 7074000
+	civControl.state.operatingModeIdx = 1
+	civControl.state.dataMode = true
+	civControl.state.filterIdx = 1
+	civControl.state.mutex.Unlock()
+	defer func() {
+		civControl.state.mutex.Lock()
+		civControl.st = nil
+		civControl.state.pendingCmds = nil
+		civControl.state.freq = 0
+		civControl.state.subFreq = 0
+		civControl.state.operatingModeIdx = 0
+		civControl.state.dataMode = false
+		civControl.state.filterIdx = 0
+		civControl.state.mutex.Unlock()
+	}()
+
+	tests := []struct {
+		method string
+		params string
+		res    string // The response value, or the fault string if fault is set.
+		fault  bool
+		cmd    []byte // The CIV command sent to the radio.
+	}{
+		{method: "main.get_version", res: "<string>1.4.7</string>"},
+		{method: "rig.get_vfo", res: "<string>14074000</string>"},
+		{method: "rig.get_vfoA", res: "<string>14074000</string>"},
+		{method: "rig.get_vfoB", res: "<string>7074000</string>"},
+		{method: "rig.get_AB", res: "<string>A</string>"},
+		{method: "rig.get_mode", res: "<string>USB-D</string>"},
+		{method: "rig.get_bw", res: "<array><data><value><string>2400</string></value><value><string></string>" +
+			"</value></data></array>"},
+		{method: "rig.get_info", res: "<string>R:IC-705\nT:R\nFA:14074000\nM:USB-D\nL:FIL2</string>"},
+		{method: "rig.set_vfo", params: "<value><double>14074000.0</double></value>", res: "",
+			cmd: []byte{254, 254, civAddress, 224, 0x25, 0x00, 0x00, 0x40, 0x07, 0x14, 0x00, 253}},
+		{method: "rig.set_frequency", params: "<value><i4>7074000</i4></value>", res: "",
+			cmd: []byte{254, 254, civAddress, 224, 0x25, 0x00, 0x00, 0x40, 0x07, 0x07, 0x00, 253}},
+		{method: "rig.set_vfoB", params: "<value><int>14075000</int></value>", res: "",
+			cmd: []byte{254, 254, civAddress, 224, 0x25, 0x01, 0x00, 0x50, 0x07, 0x14, 0x00, 253}},
+		{method: "rig.set_vfoA", params: "<value> 3573000 </value>", res: "",
+			cmd: []byte{254, 254, civAddress, 224, 0x25, 0x00, 0x00, 0x30, 0x57, 0x03, 0x00, 253}},
+		{method: "rig.set_AB", params: "<value><string>B</string></value>", res: "",
+			cmd: []byte{254, 254, civAddress, 224, 0x07, 0x01, 253}},
+		{method: "rig.set_vfo", res: "missing parameter", fault: true},
+		{method: "rig.set_vfo", params: "<value><string>x</string></value>", res: "invalid parameter x", fault: true},
+		{method: "rig.set_vfo", params: "<value><i4>-1</i4></value>", res: "invalid frequency -1", fault: true},
+		{method: "kappanhang.run_script", params: "<value>missing</value>", res: "unknown script missing",
+			fault: true},
+		{method: "kappanhang.list_scripts", res: "<array><data></data></array>"},
+		{method: "rig.foo", res: "unknown method rig.foo", fault: true},
+	}
+	var s flrigStruct
+	for _, tt := range tests {
+		req := "<?xml version=\"1.0\"?><methodCall><methodName>" + tt.method + "</methodName><params>"
+		if tt.params != "" {
+			req += "<param>" + tt.params + "</param>"
+		}
+		req += "</params></methodCall>"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(req)))
+
+		want := xml.Header + "<methodResponse><params><param><value>" + strings.ReplaceAll(tt.res, "\n", "&#xA;") +
+			"</value></param></params></methodResponse>\n"
+		if tt.fault {
+			want = xml.Header + "<methodResponse><fault><value><struct><member><name>faultCode</name><value><i4>1" +
+				"</i4></value></member><member><name>faultString</name><value><string>" + tt.res +
+				"</string></value></member></struct></value></fault></methodResponse>\n"
+		}
+		if res := w.Body.String(); res != want {
+			t.Errorf("%s(%s) got response\n%s\nwant\n%s", tt.method, tt.params, res, want)
+		}
+		if tt.cmd != nil {
+			expectTestCivCmd(t, radio, tt.cmd)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("<methodCall>")))
+	if !strings.Contains(w.Body.String(), "<fault>") {
+		t.Errorf("invalid request got response %s", w.Body.String())
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/mattn/go-isatty v0.0.11
 	github.com/mesilliac/pulse-simple v0.0.0-20170506101341-75ac54e19fdf
 	github.com/pborman/getopt v1.1.0
+	github.com/yuin/gopher-lua v0.0.0-20210529063254-f4c35e4016d9
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.16.0
 )
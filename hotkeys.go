@@ -1,202 +1,235 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
-func handleHotkey(k byte) {
-	switch k {
-	case 'l':
+type hotkeyAction struct {
+	name string
+	desc string
+	// The argument is given after the action name in the keymap.
+	run func(arg string) error
+}
+
+func parseHotkeyPercentArg(arg string) (int, error) {
+	v, err := strconv.Atoi(arg)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percent value %s", arg)
+	}
+	return v, nil
+}
+
+var hotkeyActions = []hotkeyAction{
+	{name: "quit", desc: "quit", run: func(string) error {
+		quitChan <- true
+		return nil
+	}},
+	{name: "toggle-help", desc: "toggle the hotkey help", run: func(string) error {
+		tui.toggleHelp()
+		return nil
+	}},
+	{name: "open-prompt", desc: "open the command prompt", run: func(string) error {
+		cmdPrompt.open()
+		return nil
+	}},
+	{name: "cmd", desc: "run prompt commands separated by ;", run: func(arg string) error {
+		for _, c := range strings.Split(arg, ";") {
+			if err := cmdPrompt.execute(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{name: "run-script", desc: "run script", run: func(arg string) error {
+		return scriptEngine.run(arg)
+	}},
+	{name: "toggle-monitor", desc: "toggle audio monitor", run: func(string) error {
 		audio.togglePlaybackToDefaultSoundcard()
-	case ' ':
+		return nil
+	}},
+	{name: "toggle-rec", desc: "toggle PTT and audio rec", run: func(string) error {
 		audio.toggleRecFromDefaultSoundcard()
-	case 't':
-		if err := civControl.toggleTune(); err != nil {
-			log.Error("can't toggle tune: ", err)
-		}
-	case '+':
-		if err := civControl.incPwr(); err != nil {
-			log.Error("can't increase power: ", err)
-		}
-	case '-':
-		if err := civControl.decPwr(); err != nil {
-			log.Error("can't decrease power: ", err)
-		}
-	case '0':
-		if err := civControl.setPwr(0); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '1':
-		if err := civControl.setPwr(10); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '2':
-		if err := civControl.setPwr(20); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '3':
-		if err := civControl.setPwr(30); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '4':
-		if err := civControl.setPwr(40); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '5':
-		if err := civControl.setPwr(50); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '6':
-		if err := civControl.setPwr(60); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '7':
-		if err := civControl.setPwr(70); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '8':
-		if err := civControl.setPwr(80); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '9':
-		if err := civControl.setPwr(90); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case ')':
-		if err := civControl.setPwr(100); err != nil {
-			log.Error("can't set power: ", err)
-		}
-	case '!':
-		if err := civControl.setRFGain(10); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '@':
-		if err := civControl.setRFGain(20); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '#':
-		if err := civControl.setRFGain(30); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '$':
-		if err := civControl.setRFGain(40); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '%':
-		if err := civControl.setRFGain(50); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '^':
-		if err := civControl.setRFGain(60); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '&':
-		if err := civControl.setRFGain(70); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '*':
-		if err := civControl.setRFGain(80); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '(':
-		if err := civControl.setRFGain(90); err != nil {
-			log.Error("can't set rfgain: ", err)
-		}
-	case '\'':
-		if err := civControl.incRFGain(); err != nil {
-			log.Error("can't increase rf gain: ", err)
-		}
-	case ';':
-		if err := civControl.decRFGain(); err != nil {
-			log.Error("can't decrease rf gain: ", err)
-		}
-	case '"':
-		if err := civControl.incSQL(); err != nil {
-			log.Error("can't increase sql: ", err)
-		}
-	case ':':
-		if err := civControl.decSQL(); err != nil {
-			log.Error("can't decrease sql: ", err)
-		}
-	case '.':
-		if err := civControl.incNR(); err != nil {
-			log.Error("can't increase nr: ", err)
-		}
-	case ',':
-		if err := civControl.decNR(); err != nil {
-			log.Error("can't decrease nr: ", err)
-		}
-	case '/':
-		if err := civControl.toggleNR(); err != nil {
-			log.Error("can't toggle nr: ", err)
-		}
-	case ']':
-		if err := civControl.incFreq(); err != nil {
-			log.Error("can't increase freq: ", err)
-		}
-	case '[':
-		if err := civControl.decFreq(); err != nil {
-			log.Error("can't decrease freq: ", err)
-		}
-	case '}':
-		if err := civControl.incTS(); err != nil {
-			log.Error("can't increase ts: ", err)
-		}
-	case '{':
-		if err := civControl.decTS(); err != nil {
-			log.Error("can't decrease ts: ", err)
-		}
-	case 'm':
-		if err := civControl.incOperatingMode(); err != nil {
-			log.Error("can't change mode: ", err)
-		}
-	case 'n':
-		if err := civControl.decOperatingMode(); err != nil {
-			log.Error("can't change mode: ", err)
-		}
-	case 'f':
-		if err := civControl.incFilter(); err != nil {
-			log.Error("can't change filter: ", err)
-		}
-	case 'd':
-		if err := civControl.decFilter(); err != nil {
-			log.Error("can't change filter: ", err)
-		}
-	case 'D':
-		if err := civControl.toggleDataMode(); err != nil {
-			log.Error("can't change datamode: ", err)
-		}
-	case 'b':
-		if err := civControl.incBand(); err != nil {
-			log.Error("can't change band: ", err)
-		}
-	case 'v':
-		if err := civControl.decBand(); err != nil {
-			log.Error("can't change band: ", err)
-		}
-	case 'p':
-		if err := civControl.togglePreamp(); err != nil {
-			log.Error("can't change preamp: ", err)
-		}
-	case 'a':
-		if err := civControl.toggleAGC(); err != nil {
-			log.Error("can't change agc: ", err)
-		}
-	case 'o':
-		if err := civControl.toggleVFO(); err != nil {
-			log.Error("can't change vfo: ", err)
-		}
-	case 's':
-		if err := civControl.toggleSplit(); err != nil {
-			log.Error("can't change split: ", err)
+		return nil
+	}},
+	{name: "toggle-tune", desc: "toggle tune", run: func(string) error {
+		return civControl.toggleTune()
+	}},
+	{name: "inc-pwr", desc: "increase power", run: func(string) error {
+		return civControl.incPwr()
+	}},
+	{name: "dec-pwr", desc: "decrease power", run: func(string) error {
+		return civControl.decPwr()
+	}},
+	{name: "set-pwr", desc: "set power", run: func(arg string) error {
+		v, err := parseHotkeyPercentArg(arg)
+		if err != nil {
+			return err
+		}
+		return civControl.setPwr(v)
+	}},
+	{name: "inc-rfgain", desc: "increase rf gain", run: func(string) error {
+		return civControl.incRFGain()
+	}},
+	{name: "dec-rfgain", desc: "decrease rf gain", run: func(string) error {
+		return civControl.decRFGain()
+	}},
+	{name: "set-rfgain", desc: "set rf gain", run: func(arg string) error {
+		v, err := parseHotkeyPercentArg(arg)
+		if err != nil {
+			return err
+		}
+		return civControl.setRFGain(v)
+	}},
+	{name: "inc-sql", desc: "increase sql", run: func(string) error {
+		return civControl.incSQL()
+	}},
+	{name: "dec-sql", desc: "decrease sql", run: func(string) error {
+		return civControl.decSQL()
+	}},
+	{name: "inc-nr", desc: "increase nr", run: func(string) error {
+		return civControl.incNR()
+	}},
+	{name: "dec-nr", desc: "decrease nr", run: func(string) error {
+		return civControl.decNR()
+	}},
+	{name: "toggle-nr", desc: "toggle nr", run: func(string) error {
+		return civControl.toggleNR()
+	}},
+	{name: "inc-freq", desc: "increase freq", run: func(string) error {
+		return civControl.incFreq()
+	}},
+	{name: "dec-freq", desc: "decrease freq", run: func(string) error {
+		return civControl.decFreq()
+	}},
+	{name: "inc-ts", desc: "increase ts", run: func(string) error {
+		return civControl.incTS()
+	}},
+	{name: "dec-ts", desc: "decrease ts", run: func(string) error {
+		return civControl.decTS()
+	}},
+	{name: "next-mode", desc: "change to next mode", run: func(string) error {
+		return civControl.incOperatingMode()
+	}},
+	{name: "prev-mode", desc: "change to previous mode", run: func(string) error {
+		return civControl.decOperatingMode()
+	}},
+	{name: "next-filter", desc: "change to next filter", run: func(string) error {
+		return civControl.incFilter()
+	}},
+	{name: "prev-filter", desc: "change to previous filter", run: func(string) error {
+		return civControl.decFilter()
+	}},
+	{name: "toggle-data-mode", desc: "toggle datamode", run: func(string) error {
+		return civControl.toggleDataMode()
+	}},
+	{name: "next-band", desc: "change to next band", run: func(string) error {
+		return civControl.incBand()
+	}},
+	{name: "prev-band", desc: "change to previous band", run: func(string) error {
+		return civControl.decBand()
+	}},
+	{name: "cycle-band-stack", desc: "change band stack", run: func(string) error {
+		return civControl.cycleBandStack()
+	}},
+	{name: "toggle-scan", desc: "toggle scan", run: func(string) error {
+		return scanner.toggle()
+	}},
+	{name: "toggle-sweep", desc: "toggle sweep", run: func(string) error {
+		return sweeper.toggle()
+	}},
+	{name: "toggle-scope", desc: "toggle scope", run: func(string) error {
+		return civControl.toggleScope()
+	}},
+	{name: "dec-scope-span", desc: "decrease scope span", run: func(string) error {
+		return civControl.decScopeSpan()
+	}},
+	{name: "inc-scope-span", desc: "increase scope span", run: func(string) error {
+		return civControl.incScopeSpan()
+	}},
+	{name: "dec-scope-ref", desc: "decrease scope ref level", run: func(string) error {
+		return civControl.decScopeRef()
+	}},
+	{name: "inc-scope-ref", desc: "increase scope ref level", run: func(string) error {
+		return civControl.incScopeRef()
+	}},
+	{name: "cycle-scope-speed", desc: "change scope speed", run: func(string) error {
+		return civControl.cycleScopeSpeed()
+	}},
+	{name: "toggle-preamp", desc: "change preamp", run: func(string) error {
+		return civControl.togglePreamp()
+	}},
+	{name: "toggle-agc", desc: "change agc", run: func(string) error {
+		return civControl.toggleAGC()
+	}},
+	{name: "toggle-vfo", desc: "change vfo", run: func(string) error {
+		return civControl.toggleVFO()
+	}},
+	{name: "toggle-split", desc: "change split", run: func(string) error {
+		return civControl.toggleSplit()
+	}},
+}
+
+func getHotkeyAction(name string) *hotkeyAction {
+	for i := range hotkeyActions {
+		if hotkeyActions[i].name == name {
+			return &hotkeyActions[i]
 		}
-	case '\n':
-		if statusLog.isRealtime() {
-			statusLog.mutex.Lock()
-			statusLog.clearInternal()
-			fmt.Println()
-			statusLog.mutex.Unlock()
-			statusLog.print()
+	}
+	return nil
+}
+
+// Splits the keyboard input to keys, escape sequences are kept together as one key.
+func splitKeys(b []byte) (keys []string) {
+	for i := 0; i < len(b); {
+		j := i + 1
+		if b[i] == 27 && j < len(b) {
+			switch b[j] {
+			case '[':
+				// CSI sequences end with a byte in the 0x40-0x7e range.
+				j++
+				for j < len(b) && (b[j] < 0x40 || b[j] > 0x7e) {
+					j++
+				}
+				if j < len(b) {
+					j++
+				}
+			case 'O':
+				j += 2
+				if j > len(b) {
+					j = len(b)
+				}
+			default: // Alt + key.
+				j++
+			}
+		}
+		keys = append(keys, string(b[i:j]))
+		i = j
+	}
+	return
+}
+
+func handleKeyboardInput(b []byte) {
+	for _, k := range splitKeys(b) {
+		if cmdPrompt.isActive() {
+			cmdPrompt.handleKey(k)
+		} else {
+			handleHotkey(k)
 		}
-	case 'q':
-		quitChan <- true
+	}
+}
+
+func handleHotkey(k string) {
+	binding := keymap.get(k)
+	if binding == nil {
+		return
+	}
+	a := getHotkeyAction(binding.action)
+	if a == nil {
+		return
+	}
+	if err := a.run(binding.arg); err != nil {
+		log.Error("can't ", a.desc, ": ", err)
 	}
 }
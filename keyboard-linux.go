@@ -14,11 +14,12 @@ type keyboardStruct struct {
 var keyboard keyboardStruct
 
 func (s *keyboardStruct) loop() {
-	var b []byte = make([]byte, 1)
+	// Escape sequences (sent by arrow keys for example) are usually read at once.
+	var b []byte = make([]byte, 16)
 	for {
 		n, err := os.Stdin.Read(b)
 		if n > 0 && err == nil {
-			handleHotkey(b[0])
+			handleKeyboardInput(b[:n])
 		}
 	}
 }
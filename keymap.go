@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+type keymapBinding struct {
+	key    string
+	action string
+	arg    string
+	desc   string
+}
+
+type hotkeyHelpEntry struct {
+	keys string
+	desc string
+}
+
+type keymapStruct struct {
+	bindings []keymapBinding
+	// Maps the input sequences to bindings.
+	inputs map[string]*keymapBinding
+}
+
+var keymap keymapStruct
+
+var defaultKeymap = []keymapBinding{
+	{key: "q", action: "quit"},
+	{key: "?", action: "toggle-help"},
+	{key: "enter", action: "open-prompt"},
+	{key: "l", action: "toggle-monitor"},
+	{key: "space", action: "toggle-rec"},
+	{key: "t", action: "toggle-tune"},
+	{key: "+", action: "inc-pwr"},
+	{key: "-", action: "dec-pwr"},
+	{key: "0", action: "set-pwr", arg: "0"},
+	{key: "1", action: "set-pwr", arg: "10"},
+	{key: "2", action: "set-pwr", arg: "20"},
+	{key: "3", action: "set-pwr", arg: "30"},
+	{key: "4", action: "set-pwr", arg: "40"},
+	{key: "5", action: "set-pwr", arg: "50"},
+	{key: "6", action: "set-pwr", arg: "60"},
+	{key: "7", action: "set-pwr", arg: "70"},
+	{key: "8", action: "set-pwr", arg: "80"},
+	{key: "9", action: "set-pwr", arg: "90"},
+	{key: ")", action: "set-pwr", arg: "100"},
+	{key: "!", action: "set-rfgain", arg: "10"},
+	{key: "@", action: "set-rfgain", arg: "20"},
+	{key: "hash", action: "set-rfgain", arg: "30"},
+	{key: "$", action: "set-rfgain", arg: "40"},
+	{key: "%", action: "set-rfgain", arg: "50"},
+	{key: "^", action: "set-rfgain", arg: "60"},
+	{key: "&", action: "set-rfgain", arg: "70"},
+	{key: "*", action: "set-rfgain", arg: "80"},
+	{key: "(", action: "set-rfgain", arg: "90"},
+	{key: "'", action: "inc-rfgain"},
+	{key: ";", action: "dec-rfgain"},
+	{key: "\"", action: "inc-sql"},
+	{key: ":", action: "dec-sql"},
+	{key: ".", action: "inc-nr"},
+	{key: ",", action: "dec-nr"},
+	{key: "/", action: "toggle-nr"},
+	{key: "]", action: "inc-freq"},
+	{key: "[", action: "dec-freq"},
+	{key: "up", action: "inc-freq"},
+	{key: "down", action: "dec-freq"},
+	{key: "}", action: "inc-ts"},
+	{key: "{", action: "dec-ts"},
+	{key: "m", action: "next-mode"},
+	{key: "n", action: "prev-mode"},
+	{key: "f", action: "next-filter"},
+	{key: "d", action: "prev-filter"},
+	{key: "D", action: "toggle-data-mode"},
+	{key: "b", action: "next-band"},
+	{key: "v", action: "prev-band"},
+	{key: "pgup", action: "next-band"},
+	{key: "pgdn", action: "prev-band"},
+	{key: "B", action: "cycle-band-stack"},
+	{key: "p", action: "toggle-preamp"},
+	{key: "a", action: "toggle-agc"},
+	{key: "o", action: "toggle-vfo"},
+	{key: "s", action: "toggle-split"},
+	{key: "S", action: "toggle-scan"},
+	{key: "w", action: "toggle-sweep"},
+	{key: "c", action: "toggle-scope"},
+	{key: "<", action: "dec-scope-span"},
+	{key: ">", action: "inc-scope-span"},
+	{key: "r", action: "dec-scope-ref"},
+	{key: "R", action: "inc-scope-ref"},
+	{key: "C", action: "cycle-scope-speed"},
+}
+
+var keymapKeyNames = map[string][]string{
+	"space":     {" "},
+	"hash":      {"#"},
+	"enter":     {"\n", "\r"},
+	"tab":       {"\t"},
+	"esc":       {"\x1b"},
+	"backspace": {"\x7f", "\x08"},
+	"up":        {"\x1b[A", "\x1bOA"},
+	"down":      {"\x1b[B", "\x1bOB"},
+	"right":     {"\x1b[C", "\x1bOC"},
+	"left":      {"\x1b[D", "\x1bOD"},
+	"home":      {"\x1b[H", "\x1bOH", "\x1b[1~", "\x1b[7~"},
+	"end":       {"\x1b[F", "\x1bOF", "\x1b[4~", "\x1b[8~"},
+	"insert":    {"\x1b[2~"},
+	"delete":    {"\x1b[3~"},
+	"pgup":      {"\x1b[5~"},
+	"pgdn":      {"\x1b[6~"},
+	"f1":        {"\x1bOP", "\x1b[11~", "\x1b[[A"},
+	"f2":        {"\x1bOQ", "\x1b[12~", "\x1b[[B"},
+	"f3":        {"\x1bOR", "\x1b[13~", "\x1b[[C"},
+	"f4":        {"\x1bOS", "\x1b[14~", "\x1b[[D"},
+	"f5":        {"\x1b[15~", "\x1b[[E"},
+	"f6":        {"\x1b[17~"},
+	"f7":        {"\x1b[18~"},
+	"f8":        {"\x1b[19~"},
+	"f9":        {"\x1b[20~"},
+	"f10":       {"\x1b[21~"},
+	"f11":       {"\x1b[23~"},
+	"f12":       {"\x1b[24~"},
+}
+
+// Single character keys are case sensitive, key names are not.
+func (s *keymapStruct) normalizeKey(key string) string {
+	if utf8.RuneCountInString(key) == 1 || strings.HasPrefix(key, `\e`) {
+		return key
+	}
+	return strings.ToLower(key)
+}
+
+// Returns the input sequences which are sent by the terminal for the given key.
+func (s *keymapStruct) getKeyInputs(key string) ([]string, error) {
+	key = s.normalizeKey(key)
+	if utf8.RuneCountInString(key) == 1 {
+		return []string{key}, nil
+	}
+	if inputs, ok := keymapKeyNames[key]; ok {
+		return inputs, nil
+	}
+	if strings.HasPrefix(key, `\e`) {
+		return []string{"\x1b" + key[2:]}, nil
+	}
+	if strings.HasPrefix(key, "ctrl+") && len(key) == 6 && key[5] >= 'a' && key[5] <= 'z' {
+		return []string{string(rune(key[5] - 'a' + 1))}, nil
+	}
+	if strings.HasPrefix(key, "alt+") && utf8.RuneCountInString(key) == 5 {
+		return []string{"\x1b" + key[4:]}, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", key)
+}
+
+func (s *keymapStruct) set(b keymapBinding) {
+	for i := range s.bindings {
+		if s.bindings[i].key == b.key {
+			if b.action == "none" {
+				s.bindings = append(s.bindings[:i], s.bindings[i+1:]...)
+			} else {
+				s.bindings[i] = b
+			}
+			return
+		}
+	}
+	if b.action != "none" {
+		s.bindings = append(s.bindings, b)
+	}
+}
+
+// Returns nil for empty and comment lines.
+func (s *keymapStruct) parseLine(line string) (*keymapBinding, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("missing action for key %s", fields[0])
+	}
+
+	b := &keymapBinding{
+		key:    s.normalizeKey(fields[0]),
+		action: fields[1],
+		arg:    strings.Join(fields[2:], " "),
+	}
+	if _, err := s.getKeyInputs(b.key); err != nil {
+		return nil, err
+	}
+	if b.action != "none" && getHotkeyAction(b.action) == nil {
+		return nil, fmt.Errorf("unknown action %s", b.action)
+	}
+	return b, nil
+}
+
+// Loads the default keymap, then the bindings from the keymap file override the defaults.
+func (s *keymapStruct) load() {
+	s.bindings = append([]keymapBinding{}, defaultKeymap...)
+
+	if keymapFile != "" {
+		d, err := ioutil.ReadFile(keymapFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Error("can't load keymap: ", err)
+			}
+		} else {
+			for i, line := range strings.Split(string(d), "\n") {
+				b, err := s.parseLine(line)
+				if err != nil {
+					log.Error("can't parse keymap file ", keymapFile, " line ", i+1, ": ", err)
+					continue
+				}
+				if b != nil {
+					s.set(*b)
+				}
+			}
+		}
+	}
+
+	s.inputs = make(map[string]*keymapBinding)
+	for i := range s.bindings {
+		b := &s.bindings[i]
+		switch b.action {
+		case "cmd":
+			b.desc = b.arg
+		case "run-script":
+			b.desc = "run script " + b.arg
+		default:
+			if a := getHotkeyAction(b.action); a != nil {
+				b.desc = a.desc
+			}
+		}
+		inputs, _ := s.getKeyInputs(b.key)
+		for _, input := range inputs {
+			s.inputs[input] = b
+		}
+	}
+}
+
+// Returns the binding for the given key input sequence.
+func (s *keymapStruct) get(input string) *keymapBinding {
+	return s.inputs[input]
+}
+
+// Returns the keys grouped by actions, for the help overlay of the terminal UI.
+func (s *keymapStruct) getHelp() (res []hotkeyHelpEntry) {
+	idx := make(map[string]int)
+	for _, b := range s.bindings {
+		group := b.action
+		if b.action == "cmd" || b.action == "run-script" {
+			group += " " + b.arg
+		}
+		if i, ok := idx[group]; ok {
+			res[i].keys += " " + b.key
+			continue
+		}
+		idx[group] = len(res)
+		res = append(res, hotkeyHelpEntry{keys: b.key, desc: b.desc})
+	}
+	return
+}
+
+func (s *keymapStruct) printDefaults() {
+	fmt.Println("# Keymap file format: <key> <action> [argument]")
+	fmt.Println("#")
+	fmt.Println("# Keys are single characters, or one of: space, hash, enter, tab, esc, backspace,")
+	fmt.Println("# up, down, left, right, home, end, insert, delete, pgup, pgdn, f1-f12, ctrl+<letter>,")
+	fmt.Println("# alt+<key>, or \\e followed by the rest of an escape sequence (example: \\e[1;5A).")
+	fmt.Println("# Bind a key to the none action to disable it.")
+	fmt.Println("#")
+	fmt.Println("# Actions:")
+	for _, a := range hotkeyActions {
+		fmt.Printf("#   %-18s %s\n", a.name, a.desc)
+	}
+	fmt.Println("#")
+	fmt.Println("# Example for a macro: f5 cmd freq 14.074; mode usbd fil1; pwr 40")
+	fmt.Println("# Example for running a script: f6 run-script beacon")
+	fmt.Println()
+	for _, b := range defaultKeymap {
+		line := b.key + " " + b.action
+		if b.arg != "" {
+			line += " " + b.arg
+		}
+		fmt.Println(line)
+	}
+}
+
+func getDefaultKeymapFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kappanhang", "keymap.conf")
+}
@@ -38,6 +38,19 @@ func (l *logger) Print(a ...interface{}) {
 	l.logger.Info(append([]interface{}{l.GetCallerFileName(false) + ": "}, a...)...)
 }
 
+// Logs the message with the given key-value pairs as structured fields.
+func (l *logger) PrintW(msg string, keysAndValues ...interface{}) {
+	if statusLog.isRealtime() {
+		statusLog.mutex.Lock()
+		statusLog.clearInternal()
+		defer func() {
+			statusLog.mutex.Unlock()
+			statusLog.print()
+		}()
+	}
+	l.logger.Infow(l.GetCallerFileName(false)+": "+msg, keysAndValues...)
+}
+
 func (l *logger) PrintStatusLog(a ...interface{}) {
 	l.logger.Info(append([]interface{}{l.GetCallerFileName(false) + ": "}, a...)...)
 }
@@ -78,6 +91,16 @@ func (l *logger) ErrorC(a ...interface{}) {
 	l.logger.Error(a...)
 }
 
+// Log lines are displayed in the log pane while the terminal UI is active.
+type logWriter struct{}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	if tui.addLogLine(string(p)) {
+		return len(p), nil
+	}
+	return os.Stdout.Write(p)
+}
+
 func (l *logger) Init() {
 	// Example: https://stackoverflow.com/questions/50933936/zap-logger-does-not-print-on-console-rather-print-in-the-log-file/50936341
 	pe := zap.NewProductionEncoderConfig()
@@ -94,7 +117,7 @@ func (l *logger) Init() {
 		level = zap.InfoLevel
 	}
 
-	core := zapcore.NewCore(consoleEncoder, zapcore.AddSync(os.Stdout), level)
+	core := zapcore.NewCore(consoleEncoder, zapcore.AddSync(logWriter{}), level)
 	l.logger = zap.New(core).Sugar()
 
 	var callerFilename string
@@ -0,0 +1,239 @@
+package main
+
+import "fmt"
+
+// Wireshark dissector for the RS-BA1 protocol. It can be saved with "kappanhang decode --lua-dissector" to
+// the personal Lua plugins folder of Wireshark (see Help / About Wireshark / Folders).
+const luaDissector = `-- Icom RS-BA1 protocol dissector for Wireshark, generated by kappanhang.
+
+local rsba1 = Proto("rsba1", "Icom RS-BA1")
+
+local types = {
+	[0x00] = "Data",
+	[0x01] = "Retransmit request",
+	[0x03] = "Are you there",
+	[0x04] = "I am here",
+	[0x05] = "Disconnect",
+	[0x06] = "Are you ready",
+	[0x07] = "Ping",
+}
+
+local civ_cmds = {
+	[0x00] = "Transceive freq",
+	[0x01] = "Transceive mode",
+	[0x03] = "Read freq",
+	[0x04] = "Read mode",
+	[0x05] = "Set freq",
+	[0x06] = "Set mode",
+	[0x07] = "VFO",
+	[0x08] = "Memory",
+	[0x0f] = "Split",
+	[0x10] = "Tuning step",
+	[0x11] = "Attenuator",
+	[0x14] = "Level",
+	[0x15] = "Meter",
+	[0x16] = "Function",
+	[0x1a] = "Misc",
+	[0x1c] = "PTT/tune",
+	[0x25] = "VFO freq",
+	[0x26] = "VFO mode",
+	[0x27] = "Scope",
+	[0xfa] = "NG",
+	[0xfb] = "OK",
+}
+
+local f = rsba1.fields
+f.len = ProtoField.uint32("rsba1.len", "Length", base.DEC)
+f.type = ProtoField.uint16("rsba1.type", "Type", base.HEX, types)
+f.seq = ProtoField.uint16("rsba1.seq", "Sequence", base.DEC)
+f.sentid = ProtoField.uint32("rsba1.sentid", "Sender ID", base.HEX)
+f.rcvdid = ProtoField.uint32("rsba1.rcvdid", "Receiver ID", base.HEX)
+f.retransmit_start = ProtoField.uint16("rsba1.retransmit.start", "Retransmit start", base.DEC)
+f.retransmit_end = ProtoField.uint16("rsba1.retransmit.end", "Retransmit end", base.DEC)
+f.ping_reply = ProtoField.uint8("rsba1.ping.reply", "Ping reply", base.DEC)
+f.ping_id = ProtoField.bytes("rsba1.ping.id", "Ping ID")
+f.innerlen = ProtoField.uint32("rsba1.control.innerlen", "Inner length", base.DEC)
+f.reqreply = ProtoField.uint8("rsba1.control.reqreply", "Request/reply", base.DEC, {[1] = "Request", [2] = "Reply"})
+f.reqtype = ProtoField.uint8("rsba1.control.reqtype", "Request type", base.HEX)
+f.innerseq = ProtoField.uint16("rsba1.control.innerseq", "Inner sequence", base.DEC)
+f.authid = ProtoField.bytes("rsba1.control.authid", "Auth ID")
+f.replyid = ProtoField.bytes("rsba1.control.replyid", "Reply ID")
+f.name = ProtoField.string("rsba1.control.name", "Name")
+f.connection = ProtoField.string("rsba1.control.connection", "Connection")
+f.radio = ProtoField.string("rsba1.control.radio", "Radio")
+f.audio_name = ProtoField.string("rsba1.control.audio", "Audio device")
+f.civ_address = ProtoField.uint8("rsba1.control.civaddress", "CI-V address", base.HEX)
+f.error = ProtoField.bytes("rsba1.control.error", "Error")
+f.busy = ProtoField.uint8("rsba1.control.busy", "Streams opened", base.DEC)
+f.rx_enable = ProtoField.uint8("rsba1.control.rxenable", "RX enable", base.DEC)
+f.tx_enable = ProtoField.uint8("rsba1.control.txenable", "TX enable", base.DEC)
+f.rx_codec = ProtoField.uint8("rsba1.control.rxcodec", "RX codec", base.HEX)
+f.tx_codec = ProtoField.uint8("rsba1.control.txcodec", "TX codec", base.HEX)
+f.rx_samplerate = ProtoField.uint16("rsba1.control.rxsamplerate", "RX sample rate", base.DEC)
+f.tx_samplerate = ProtoField.uint16("rsba1.control.txsamplerate", "TX sample rate", base.DEC)
+f.serial_port = ProtoField.uint16("rsba1.control.serialport", "Serial port", base.DEC)
+f.audio_port = ProtoField.uint16("rsba1.control.audioport", "Audio port", base.DEC)
+f.txbuf = ProtoField.uint16("rsba1.control.txbuf", "TX buffer (ms)", base.DEC)
+f.data_cmd = ProtoField.uint8("rsba1.data.cmd", "Data command", base.HEX, {[0xc0] = "Open/close", [0xc1] = "CI-V"})
+f.data_len = ProtoField.uint16("rsba1.data.len", "Data length", base.DEC)
+f.serial_len = ProtoField.uint8("rsba1.serial.len", "Serial data length", base.DEC)
+f.sendseq = ProtoField.uint16("rsba1.data.sendseq", "Send sequence", base.DEC)
+f.open = ProtoField.uint8("rsba1.serial.open", "Open", base.HEX, {[0x00] = "Close", [0x05] = "Open"})
+f.audio_ident = ProtoField.uint8("rsba1.audio.ident", "Audio ident", base.HEX)
+f.pcm = ProtoField.bytes("rsba1.audio.pcm", "PCM data")
+f.civ_to = ProtoField.uint8("rsba1.civ.to", "To", base.HEX)
+f.civ_from = ProtoField.uint8("rsba1.civ.from", "From", base.HEX)
+f.civ_cmd = ProtoField.uint8("rsba1.civ.cmd", "Command", base.HEX, civ_cmds)
+f.civ_payload = ProtoField.bytes("rsba1.civ.payload", "Payload")
+f.payload = ProtoField.bytes("rsba1.payload", "Payload")
+
+local function stream_name(pinfo)
+	for _, port in ipairs({pinfo.src_port, pinfo.dst_port}) do
+		if port == 50001 then return "control" end
+		if port == 50002 then return "serial" end
+		if port == 50003 then return "audio" end
+	end
+	return "unknown"
+end
+
+local function dissect_civ(buf, tree)
+	local i = 0
+	while i + 1 < buf:len() do
+		if buf(i, 1):uint() == 0xfe and buf(i + 1, 1):uint() == 0xfe then
+			local j = i + 2
+			while j < buf:len() and buf(j, 1):uint() ~= 0xfd do
+				j = j + 1
+			end
+			if j >= buf:len() or j - i < 5 then
+				break
+			end
+			local t = tree:add(rsba1, buf(i, j - i + 1), "CI-V frame")
+			t:add(f.civ_to, buf(i + 2, 1))
+			t:add(f.civ_from, buf(i + 3, 1))
+			t:add(f.civ_cmd, buf(i + 4, 1))
+			if j > i + 5 then
+				t:add(f.civ_payload, buf(i + 5, j - i - 5))
+			end
+			i = j + 1
+		else
+			i = i + 1
+		end
+	end
+end
+
+local function dissect_control(buf, tree, info)
+	local t = tree:add(rsba1, buf(16), "Control")
+	t:add(f.innerlen, buf(16, 4))
+	t:add(f.reqreply, buf(20, 1))
+	t:add(f.reqtype, buf(21, 1))
+	t:add_le(f.innerseq, buf(23, 2))
+	t:add(f.authid, buf(26, 6))
+
+	local len = buf:len()
+	local first = buf(0, 1):uint()
+	if len == 128 and first == 0x80 then
+		info = "Login"
+		t:add(f.name, buf(96, 16))
+	elseif len == 96 and first == 0x60 then
+		info = "Login reply"
+		t:add(f.error, buf(48, 4))
+		t:add(f.connection, buf(64, 16))
+	elseif len == 64 and first == 0x40 then
+		info = "Auth"
+	elseif len == 80 and first == 0x50 then
+		info = "Status"
+		t:add(f.error, buf(48, 4))
+	elseif len == 168 and first == 0xa8 then
+		info = "Capabilities"
+		t:add(f.replyid, buf(66, 16))
+		t:add(f.radio, buf(82, 32))
+		t:add(f.audio_name, buf(114, 32))
+		t:add(f.civ_address, buf(148, 1))
+	elseif len == 144 and first == 0x90 then
+		info = "Connection info"
+		t:add(f.radio, buf(64, 32))
+		t:add(f.busy, buf(96, 1))
+		t:add(f.rx_enable, buf(112, 1))
+		t:add(f.tx_enable, buf(113, 1))
+		t:add(f.rx_codec, buf(114, 1))
+		t:add(f.tx_codec, buf(115, 1))
+		t:add(f.rx_samplerate, buf(118, 2))
+		t:add(f.tx_samplerate, buf(122, 2))
+		t:add(f.serial_port, buf(126, 2))
+		t:add(f.audio_port, buf(130, 2))
+		t:add(f.txbuf, buf(134, 2))
+	end
+	return info
+end
+
+function rsba1.dissector(buf, pinfo, tree)
+	if buf:len() < 16 then
+		return 0
+	end
+	pinfo.cols.protocol = "RS-BA1"
+
+	local stream = stream_name(pinfo)
+	local t = tree:add(rsba1, buf(), "Icom RS-BA1 (" .. stream .. ")")
+	t:add_le(f.len, buf(0, 4))
+	t:add_le(f.type, buf(4, 2))
+	t:add_le(f.seq, buf(6, 2))
+	t:add(f.sentid, buf(8, 4))
+	t:add(f.rcvdid, buf(12, 4))
+
+	local typ = buf(4, 2):le_uint()
+	local info = types[typ] or "Unknown"
+	if typ == 0x01 then
+		local i = 16
+		while i + 4 <= buf:len() do
+			t:add_le(f.retransmit_start, buf(i, 2))
+			t:add_le(f.retransmit_end, buf(i + 2, 2))
+			i = i + 4
+		end
+	elseif typ == 0x07 and buf:len() >= 21 then
+		t:add(f.ping_reply, buf(16, 1))
+		t:add(f.ping_id, buf(17, 4))
+		if buf(16, 1):uint() == 0 then
+			info = "Ping request"
+		else
+			info = "Ping reply"
+		end
+	elseif typ == 0x00 and buf:len() == 16 then
+		info = "Idle"
+	elseif typ == 0x00 and buf:len() >= 24 then
+		if stream == "control" and buf:len() >= 64 then
+			info = dissect_control(buf, t, "Control")
+		elseif stream == "serial" and buf(16, 1):uint() == 0xc1 then
+			info = "Serial data"
+			t:add(f.data_cmd, buf(16, 1))
+			t:add(f.serial_len, buf(17, 1))
+			t:add(f.sendseq, buf(19, 2))
+			dissect_civ(buf(21):tvb(), t)
+		elseif stream == "serial" and buf(16, 1):uint() == 0xc0 then
+			info = "Serial open/close"
+			t:add(f.data_cmd, buf(16, 1))
+			t:add(f.open, buf(21, 1))
+		elseif stream == "audio" then
+			info = "Audio"
+			t:add(f.audio_ident, buf(16, 1))
+			t:add(f.sendseq, buf(18, 2))
+			t:add(f.data_len, buf(22, 2))
+			if buf:len() > 24 then
+				t:add(f.pcm, buf(24))
+			end
+		else
+			t:add(f.payload, buf(16))
+		end
+	end
+	pinfo.cols.info = stream .. ": " .. info .. " seq=" .. buf(6, 2):le_uint()
+	return buf:len()
+end
+
+local udp_port = DissectorTable.get("udp.port")
+udp_port:add(50001, rsba1)
+udp_port:add(50002, rsba1)
+udp_port:add(50003, rsba1)
+`
+
+func printLuaDissector() {
+	fmt.Print(luaDissector)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
 	"runtime/debug"
@@ -9,11 +11,15 @@ import (
 	"time"
 )
 
-const waitBetweenRetries = time.Second
-const retryCount = 5
-const waitOnRetryFailure = 65 * time.Second
+var gotErrChan = make(chan error)
 
-var gotErrChan = make(chan bool)
+type streamError struct {
+	name     string
+	instance uint32
+}
+
+// Gets the streams which need to be restarted.
+var gotStreamErrChan = make(chan streamError, 2)
 var quitChan = make(chan bool)
 
 func getAboutStr() string {
@@ -28,26 +34,33 @@ func getAboutStr() string {
 }
 
 func wait(d time.Duration, osSignal chan os.Signal) (shouldExit bool) {
-	for sec := d.Seconds(); sec > 0; sec-- {
-		log.Print("waiting ", sec, " seconds...")
+	for d > 0 {
+		log.Print("waiting ", d.Round(100*time.Millisecond).Seconds(), " seconds...")
+		step := time.Second
+		if d < step {
+			step = d
+		}
 		select {
-		case <-time.After(time.Second):
+		case <-clock.after(step):
 		case <-osSignal:
 			log.Print("sigterm received")
 			return true
 		case <-quitChan:
 			return true
 		}
+		d -= step
 	}
 	return false
 }
 
-func runControlStream(osSignal chan os.Signal) (requireWait, shouldExit bool, exitCode int) {
+// Returns the error which ended the session.
+func runControlStream(osSignal chan os.Signal) (sessionErr error, shouldExit bool, exitCode int) {
 	// Depleting gotErrChan.
 	var finished bool
 	for !finished {
 		select {
 		case <-gotErrChan:
+		case <-gotStreamErrChan:
 		default:
 			finished = true
 		}
@@ -59,24 +72,22 @@ func runControlStream(osSignal chan os.Signal) (requireWait, shouldExit bool, ex
 		log.Error(err)
 		ctrl.deinit()
 		if strings.Contains(err.Error(), "invalid username/password") {
-			return false, true, 1
+			return err, true, 1
 		}
-		return
+		return err, false, 0
 	}
 
 	select {
-	// Need to wait before reinit because the IC-705 will disconnect our audio stream eventually if we relogin
-	// in a too short interval without a deauth...
-	case requireWait = <-gotErrChan:
+	case sessionErr = <-gotErrChan:
 		ctrl.deinit()
 		return
 	case <-osSignal:
 		log.Print("sigterm received")
 		ctrl.deinit()
-		return false, true, 0
+		return nil, true, 0
 	case <-quitChan:
 		ctrl.deinit()
-		return false, true, 0
+		return nil, true, 0
 	}
 }
 
@@ -84,35 +95,75 @@ func reportError(err error) {
 	if !strings.Contains(err.Error(), "use of closed network connection") {
 		log.ErrorC(log.GetCallerFileName(true), ": ", err)
 	}
+	events.reportDisconnected(err)
+
+	// Non-blocking notify.
+	select {
+	case gotErrChan <- err:
+	default:
+	}
+}
 
-	requireWait := true
-	if strings.Contains(err.Error(), "got radio disconnected") {
-		requireWait = false
+// Reports an error which requires only the given stream to be restarted.
+func reportStreamError(e streamError, err error) {
+	if !strings.Contains(err.Error(), "use of closed network connection") {
+		log.ErrorC(log.GetCallerFileName(true), ": ", e.name, "/", err)
 	}
 
 	// Non-blocking notify.
 	select {
-	case gotErrChan <- requireWait:
+	case gotStreamErrChan <- e:
 	default:
 	}
 }
 
 func main() {
 	parseArgs()
+
+	if decodeLuaDissector {
+		printLuaDissector()
+		os.Exit(0)
+	}
+	if decodeFile != "" {
+		if err := runDecode(decodeFile); err != nil {
+			fmt.Fprintln(os.Stderr, "can't decode capture:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	log.Init()
 	log.Print(getAboutStr())
 
+	if replayFile != "" {
+		if err := runReplay(replayFile); err != nil {
+			log.Error("can't replay capture: ", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	packetCapture.init()
+	keymap.load()
+	events.load()
+	bandData.init()
+	radioInfo.init()
+	scriptEngine.load()
+	scheduler.init()
+
 	osSignal := make(chan os.Signal, 1)
 	signal.Notify(osSignal, os.Interrupt, syscall.SIGTERM)
 
-	var retries int
-	var requireWait bool
+	rand.Seed(time.Now().UnixNano())
+
+	var sessionErr error
 	var shouldExit bool
 	var exitCode int
 
 exit:
 	for {
-		requireWait, shouldExit, exitCode = runControlStream(osSignal)
+		sessionStartedAt := clock.now()
+		sessionErr, shouldExit, exitCode = runControlStream(osSignal)
 
 		if shouldExit {
 			break
@@ -127,33 +178,44 @@ exit:
 		default:
 		}
 
-		if requireWait {
-			if retries < retryCount {
-				retries++
-				shouldExit = wait(waitBetweenRetries, osSignal)
-			} else {
-				retries = 0
-				shouldExit = wait(waitOnRetryFailure, osSignal)
-			}
-		} else {
-			retries = 0
-			shouldExit = wait(time.Second, osSignal)
+		if shouldExit = wait(reconnect.sessionEnded(sessionErr, clock.since(sessionStartedAt)), osSignal); shouldExit {
+			break
 		}
 
-		if shouldExit {
-			break
+		for reconnectProbe {
+			err := probeReachability()
+			if err == nil {
+				break
+			}
+			log.Error(err)
+			if shouldExit = wait(reconnect.probeFailed(), osSignal); shouldExit {
+				break exit
+			}
 		}
+
+		reconnect.startingAttempt()
 		log.Print("restarting control stream...")
 	}
 
+	reconnect.logStats()
+	scheduler.deinit()
+	bandData.deinit()
+	radioInfo.deinit()
+	scriptEngine.stopAll()
+	scanner.stop()
+	sweeper.stop()
 	rigctld.deinit()
+	flrig.deinit()
+	tci.deinit()
 	serialTCPSrv.deinit()
 	runCmdRunner.stop()
 	serialCmdRunner.stop()
 	audio.deinit()
 	serialPort.deinit()
+	packetCapture.deinit()
 
 	if statusLog.isRealtimeInternal() {
+		tui.deinit()
 		keyboard.deinit()
 	}
 
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// How long the tests wait for something which happens in another goroutine.
+const testWaitTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	quietLog = true
+	log.Init()
+	os.Exit(m.Run())
+}
+
+// Records the log messages until the end of the test.
+func observeLog(t testing.TB) *observer.ObservedLogs {
+	core, logs := observer.New(zap.DebugLevel)
+	prevLogger := log.logger
+	log.logger = zap.New(core).Sugar()
+	t.Cleanup(func() {
+		log.logger = prevLogger
+	})
+	return logs
+}
+
+// Returns the number of logged messages containing str.
+func countLogs(logs *observer.ObservedLogs, str string) (n int) {
+	for _, e := range logs.All() {
+		if strings.Contains(e.Message, str) {
+			n++
+		}
+	}
+	return
+}
+
+// Waits until a message containing str gets logged, and returns the number of such messages.
+func waitForLog(t testing.TB, logs *observer.ObservedLogs, str string) int {
+	t.Helper()
+	for deadline := time.Now().Add(testWaitTimeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if n := countLogs(logs, str); n > 0 {
+			return n
+		}
+	}
+	t.Fatal("no log message containing ", str)
+	return 0
+}
+
+// Returns a connection for a stream, and the socket of the radio it sends to.
+func newTestStreamConn(t testing.TB) (conn, radio *net.UDPConn) {
+	radio, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = net.DialUDP("udp", nil, radio.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		radio.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		radio.Close()
+	})
+	return conn, radio
+}
+
+// Reads and demuxes a packet received by the radio.
+func readTestPkt(t testing.TB, radio *net.UDPConn) interface{} {
+	t.Helper()
+	if err := radio.SetReadDeadline(time.Now().Add(testWaitTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	n, err := radio.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := demuxPkt(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
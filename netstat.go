@@ -14,9 +14,16 @@ type netstatStruct struct {
 	lastGet        time.Time
 
 	lostPkts             int
+	lostGaps             int
 	lastLostReport       time.Time
 	retransmits          int
+	retransmitGaps       int
 	lastRetransmitReport time.Time
+
+	// Totals since the last reset, used for tuning the buffer lengths.
+	totalLostPkts             int
+	totalServedRetransmits    int
+	totalRequestedRetransmits int
 }
 
 var netstat netstatStruct
@@ -44,27 +51,57 @@ func (b *netstatStruct) add(toRadioBytes, fromRadioBytes int) {
 	}
 }
 
+// Call this function once for every gap of lost packets.
 func (b *netstatStruct) reportLoss(pkts int) {
 	netstatMutex.Lock()
 	defer netstatMutex.Unlock()
 
-	b.lastLostReport = time.Now()
+	b.lastLostReport = clock.now()
 	b.lostPkts += pkts
+	b.lostGaps++
+	b.totalLostPkts += pkts
+}
+
+// Has to be called with the mutex locked.
+func (b *netstatStruct) addRetransmit(pkts int) {
+	b.lastRetransmitReport = clock.now()
+	b.retransmits += pkts
+	b.retransmitGaps++
 }
 
+// Call this function once for every range of packets retransmitted to the radio.
 func (b *netstatStruct) reportRetransmit(pkts int) {
 	netstatMutex.Lock()
 	defer netstatMutex.Unlock()
 
-	b.lastRetransmitReport = time.Now()
-	b.retransmits += pkts
+	b.addRetransmit(pkts)
+	b.totalServedRetransmits += pkts
+}
+
+// Call this function once for every range of packets we request the radio to retransmit.
+func (b *netstatStruct) reportRetransmitRequest(pkts int) {
+	netstatMutex.Lock()
+	defer netstatMutex.Unlock()
+
+	b.addRetransmit(pkts)
+	b.totalRequestedRetransmits += pkts
+}
+
+// Returns the number of lost packets, and the number of packets retransmitted to the radio and requested
+// from the radio since the last reset.
+func (b *netstatStruct) getTotals() (lost, servedRetransmits, requestedRetransmits int) {
+	netstatMutex.Lock()
+	defer netstatMutex.Unlock()
+
+	return b.totalLostPkts, b.totalServedRetransmits, b.totalRequestedRetransmits
 }
 
-func (b *netstatStruct) get() (toRadioBytesPerSec, fromRadioBytesPerSec int, lost int, retransmits int) {
+func (b *netstatStruct) get() (toRadioBytesPerSec, fromRadioBytesPerSec int, lost, lostGaps int, retransmits,
+	retransmitGaps int) {
 	netstatMutex.Lock()
 	defer netstatMutex.Unlock()
 
-	secs := time.Since(b.lastGet).Seconds()
+	secs := clock.since(b.lastGet).Seconds()
 	toRadioBytesPerSec = int(float64(b.toRadioBytes) / secs)
 	fromRadioBytesPerSec = int(float64(b.fromRadioBytes) / secs)
 
@@ -72,20 +109,24 @@ func (b *netstatStruct) get() (toRadioBytesPerSec, fromRadioBytesPerSec int, los
 	b.toRadioPkts = 0
 	b.fromRadioBytes = 0
 	b.fromRadioPkts = 0
-	b.lastGet = time.Now()
+	b.lastGet = clock.now()
 
-	secs = time.Since(b.lastLostReport).Seconds()
+	secs = clock.since(b.lastLostReport).Seconds()
 	lost = b.lostPkts
+	lostGaps = b.lostGaps
 	if secs >= 60 {
 		b.lostPkts = 0
-		b.lastLostReport = time.Now()
+		b.lostGaps = 0
+		b.lastLostReport = clock.now()
 	}
 
-	secs = time.Since(b.lastRetransmitReport).Seconds()
+	secs = clock.since(b.lastRetransmitReport).Seconds()
 	retransmits = b.retransmits
+	retransmitGaps = b.retransmitGaps
 	if secs >= 60 {
 		b.retransmits = 0
-		b.lastRetransmitReport = time.Now()
+		b.retransmitGaps = 0
+		b.lastRetransmitReport = clock.now()
 	}
 
 	return
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNetstat(t *testing.T) {
+	c := useFakeClock(t)
+	netstat.reset()
+	defer netstat.reset()
+
+	netstat.get()
+	netstat.add(1000, 0)
+	netstat.add(0, 500)
+	netstat.reportLoss(3)
+	c.advance(2 * time.Second)
+
+	toRadio, fromRadio, lost, lostGaps, _, _ := netstat.get()
+	if toRadio != 500 || fromRadio != 250 {
+		t.Error("got ", toRadio, "/", fromRadio, " bytes/s, expected 500/250")
+	}
+	if lost != 3 || lostGaps != 1 {
+		t.Error("got ", lost, " lost packets in ", lostGaps, " gaps, expected 3 in 1")
+	}
+
+	// Loss counters are kept for a minute after the last loss.
+	c.advance(time.Minute)
+	if _, _, lost, _, _, _ = netstat.get(); lost != 3 {
+		t.Error("lost counter reset too early")
+	}
+	if _, _, lost, _, _, _ = netstat.get(); lost != 0 {
+		t.Error("lost counter not reset")
+	}
+}
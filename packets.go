@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Typed RS-BA1 packets. All packets start with a 16 byte header:
+//
+//	0-3:   packet length (little endian)
+//	4-5:   packet type (little endian)
+//	6-7:   sequence number (little endian)
+//	8-11:  sender session ID (big endian)
+//	12-15: receiver session ID (big endian)
+//
+// Note that the radio sometimes sends 0 as the packet length, so the length field is not checked when decoding.
+
+const pktHeaderLength = 16
+
+const (
+	pktTypeData              = 0x00 // Also used as idle packet if it has no payload.
+	pktTypeRetransmitRequest = 0x01
+	pktTypeAreYouThere       = 0x03
+	pktTypeIAmHere           = 0x04
+	pktTypeDisconnect        = 0x05
+	pktTypeAreYouReady       = 0x06
+	pktTypePing              = 0x07
+)
+
+const (
+	pktLoginLength            = 128
+	pktLoginReplyLength       = 96
+	pktAuthLength             = 64
+	pktStatusLength           = 80
+	pktCapabilitiesLength     = 168
+	pktConnInfoLength         = 144
+	pktPingLength             = 21
+	pktSerialDataHeaderLength = 21
+	pktSerialOpenCloseLength  = 22
+	pktAudioHeaderLength      = 24
+	pktAudioMinLength         = 580
+)
+
+const (
+	pktControlRequest = 0x01
+	pktControlReply   = 0x02
+)
+
+const (
+	pktSerialCmdOpenClose = 0xc0
+	pktSerialCmdData      = 0xc1
+	pktSerialMagicOpen    = 0x05
+	pktSerialMagicClose   = 0x00
+	pktAudioIdent         = 0x80
+)
+
+var errPktTooShort = errors.New("packet too short")
+
+func pktCheckLength(d []byte, l int) error {
+	if len(d) < l {
+		return fmt.Errorf("%w: got %d bytes, expected %d", errPktTooShort, len(d), l)
+	}
+	return nil
+}
+
+func pktPutString(b []byte, s string) {
+	copy(b[:len(b)-1], s) // Leaving space for the terminating zero.
+}
+
+type pktHeader struct {
+	typ    uint16
+	seq    uint16
+	sentID uint32
+	rcvdID uint32
+}
+
+func (h *pktHeader) put(b []byte) {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.LittleEndian.PutUint16(b[4:6], h.typ)
+	binary.LittleEndian.PutUint16(b[6:8], h.seq)
+	binary.BigEndian.PutUint32(b[8:12], h.sentID)
+	binary.BigEndian.PutUint32(b[12:16], h.rcvdID)
+}
+
+func (h *pktHeader) get(d []byte) error {
+	if err := pktCheckLength(d, pktHeaderLength); err != nil {
+		return err
+	}
+	h.typ = binary.LittleEndian.Uint16(d[4:6])
+	h.seq = binary.LittleEndian.Uint16(d[6:8])
+	h.sentID = binary.BigEndian.Uint32(d[8:12])
+	h.rcvdID = binary.BigEndian.Uint32(d[12:16])
+	return nil
+}
+
+func (h *pktHeader) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktHeaderLength)
+	h.put(b)
+	return b, nil
+}
+
+func (h *pktHeader) UnmarshalBinary(d []byte) error {
+	return h.get(d)
+}
+
+// Returns a header sent from the given stream.
+func newPktHeader(s *streamCommon, typ, seq uint16) pktHeader {
+	return pktHeader{typ: typ, seq: seq, sentID: s.localSID, rcvdID: s.remoteSID}
+}
+
+// A retransmit request for a single packet has the requested sequence number in the header. Requests for
+// ranges have a list of start and end sequence numbers after the header.
+type pktRetransmitRequest struct {
+	pktHeader
+	ranges []seqNumRange
+}
+
+func (p *pktRetransmitRequest) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktHeaderLength+len(p.ranges)*4)
+	h := p.pktHeader
+	h.typ = pktTypeRetransmitRequest
+	h.put(b)
+	for i, r := range p.ranges {
+		binary.LittleEndian.PutUint16(b[pktHeaderLength+i*4:], uint16(r[0]))
+		binary.LittleEndian.PutUint16(b[pktHeaderLength+i*4+2:], uint16(r[1]))
+	}
+	return b, nil
+}
+
+func (p *pktRetransmitRequest) UnmarshalBinary(d []byte) error {
+	if err := p.get(d); err != nil {
+		return err
+	}
+	p.ranges = nil
+	for r := d[pktHeaderLength:]; len(r) >= 4; r = r[4:] {
+		p.ranges = append(p.ranges, seqNumRange{seqNum(binary.LittleEndian.Uint16(r[0:2])),
+			seqNum(binary.LittleEndian.Uint16(r[2:4]))})
+	}
+	return nil
+}
+
+type pktPing struct {
+	pktHeader
+	reply bool
+	id    [4]byte
+}
+
+func (p *pktPing) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktPingLength)
+	h := p.pktHeader
+	h.typ = pktTypePing
+	h.put(b)
+	if p.reply {
+		b[16] = 0x01
+	}
+	copy(b[17:21], p.id[:])
+	return b, nil
+}
+
+func (p *pktPing) UnmarshalBinary(d []byte) error {
+	if err := pktCheckLength(d, pktPingLength); err != nil {
+		return err
+	}
+	if err := p.get(d); err != nil {
+		return err
+	}
+	p.reply = d[16] != 0x00
+	copy(p.id[:], d[17:21])
+	return nil
+}
+
+// Packets on the control stream have an inner header after the common header:
+//
+//	16-19: inner length (big endian)
+//	20:    request (1) or reply (2)
+//	21:    request type
+//	23-24: inner sequence number (little endian)
+//	26-31: auth ID
+type pktControlHeader struct {
+	pktHeader
+	reqReply byte
+	reqType  byte
+	innerSeq uint16
+	authID   [6]byte
+}
+
+func (h *pktControlHeader) put(b []byte) {
+	h.pktHeader.put(b)
+	binary.BigEndian.PutUint32(b[16:20], uint32(len(b)-pktHeaderLength))
+	b[20] = h.reqReply
+	b[21] = h.reqType
+	b[23] = byte(h.innerSeq)
+	b[24] = byte(h.innerSeq >> 8)
+	copy(b[26:32], h.authID[:])
+}
+
+func (h *pktControlHeader) get(d []byte, l int) error {
+	if err := pktCheckLength(d, l); err != nil {
+		return err
+	}
+	if err := h.pktHeader.get(d); err != nil {
+		return err
+	}
+	h.reqReply = d[20]
+	h.reqType = d[21]
+	h.innerSeq = uint16(d[23]) | uint16(d[24])<<8
+	copy(h.authID[:], d[26:32])
+	return nil
+}
+
+type pktLogin struct {
+	pktControlHeader
+	username [16]byte // Encoded with passcode().
+	password [16]byte
+	name     string
+}
+
+func (p *pktLogin) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktLoginLength)
+	p.put(b)
+	copy(b[64:80], p.username[:])
+	copy(b[80:96], p.password[:])
+	pktPutString(b[96:112], p.name)
+	return b, nil
+}
+
+func (p *pktLogin) UnmarshalBinary(d []byte) error {
+	if err := p.get(d, pktLoginLength); err != nil {
+		return err
+	}
+	copy(p.username[:], d[64:80])
+	copy(p.password[:], d[80:96])
+	p.name = parseNullTerminatedString(d[96:112])
+	return nil
+}
+
+type pktLoginReply struct {
+	pktControlHeader
+	errorCode  uint32
+	connection string
+}
+
+const pktLoginErrorInvalidCredentials = 0xfffffffe
+
+func (p *pktLoginReply) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktLoginReplyLength)
+	p.put(b)
+	binary.BigEndian.PutUint32(b[48:52], p.errorCode)
+	pktPutString(b[64:80], p.connection)
+	return b, nil
+}
+
+func (p *pktLoginReply) UnmarshalBinary(d []byte) error {
+	if err := p.get(d, pktLoginReplyLength); err != nil {
+		return err
+	}
+	p.errorCode = binary.BigEndian.Uint32(d[48:52])
+	p.connection = parseNullTerminatedString(d[64:80])
+	return nil
+}
+
+type pktAuth struct {
+	pktControlHeader
+}
+
+func (p *pktAuth) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktAuthLength)
+	p.put(b)
+	return b, nil
+}
+
+func (p *pktAuth) UnmarshalBinary(d []byte) error {
+	return p.get(d, pktAuthLength)
+}
+
+type pktStatus struct {
+	pktControlHeader
+	errorCode    uint32
+	disconnected bool
+}
+
+func (p *pktStatus) authFailed() bool {
+	return p.errorCode>>8 == 0xffffff
+}
+
+func (p *pktStatus) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktStatusLength)
+	p.put(b)
+	binary.BigEndian.PutUint32(b[48:52], p.errorCode)
+	if p.disconnected {
+		b[64] = 0x01
+	}
+	return b, nil
+}
+
+func (p *pktStatus) UnmarshalBinary(d []byte) error {
+	if err := p.get(d, pktStatusLength); err != nil {
+		return err
+	}
+	p.errorCode = binary.BigEndian.Uint32(d[48:52])
+	p.disconnected = p.errorCode>>8 == 0 && d[64] == 0x01
+	return nil
+}
+
+type pktCapabilities struct {
+	pktControlHeader
+	replyID    [16]byte
+	radioName  string
+	audioName  string
+	civAddress byte
+}
+
+func (p *pktCapabilities) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktCapabilitiesLength)
+	p.put(b)
+	copy(b[66:82], p.replyID[:])
+	pktPutString(b[82:114], p.radioName)
+	pktPutString(b[114:146], p.audioName)
+	b[148] = p.civAddress
+	return b, nil
+}
+
+func (p *pktCapabilities) UnmarshalBinary(d []byte) error {
+	if err := p.get(d, pktCapabilitiesLength); err != nil {
+		return err
+	}
+	copy(p.replyID[:], d[66:82])
+	p.radioName = parseNullTerminatedString(d[82:114])
+	p.audioName = parseNullTerminatedString(d[114:146])
+	p.civAddress = d[148]
+	return nil
+}
+
+// Sent by the PC to request the serial and audio streams.
+type pktConnInfo struct {
+	pktControlHeader
+	replyID      [16]byte // Got in the capabilities packet.
+	radioName    string
+	username     [16]byte // Encoded with passcode().
+	rxEnable     byte
+	txEnable     byte
+	rxCodec      byte
+	txCodec      byte
+	rxSampleRate uint32
+	txSampleRate uint32
+	serialPort   uint32
+	audioPort    uint32
+	txBufLenMs   uint32
+}
+
+func (p *pktConnInfo) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktConnInfoLength)
+	p.put(b)
+	copy(b[32:48], p.replyID[:])
+	pktPutString(b[64:96], p.radioName)
+	copy(b[96:112], p.username[:])
+	b[112] = p.rxEnable
+	b[113] = p.txEnable
+	b[114] = p.rxCodec
+	b[115] = p.txCodec
+	binary.BigEndian.PutUint32(b[116:120], p.rxSampleRate)
+	binary.BigEndian.PutUint32(b[120:124], p.txSampleRate)
+	binary.BigEndian.PutUint32(b[124:128], p.serialPort)
+	binary.BigEndian.PutUint32(b[128:132], p.audioPort)
+	binary.BigEndian.PutUint32(b[132:136], p.txBufLenMs)
+	b[136] = 0x01
+	return b, nil
+}
+
+func (p *pktConnInfo) UnmarshalBinary(d []byte) error {
+	if err := p.get(d, pktConnInfoLength); err != nil {
+		return err
+	}
+	copy(p.replyID[:], d[32:48])
+	p.radioName = parseNullTerminatedString(d[64:96])
+	copy(p.username[:], d[96:112])
+	p.rxEnable = d[112]
+	p.txEnable = d[113]
+	p.rxCodec = d[114]
+	p.txCodec = d[115]
+	p.rxSampleRate = binary.BigEndian.Uint32(d[116:120])
+	p.txSampleRate = binary.BigEndian.Uint32(d[120:124])
+	p.serialPort = binary.BigEndian.Uint32(d[124:128])
+	p.audioPort = binary.BigEndian.Uint32(d[128:132])
+	p.txBufLenMs = binary.BigEndian.Uint32(d[132:136])
+	return nil
+}
+
+// Sent by the radio as an answer to pktConnInfo.
+type pktConnInfoReply struct {
+	pktControlHeader
+	radioName string
+	opened    bool
+}
+
+func (p *pktConnInfoReply) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktConnInfoLength)
+	p.put(b)
+	pktPutString(b[64:96], p.radioName)
+	if p.opened {
+		b[96] = 0x01
+	}
+	return b, nil
+}
+
+func (p *pktConnInfoReply) UnmarshalBinary(d []byte) error {
+	if err := p.get(d, pktConnInfoLength); err != nil {
+		return err
+	}
+	p.radioName = parseNullTerminatedString(d[64:96])
+	p.opened = d[96] == 0x01
+	return nil
+}
+
+type pktSerialData struct {
+	pktHeader
+	sendSeq uint16
+	data    []byte
+}
+
+func (p *pktSerialData) MarshalBinary() ([]byte, error) {
+	if len(p.data) > 0xff-pktSerialDataHeaderLength {
+		return nil, errors.New("serial data too long")
+	}
+	b := make([]byte, pktSerialDataHeaderLength+len(p.data))
+	h := p.pktHeader
+	h.typ = pktTypeData
+	h.put(b)
+	b[16] = pktSerialCmdData
+	b[17] = byte(len(p.data))
+	binary.BigEndian.PutUint16(b[19:21], p.sendSeq)
+	copy(b[21:], p.data)
+	return b, nil
+}
+
+func (p *pktSerialData) UnmarshalBinary(d []byte) error {
+	if err := pktCheckLength(d, pktSerialDataHeaderLength+1); err != nil {
+		return err
+	}
+	if d[16] != pktSerialCmdData || int(d[17]) != len(d)-pktSerialDataHeaderLength {
+		return errors.New("not a serial data packet")
+	}
+	// The packet length is sent in one byte by the radio's software.
+	if len(d) > 0xff {
+		return errors.New("serial data too long")
+	}
+	if err := p.get(d); err != nil {
+		return err
+	}
+	p.sendSeq = binary.BigEndian.Uint16(d[19:21])
+	p.data = d[21:]
+	return nil
+}
+
+type pktSerialOpenClose struct {
+	pktHeader
+	sendSeq uint16
+	open    bool
+}
+
+func (p *pktSerialOpenClose) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktSerialOpenCloseLength)
+	h := p.pktHeader
+	h.typ = pktTypeData
+	h.put(b)
+	b[16] = pktSerialCmdOpenClose
+	b[17] = 0x01
+	binary.BigEndian.PutUint16(b[19:21], p.sendSeq)
+	if p.open {
+		b[21] = pktSerialMagicOpen
+	} else {
+		b[21] = pktSerialMagicClose
+	}
+	return b, nil
+}
+
+func (p *pktSerialOpenClose) UnmarshalBinary(d []byte) error {
+	if err := pktCheckLength(d, pktSerialOpenCloseLength); err != nil {
+		return err
+	}
+	if d[16] != pktSerialCmdOpenClose {
+		return errors.New("not a serial open/close packet")
+	}
+	if err := p.get(d); err != nil {
+		return err
+	}
+	p.sendSeq = binary.BigEndian.Uint16(d[19:21])
+	p.open = d[21] == pktSerialMagicOpen
+	return nil
+}
+
+type pktAudio struct {
+	pktHeader
+	ident   byte
+	sendSeq uint16
+	data    []byte
+}
+
+func (p *pktAudio) MarshalBinary() ([]byte, error) {
+	b := make([]byte, pktAudioHeaderLength+len(p.data))
+	h := p.pktHeader
+	h.typ = pktTypeData
+	h.put(b)
+	b[16] = p.ident
+	binary.BigEndian.PutUint16(b[18:20], p.sendSeq)
+	binary.BigEndian.PutUint16(b[22:24], uint16(len(p.data)))
+	copy(b[24:], p.data)
+	return b, nil
+}
+
+func (p *pktAudio) UnmarshalBinary(d []byte) error {
+	if err := pktCheckLength(d, pktAudioHeaderLength); err != nil {
+		return err
+	}
+	if err := p.get(d); err != nil {
+		return err
+	}
+	p.ident = d[16]
+	p.sendSeq = binary.BigEndian.Uint16(d[18:20])
+	p.data = d[24:]
+	return nil
+}
+
+// Returns the typed form of the given received packet: *pktHeader for packets without a payload (see
+// pktHeader.typ), *pktRetransmitRequest, *pktPing, or one of the data packets. The data packets are
+// recognized by their length and their first bytes, the same way the radio's software does it.
+func demuxPkt(d []byte) (interface{}, error) {
+	var h pktHeader
+	if err := h.get(d); err != nil {
+		return nil, err
+	}
+
+	var p interface {
+		UnmarshalBinary(d []byte) error
+	}
+	switch h.typ {
+	case pktTypeRetransmitRequest:
+		p = &pktRetransmitRequest{}
+	case pktTypePing:
+		p = &pktPing{}
+	case pktTypeData:
+		p = demuxDataPkt(d)
+	default:
+		if len(d) == pktHeaderLength {
+			return &h, nil
+		}
+	}
+	if p == nil {
+		return nil, fmt.Errorf("unknown packet type %.2x, length %d", h.typ, len(d))
+	}
+	if err := p.UnmarshalBinary(d); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func demuxDataPkt(d []byte) interface {
+	UnmarshalBinary(d []byte) error
+} {
+	if len(d) == pktHeaderLength {
+		return &pktHeader{}
+	}
+	if len(d) > pktSerialDataHeaderLength && d[16] == pktSerialCmdData && int(d[17]) == len(d)-pktSerialDataHeaderLength {
+		return &pktSerialData{}
+	}
+	if len(d) == pktSerialOpenCloseLength && d[16] == pktSerialCmdOpenClose {
+		return &pktSerialOpenClose{}
+	}
+	// The radio sends audio packets with 0x56c and 0x244 as their length. Audio packets of other lengths are
+	// recognized if their length field is correct.
+	if len(d) >= pktAudioMinLength && binary.LittleEndian.Uint16(d[2:4]) == 0 &&
+		(d[0] == 0x6c && d[1] == 0x05 || d[0] == 0x44 && d[1] == 0x02 ||
+			binary.LittleEndian.Uint32(d[0:4]) == uint32(len(d))) {
+		return &pktAudio{}
+	}
+
+	switch {
+	case len(d) == pktLoginLength && d[0] == pktLoginLength:
+		return &pktLogin{}
+	case len(d) == pktLoginReplyLength && d[0] == 0x60:
+		return &pktLoginReply{}
+	case len(d) == pktAuthLength && d[0] == pktAuthLength:
+		return &pktAuth{}
+	case len(d) == pktStatusLength && d[0] == pktStatusLength:
+		return &pktStatus{}
+	case len(d) == pktCapabilitiesLength && d[0] == pktCapabilitiesLength:
+		return &pktCapabilities{}
+	case len(d) == pktConnInfoLength && d[0] == pktConnInfoLength:
+		return &pktConnInfoReply{}
+	}
+	return nil
+}
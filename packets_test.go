@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"testing"
+)
+
+// Packets built the same way as the byte literals the senders used before the typed packets were added.
+// The session IDs are from the example packets in the comments of the stream code.
+const testLocalSID = 0xbed9f263
+const testRemoteSID = 0xe435dd72
+
+var testSIDBytes = []byte{0xbe, 0xd9, 0xf2, 0x63, 0xe4, 0x35, 0xdd, 0x72}
+
+var testUsername = [16]byte{0x3f, 0x25, 0x25, 0x47, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+var testPassword = [16]byte{0x3f, 0x25, 0x25, 0x47, 0x3f, 0x25, 0x25, 0x47, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+var testReplyID = [16]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+func testControlHeader(reqReply, reqType byte, innerSeq uint16, authID [6]byte) pktControlHeader {
+	return pktControlHeader{pktHeader: pktHeader{typ: pktTypeData, seq: 0x0d, sentID: testLocalSID, rcvdID: testRemoteSID},
+		reqReply: reqReply, reqType: reqType, innerSeq: innerSeq, authID: authID}
+}
+
+func testPktBytes(parts ...[]byte) (res []byte) {
+	for _, p := range parts {
+		res = append(res, p...)
+	}
+	return
+}
+
+var testGoldenPkts = []struct {
+	name string
+	pkt  encoding.BinaryMarshaler
+	d    []byte
+}{
+	{
+		name: "login",
+		pkt: &pktLogin{pktControlHeader: testControlHeader(pktControlRequest, 0x00, 0x0102, [6]byte{0xaa, 0xbb}),
+			username: testUsername, password: testPassword, name: "icom-pc"},
+		d: testPktBytes([]byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0x00, 0x00, 0x00, 0x70, 0x01, 0x00, 0x00, 0x02,
+				0x01, 0x00, 0xaa, 0xbb, 0x00, 0x00, 0x00, 0x00},
+			make([]byte, 32),
+			testUsername[:], testPassword[:],
+			[]byte{0x69, 0x63, 0x6f, 0x6d, 0x2d, 0x70, 0x63, 0x00}, // icom-pc in plain text
+			make([]byte, 24)),
+	},
+	{
+		name: "auth",
+		pkt: &pktAuth{pktControlHeader: testControlHeader(pktControlRequest, 0x05, 0x0002,
+			[6]byte{0x00, 0x00, 0x5d, 0x37, 0x12, 0x82})},
+		d: testPktBytes([]byte{0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0x00, 0x00, 0x00, 0x30, 0x01, 0x05, 0x00, 0x02,
+				0x00, 0x00, 0x00, 0x00, 0x5d, 0x37, 0x12, 0x82},
+			make([]byte, 32)),
+	},
+	{
+		name: "conninfo",
+		pkt: &pktConnInfo{pktControlHeader: testControlHeader(pktControlRequest, 0x03, 0x0003,
+			[6]byte{0x00, 0x00, 0x5d, 0x37, 0x12, 0x82}),
+			replyID: testReplyID, radioName: "IC-705", username: testUsername,
+			rxEnable: 0x01, txEnable: 0x01, rxCodec: 0x04, txCodec: 0x04,
+			rxSampleRate: 48000, txSampleRate: 48000, serialPort: 50002, audioPort: 50003, txBufLenMs: 300},
+		d: testPktBytes([]byte{0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0x00, 0x00, 0x00, 0x80, 0x01, 0x03, 0x00, 0x03,
+				0x00, 0x00, 0x00, 0x00, 0x5d, 0x37, 0x12, 0x82},
+			testReplyID[:],
+			make([]byte, 16),
+			[]byte{0x49, 0x43, 0x2d, 0x37, 0x30, 0x35, 0x00, 0x00}, // IC-705 in plain text
+			make([]byte, 24),
+			testUsername[:],
+			[]byte{0x01, 0x01, 0x04, 0x04, 0x00, 0x00, 0xbb, 0x80,
+				0x00, 0x00, 0xbb, 0x80,
+				0x00, 0x00, 0xc3, 0x52,
+				0x00, 0x00, 0xc3, 0x53, 0x00, 0x00,
+				0x01, 0x2c, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}),
+	},
+	{
+		name: "serial data",
+		pkt: &pktSerialData{pktHeader: pktHeader{seq: 0x0d, sentID: testLocalSID, rcvdID: testRemoteSID},
+			sendSeq: 0x0102, data: []byte{0xfe, 0xfe, 0xa4, 0xe0, 0x03, 0xfd}},
+		d: testPktBytes([]byte{0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0xc1, 0x06, 0x00, 0x01, 0x02},
+			[]byte{0xfe, 0xfe, 0xa4, 0xe0, 0x03, 0xfd}),
+	},
+	{
+		name: "serial open",
+		pkt: &pktSerialOpenClose{pktHeader: pktHeader{seq: 0x0d, sentID: testLocalSID, rcvdID: testRemoteSID},
+			sendSeq: 0x0102, open: true},
+		d: testPktBytes([]byte{0x16, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0xc0, 0x01, 0x00, 0x01, 0x02, 0x05}),
+	},
+	{
+		name: "serial close",
+		pkt: &pktSerialOpenClose{pktHeader: pktHeader{seq: 0x0d, sentID: testLocalSID, rcvdID: testRemoteSID},
+			sendSeq: 0x0102},
+		d: testPktBytes([]byte{0x16, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0xc0, 0x01, 0x00, 0x01, 0x02, 0x00}),
+	},
+	{
+		name: "audio part 1",
+		pkt: &pktAudio{pktHeader: pktHeader{seq: 0x0d, sentID: testLocalSID, rcvdID: testRemoteSID},
+			ident: pktAudioIdent, sendSeq: 0x0102, data: bytes.Repeat([]byte{0x12, 0x34}, 1364/2)},
+		d: testPktBytes([]byte{0x6c, 0x05, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0x80, 0x00, 0x01, 0x02, 0x00, 0x00, 0x05, 0x54},
+			bytes.Repeat([]byte{0x12, 0x34}, 1364/2)),
+	},
+	{
+		name: "audio part 2",
+		pkt: &pktAudio{pktHeader: pktHeader{seq: 0x0d, sentID: testLocalSID, rcvdID: testRemoteSID},
+			ident: pktAudioIdent, sendSeq: 0x0102, data: bytes.Repeat([]byte{0x12, 0x34}, 556/2)},
+		d: testPktBytes([]byte{0x44, 0x02, 0x00, 0x00, 0x00, 0x00, 0x0d, 0x00}, testSIDBytes,
+			[]byte{0x80, 0x00, 0x01, 0x02, 0x00, 0x00, 0x02, 0x2c},
+			bytes.Repeat([]byte{0x12, 0x34}, 556/2)),
+	},
+	{
+		// Example request from PC:  0x15, 0x00, 0x00, 0x00, 0x07, 0x00, 0x09, 0x00, 0xbe, 0xd9, 0xf2, 0x63, 0xe4, 0x35, 0xdd, 0x72, 0x00, 0x78, 0x40, 0xf6, 0x02
+		name: "ping request",
+		pkt: &pktPing{pktHeader: pktHeader{typ: pktTypePing, seq: 0x09, sentID: testLocalSID, rcvdID: testRemoteSID},
+			id: [4]byte{0x78, 0x40, 0xf6, 0x02}},
+		d: []byte{0x15, 0x00, 0x00, 0x00, 0x07, 0x00, 0x09, 0x00, 0xbe, 0xd9, 0xf2, 0x63, 0xe4, 0x35, 0xdd, 0x72, 0x00,
+			0x78, 0x40, 0xf6, 0x02},
+	},
+	{
+		// Example answer from PC: 0x15, 0x00, 0x00, 0x00, 0x07, 0x00, 0x1c, 0x0e, 0xbe, 0xd9, 0xf2, 0x63, 0xe4, 0x35, 0xdd, 0x72, 0x01, 0x57, 0x2b, 0x12, 0x00
+		name: "ping reply",
+		pkt: &pktPing{pktHeader: pktHeader{typ: pktTypePing, seq: 0x0e1c, sentID: testLocalSID, rcvdID: testRemoteSID},
+			reply: true, id: [4]byte{0x57, 0x2b, 0x12, 0x00}},
+		d: []byte{0x15, 0x00, 0x00, 0x00, 0x07, 0x00, 0x1c, 0x0e, 0xbe, 0xd9, 0xf2, 0x63, 0xe4, 0x35, 0xdd, 0x72, 0x01,
+			0x57, 0x2b, 0x12, 0x00},
+	},
+	{
+		name: "retransmit request",
+		pkt:  &pktRetransmitRequest{pktHeader: pktHeader{typ: pktTypeRetransmitRequest, seq: 0x0102, sentID: testLocalSID, rcvdID: testRemoteSID}},
+		d:    testPktBytes([]byte{0x10, 0x00, 0x00, 0x00, 0x01, 0x00, 0x02, 0x01}, testSIDBytes),
+	},
+	{
+		name: "pkt3",
+		pkt:  &pktHeader{typ: pktTypeAreYouThere, sentID: testLocalSID, rcvdID: testRemoteSID},
+		d:    testPktBytes([]byte{0x10, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00}, testSIDBytes),
+	},
+}
+
+func TestPktGolden(t *testing.T) {
+	for _, tt := range testGoldenPkts {
+		d, err := tt.pkt.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: marshal error %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(d, tt.d) {
+			t.Errorf("%s: marshaled to\n% x\nwant\n% x", tt.name, d, tt.d)
+		}
+
+		p, err := demuxPkt(tt.d)
+		if err != nil {
+			t.Errorf("%s: demux error %v", tt.name, err)
+			continue
+		}
+		// The request and the reply of the connection info have the same length, demuxPkt() returns the reply.
+		if _, ok := tt.pkt.(*pktConnInfo); ok {
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.pkt) {
+			t.Errorf("%s: demuxed to %+v, want %+v", tt.name, p, tt.pkt)
+		}
+	}
+}
+
+type testPkt interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// Returns a new, empty packet of the same type.
+func newTestPktOfType(p interface{}) testPkt {
+	return reflect.New(reflect.TypeOf(p).Elem()).Interface().(testPkt)
+}
+
+func TestPktRoundTrip(t *testing.T) {
+	authID := [6]byte{0x00, 0x00, 0x5d, 0x37, 0x12, 0x82}
+	h := pktHeader{typ: pktTypeData, seq: 0xfffe, sentID: testLocalSID, rcvdID: testRemoteSID}
+	pkts := []testPkt{
+		&pktHeader{typ: pktTypeDisconnect, seq: 1, sentID: testLocalSID, rcvdID: testRemoteSID},
+		&pktHeader{typ: pktTypeData, seq: 0xffff, sentID: testLocalSID, rcvdID: testRemoteSID},
+		&pktRetransmitRequest{pktHeader: pktHeader{typ: pktTypeRetransmitRequest, seq: 5}},
+		&pktRetransmitRequest{pktHeader: pktHeader{typ: pktTypeRetransmitRequest}, ranges: []seqNumRange{{1, 3}}},
+		&pktRetransmitRequest{pktHeader: pktHeader{typ: pktTypeRetransmitRequest},
+			ranges: []seqNumRange{{0xfffe, 1}, {10, 12}, {20, 20}}},
+		&pktPing{pktHeader: pktHeader{typ: pktTypePing, seq: 3}, id: [4]byte{1, 2, 3, 4}},
+		&pktPing{pktHeader: pktHeader{typ: pktTypePing, seq: 3}, reply: true, id: [4]byte{1, 2, 3, 4}},
+		&pktLogin{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlRequest, innerSeq: 0x1234,
+			authID: authID}, username: testUsername, password: testPassword, name: "icom-pc"},
+		&pktLoginReply{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlReply, authID: authID},
+			errorCode: pktLoginErrorInvalidCredentials, connection: "FTTH"},
+		&pktAuth{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlReply, reqType: 0x05,
+			innerSeq: 2, authID: authID}},
+		&pktStatus{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlReply, authID: authID},
+			errorCode: 0xffffffff},
+		&pktStatus{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlReply, authID: authID},
+			disconnected: true},
+		&pktCapabilities{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlReply, authID: authID},
+			replyID: testReplyID, radioName: "IC-705", audioName: "IC-705 Audio", civAddress: 0xa4},
+		&pktConnInfo{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlRequest, reqType: 0x03,
+			authID: authID}, replyID: testReplyID, radioName: "IC-705", username: testUsername, rxEnable: 1,
+			txEnable: 1, rxCodec: 4, txCodec: 4, rxSampleRate: 48000, txSampleRate: 48000, serialPort: 50002,
+			audioPort: 50003, txBufLenMs: 500},
+		&pktConnInfoReply{pktControlHeader: pktControlHeader{pktHeader: h, reqReply: pktControlReply, authID: authID},
+			radioName: "IC-705", opened: true},
+		&pktSerialData{pktHeader: h, sendSeq: 0xffff, data: []byte{0xfe, 0xfe, 0xe0, 0xa4, 0xfb, 0xfd}},
+		&pktSerialData{pktHeader: h, data: bytes.Repeat([]byte{0xfe}, 0xff-pktSerialDataHeaderLength)},
+		&pktSerialOpenClose{pktHeader: h, sendSeq: 7, open: true},
+		&pktSerialOpenClose{pktHeader: h, sendSeq: 8},
+		&pktAudio{pktHeader: h, ident: pktAudioIdent, sendSeq: 0xffff, data: make([]byte, 556)},
+	}
+	for _, p := range pkts {
+		d, err := p.MarshalBinary()
+		if err != nil {
+			t.Errorf("%T: marshal error %v", p, err)
+			continue
+		}
+		res := newTestPktOfType(p)
+		if err := res.UnmarshalBinary(d); err != nil {
+			t.Errorf("%T: unmarshal error %v", p, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, p) {
+			t.Errorf("%T: round trip got %+v, want %+v", p, res, p)
+		}
+
+		// Too short packets are rejected.
+		if len(d) > pktHeaderLength {
+			if err := newTestPktOfType(p).UnmarshalBinary(d[:pktHeaderLength-1]); err == nil {
+				t.Errorf("%T: no error for a too short packet", p)
+			}
+		}
+	}
+
+	if _, err := (&pktSerialData{data: make([]byte, 0xff-pktSerialDataHeaderLength+1)}).MarshalBinary(); err == nil {
+		t.Error("no error for too long serial data")
+	}
+}
+
+func TestDemuxPkt(t *testing.T) {
+	// Packets without a payload are returned as headers.
+	for _, typ := range []uint16{pktTypeData, pktTypeAreYouThere, pktTypeIAmHere, pktTypeDisconnect,
+		pktTypeAreYouReady} {
+		d, _ := (&pktHeader{typ: typ, seq: 1}).MarshalBinary()
+		p, err := demuxPkt(d)
+		if err != nil {
+			t.Errorf("type %d: demux error %v", typ, err)
+			continue
+		}
+		if h, ok := p.(*pktHeader); !ok || h.typ != typ || h.seq != 1 {
+			t.Errorf("type %d: demuxed to %+v", typ, p)
+		}
+	}
+
+	// The radio sometimes sends 0 as the length of ping packets.
+	d := []byte{0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x1c, 0x0e, 0xe4, 0x35, 0xdd, 0x72, 0xbe, 0xd9, 0xf2, 0x63, 0x00,
+		0x57, 0x2b, 0x12, 0x00}
+	if p, err := demuxPkt(d); err != nil {
+		t.Error(err)
+	} else if ping, ok := p.(*pktPing); !ok || ping.reply || ping.seq != 0x0e1c {
+		t.Errorf("ping demuxed to %+v", p)
+	}
+
+	for _, d := range [][]byte{
+		nil,
+		{0x10, 0x00, 0x00},
+		{0x10, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}, // Too short ping.
+		{0x11, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0x11, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0}, // Unknown data packet.
+		// Serial data which is too long to be marshaled.
+		testPktBytes([]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, testSIDBytes,
+			[]byte{0xc1, 0xeb, 0x00, 0x00, 0x00}, make([]byte, 0xeb)),
+	} {
+		if p, err := demuxPkt(d); err == nil {
+			t.Errorf("% x: demuxed to %+v, expected an error", d, p)
+		}
+	}
+}
+
+// Any input is demuxed without a panic. The fields of a demuxed packet survive re-encoding: the re-encoded
+// bytes unmarshal to the same packet, and re-encoding is stable. Bytes which are not part of any field (like
+// the length field, which the radio sometimes sends as 0) are not kept, so the re-encoded bytes only equal the
+// input for packets in their canonical form, which is checked for the golden packets.
+func FuzzDemuxPkt(f *testing.F) {
+	for _, tt := range testGoldenPkts {
+		f.Add(tt.d)
+	}
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x1c, 0x0e, 0xe4, 0x35, 0xdd, 0x72, 0xbe, 0xd9, 0xf2, 0x63, 0x00,
+		0x57, 0x2b, 0x12, 0x00})
+	f.Add(testPktBytes([]byte{0x18, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}, testSIDBytes,
+		[]byte{0x01, 0x00, 0x03, 0x00, 0xfe, 0xff, 0x01, 0x00}))
+
+	f.Fuzz(func(t *testing.T, d []byte) {
+		p, err := demuxPkt(d)
+		if err != nil {
+			return
+		}
+		m, ok := p.(testPkt)
+		if !ok {
+			t.Fatalf("demuxed to %T which can't be marshaled", p)
+		}
+		d2, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T: marshal error %v", p, err)
+		}
+
+		p2 := newTestPktOfType(p)
+		if err := p2.UnmarshalBinary(d2); err != nil {
+			t.Fatalf("%T: unmarshal error %v", p, err)
+		}
+		if !reflect.DeepEqual(p2, p) {
+			t.Fatalf("%T: got %+v after re-encoding, want %+v", p, p2, p)
+		}
+		d3, _ := p2.MarshalBinary()
+		if !bytes.Equal(d3, d2) {
+			t.Fatalf("%T: re-encoding is not stable:\n% x\n% x", p, d2, d3)
+		}
+
+		// The canonical form of the packet is demuxed to the same packet type.
+		if p3, err := demuxPkt(d2); err != nil {
+			t.Fatalf("%T: can't demux re-encoded packet: %v", p, err)
+		} else if reflect.TypeOf(p3) != reflect.TypeOf(p) {
+			if _, ok := p.(*pktConnInfo); !ok {
+				t.Fatalf("%T: re-encoded packet demuxed to %T", p, p3)
+			}
+		}
+	})
+}
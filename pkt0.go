@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"sync"
 	"time"
 )
@@ -12,10 +10,11 @@ const pkt0IdleAfter = time.Second
 const pkt0IdleSendInterval = time.Second
 
 type pkt0Type struct {
-	sendSeq uint16
-	mutex   sync.Mutex // Protects sendSeq
+	sendSeq                 uint16
+	lastRetransmitRequestAt time.Time
+	mutex                   sync.Mutex // Protects sendSeq and lastRetransmitRequestAt
 
-	sendTimer         *time.Timer
+	sendTimer         clockTimer
 	lastTrackedSentAt time.Time
 
 	txSeqBuf txSeqBufStruct
@@ -27,8 +26,8 @@ type pkt0Type struct {
 
 func (p *pkt0Type) retransmitRange(s *streamCommon, start, end uint16) error {
 	log.Debug(s.name+"/got retransmit request for #", start, "-", end)
+	netstat.reportRetransmit(int(end-start) + 1)
 	for {
-		netstat.reportRetransmit(1)
 		d := p.txSeqBuf.get(seqNum(start))
 		if d != nil {
 			log.Debug(s.name+"/retransmitting #", start)
@@ -58,13 +57,13 @@ func (p *pkt0Type) retransmitRange(s *streamCommon, start, end uint16) error {
 	return nil
 }
 
-func (p *pkt0Type) handle(s *streamCommon, r []byte) error {
-	if len(r) < 16 {
-		return nil
-	}
+func (p *pkt0Type) handle(s *streamCommon, r *pktRetransmitRequest) error {
+	p.mutex.Lock()
+	p.lastRetransmitRequestAt = clock.now()
+	p.mutex.Unlock()
 
-	if bytes.Equal(r[:6], []byte{0x10, 0x00, 0x00, 0x00, 0x01, 0x00}) {
-		seq := binary.LittleEndian.Uint16(r[6:8])
+	if len(r.ranges) == 0 {
+		seq := r.seq
 		d := p.txSeqBuf.get(seqNum(seq))
 		log.Debug(s.name+"/got retransmit request for #", seq)
 		if d != nil {
@@ -87,28 +86,27 @@ func (p *pkt0Type) handle(s *streamCommon, r []byte) error {
 				return err
 			}
 		}
-	} else if bytes.Equal(r[:6], []byte{0x18, 0x00, 0x00, 0x00, 0x01, 0x00}) {
-		r = r[16:]
-		for len(r) >= 4 {
-			start := binary.LittleEndian.Uint16(r[0:2])
-			end := binary.LittleEndian.Uint16(r[2:4])
-			if err := p.retransmitRange(s, start, end); err != nil {
-				return err
-			}
-			r = r[4:]
+		return nil
+	}
+
+	for _, rr := range r.ranges {
+		if err := p.retransmitRange(s, uint16(rr[0]), uint16(rr[1])); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (p *pkt0Type) isIdlePkt0(r []byte) bool {
-	return len(r) == 16 && bytes.Equal(r[:6], []byte{0x10, 0x00, 0x00, 0x00, 0x00, 0x00})
+// Returns the time of the last retransmit request got from the radio.
+func (p *pkt0Type) getLastRetransmitRequestAt() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.lastRetransmitRequestAt
 }
 
-func (p *pkt0Type) isPkt0(r []byte) bool {
-	return len(r) >= 16 && (p.isIdlePkt0(r) ||
-		bytes.Equal(r[:6], []byte{0x10, 0x00, 0x00, 0x00, 0x01, 0x00}) || // Retransmit request for 1 packet.
-		bytes.Equal(r[:6], []byte{0x18, 0x00, 0x00, 0x00, 0x01, 0x00})) // Retransmit request for ranges.
+func (p *pkt0Type) isIdlePkt0(r []byte) bool {
+	var h pktHeader
+	return len(r) == pktHeaderLength && h.UnmarshalBinary(r) == nil && h.typ == pktTypeData
 }
 
 //var drop int
@@ -143,7 +141,7 @@ func (p *pkt0Type) sendTrackedPacket(s *streamCommon, d []byte) error {
 	p.sendSeq++
 
 	if !p.isIdlePkt0(d) {
-		p.lastTrackedSentAt = time.Now()
+		p.lastTrackedSentAt = clock.now()
 		if p.periodicIntervalResetChan != nil {
 			// Non-blocking send.
 			select {
@@ -157,9 +155,8 @@ func (p *pkt0Type) sendTrackedPacket(s *streamCommon, d []byte) error {
 }
 
 func (p *pkt0Type) sendIdle(s *streamCommon, tracked bool, seqIfUntracked uint16) error {
-	d := []byte{0x10, 0x00, 0x00, 0x00, 0x00, 0x00, byte(seqIfUntracked), byte(seqIfUntracked >> 8),
-		byte(s.localSID >> 24), byte(s.localSID >> 16), byte(s.localSID >> 8), byte(s.localSID),
-		byte(s.remoteSID >> 24), byte(s.remoteSID >> 16), byte(s.remoteSID >> 8), byte(s.remoteSID)}
+	h := newPktHeader(s, pktTypeData, seqIfUntracked)
+	d, _ := h.MarshalBinary()
 	if tracked {
 		return p.sendTrackedPacket(s, d)
 	}
@@ -170,22 +167,22 @@ func (p *pkt0Type) loop(s *streamCommon) {
 	for {
 		select {
 		case <-p.periodicIntervalResetChan:
-			if !p.sendTimer.Stop() {
-				<-p.sendTimer.C
+			if !p.sendTimer.stop() {
+				<-p.sendTimer.c()
 			}
-			p.sendTimer.Reset(pkt0DefaultSendInterval)
-		case <-p.sendTimer.C:
+			p.sendTimer.reset(pkt0DefaultSendInterval)
+		case <-p.sendTimer.c():
 			if err := p.sendIdle(s, true, 0); err != nil {
-				reportError(err)
+				s.reportError(err)
 			}
 
-			if time.Since(p.lastTrackedSentAt) >= pkt0IdleAfter {
-				p.sendTimer.Reset(pkt0IdleSendInterval)
+			if clock.since(p.lastTrackedSentAt) >= pkt0IdleAfter {
+				p.sendTimer.reset(pkt0IdleSendInterval)
 			} else {
-				p.sendTimer.Reset(pkt0DefaultSendInterval)
+				p.sendTimer.reset(pkt0DefaultSendInterval)
 			}
 		case <-p.periodicStopNeededChan:
-			p.sendTimer.Stop()
+			p.sendTimer.stop()
 			p.periodicStopFinishedChan <- true
 			return
 		}
@@ -193,7 +190,7 @@ func (p *pkt0Type) loop(s *streamCommon) {
 }
 
 func (p *pkt0Type) startPeriodicSend(s *streamCommon) {
-	p.sendTimer = time.NewTimer(pkt0IdleSendInterval)
+	p.sendTimer = clock.newTimer(pkt0IdleSendInterval)
 
 	p.periodicIntervalResetChan = make(chan bool)
 	p.periodicStopNeededChan = make(chan bool)
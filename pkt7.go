@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
-	"encoding/binary"
-	"errors"
+	"fmt"
 	"time"
 )
 
@@ -18,8 +16,8 @@ type pkt7Type struct {
 	innerSendSeq uint16
 	// lastConfirmedSeq uint16
 
-	sendTicker   *time.Ticker
-	timeoutTimer *time.Timer
+	sendTicker   clockTicker
+	timeoutTimer clockTimer
 	latency      time.Duration
 	lastSendAt   time.Time
 
@@ -29,31 +27,26 @@ type pkt7Type struct {
 
 var controlStreamLatency time.Duration
 
-func (p *pkt7Type) isPkt7(r []byte) bool {
-	return len(r) == 21 && bytes.Equal(r[1:6], []byte{0x00, 0x00, 0x00, 0x07, 0x00}) // Note that the first byte can be 0x15 or 0x00, so we ignore that.
-}
-
-func (p *pkt7Type) handle(s *streamCommon, r []byte) error {
-	gotSeq := binary.LittleEndian.Uint16(r[6:8])
-	if r[16] == 0x00 { // This is a pkt7 request from the radio.
+func (p *pkt7Type) handle(s *streamCommon, r *pktPing) error {
+	if !r.reply { // This is a pkt7 request from the radio.
 		// Replying to the radio.
 		// Example request from radio: 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x1c, 0x0e, 0xe4, 0x35, 0xdd, 0x72, 0xbe, 0xd9, 0xf2, 0x63, 0x00, 0x57, 0x2b, 0x12, 0x00
 		// Example answer from PC:     0x15, 0x00, 0x00, 0x00, 0x07, 0x00, 0x1c, 0x0e, 0xbe, 0xd9, 0xf2, 0x63, 0xe4, 0x35, 0xdd, 0x72, 0x01, 0x57, 0x2b, 0x12, 0x00
 		if p.sendTicker != nil { // Only replying if the auth is already done.
-			if err := p.sendReply(s, r[17:21], gotSeq); err != nil {
+			if err := p.sendReply(s, r.id, r.seq); err != nil {
 				return err
 			}
 		}
 	} else { // This is a pkt7 reply to our request.
 		if p.sendTicker != nil { // Auth is already done?
 			if p.timeoutTimer != nil {
-				p.timeoutTimer.Stop()
-				p.timeoutTimer.Reset(pkt7TimeoutDuration)
+				p.timeoutTimer.stop()
+				p.timeoutTimer.reset(pkt7TimeoutDuration)
 			}
 
 			if s.name == "control" { // Only measure latency on the control stream.
 				// Only measure latency after the timeout has been initialized, so the auth is already done.
-				p.latency += time.Since(p.lastSendAt)
+				p.latency += clock.since(p.lastSendAt)
 				p.latency /= 2
 				statusLog.reportRTTLatency(p.latency)
 
@@ -76,12 +69,10 @@ func (p *pkt7Type) handle(s *streamCommon, r []byte) error {
 	return nil
 }
 
-func (p *pkt7Type) sendDo(s *streamCommon, replyID []byte, seq uint16) error {
+func (p *pkt7Type) sendDo(s *streamCommon, reply bool, replyID [4]byte, seq uint16) error {
 	// Example request from PC:  0x15, 0x00, 0x00, 0x00, 0x07, 0x00, 0x09, 0x00, 0xbe, 0xd9, 0xf2, 0x63, 0xe4, 0x35, 0xdd, 0x72, 0x00, 0x78, 0x40, 0xf6, 0x02
 	// Example reply from radio: 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x09, 0x00, 0xe4, 0x35, 0xdd, 0x72, 0xbe, 0xd9, 0xf2, 0x63, 0x01, 0x78, 0x40, 0xf6, 0x02
-	var replyFlag byte
-	if replyID == nil {
-		replyID = make([]byte, 4)
+	if !reply {
 		var randID [1]byte
 		if _, err := rand.Read(randID[:]); err != nil {
 			return err
@@ -91,43 +82,39 @@ func (p *pkt7Type) sendDo(s *streamCommon, replyID []byte, seq uint16) error {
 		replyID[2] = byte(p.innerSendSeq >> 8)
 		replyID[3] = 0x06
 		p.innerSendSeq++
-	} else {
-		replyFlag = 0x01
 	}
 
-	d := []byte{0x15, 0x00, 0x00, 0x00, 0x07, 0x00, byte(seq), byte(seq >> 8),
-		byte(s.localSID >> 24), byte(s.localSID >> 16), byte(s.localSID >> 8), byte(s.localSID),
-		byte(s.remoteSID >> 24), byte(s.remoteSID >> 16), byte(s.remoteSID >> 8), byte(s.remoteSID),
-		replyFlag, replyID[0], replyID[1], replyID[2], replyID[3]}
-	if err := s.send(d); err != nil {
+	pkt := pktPing{pktHeader: newPktHeader(s, pktTypePing, seq), reply: reply, id: replyID}
+	d, err := pkt.MarshalBinary()
+	if err != nil {
 		return err
 	}
-	return nil
+	return s.send(d)
 }
 
 func (p *pkt7Type) send(s *streamCommon) error {
-	if err := p.sendDo(s, nil, p.sendSeq); err != nil {
+	if err := p.sendDo(s, false, [4]byte{}, p.sendSeq); err != nil {
 		return err
 	}
-	p.lastSendAt = time.Now()
+	p.lastSendAt = clock.now()
 	p.sendSeq++
 	return nil
 }
 
-func (p *pkt7Type) sendReply(s *streamCommon, replyID []byte, seq uint16) error {
-	return p.sendDo(s, replyID, seq)
+func (p *pkt7Type) sendReply(s *streamCommon, replyID [4]byte, seq uint16) error {
+	return p.sendDo(s, true, replyID, seq)
 }
 
 func (p *pkt7Type) loop(s *streamCommon) {
 	for {
 		if p.timeoutTimer != nil {
 			select {
-			case <-p.timeoutTimer.C:
-				reportError(errors.New(s.name + "/ping timeout"))
+			case <-p.timeoutTimer.c():
+				s.reportError(fmt.Errorf("%s/%w", s.name, errPingTimeout))
 
-			case <-p.sendTicker.C:
+			case <-p.sendTicker.c():
 				if err := p.send(s); err != nil {
-					reportError(err)
+					s.reportError(err)
 				}
 			case <-p.periodicStopNeededChan:
 				p.periodicStopFinishedChan <- true
@@ -135,9 +122,9 @@ func (p *pkt7Type) loop(s *streamCommon) {
 			}
 		} else {
 			select {
-			case <-p.sendTicker.C:
+			case <-p.sendTicker.c():
 				if err := p.send(s); err != nil {
-					reportError(err)
+					s.reportError(err)
 				}
 			case <-p.periodicStopNeededChan:
 				p.periodicStopFinishedChan <- true
@@ -152,9 +139,9 @@ func (p *pkt7Type) startPeriodicSend(s *streamCommon, firstSeqNo uint16, checkPi
 	p.innerSendSeq = 0x8304
 	// p.lastConfirmedSeq = p.sendSeq - 1
 
-	p.sendTicker = time.NewTicker(pkt7SendInterval)
+	p.sendTicker = clock.newTicker(pkt7SendInterval)
 	if checkPingTimeout {
-		p.timeoutTimer = time.NewTimer(pkt7TimeoutDuration)
+		p.timeoutTimer = clock.newTimer(pkt7TimeoutDuration)
 	}
 
 	p.periodicStopNeededChan = make(chan bool)
@@ -171,7 +158,7 @@ func (p *pkt7Type) stopPeriodicSend() {
 	<-p.periodicStopFinishedChan
 
 	if p.timeoutTimer != nil {
-		p.timeoutTimer.Stop()
+		p.timeoutTimer.stop()
 	}
-	p.sendTicker.Stop()
+	p.sendTicker.stop()
 }
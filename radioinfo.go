@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/xml"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The default UDP port of N1MM+ RadioInfo broadcasts.
+const radioInfoDefaultPort = "12060"
+
+// N1MM+ RadioInfo packet, accepted by loggers like N1MM+, DXLog and Log4OM. Frequencies are in 10 Hz units.
+type radioInfoMsg struct {
+	XMLName        xml.Name `xml:"RadioInfo"`
+	App            string   `xml:"app"`
+	StationName    string   `xml:"StationName"`
+	RadioNr        int      `xml:"RadioNr"`
+	Freq           uint     `xml:"Freq"`
+	TXFreq         uint     `xml:"TXFreq"`
+	Mode           string   `xml:"Mode"`
+	IsRunning      string   `xml:"IsRunning"`
+	FocusRadioNr   int      `xml:"FocusRadioNr"`
+	IsStereo       string   `xml:"IsStereo"`
+	IsSplit        string   `xml:"IsSplit"`
+	ActiveRadioNr  int      `xml:"ActiveRadioNr"`
+	IsTransmitting string   `xml:"IsTransmitting"`
+	RadioName      string   `xml:"RadioName"`
+	IsConnected    string   `xml:"IsConnected"`
+}
+
+type radioInfoStruct struct {
+	mutex   sync.Mutex
+	freq    uint
+	subFreq uint
+	mode    string
+	split   bool
+	ptt     bool
+
+	stationName string
+	conn        net.Conn
+
+	// Signals the send loop that the state has changed.
+	changedChan chan bool
+
+	deinitNeededChan   chan bool
+	deinitFinishedChan chan bool
+}
+
+var radioInfo radioInfoStruct
+
+func radioInfoBool(b bool) string {
+	if b {
+		return "True"
+	}
+	return "False"
+}
+
+// Mutex must be held.
+func (s *radioInfoStruct) notify() {
+	if s.changedChan == nil {
+		return
+	}
+	// Non-blocking notify.
+	select {
+	case s.changedChan <- true:
+	default:
+	}
+}
+
+// The report functions can be called with the civcontrol state mutex held.
+func (s *radioInfoStruct) reportFrequency(freq uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if freq != s.freq {
+		s.freq = freq
+		s.notify()
+	}
+}
+
+func (s *radioInfoStruct) reportSubFrequency(freq uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if freq != s.subFreq {
+		s.subFreq = freq
+		s.notify()
+	}
+}
+
+func (s *radioInfoStruct) reportMode(mode string) {
+	// Loggers don't know about the reverse modes.
+	mode = strings.TrimSuffix(mode, "-R")
+	if mode == "WFM" {
+		mode = "FM"
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if mode != s.mode {
+		s.mode = mode
+		s.notify()
+	}
+}
+
+func (s *radioInfoStruct) reportSplit(split bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if split != s.split {
+		s.split = split
+		s.notify()
+	}
+}
+
+func (s *radioInfoStruct) reportPTT(ptt bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ptt != s.ptt {
+		s.ptt = ptt
+		s.notify()
+	}
+}
+
+func (s *radioInfoStruct) getMsg() ([]byte, error) {
+	s.mutex.Lock()
+	msg := radioInfoMsg{
+		App:            "kappanhang",
+		StationName:    s.stationName,
+		RadioNr:        1,
+		Freq:           s.freq / 10,
+		TXFreq:         s.freq / 10,
+		Mode:           s.mode,
+		IsRunning:      radioInfoBool(false),
+		FocusRadioNr:   1,
+		IsStereo:       radioInfoBool(false),
+		IsSplit:        radioInfoBool(s.split),
+		ActiveRadioNr:  1,
+		IsTransmitting: radioInfoBool(s.ptt),
+		RadioName:      "IC-705",
+		IsConnected:    radioInfoBool(true),
+	}
+	// In split mode we transmit on the other VFO.
+	if s.split && s.subFreq != 0 {
+		msg.TXFreq = s.subFreq / 10
+	}
+	s.mutex.Unlock()
+
+	b, err := xml.MarshalIndent(msg, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func (s *radioInfoStruct) loop() {
+	for {
+		select {
+		case <-s.changedChan:
+		case <-s.deinitNeededChan:
+			s.deinitFinishedChan <- true
+			return
+		}
+
+		s.mutex.Lock()
+		gotState := s.freq != 0 && s.mode != ""
+		s.mutex.Unlock()
+		if !gotState {
+			continue
+		}
+
+		b, err := s.getMsg()
+		if err != nil {
+			log.Error("can't encode radio info: ", err)
+			continue
+		}
+		if _, err := s.conn.Write(b); err != nil {
+			log.Error("can't send radio info: ", err)
+		}
+	}
+}
+
+// The address is in the host[:port] format.
+func (s *radioInfoStruct) init() {
+	if radioInfoAddress == "" {
+		return
+	}
+
+	addr := radioInfoAddress
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, radioInfoDefaultPort)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Error("can't open radio info broadcast: ", err)
+		return
+	}
+	log.Print("sending radio info to ", addr)
+
+	s.stationName, _ = os.Hostname()
+	s.conn = conn
+
+	s.mutex.Lock()
+	s.changedChan = make(chan bool, 1)
+	s.mutex.Unlock()
+
+	s.deinitNeededChan = make(chan bool)
+	s.deinitFinishedChan = make(chan bool)
+	go s.loop()
+}
+
+func (s *radioInfoStruct) deinit() {
+	if s.deinitNeededChan == nil {
+		return
+	}
+	s.deinitNeededChan <- true
+	<-s.deinitFinishedChan
+	s.conn.Close()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The wait before a reconnect attempt is doubled after every failed attempt, starting from the min. wait up to
+// the max. wait. Random jitter is added, so multiple clients won't hammer the radio at the same time.
+// Waiting is needed, as the IC-705 will disconnect our audio stream eventually if we relogin in a too short
+// interval without a deauth.
+
+const reconnectBackoffFactor = 2
+const reconnectJitter = 0.2
+
+// The back-off is reset if a session lasted at least this long.
+const reconnectStableSessionLength = time.Minute
+
+type reconnectStruct struct {
+	mutex sync.Mutex
+
+	failedAttempts int // Number of consecutive failed attempts.
+	lastReason     string
+
+	// Metrics.
+	attempts          int
+	probeFailures     int
+	reasons           map[string]int
+	totalWait         time.Duration
+	sessionsConnected int
+}
+
+var reconnect reconnectStruct
+
+// Session errors are wrapped around these, so the reconnect reason does not depend on the error messages.
+var (
+	errRadioDisconnected   = errors.New("got radio disconnected")
+	errPingTimeout         = errors.New("ping timeout")
+	errStreamRestartFailed = errors.New("restart failed")
+	errStreamFailedAgain   = errors.New("stream failed again after restart")
+	errTimeout             = errors.New("timeout")
+	errRadioUnreachable    = errors.New("radio unreachable")
+)
+
+// Returns a short reason category of the given error, used in the logs, the metrics and the hook variables.
+func getReconnectReason(err error) string {
+	switch {
+	case err == nil:
+		return "unknown"
+	case errors.Is(err, errRadioDisconnected):
+		return "radio-disconnect"
+	case errors.Is(err, errPingTimeout):
+		return "ping-timeout"
+	case errors.Is(err, errStreamRestartFailed) || errors.Is(err, errStreamFailedAgain):
+		return "stream-failure"
+	case errors.Is(err, errTimeout):
+		return "timeout"
+	case errors.Is(err, errRadioUnreachable):
+		return "unreachable"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network"
+	}
+	return "error"
+}
+
+func (r *reconnectStruct) getBackoff() time.Duration {
+	w := reconnectMinWait
+	for i := 1; i < r.failedAttempts && w < reconnectMaxWait; i++ {
+		w *= reconnectBackoffFactor
+	}
+	w = time.Duration(float64(w) * (1 - reconnectJitter + 2*reconnectJitter*rand.Float64()))
+	if w > reconnectMaxWait {
+		w = reconnectMaxWait
+	}
+	if w < reconnectMinWait {
+		w = reconnectMinWait
+	}
+	return w
+}
+
+// Has to be called when a session ends. Returns the time to wait before the next attempt.
+func (r *reconnectStruct) sessionEnded(err error, sessionLength time.Duration) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	reason := getReconnectReason(err)
+	// The radio closed the session gracefully, or we were connected long enough, so the next attempt is not
+	// a retry of a failing one.
+	if reason == "radio-disconnect" || sessionLength >= reconnectStableSessionLength {
+		r.failedAttempts = 0
+	}
+	r.failedAttempts++
+	r.lastReason = reason
+	if r.reasons == nil {
+		r.reasons = make(map[string]int)
+	}
+	r.reasons[reason]++
+
+	w := r.getBackoff()
+	if reason == "radio-disconnect" {
+		w = reconnectMinWait
+	}
+	r.totalWait += w
+	return w
+}
+
+// Has to be called when the radio could not be reached before an attempt. Returns the time to wait before the
+// next probe.
+func (r *reconnectStruct) probeFailed() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.failedAttempts++
+	r.probeFailures++
+	r.lastReason = "unreachable"
+	w := r.getBackoff()
+	r.totalWait += w
+	return w
+}
+
+func (r *reconnectStruct) startingAttempt() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.attempts++
+	log.PrintW("reconnect attempt", "attempt", r.attempts, "failedAttempts", r.failedAttempts,
+		"reason", r.lastReason, "probeFailures", r.probeFailures, "totalWait", r.totalWait.String())
+}
+
+// Returns the reconnect metrics displayed by the status log.
+func (r *reconnectStruct) getMetrics() (attempts, probeFailures int, lastReason string, totalWait time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.attempts, r.probeFailures, r.lastReason, r.totalWait
+}
+
+func (r *reconnectStruct) reportConnected() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sessionsConnected++
+}
+
+// Returns the environment variables for the reconnect event hooks.
+func (r *reconnectStruct) getEnv() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return []string{fmt.Sprint("KAPPANHANG_RECONNECT_ATTEMPTS=", r.attempts),
+		"KAPPANHANG_RECONNECT_REASON=" + r.lastReason}
+}
+
+func (r *reconnectStruct) logStats() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.attempts == 0 && r.probeFailures == 0 {
+		return
+	}
+	kv := []interface{}{"attempts", r.attempts, "probeFailures", r.probeFailures,
+		"sessionsConnected", r.sessionsConnected, "totalWait", r.totalWait.String()}
+	var reasons []string
+	for reason := range r.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		kv = append(kv, "reason."+reason, r.reasons[reason])
+	}
+	log.PrintW("reconnect stats", kv...)
+}
+
+// Checks if the radio can be reached by resolving its address (mDNS names like ic-705.local are resolved by
+// the system resolver), and sending a single pkt3 to the control port from a separate socket. The radio
+// answers it with a pkt4 without starting a session, so the probe doesn't count as a login.
+func probeReachability() error {
+	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprint(connectAddress, ":", controlStreamPort))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRadioUnreachable, err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRadioUnreachable, err)
+	}
+	defer conn.Close()
+
+	h := pktHeader{typ: pktTypeAreYouThere, sentID: rand.Uint32()}
+	d, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(d); err != nil {
+		return fmt.Errorf("%w: %v", errRadioUnreachable, err)
+	}
+
+	// Setting a deadline which has already passed makes the pending read return.
+	timeout := clock.afterFunc(expectTimeoutDuration, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer timeout.stop()
+
+	b := make([]byte, 1500)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errRadioUnreachable, err)
+		}
+		var r pktHeader
+		if r.UnmarshalBinary(b[:n]) == nil && r.typ == pktTypeIAmHere {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeReachability(t *testing.T) {
+	radio, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: controlStreamPort})
+	if err != nil {
+		t.Skip("can't listen on the control port: ", err)
+	}
+	defer radio.Close()
+	c := useFakeClock(t)
+	defer func(a string) { connectAddress = a }(connectAddress)
+	connectAddress = "127.0.0.1"
+
+	result := make(chan error)
+	go func() { result <- probeReachability() }()
+
+	// The radio answers the pkt3 with a pkt4. Nothing else should be sent from the probe socket.
+	if err := radio.SetReadDeadline(time.Now().Add(testWaitTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	n, addr, err := radio.ReadFromUDP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h pktHeader
+	if err := h.UnmarshalBinary(b[:n]); err != nil || h.typ != pktTypeAreYouThere {
+		t.Fatalf("probe sent %x, expected a pkt3", b[:n])
+	}
+	r, err := (&pktHeader{typ: pktTypeIAmHere, rcvdID: h.sentID}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := radio.WriteToUDP(r, addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if err := radio.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := radio.ReadFromUDP(make([]byte, 1500)); err == nil {
+		t.Fatal("probe sent an unexpected packet of ", n, " bytes")
+	}
+
+	// Without an answer the probe fails.
+	go func() { result <- probeReachability() }()
+	c.waitForTimer(t, c.now().Add(expectTimeoutDuration))
+	c.advance(expectTimeoutDuration)
+	if err := <-result; err == nil || !strings.Contains(err.Error(), "radio unreachable") {
+		t.Fatal("expected an unreachable error, got ", err)
+	}
+	select {
+	case e := <-gotStreamErrChan:
+		t.Fatal("probe error sent as a stream error: ", e)
+	default:
+	}
+}
+
+func TestReconnectMetrics(t *testing.T) {
+	var r reconnectStruct
+	if attempts, probeFailures, _, _ := r.getMetrics(); attempts != 0 || probeFailures != 0 {
+		t.Fatal("metrics not empty at start")
+	}
+	r.startingAttempt()
+	w := r.sessionEnded(fmt.Errorf("control/%w", errPingTimeout), time.Second)
+	w += r.probeFailed()
+	attempts, probeFailures, lastReason, totalWait := r.getMetrics()
+	if attempts != 1 || probeFailures != 1 || lastReason != "unreachable" || totalWait != w {
+		t.Fatal("got metrics ", attempts, " ", probeFailures, " ", lastReason, " ", totalWait)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	defer func(min, max time.Duration) {
+		reconnectMinWait = min
+		reconnectMaxWait = max
+	}(reconnectMinWait, reconnectMaxWait)
+	reconnectMinWait = time.Second
+	reconnectMaxWait = 10 * time.Second
+
+	expectWait := func(w, base time.Duration) {
+		t.Helper()
+		min := time.Duration(float64(base) * (1 - reconnectJitter))
+		max := time.Duration(float64(base) * (1 + reconnectJitter))
+		if min < reconnectMinWait {
+			min = reconnectMinWait
+		}
+		if max > reconnectMaxWait {
+			max = reconnectMaxWait
+		}
+		if w < min || w > max {
+			t.Fatal("got wait ", w, ", expected between ", min, " and ", max)
+		}
+	}
+
+	var r reconnectStruct
+	sessionErr := errTimeout
+	for i := 0; i < 100; i++ {
+		r = reconnectStruct{}
+		// The wait doubles after every failed attempt until it reaches the max. wait.
+		for _, base := range []time.Duration{1, 2, 4, 8, 10, 10} {
+			expectWait(r.sessionEnded(sessionErr, time.Second), base*time.Second)
+		}
+		// Failing after a stable session starts again from the min. wait.
+		expectWait(r.sessionEnded(sessionErr, reconnectStableSessionLength), time.Second)
+		expectWait(r.sessionEnded(sessionErr, reconnectStableSessionLength-time.Second), 2*time.Second)
+	}
+
+	// The radio closing the session is not a failed attempt.
+	if w := r.sessionEnded(errRadioDisconnected, 0); w != reconnectMinWait {
+		t.Fatal("got wait ", w, " after radio disconnect")
+	}
+}
+
+func TestReconnectWait(t *testing.T) {
+	c := useFakeClock(t)
+	osSignal := make(chan os.Signal, 1)
+
+	result := make(chan bool)
+	go func() { result <- wait(1500*time.Millisecond, osSignal) }()
+	c.waitForTimer(t, c.now().Add(time.Second))
+	c.advance(time.Second)
+	c.waitForTimer(t, c.now().Add(500*time.Millisecond))
+	c.advance(500 * time.Millisecond)
+	if <-result {
+		t.Fatal("wait returned exit without a signal")
+	}
+
+	go func() { result <- wait(time.Minute, osSignal) }()
+	c.waitForTimer(t, c.now().Add(time.Second))
+	osSignal <- os.Interrupt
+	if !<-result {
+		t.Fatal("wait did not return exit on a signal")
+	}
+}
+
+func TestGetReconnectReason(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		reason string
+	}{
+		{nil, "unknown"},
+		{errRadioDisconnected, "radio-disconnect"},
+		{fmt.Errorf("serial/%w", errPingTimeout), "ping-timeout"},
+		{fmt.Errorf("audio/%w: %v", errStreamRestartFailed, errTimeout), "stream-failure"},
+		{fmt.Errorf("serial/%w", errStreamFailedAgain), "stream-failure"},
+		{fmt.Errorf("serial/%w", fmt.Errorf("serial/expect %w", errTimeout)), "timeout"},
+		{fmt.Errorf("%w: no route", errRadioUnreachable), "unreachable"},
+		{&net.OpError{Op: "read", Err: errors.New("connection refused")}, "network"},
+		// Only the wrapped errors count, not the message.
+		{errors.New("ping timeout"), "error"},
+	} {
+		if reason := getReconnectReason(test.err); reason != test.reason {
+			t.Error("got reason ", reason, " for ", test.err, ", expected ", test.reason)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Feeds the packets of a capture made with --capture through the same handlers which process the packets
+// coming from the radio. Packets are replayed in real time, so the sequence buffers behave like they did
+// when the capture was made.
+
+type replayStruct struct {
+	control streamCommon
+	serial  serialStream
+	audio   audioStream
+
+	counts map[string]int
+
+	finishNeededChan   chan bool
+	finishFinishedChan chan bool
+}
+
+func (s *replayStruct) loop() {
+	for {
+		select {
+		case e := <-s.serial.rxSeqBufEntryChan:
+			s.serial.handleRxSeqBufEntry(e)
+		case e := <-s.audio.rxSeqBufEntryChan:
+			s.audio.handleRxSeqBufEntry(e)
+		case <-audio.play:
+		case <-s.finishNeededChan:
+			s.finishFinishedChan <- true
+			return
+		}
+	}
+}
+
+func (s *replayStruct) handle(p capturedPacket) {
+	var st *streamCommon
+	switch p.stream {
+	case "control":
+		st = &s.control
+	case "serial":
+		st = &s.serial.common
+	case "audio":
+		st = &s.audio.common
+	default:
+		s.counts["unknown"]++
+		return
+	}
+
+	if p.outbound {
+		s.counts[p.stream+"/out"]++
+		return
+	}
+	s.counts[p.stream+"/in"]++
+
+	r := receivedPkt{raw: p.data}
+	r.pkt, _ = demuxPkt(p.data)
+	switch pkt := r.pkt.(type) {
+	case *pktPing:
+		if err := st.pkt7.handle(st, pkt); err != nil {
+			log.Error(st.name+"/", err)
+		}
+		return
+	case *pktRetransmitRequest:
+		if err := st.pkt0.handle(st, pkt); err != nil {
+			log.Error(st.name+"/", err)
+		}
+	}
+
+	var err error
+	switch p.stream {
+	case "serial":
+		err = s.serial.handleRead(r)
+	case "audio":
+		err = s.audio.handleRead(r)
+	default:
+		log.Debug(st.name+"/got ", len(p.data), " bytes")
+	}
+	if err != nil {
+		log.Error(st.name+"/", err)
+	}
+}
+
+func runReplay(path string) error {
+	pkts, err := readPacketCapture(path)
+	if err != nil {
+		return err
+	}
+	if len(pkts) == 0 {
+		return fmt.Errorf("no packets found in %s", path)
+	}
+	log.Print("replaying ", len(pkts), " packets from ", path)
+
+	// Don't touch the band stacking registers of the real radio.
+	bandStackFile = ""
+
+	var s replayStruct
+	s.counts = make(map[string]int)
+	s.control.name = "control"
+	s.serial.common.name = "serial"
+	s.audio.common.name = "audio"
+	s.serial.rxSeqBufEntryChan = make(chan seqBufEntry)
+	s.serial.rxSeqBuf.init(getRxSeqBufLength(), 0xffff, 0, s.serial.rxSeqBufEntryChan, s.serial.common.requestRetransmit)
+	s.audio.rxSeqBufEntryChan = make(chan seqBufEntry)
+	s.audio.rxSeqBuf.init(getRxSeqBufLength(), 0xffff, 0, s.audio.rxSeqBufEntryChan, s.audio.common.requestRetransmit)
+	audio.play = make(chan []byte)
+	s.finishNeededChan = make(chan bool)
+	s.finishFinishedChan = make(chan bool)
+	go s.loop()
+
+	startedAt := time.Now()
+	for _, p := range pkts {
+		if d := p.t.Sub(pkts[0].t) - time.Since(startedAt); d > 0 {
+			time.Sleep(d)
+		}
+		s.handle(p)
+	}
+
+	// Letting the sequence buffers flush.
+	time.Sleep(2 * jitterBufferMax)
+	s.finishNeededChan <- true
+	<-s.finishFinishedChan
+	s.serial.rxSeqBuf.deinit()
+	s.audio.rxSeqBuf.deinit()
+
+	for _, n := range []string{"control", "serial", "audio"} {
+		log.Print(n, ": ", s.counts[n+"/in"], " packets from radio, ", s.counts[n+"/out"], " packets to radio")
+	}
+	if s.counts["unknown"] > 0 {
+		log.Print(s.counts["unknown"], " packets of unknown streams skipped")
+	}
+	log.Print("replay finished in ", time.Since(startedAt).Round(time.Millisecond))
+	return nil
+}
@@ -354,6 +354,16 @@ func (s *rigctldStruct) processCmd(cmd string) (close bool, err error) {
 		} else {
 			_ = s.sendReplyCode(rigctldNoError)
 		}
+	case cmdSplit[0] == "\\run_script":
+		if len(cmdSplit) != 2 {
+			_ = s.sendReplyCode(rigctldInvalidParam)
+			return
+		}
+		if err = scriptEngine.run(cmdSplit[1]); err != nil {
+			_ = s.sendReplyCode(rigctldInvalidParam)
+		} else {
+			_ = s.sendReplyCode(rigctldNoError)
+		}
 	case cmd == "v": // Ignore this command.
 		_ = s.sendReplyCode(rigctldUnsupportedCmd)
 		return
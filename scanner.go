@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time to wait after tuning to a channel before reading the S meter.
+const scanDwellTime = 300 * time.Millisecond
+const scanReadTimeout = time.Second
+const scanPriorityCheckInterval = 5 * time.Second
+
+// In carrier resume mode the scan continues after the signal has been gone for this long.
+const scanCarrierResumeDelay = 2 * time.Second
+
+type scanResumeMode int
+
+const (
+	scanResumeCarrier = scanResumeMode(iota)
+	scanResumeHold
+	scanResumeTimer
+)
+
+// A scanned channel is either a frequency, or a memory channel of the radio if mem is not 0.
+type scanChannel struct {
+	freq uint
+	mem  int
+}
+
+func (c scanChannel) String() string {
+	if c.mem > 0 {
+		return fmt.Sprint("memory ", c.mem)
+	}
+	return formatFreqMHz(c.freq) + " MHz"
+}
+
+type scannerStruct struct {
+	mutex       sync.Mutex
+	running     bool
+	autoStarted bool
+
+	channels      []scanChannel
+	priorityFreq  uint
+	stopOnSValue  int // -1 if disabled.
+	stopOnSquelch bool
+	resumeMode    scanResumeMode
+	resumeAfter   time.Duration
+
+	gotSChan       chan int
+	gotSquelchChan chan bool
+
+	// True if the radio has been switched to memory mode by the scan.
+	inMemoryMode bool
+
+	// These are closed (not written to) as the scan loop can also stop by itself.
+	stopNeededChan   chan bool
+	stopFinishedChan chan bool
+}
+
+var scanner scannerStruct
+
+var errScanStopped = errors.New("scan stopped")
+
+func (s *scannerStruct) isRunning() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.running
+}
+
+func (s *scannerStruct) reportS(sValue int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return
+	}
+	// Non-blocking notify.
+	select {
+	case s.gotSChan <- sValue:
+	default:
+	}
+}
+
+func (s *scannerStruct) reportSquelch(open bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return
+	}
+	// Non-blocking notify.
+	select {
+	case s.gotSquelchChan <- open:
+	default:
+	}
+}
+
+// Parses a list of memory channel numbers, ranges are also accepted (example: 1-10,15).
+func parseMemoryList(str string) (mems []int, err error) {
+	for _, c := range strings.Split(str, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		r := strings.Split(c, "-")
+		if len(r) > 2 {
+			return nil, fmt.Errorf("invalid memory channel range %s", c)
+		}
+		var from, to int
+		if from, err = strconv.Atoi(strings.TrimSpace(r[0])); err != nil {
+			return nil, fmt.Errorf("invalid memory channel %s", r[0])
+		}
+		to = from
+		if len(r) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(r[1])); err != nil {
+				return nil, fmt.Errorf("invalid memory channel %s", r[1])
+			}
+		}
+		// Channels 100 and 101 are the program scan edges.
+		if from < 1 || to > 99 || to < from {
+			return nil, fmt.Errorf("invalid memory channel range %s", c)
+		}
+		for m := from; m <= to; m++ {
+			mems = append(mems, m)
+		}
+	}
+	if len(mems) == 0 {
+		return nil, errors.New("no memory channels given")
+	}
+	return
+}
+
+func (s *scannerStruct) parseConfig() (err error) {
+	s.channels = nil
+	if scanMems != "" {
+		var mems []int
+		if mems, err = parseMemoryList(scanMems); err != nil {
+			return
+		}
+		for _, m := range mems {
+			s.channels = append(s.channels, scanChannel{mem: m})
+		}
+	} else {
+		var freqs []uint
+		if freqs, err = parseFreqList(scanFreqs, scanStep); err != nil {
+			return
+		}
+		for _, f := range freqs {
+			s.channels = append(s.channels, scanChannel{freq: f})
+		}
+	}
+
+	s.priorityFreq = 0
+	if scanPriorityFreq != "" {
+		if s.priorityFreq, err = parseFreqMHz(scanPriorityFreq); err != nil {
+			return
+		}
+	}
+
+	s.stopOnSValue = -1
+	if scanStopSLevel != "" {
+		if s.stopOnSValue, err = parseSValue(scanStopSLevel); err != nil {
+			return
+		}
+	}
+	s.stopOnSquelch = scanStopOnSquelch || s.stopOnSValue < 0
+
+	switch scanResume {
+	case "carrier":
+		s.resumeMode = scanResumeCarrier
+	case "hold":
+		s.resumeMode = scanResumeHold
+	default:
+		var secs int
+		if secs, err = strconv.Atoi(scanResume); err != nil || secs <= 0 {
+			return fmt.Errorf("invalid scan resume mode %s", scanResume)
+		}
+		s.resumeMode = scanResumeTimer
+		s.resumeAfter = time.Duration(secs) * time.Second
+	}
+	return nil
+}
+
+func (s *scannerStruct) wait(d time.Duration) error {
+	select {
+	case <-clock.after(d):
+		return nil
+	case <-s.stopNeededChan:
+		return errScanStopped
+	}
+}
+
+// Memory channels are selected with the memory command, like the mem command of the command prompt does.
+// Before tuning to a frequency after a memory channel, the radio is switched back to VFO mode.
+func (s *scannerStruct) tune(c scanChannel) error {
+	civControl.state.mutex.Lock()
+	var err error
+	if c.mem > 0 {
+		err = civControl.setMemory(c.mem)
+		s.inMemoryMode = true
+	} else {
+		if s.inMemoryMode {
+			err = civControl.setVFO(0)
+			s.inMemoryMode = false
+		}
+		if err == nil {
+			err = civControl.setMainVFOFreq(c.freq)
+		}
+	}
+	civControl.state.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.wait(scanDwellTime)
+}
+
+func (s *scannerStruct) readSignal() (sValue int, squelchOpen bool, err error) {
+	civControl.state.mutex.Lock()
+	err = civControl.getS()
+	if err == nil && s.stopOnSquelch {
+		err = civControl.getSquelchStatus()
+	}
+	civControl.state.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	gotS := false
+	gotSquelch := !s.stopOnSquelch
+	timeout := clock.newTimer(scanReadTimeout)
+	defer timeout.stop()
+	for !gotS || !gotSquelch {
+		select {
+		case sValue = <-s.gotSChan:
+			gotS = true
+		case squelchOpen = <-s.gotSquelchChan:
+			gotSquelch = true
+		case <-timeout.c():
+			return sValue, squelchOpen, errors.New("s meter read timeout")
+		case <-s.stopNeededChan:
+			return sValue, squelchOpen, errScanStopped
+		}
+	}
+	return
+}
+
+func (s *scannerStruct) isActive(sValue int, squelchOpen bool) bool {
+	return (s.stopOnSValue >= 0 && sValue >= s.stopOnSValue) || (s.stopOnSquelch && squelchOpen)
+}
+
+func (s *scannerStruct) checkChannel(c scanChannel) (active bool, sValue int, err error) {
+	if err = s.tune(c); err != nil {
+		return
+	}
+	var squelchOpen bool
+	if sValue, squelchOpen, err = s.readSignal(); err != nil {
+		return
+	}
+	return s.isActive(sValue, squelchOpen), sValue, nil
+}
+
+func (s *scannerStruct) logHit(c scanChannel, sValue int) {
+	f := c.freq
+	if c.mem > 0 {
+		// The frequency of the memory channel is queried by civControl when the channel is selected.
+		civControl.state.mutex.Lock()
+		f = civControl.state.freq
+		civControl.state.mutex.Unlock()
+		log.Print("scan hit on ", c, " (", formatFreqMHz(f), " MHz) ", formatSValue(sValue))
+	} else {
+		log.Print("scan hit on ", c, " ", formatSValue(sValue))
+	}
+
+	if scanLogFile == "" {
+		return
+	}
+	file, err := os.OpenFile(scanLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("can't open scan log: ", err)
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s,%d,%s\n", clock.now().UTC().Format(time.RFC3339), f,
+		formatSValue(sValue)); err != nil {
+		log.Error("can't write scan log: ", err)
+	}
+}
+
+// Returns errScanStopped if the scan should not continue.
+func (s *scannerStruct) waitForResume() error {
+	switch s.resumeMode {
+	case scanResumeHold:
+		return errScanStopped
+	case scanResumeTimer:
+		return s.wait(s.resumeAfter)
+	}
+
+	lastActiveAt := clock.now()
+	for clock.since(lastActiveAt) < scanCarrierResumeDelay {
+		if err := s.wait(scanDwellTime); err != nil {
+			return err
+		}
+		sValue, squelchOpen, err := s.readSignal()
+		if err == errScanStopped {
+			return err
+		}
+		if err != nil || s.isActive(sValue, squelchOpen) {
+			lastActiveAt = clock.now()
+		}
+	}
+	return nil
+}
+
+// Returns errScanStopped if the scan should not continue.
+func (s *scannerStruct) scanChannel(c scanChannel) error {
+	active, sValue, err := s.checkChannel(c)
+	if err != nil {
+		if err != errScanStopped {
+			log.Debug("can't check ", c, ": ", err)
+			return nil
+		}
+		return err
+	}
+	if !active {
+		return nil
+	}
+
+	s.logHit(c, sValue)
+	statusLog.reportScan("HIT")
+	if err := s.waitForResume(); err != nil {
+		return err
+	}
+	statusLog.reportScan("SCAN")
+	return nil
+}
+
+func (s *scannerStruct) loop() {
+	defer func() {
+		s.mutex.Lock()
+		s.running = false
+		s.mutex.Unlock()
+
+		statusLog.reportScan("")
+		close(s.stopFinishedChan)
+	}()
+
+	startedAt := clock.now()
+	lastPriorityCheckAt := startedAt
+	statusLog.reportScan("SCAN")
+
+	for i := 0; ; i = (i + 1) % len(s.channels) {
+		if scanTimeout > 0 && clock.since(startedAt) >= scanTimeout {
+			log.Print("scan timeout")
+			return
+		}
+
+		if s.priorityFreq != 0 && clock.since(lastPriorityCheckAt) >= scanPriorityCheckInterval {
+			if err := s.scanChannel(scanChannel{freq: s.priorityFreq}); err != nil {
+				log.Print("scan stopped on priority channel ", formatFreqMHz(s.priorityFreq))
+				return
+			}
+			lastPriorityCheckAt = clock.now()
+		}
+
+		if err := s.scanChannel(s.channels[i]); err != nil {
+			log.Print("scan stopped on ", s.channels[i])
+			return
+		}
+	}
+}
+
+func (s *scannerStruct) start() error {
+	if sweeper.isRunning() {
+		return errors.New("sweep is running")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running {
+		return nil
+	}
+	if err := s.parseConfig(); err != nil {
+		return err
+	}
+
+	s.gotSChan = make(chan int)
+	s.gotSquelchChan = make(chan bool)
+	s.stopNeededChan = make(chan bool)
+	s.stopFinishedChan = make(chan bool)
+	s.running = true
+
+	log.Print("scan started on ", len(s.channels), " channels")
+	go s.loop()
+	return nil
+}
+
+// The scan is started automatically on the first connection if scan frequencies are given.
+func (s *scannerStruct) startIfNeeded() {
+	if s.autoStarted || (scanFreqs == "" && scanMems == "") {
+		return
+	}
+	s.autoStarted = true
+
+	if err := s.start(); err != nil {
+		log.Error("can't start scan: ", err)
+	}
+}
+
+func (s *scannerStruct) stop() {
+	s.mutex.Lock()
+	if !s.running {
+		s.mutex.Unlock()
+		return
+	}
+	close(s.stopNeededChan)
+	s.mutex.Unlock()
+
+	<-s.stopFinishedChan
+}
+
+func (s *scannerStruct) toggle() error {
+	if s.isRunning() {
+		s.stop()
+		return nil
+	}
+	return s.start()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMemoryList(t *testing.T) {
+	tests := []struct {
+		str  string
+		mems []int
+		ok   bool
+	}{
+		{"1", []int{1}, true},
+		{"1-3,15", []int{1, 2, 3, 15}, true},
+		{" 5 - 6 , 99", []int{5, 6, 99}, true},
+		{"", nil, false},
+		{"0", nil, false},
+		{"100", nil, false},
+		{"3-1", nil, false},
+		{"1-2-3", nil, false},
+		{"a", nil, false},
+	}
+	for _, tt := range tests {
+		mems, err := parseMemoryList(tt.str)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseMemoryList(%q) error %v", tt.str, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(mems, tt.mems) {
+			t.Errorf("parseMemoryList(%q) = %v, want %v", tt.str, mems, tt.mems)
+		}
+	}
+}
+
+func TestParseFreqList(t *testing.T) {
+	tests := []struct {
+		str   string
+		step  uint
+		freqs []uint
+		err   string
+	}{
+		{str: "145.500, 146.520", step: 1000, freqs: []uint{145500000, 146520000}},
+		{str: "7.000-7.002,14.074", step: 1000, freqs: []uint{7000000, 7001000, 7002000, 14074000}},
+		{str: "7.000-7.0025", step: 1000, freqs: []uint{7000000, 7001000, 7002000}},
+		{str: "4294.967-4294.967295", step: 1000, freqs: []uint{4294967000}},
+		{str: "7.000-7.200", step: 0, err: "invalid frequency range 7.000-7.200"},
+		{str: "7.200-7.000", step: 1000, err: "invalid frequency range 7.200-7.000"},
+		{str: "1-1000", step: 1, err: "too many frequencies in range 1-1000"},
+		{str: "1-1.09999,1.1-1.2", step: 1, err: "too many frequencies in range 1.1-1.2"},
+		{str: "1e300", step: 1000, err: "invalid frequency 1e300"},
+		{str: "", step: 1000, err: "no frequencies given"},
+	}
+	for _, tt := range tests {
+		freqs, err := parseFreqList(tt.str, tt.step)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseFreqList(%q) error %v, want %q", tt.str, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFreqList(%q) error %v", tt.str, err)
+			continue
+		}
+		if !reflect.DeepEqual(freqs, tt.freqs) {
+			t.Errorf("parseFreqList(%q) = %v, want %v", tt.str, freqs, tt.freqs)
+		}
+	}
+}
+
+func newTestScanner() *scannerStruct {
+	return &scannerStruct{
+		running:          true,
+		stopOnSValue:     5,
+		gotSChan:         make(chan int),
+		gotSquelchChan:   make(chan bool),
+		stopNeededChan:   make(chan bool),
+		stopFinishedChan: make(chan bool),
+	}
+}
+
+// Lets the scanner wait for the dwell time, then answers its S meter query.
+func stepTestScanner(t *testing.T, c *fakeClock, s *scannerStruct, sValue int) {
+	t.Helper()
+	c.waitForTimer(t, c.now().Add(scanDwellTime))
+	c.advance(scanDwellTime)
+	select {
+	case s.gotSChan <- sValue:
+	case <-time.After(testWaitTimeout):
+		t.Fatal("scanner has not read the S meter")
+	}
+}
+
+func TestScannerWaitForResume(t *testing.T) {
+	c := useFakeClock(t)
+	s := newTestScanner()
+	finishedChan := make(chan error)
+
+	s.resumeMode = scanResumeHold
+	if err := s.waitForResume(); err != errScanStopped {
+		t.Errorf("hold mode got error %v, want %v", err, errScanStopped)
+	}
+
+	s.resumeMode = scanResumeTimer
+	s.resumeAfter = 5 * time.Second
+	go func() {
+		finishedChan <- s.waitForResume()
+	}()
+	c.waitForTimer(t, c.now().Add(s.resumeAfter))
+	c.advance(s.resumeAfter)
+	if err := <-finishedChan; err != nil {
+		t.Errorf("timer mode got error %v", err)
+	}
+
+	// The scan resumes when the signal has been gone for scanCarrierResumeDelay.
+	s.resumeMode = scanResumeCarrier
+	go func() {
+		finishedChan <- s.waitForResume()
+	}()
+	start := c.now()
+	stepTestScanner(t, c, s, 9)
+	lastActiveAt := c.now()
+	for c.since(lastActiveAt) < scanCarrierResumeDelay {
+		select {
+		case err := <-finishedChan:
+			t.Fatalf("carrier mode resumed after %v with error %v", c.since(start), err)
+		default:
+		}
+		stepTestScanner(t, c, s, 2)
+	}
+	if err := <-finishedChan; err != nil {
+		t.Errorf("carrier mode got error %v", err)
+	}
+
+	// A read timeout counts as an active signal.
+	go func() {
+		finishedChan <- s.waitForResume()
+	}()
+	c.waitForTimer(t, c.now().Add(scanDwellTime))
+	c.advance(scanDwellTime)
+	c.waitForTimer(t, c.now().Add(scanReadTimeout))
+	c.advance(scanReadTimeout)
+	lastActiveAt = c.now()
+	for c.since(lastActiveAt) < scanCarrierResumeDelay {
+		stepTestScanner(t, c, s, 0)
+	}
+	if err := <-finishedChan; err != nil {
+		t.Errorf("carrier mode got error %v", err)
+	}
+
+	go func() {
+		finishedChan <- s.waitForResume()
+	}()
+	stepTestScanner(t, c, s, 9)
+	c.waitForTimer(t, c.now().Add(scanDwellTime))
+	close(s.stopNeededChan)
+	if err := <-finishedChan; err != errScanStopped {
+		t.Errorf("stopped carrier mode got error %v, want %v", err, errScanStopped)
+	}
+}
+
+func TestScannerLoop(t *testing.T) {
+	c := useFakeClock(t)
+	logs := observeLog(t)
+	s := newTestScanner()
+	s.channels = []scanChannel{{freq: 14074000}, {freq: 14075000}}
+	s.resumeMode = scanResumeHold
+	go s.loop()
+
+	stepTestScanner(t, c, s, 0)
+	stepTestScanner(t, c, s, 0)
+	// The hit stops the scan in hold mode.
+	stepTestScanner(t, c, s, 9)
+	select {
+	case <-s.stopFinishedChan:
+	case <-time.After(testWaitTimeout):
+		t.Fatal("scan has not been stopped")
+	}
+	if s.isRunning() {
+		t.Error("scanner is still running")
+	}
+	if countLogs(logs, "scan hit on 14.074000 MHz S9") != 1 || countLogs(logs, "scan stopped on 14.074000 MHz") != 1 {
+		t.Error("hit has not been logged")
+	}
+
+	s = newTestScanner()
+	s.channels = []scanChannel{{freq: 14074000}}
+	go s.loop()
+	stepTestScanner(t, c, s, 0)
+	c.waitForTimer(t, c.now().Add(scanDwellTime))
+	close(s.stopNeededChan)
+	select {
+	case <-s.stopFinishedChan:
+	case <-time.After(testWaitTimeout):
+		t.Fatal("scan has not been stopped")
+	}
+}
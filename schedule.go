@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const scheduleCheckInterval = time.Second
+
+// Cron entries are checked minute by minute for this long when searching for the next run.
+const scheduleMaxCronLookahead = 4 * 366 * 24 * time.Hour
+
+type scheduleCron struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+	// If both the day of month and the day of week are restricted, matching either is enough, as in cron.
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+type scheduleEntry struct {
+	ID     int    `json:"id"`
+	When   string `json:"when"`
+	Action string `json:"action"`
+
+	interval time.Duration
+	cron     *scheduleCron
+	utc      bool
+	proto    *lua.FunctionProto
+	next     time.Time
+}
+
+type schedulerStruct struct {
+	mutex   sync.Mutex
+	entries []*scheduleEntry
+	lastID  int
+
+	deinitNeededChan   chan bool
+	deinitFinishedChan chan bool
+}
+
+var scheduler schedulerStruct
+
+// Parses a cron field like "*", "*/15", "1-5", "0,30" or "8-18/2" to res. A single value with a step, like
+// "5/15", means from the value to max, as in cron.
+func parseScheduleCronField(str string, min, max int, res []bool) (restricted bool, err error) {
+	for _, part := range strings.Split(str, ",") {
+		step := 1
+		i := strings.Index(part, "/")
+		if i >= 0 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return false, fmt.Errorf("invalid step in %s", str)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			restricted = true
+			r := strings.SplitN(part, "-", 2)
+			if from, err = strconv.Atoi(r[0]); err != nil {
+				return false, fmt.Errorf("invalid value in %s", str)
+			}
+			to = from
+			if i >= 0 {
+				to = max
+			}
+			if len(r) == 2 {
+				if to, err = strconv.Atoi(r[1]); err != nil {
+					return false, fmt.Errorf("invalid value in %s", str)
+				}
+			}
+			if from < min || to > max || from > to {
+				return false, fmt.Errorf("%s is out of range %d-%d", str, min, max)
+			}
+		}
+		for v := from; v <= to; v += step {
+			res[v] = true
+		}
+	}
+	return restricted, nil
+}
+
+func parseScheduleCron(fields []string) (*scheduleCron, error) {
+	c := &scheduleCron{}
+	if _, err := parseScheduleCronField(fields[0], 0, 59, c.minutes[:]); err != nil {
+		return nil, err
+	}
+	if _, err := parseScheduleCronField(fields[1], 0, 23, c.hours[:]); err != nil {
+		return nil, err
+	}
+	var err error
+	if c.daysRestricted, err = parseScheduleCronField(fields[2], 1, 31, c.days[:]); err != nil {
+		return nil, err
+	}
+	if _, err := parseScheduleCronField(fields[3], 1, 12, c.months[:]); err != nil {
+		return nil, err
+	}
+	// Sunday can be given as 0 or 7.
+	var weekdays [8]bool
+	if c.weekdaysRestricted, err = parseScheduleCronField(fields[4], 0, 7, weekdays[:]); err != nil {
+		return nil, err
+	}
+	copy(c.weekdays[:], weekdays[:7])
+	c.weekdays[0] = c.weekdays[0] || weekdays[7]
+	return c, nil
+}
+
+func (c *scheduleCron) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[t.Month()] {
+		return false
+	}
+	dayMatches := c.days[t.Day()]
+	weekdayMatches := c.weekdays[t.Weekday()]
+	if c.daysRestricted && c.weekdaysRestricted {
+		return dayMatches || weekdayMatches
+	}
+	return dayMatches && weekdayMatches
+}
+
+// Parses the time specification at the beginning of args, returns the number of fields used.
+// Accepted formats: every <duration>, at <HH:MM>[utc], cron [utc] <min> <hour> <day> <month> <weekday>
+func (e *scheduleEntry) parseWhen(args []string) (n int, err error) {
+	if len(args) == 0 {
+		return 0, errors.New("missing time")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "every":
+		if len(args) < 2 {
+			return 0, errors.New("missing interval")
+		}
+		if e.interval, err = time.ParseDuration(args[1]); err != nil {
+			return 0, err
+		}
+		if e.interval < time.Second {
+			return 0, errors.New("interval is too short")
+		}
+		n = 2
+	case "at":
+		if len(args) < 2 {
+			return 0, errors.New("missing time of day")
+		}
+		t := strings.ToLower(args[1])
+		if strings.HasSuffix(t, "utc") {
+			e.utc = true
+			t = strings.TrimSuffix(t, "utc")
+		}
+		hm := strings.SplitN(t, ":", 2)
+		if len(hm) != 2 {
+			return 0, fmt.Errorf("invalid time of day %s", args[1])
+		}
+		if e.cron, err = parseScheduleCron([]string{hm[1], hm[0], "*", "*", "*"}); err != nil {
+			return 0, fmt.Errorf("invalid time of day %s", args[1])
+		}
+		n = 2
+	case "cron":
+		n = 1
+		if len(args) > 1 && strings.ToLower(args[1]) == "utc" {
+			e.utc = true
+			n++
+		}
+		if len(args) < n+5 {
+			return 0, errors.New("missing cron fields")
+		}
+		if e.cron, err = parseScheduleCron(args[n : n+5]); err != nil {
+			return 0, err
+		}
+		n += 5
+	default:
+		return 0, fmt.Errorf("unknown time format %s", args[0])
+	}
+	e.When = strings.Join(args[:n], " ")
+	return n, nil
+}
+
+// Actions are Lua scripts.
+func (e *scheduleEntry) parseAction() (err error) {
+	if strings.TrimSpace(e.Action) == "" {
+		return errors.New("missing action")
+	}
+	e.proto, err = compileScript(fmt.Sprint("schedule-", e.ID), e.Action)
+	return
+}
+
+func (e *scheduleEntry) nextRun(after time.Time) time.Time {
+	if e.cron == nil {
+		return after.Add(e.interval)
+	}
+
+	t := after.Local()
+	if e.utc {
+		t = after.UTC()
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.Add(scheduleMaxCronLookahead); t.Before(end); t = t.Add(time.Minute) {
+		if e.cron.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (e *scheduleEntry) String() string {
+	next := "never"
+	if !e.next.IsZero() {
+		next = e.next.Local().Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint("#", e.ID, " ", e.When, " (next: ", next, "): ", e.Action)
+}
+
+func (s *schedulerStruct) load() {
+	if scheduleFile == "" {
+		return
+	}
+	d, err := ioutil.ReadFile(scheduleFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("can't load schedule: ", err)
+		}
+		return
+	}
+
+	var entries []*scheduleEntry
+	if err := json.Unmarshal(d, &entries); err != nil {
+		log.Error("can't parse schedule file ", scheduleFile, ": ", err)
+		return
+	}
+	now := clock.now()
+	for _, e := range entries {
+		if e.ID > s.lastID {
+			s.lastID = e.ID
+		}
+		if _, err := e.parseWhen(strings.Fields(e.When)); err != nil {
+			log.Error("can't parse schedule entry #", e.ID, ": ", err)
+			continue
+		}
+		if err := e.parseAction(); err != nil {
+			log.Error("can't parse schedule entry #", e.ID, ": ", err)
+			continue
+		}
+		e.next = e.nextRun(now)
+		s.entries = append(s.entries, e)
+	}
+}
+
+// Mutex must be held.
+func (s *schedulerStruct) save() {
+	if scheduleFile == "" {
+		return
+	}
+
+	d, err := json.MarshalIndent(s.entries, "", "\t")
+	if err != nil {
+		log.Error("can't encode schedule: ", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(scheduleFile), 0755); err != nil {
+		log.Error("can't save schedule: ", err)
+		return
+	}
+	if err := ioutil.WriteFile(scheduleFile, d, 0644); err != nil {
+		log.Error("can't save schedule: ", err)
+	}
+}
+
+// Adds a new entry from a command like: every 10m run("beacon")
+// The action is stored as it is given, so its strings keep their spacing.
+func (s *schedulerStruct) add(cmd string) (*scheduleEntry, error) {
+	e := &scheduleEntry{}
+	n, err := e.parseWhen(strings.Fields(cmd))
+	if err != nil {
+		return nil, err
+	}
+	e.Action = skipFields(cmd, n)
+	if err := e.parseAction(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastID++
+	e.ID = s.lastID
+	e.next = e.nextRun(clock.now())
+	s.entries = append(s.entries, e)
+	s.save()
+	return e, nil
+}
+
+func (s *schedulerStruct) cancel(id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, e := range s.entries {
+		if e.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			s.save()
+			// Stopping the action if it's running.
+			_ = scriptEngine.stop(fmt.Sprint("schedule-", id))
+			return nil
+		}
+	}
+	return fmt.Errorf("no schedule entry #%d", id)
+}
+
+func (s *schedulerStruct) list() (res []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range s.entries {
+		res = append(res, e.String())
+	}
+	return
+}
+
+func (s *schedulerStruct) check(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range s.entries {
+		if e.next.IsZero() || now.Before(e.next) {
+			continue
+		}
+		e.next = e.nextRun(now)
+
+		log.Print("running schedule entry ", e)
+		if err := scriptEngine.start(fmt.Sprint("schedule-", e.ID), e.proto); err != nil {
+			log.Error("can't run schedule entry #", e.ID, ": ", err)
+		}
+	}
+}
+
+func (s *schedulerStruct) loop() {
+	ticker := clock.newTicker(scheduleCheckInterval)
+	defer ticker.stop()
+
+	for {
+		select {
+		case now := <-ticker.c():
+			s.check(now)
+		case <-s.deinitNeededChan:
+			s.deinitFinishedChan <- true
+			return
+		}
+	}
+}
+
+func (s *schedulerStruct) init() {
+	s.load()
+
+	s.deinitNeededChan = make(chan bool)
+	s.deinitFinishedChan = make(chan bool)
+	go s.loop()
+}
+
+func (s *schedulerStruct) deinit() {
+	if s.deinitNeededChan == nil {
+		return
+	}
+
+	s.deinitNeededChan <- true
+	<-s.deinitFinishedChan
+}
+
+func getDefaultScheduleFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kappanhang", "schedule.json")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleCronField(t *testing.T) {
+	tests := []struct {
+		str        string
+		values     []int
+		restricted bool
+		err        string
+	}{
+		{str: "*", values: []int{0, 1, 2, 30, 59}},
+		{str: "*/15", values: []int{0, 15, 30, 45}},
+		{str: "5/15", values: []int{5, 20, 35, 50}, restricted: true},
+		{str: "5", values: []int{5}, restricted: true},
+		{str: "1-5", values: []int{1, 2, 3, 4, 5}, restricted: true},
+		{str: "0,30", values: []int{0, 30}, restricted: true},
+		{str: "8-18/5", values: []int{8, 13, 18}, restricted: true},
+		{str: "50/5,1", values: []int{1, 50, 55}, restricted: true},
+		{str: "60", err: "60 is out of range 0-59"},
+		{str: "5-1", err: "5-1 is out of range 0-59"},
+		{str: "*/0", err: "invalid step in */0"},
+		{str: "*/x", err: "invalid step in */x"},
+		{str: "x", err: "invalid value in x"},
+		{str: "1-x", err: "invalid value in 1-x"},
+	}
+	for _, tt := range tests {
+		var res [60]bool
+		restricted, err := parseScheduleCronField(tt.str, 0, 59, res[:])
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseScheduleCronField(%q) error %v, want %q", tt.str, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseScheduleCronField(%q) error %v", tt.str, err)
+			continue
+		}
+		if restricted != tt.restricted {
+			t.Errorf("parseScheduleCronField(%q) restricted %v, want %v", tt.str, restricted, tt.restricted)
+		}
+		var want [60]bool
+		for _, v := range tt.values {
+			want[v] = true
+		}
+		if tt.str == "*" {
+			for i := range want {
+				want[i] = true
+			}
+		}
+		if res != want {
+			t.Errorf("parseScheduleCronField(%q) got %v, want %v", tt.str, res, want)
+		}
+	}
+}
+
+func TestScheduleNextRun(t *testing.T) {
+	// 2021-01-01 is a Friday.
+	after := time.Date(2021, 1, 1, 10, 0, 30, 0, time.UTC)
+	tests := []struct {
+		when string
+		next time.Time
+		err  string
+	}{
+		{when: "every 10m", next: after.Add(10 * time.Minute)},
+		{when: "every 1h30m", next: after.Add(90 * time.Minute)},
+		{when: "at 10:30utc", next: time.Date(2021, 1, 1, 10, 30, 0, 0, time.UTC)},
+		{when: "at 06:30UTC", next: time.Date(2021, 1, 2, 6, 30, 0, 0, time.UTC)},
+		{when: "cron utc * * * * *", next: time.Date(2021, 1, 1, 10, 1, 0, 0, time.UTC)},
+		{when: "cron utc 5/15 * * * *", next: time.Date(2021, 1, 1, 10, 5, 0, 0, time.UTC)},
+		{when: "cron utc 0 12 * * 1-5", next: time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{when: "cron utc 0 9 * * 1-5", next: time.Date(2021, 1, 4, 9, 0, 0, 0, time.UTC)},
+		{when: "cron utc 0 0 * * 7", next: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week has to match.
+		{when: "cron utc 0 0 13 * 5", next: time.Date(2021, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{when: "cron utc 0 0 2 * 3", next: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{when: "cron utc 0 0 1 3 *", next: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{when: "cron utc 0 0 30 2 *"},
+		{when: "every 500ms", err: "interval is too short"},
+		{when: "at 25:00", err: "invalid time of day 25:00"},
+		{when: "cron 0 0 * *", err: "missing cron fields"},
+		{when: "cron 0 0 32 * *", err: "32 is out of range 1-31"},
+		{when: "sometimes", err: "unknown time format sometimes"},
+	}
+	for _, tt := range tests {
+		e := &scheduleEntry{}
+		_, err := e.parseWhen(strings.Fields(tt.when))
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseWhen(%q) error %v, want %q", tt.when, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseWhen(%q) error %v", tt.when, err)
+			continue
+		}
+		if next := e.nextRun(after); !next.Equal(tt.next) {
+			t.Errorf("%q next run %v, want %v", tt.when, next, tt.next)
+		}
+	}
+}
+
+func TestScheduleAdd(t *testing.T) {
+	c := useFakeClock(t)
+	var s schedulerStruct
+
+	e, err := s.add(" every  10m  exec('a;  b') ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != 1 || e.When != "every 10m" || e.Action != "exec('a;  b')" {
+		t.Errorf("got entry %+v", e)
+	}
+	if !e.next.Equal(c.now().Add(10 * time.Minute)) {
+		t.Errorf("next run %v, want %v", e.next, c.now().Add(10*time.Minute))
+	}
+
+	for _, cmd := range []string{"every 10m", "every 10m if then", "never log('a')"} {
+		if _, err := s.add(cmd); err == nil {
+			t.Errorf("add(%q) succeeded", cmd)
+		}
+	}
+	if len(s.entries) != 1 {
+		t.Errorf("got %d entries, want 1", len(s.entries))
+	}
+}
+
+func TestSchedulerLoop(t *testing.T) {
+	c := useFakeClock(t)
+	logs := observeLog(t)
+	var s schedulerStruct
+	s.init()
+	defer s.deinit()
+
+	if _, err := s.add("every 10s log('beacon')"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ticks are dropped while the loop is busy, so the clock is moved until the entry runs.
+	start := c.now()
+	for deadline := time.Now().Add(testWaitTimeout); countLogs(logs, "running schedule entry") == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("schedule entry has not been run")
+		}
+		c.advance(scheduleCheckInterval)
+		time.Sleep(time.Millisecond)
+	}
+	if d := c.since(start); d < 10*time.Second {
+		t.Errorf("schedule entry run after %v, want at least 10s", d)
+	}
+	waitForLog(t, logs, "schedule-1: beacon")
+}
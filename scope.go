@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Waveform data values are between 0 and this value.
+const scopeMaxAmplitude = 160
+
+// Lines are dropped for subscribers which are not reading their channel fast enough.
+const scopeSubscriberChanSize = 16
+
+// These are the scope modes sent in the first division of the waveform data.
+const (
+	scopeModeCenter       = 0x00
+	scopeModeFixed        = 0x01
+	scopeModeScrollCenter = 0x02
+	scopeModeScrollFixed  = 0x03
+)
+
+var scopeSpectrumChars = []rune("▁▂▃▄▅▆▇█")
+var scopeWaterfallChars = []rune(" ░▒▓█")
+
+type scopeLine struct {
+	receivedAt time.Time
+	freqFrom   uint
+	freqTo     uint
+	outOfRange bool
+	data       []byte
+}
+
+type scopeStruct struct {
+	mutex       sync.Mutex
+	subscribers []chan scopeLine
+
+	// The line currently reassembled from the waveform data divisions.
+	line         scopeLine
+	assembling   bool
+	nextDivision int
+}
+
+var scope scopeStruct
+
+// Returns a channel which receives every reassembled waveform line.
+func (s *scopeStruct) subscribe() chan scopeLine {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ch := make(chan scopeLine, scopeSubscriberChanSize)
+	s.subscribers = append(s.subscribers, ch)
+	return ch
+}
+
+func (s *scopeStruct) unsubscribe(ch chan scopeLine) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.subscribers {
+		if s.subscribers[i] == ch {
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *scopeStruct) publish(l scopeLine) {
+	for _, ch := range s.subscribers {
+		// Non-blocking notify.
+		select {
+		case ch <- l:
+		default:
+		}
+	}
+}
+
+// Processes the payload of a 0x27 0x00 message, starting with the main/sub receiver byte.
+// The radio sends a waveform line in multiple divisions, the first one also contains the frequency
+// range of the line.
+func (s *scopeStruct) addWaveformData(d []byte) {
+	if len(d) < 3 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	division := decodeBCDByte(d[1])
+	divisionCount := decodeBCDByte(d[2])
+	d = d[3:]
+
+	if division == 1 {
+		if len(d) < 12 {
+			s.assembling = false
+			return
+		}
+		f1 := civControl.decodeFreqData(d[1:6])
+		f2 := civControl.decodeFreqData(d[6:11])
+		s.line = scopeLine{
+			receivedAt: time.Now(),
+			outOfRange: d[11] != 0,
+		}
+		switch d[0] {
+		case scopeModeCenter, scopeModeScrollCenter:
+			// The second frequency is the span in center mode.
+			if f2 < f1 {
+				s.line.freqFrom = f1 - f2
+			}
+			s.line.freqTo = f1 + f2
+		default:
+			s.line.freqFrom = f1
+			s.line.freqTo = f2
+		}
+		s.assembling = true
+		d = d[12:]
+	} else if !s.assembling || division != s.nextDivision {
+		// A division got lost, dropping the line.
+		s.assembling = false
+		return
+	}
+
+	s.line.data = append(s.line.data, d...)
+	s.nextDivision = division + 1
+
+	if division >= divisionCount {
+		s.assembling = false
+		if len(s.line.data) > 0 {
+			s.publish(s.line)
+		}
+	}
+}
+
+// Resamples the line to the given width using the peak value of the covered points for each column.
+// Returned values are between 0 and 1.
+func (l *scopeLine) resample(width int) []float64 {
+	res := make([]float64, width)
+	if len(l.data) == 0 || width <= 0 {
+		return res
+	}
+	for x := range res {
+		from := x * len(l.data) / width
+		to := (x + 1) * len(l.data) / width
+		if to <= from {
+			to = from + 1
+		}
+		var peak byte
+		for _, v := range l.data[from:to] {
+			if v > peak {
+				peak = v
+			}
+		}
+		res[x] = float64(peak) / scopeMaxAmplitude
+		if res[x] > 1 {
+			res[x] = 1
+		}
+	}
+	return res
+}
+
+func (l *scopeLine) render(width int, chars []rune) string {
+	res := make([]rune, width)
+	for x, v := range l.resample(width) {
+		res[x] = chars[int(v*float64(len(chars)-1)+0.5)]
+	}
+	return string(res)
+}
+
+// Returns the line as a single row bar graph.
+func (l *scopeLine) renderSpectrum(width int) string {
+	return l.render(width, scopeSpectrumChars)
+}
+
+// Returns the line as a waterfall row using shades.
+func (l *scopeLine) renderWaterfall(width int) string {
+	return l.render(width, scopeWaterfallChars)
+}
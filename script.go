@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Scripts are Lua programs. Scripts named like on-<event> are event hooks.
+const scriptFileExt = ".lua"
+const scriptHookPrefix = "on-"
+const scriptSAboveHookEvent = "s-above"
+
+// Limits the depth of scripts running other scripts, so a script can't run itself forever.
+const scriptMaxRunDepth = 10
+
+// Scripts calling functions in a loop without sleeping are slowed down, so they can't flood the radio and
+// the log.
+const scriptMaxCallsWithoutSleep = 100
+const scriptThrottleInterval = 100 * time.Millisecond
+
+type script struct {
+	name  string
+	proto *lua.FunctionProto
+}
+
+type scriptHook struct {
+	scriptName string
+	event      string
+	sValue     int
+	proto      *lua.FunctionProto
+
+	running bool
+	// For s-above hooks, true while the S meter is at or above the hook's level.
+	above bool
+}
+
+type scriptRun struct {
+	name string
+	// Closed when the run should be stopped.
+	stopChan chan bool
+	depth    int
+
+	callsWithoutSleep int
+	// Set when the script stops itself.
+	stopped bool
+}
+
+type scriptEngineStruct struct {
+	mutex   sync.Mutex
+	scripts map[string]*script
+	running map[string]*scriptRun
+	hooks   []*scriptHook
+	// Closed when running hooks should be stopped.
+	hooksStopChan chan bool
+}
+
+var scriptEngine scriptEngineStruct
+
+var errScriptStopped = errors.New("script stopped")
+
+// Compiles the source, errors contain the name and the line number.
+func compileScript(name, src string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(src), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// Returns the hook for scripts named like on-<event> or on-s-above-<s level>, or nil for other scripts.
+func newScriptHook(name string, proto *lua.FunctionProto) (*scriptHook, error) {
+	if !strings.HasPrefix(name, scriptHookPrefix) {
+		return nil, nil
+	}
+	event := strings.TrimPrefix(name, scriptHookPrefix)
+	h := &scriptHook{scriptName: name, event: strings.ToLower(event), proto: proto}
+	if strings.HasPrefix(h.event, scriptSAboveHookEvent+"-") {
+		var err error
+		if h.sValue, err = parseSValue(event[len(scriptSAboveHookEvent)+1:]); err != nil {
+			return nil, err
+		}
+		h.event = scriptSAboveHookEvent
+	} else if !isEventName(h.event) {
+		return nil, fmt.Errorf("unknown event %s", h.event)
+	}
+	return h, nil
+}
+
+// Loads all scripts from the script directory. Already running scripts and hooks are stopped.
+func (s *scriptEngineStruct) load() {
+	s.stopAll()
+
+	scripts := make(map[string]*script)
+	var hooks []*scriptHook
+	if scriptDir != "" {
+		files, err := filepath.Glob(filepath.Join(scriptDir, "*"+scriptFileExt))
+		if err != nil {
+			log.Error("can't list scripts: ", err)
+		}
+		for _, f := range files {
+			d, err := ioutil.ReadFile(f)
+			if err != nil {
+				log.Error("can't load script: ", err)
+				continue
+			}
+			name := strings.TrimSuffix(filepath.Base(f), scriptFileExt)
+			proto, err := compileScript(name, string(d))
+			if err != nil {
+				log.Error("can't parse script ", f, ": ", err)
+				continue
+			}
+			h, err := newScriptHook(name, proto)
+			if err != nil {
+				log.Error("can't load script ", f, ": ", err)
+				continue
+			}
+			if h != nil {
+				hooks = append(hooks, h)
+			}
+			scripts[name] = &script{name: name, proto: proto}
+		}
+	}
+
+	s.mutex.Lock()
+	s.scripts = scripts
+	s.hooks = hooks
+	s.hooksStopChan = make(chan bool)
+	s.mutex.Unlock()
+
+	if len(scripts) > 0 {
+		log.Print("loaded ", len(scripts), " scripts from ", scriptDir)
+	}
+}
+
+func (s *scriptEngineStruct) list() (res []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name := range s.scripts {
+		if s.running[name] != nil {
+			name += " (running)"
+		}
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return
+}
+
+// Starts the given script in the background.
+func (s *scriptEngineStruct) run(name string) error {
+	s.mutex.Lock()
+	sc := s.scripts[name]
+	s.mutex.Unlock()
+
+	if sc == nil {
+		return fmt.Errorf("unknown script %s", name)
+	}
+	return s.start(name, sc.proto)
+}
+
+// Runs the compiled script in the background. The run can be stopped by the given name.
+func (s *scriptEngineStruct) start(name string, proto *lua.FunctionProto) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running[name] != nil {
+		return fmt.Errorf("script %s is already running", name)
+	}
+	if s.running == nil {
+		s.running = make(map[string]*scriptRun)
+	}
+	r := &scriptRun{name: name, stopChan: make(chan bool)}
+	s.running[name] = r
+
+	go func() {
+		log.Print("script ", name, " started")
+		err := s.exec(proto, r)
+		switch err {
+		case nil:
+			log.Print("script ", name, " finished")
+		case errScriptStopped:
+			log.Print("script ", name, " stopped")
+		default:
+			log.Error("script ", name, " error: ", err)
+		}
+
+		s.mutex.Lock()
+		if s.running[name] == r {
+			delete(s.running, name)
+		}
+		s.mutex.Unlock()
+	}()
+	return nil
+}
+
+func (s *scriptEngineStruct) stop(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r := s.running[name]
+	if r == nil {
+		return fmt.Errorf("script %s is not running", name)
+	}
+	close(r.stopChan)
+	delete(s.running, name)
+	return nil
+}
+
+// Stops all running scripts and hooks.
+func (s *scriptEngineStruct) stopAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, r := range s.running {
+		close(r.stopChan)
+		delete(s.running, name)
+	}
+	if s.hooksStopChan != nil {
+		close(s.hooksStopChan)
+		s.hooksStopChan = nil
+	}
+}
+
+// Runs the hook in the background, if it's not already running. Mutex must be held.
+func (s *scriptEngineStruct) runHook(h *scriptHook) {
+	if h.running || s.hooksStopChan == nil {
+		return
+	}
+	h.running = true
+
+	r := &scriptRun{name: h.scriptName, stopChan: s.hooksStopChan}
+	go func() {
+		if err := s.exec(h.proto, r); err != nil && err != errScriptStopped {
+			log.Error("script ", r.name, " error: ", err)
+		}
+
+		s.mutex.Lock()
+		h.running = false
+		s.mutex.Unlock()
+	}()
+}
+
+// Runs the hooks of the given event. Can be called with the civcontrol state mutex held.
+func (s *scriptEngineStruct) fire(event string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, h := range s.hooks {
+		if h.event == event {
+			s.runHook(h)
+		}
+	}
+}
+
+// Runs the s-above hooks when the S meter reaches their level.
+func (s *scriptEngineStruct) reportS(sValue int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, h := range s.hooks {
+		if h.event != scriptSAboveHookEvent {
+			continue
+		}
+		above := sValue >= h.sValue
+		if above && !h.above {
+			s.runHook(h)
+		}
+		h.above = above
+	}
+}
+
+func (s *scriptEngineStruct) wait(d time.Duration, r *scriptRun) error {
+	select {
+	case <-clock.after(d):
+		return nil
+	case <-r.stopChan:
+		return errScriptStopped
+	}
+}
+
+// Runs an external command and waits for it to finish.
+func (s *scriptEngineStruct) execCmd(args []string, r *scriptRun) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	finishedChan := make(chan error)
+	go func() {
+		finishedChan <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-finishedChan:
+	case <-r.stopChan:
+		_ = cmd.Process.Kill()
+		<-finishedChan
+		err = errScriptStopped
+	}
+	logCmdOutput(args[0], out.Bytes())
+	return err
+}
+
+// Durations can be given as a string like "500ms", or as a number of seconds.
+func getScriptDuration(L *lua.LState, n int) time.Duration {
+	switch v := L.CheckAny(n).(type) {
+	case lua.LNumber:
+		return time.Duration(float64(v) * float64(time.Second))
+	case lua.LString:
+		d, err := time.ParseDuration(string(v))
+		if err != nil {
+			L.ArgError(n, err.Error())
+		}
+		return d
+	}
+	L.ArgError(n, "duration expected")
+	return 0
+}
+
+// Runs a command prompt command with the arguments of the function, if it got any.
+func (s *scriptEngineStruct) setIfNeeded(L *lua.LState, cmd string) bool {
+	if L.GetTop() == 0 {
+		return false
+	}
+	args := []string{cmd}
+	for i := 1; i <= L.GetTop(); i++ {
+		args = append(args, L.CheckString(i))
+	}
+	if err := cmdPrompt.execute(strings.Join(args, " ")); err != nil {
+		L.RaiseError("%s", err)
+	}
+	return true
+}
+
+// Returns the functions available for scripts.
+func (s *scriptEngineStruct) getFuncs(r *scriptRun) map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"cmd": func(L *lua.LState) int {
+			if err := cmdPrompt.execute(L.CheckString(1)); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0
+		},
+		"freq": func(L *lua.LState) int {
+			if s.setIfNeeded(L, "freq") {
+				return 0
+			}
+			civControl.state.mutex.Lock()
+			defer civControl.state.mutex.Unlock()
+			L.Push(lua.LNumber(civControl.state.freq))
+			return 1
+		},
+		"mode": func(L *lua.LState) int {
+			if s.setIfNeeded(L, "mode") {
+				return 0
+			}
+			civControl.state.mutex.Lock()
+			defer civControl.state.mutex.Unlock()
+			mode := civOperatingModes[civControl.state.operatingModeIdx].name
+			if civControl.state.dataMode {
+				mode += "D"
+			}
+			L.Push(lua.LString(mode))
+			L.Push(lua.LString(civFilters[civControl.state.filterIdx].name))
+			return 2
+		},
+		"pwr": func(L *lua.LState) int {
+			if s.setIfNeeded(L, "pwr") {
+				return 0
+			}
+			civControl.state.mutex.Lock()
+			defer civControl.state.mutex.Unlock()
+			L.Push(lua.LNumber(civControl.state.pwrPercent))
+			return 1
+		},
+		"ptt": func(L *lua.LState) int {
+			civControl.state.mutex.Lock()
+			defer civControl.state.mutex.Unlock()
+			if L.GetTop() == 0 {
+				L.Push(lua.LBool(civControl.state.ptt))
+				return 1
+			}
+			if err := civControl.setPTT(L.CheckBool(1)); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0
+		},
+		"tune": func(L *lua.LState) int {
+			civControl.state.mutex.Lock()
+			defer civControl.state.mutex.Unlock()
+			if err := civControl.setTune(true); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0
+		},
+		"smeter": func(L *lua.LState) int {
+			civControl.state.mutex.Lock()
+			defer civControl.state.mutex.Unlock()
+			L.Push(lua.LNumber(civControl.state.sValue))
+			return 1
+		},
+		"slevel": func(L *lua.LState) int {
+			v, err := parseSValue(L.CheckString(1))
+			if err != nil {
+				L.ArgError(1, err.Error())
+			}
+			L.Push(lua.LNumber(v))
+			return 1
+		},
+		"sleep": func(L *lua.LState) int {
+			if err := s.wait(getScriptDuration(L, 1), r); err != nil {
+				L.RaiseError("%s", err)
+			}
+			r.callsWithoutSleep = 0
+			return 0
+		},
+		"play": func(L *lua.LState) int {
+			if err := audio.transmitFile(L.CheckString(1), r.stopChan); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0
+		},
+		"capture": func(L *lua.LState) int {
+			path := expandTimeFormat(L.CheckString(1), clock.now())
+			if err := audio.captureToFile(path, getScriptDuration(L, 2), r.stopChan); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0
+		},
+		"log": func(L *lua.LState) int {
+			var args []string
+			for i := 1; i <= L.GetTop(); i++ {
+				args = append(args, L.ToStringMeta(L.Get(i)).String())
+			}
+			log.Print(r.name, ": ", strings.Join(args, " "))
+			return 0
+		},
+		"exec": func(L *lua.LState) int {
+			args := []string{L.CheckString(1)}
+			for i := 2; i <= L.GetTop(); i++ {
+				args = append(args, L.CheckString(i))
+			}
+			if err := s.execCmd(args, r); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0
+		},
+		"run": func(L *lua.LState) int {
+			name := L.CheckString(1)
+			if r.depth >= scriptMaxRunDepth {
+				L.RaiseError("too many nested script runs")
+			}
+			s.mutex.Lock()
+			sc := s.scripts[name]
+			s.mutex.Unlock()
+			if sc == nil {
+				L.RaiseError("unknown script %s", name)
+			}
+			r.depth++
+			L.Push(L.NewFunctionFromProto(sc.proto))
+			L.Call(0, 0)
+			r.depth--
+			return 0
+		},
+		"stop": func(L *lua.LState) int {
+			r.stopped = true
+			L.RaiseError("%s", errScriptStopped)
+			return 0
+		},
+	}
+}
+
+// Runs the compiled script in a new Lua state and waits for it to finish.
+func (s *scriptEngineStruct) exec(proto *lua.FunctionProto, r *scriptRun) error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for name, f := range s.getFuncs(r) {
+		f := f
+		L.SetGlobal(name, L.NewFunction(func(L *lua.LState) int {
+			r.callsWithoutSleep++
+			n := f(L)
+			if r.callsWithoutSleep > scriptMaxCallsWithoutSleep {
+				if err := s.wait(scriptThrottleInterval, r); err != nil {
+					L.RaiseError("%s", err)
+				}
+			}
+			return n
+		}))
+	}
+
+	// The context interrupts the script even if it's running a loop without calling any functions.
+	ctx, cancel := context.WithCancel(context.Background())
+	finishedChan := make(chan bool)
+	defer close(finishedChan)
+	go func() {
+		select {
+		case <-r.stopChan:
+			cancel()
+		case <-finishedChan:
+		}
+	}()
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	err := L.PCall(0, 0, nil)
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-r.stopChan:
+		return errScriptStopped
+	default:
+	}
+	if r.stopped {
+		return errScriptStopped
+	}
+	// Only returning the message, without the stack trace.
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		return errors.New(apiErr.Object.String())
+	}
+	return err
+}
+
+func getDefaultScriptDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kappanhang", "scripts")
+}
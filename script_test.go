@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewScriptHook(t *testing.T) {
+	sValue, _ := parseSValue("S9+10")
+	tests := []struct {
+		name   string
+		event  string
+		sValue int
+		err    string
+	}{
+		{name: "ft8-20m"},
+		{name: "on-connect", event: "connect"},
+		{name: "on-PTT-ON", event: "ptt-on"},
+		{name: "on-s-above-S9+10", event: "s-above", sValue: sValue},
+		{name: "on-s-above-s5", event: "s-above", sValue: 5},
+		{name: "on-foo", err: "unknown event foo"},
+		{name: "on-s-above", err: "unknown event s-above"},
+		{name: "on-s-above-X", err: "invalid S meter value X"},
+	}
+	for _, tt := range tests {
+		h, err := newScriptHook(tt.name, nil)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("newScriptHook(%q) error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newScriptHook(%q) error %v", tt.name, err)
+			continue
+		}
+		if tt.event == "" {
+			if h != nil {
+				t.Errorf("newScriptHook(%q) returned a hook for a script", tt.name)
+			}
+			continue
+		}
+		if h == nil || h.event != tt.event || h.sValue != tt.sValue || h.scriptName != tt.name {
+			t.Errorf("newScriptHook(%q) got %+v, want event %s, s %d", tt.name, h, tt.event, tt.sValue)
+		}
+	}
+}
+
+// Scripts write to the output file with exec, so the order of the executed calls can be checked.
+func runTestScript(t *testing.T, src string, scripts map[string]string) (out string, err error) {
+	dir, err := ioutil.TempDir("", "kappanhang-script-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outFile := filepath.Join(dir, "out")
+	appendCmd := filepath.Join(dir, "append.sh")
+	if err := ioutil.WriteFile(appendCmd, []byte("#!/bin/sh\necho -n \"$1\" >> "+outFile+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var e scriptEngineStruct
+	e.scripts = make(map[string]*script)
+	for name, src := range scripts {
+		proto, err := compileScript(name, strings.ReplaceAll(src, "APPEND", "'"+appendCmd+"'"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.scripts[name] = &script{name: name, proto: proto}
+	}
+	proto, err := compileScript("test", strings.ReplaceAll(src, "APPEND", "'"+appendCmd+"'"))
+	if err != nil {
+		return "", err
+	}
+	r := &scriptRun{name: "test", stopChan: make(chan bool)}
+	err = e.exec(proto, r)
+
+	d, _ := ioutil.ReadFile(outFile)
+	return string(d), err
+}
+
+func TestScriptExec(t *testing.T) {
+	civControl.state.mutex.Lock()
+	civControl.state.freq = 14074000
+	civControl.state.ptt = false
+	civControl.state.operatingModeIdx = 1
+	civControl.state.dataMode = true
+	civControl.state.mutex.Unlock()
+	defer func() {
+		civControl.state.mutex.Lock()
+		civControl.state.freq = 0
+		civControl.state.operatingModeIdx = 0
+		civControl.state.dataMode = false
+		civControl.state.mutex.Unlock()
+	}()
+
+	tests := []struct {
+		src     string
+		scripts map[string]string
+		out     string
+		err     string
+	}{
+		{src: "exec(APPEND, 'a')\nexec(APPEND, 'b')", out: "ab"},
+		{src: "exec(APPEND, 'a'); exec(APPEND, 'b; c')", out: "ab; c"},
+		{src: "for i = 1, 3 do exec(APPEND, 'a') end exec(APPEND, 'b')", out: "aaab"},
+		{src: "if freq() >= 14000000 then exec(APPEND, 'a') else exec(APPEND, 'b') end", out: "a"},
+		{src: "if freq() == 14074000 and not ptt() then exec(APPEND, 'a') end", out: "a"},
+		{src: "local m, f = mode() exec(APPEND, m .. ' ' .. f)", out: "USBD FIL1"},
+		{src: "if slevel('S9+10') > slevel('s9') then exec(APPEND, 'a') end", out: "a"},
+		{src: "exec(APPEND, 'a') stop() exec(APPEND, 'b')", out: "a", err: errScriptStopped.Error()},
+		{src: "sleep('1ms') sleep(0.001) exec(APPEND, 'a')", out: "a"},
+		{src: "run('other') exec(APPEND, 'b')", scripts: map[string]string{"other": "exec(APPEND, 'a')"},
+			out: "ab"},
+		{src: "run('self')", scripts: map[string]string{"self": "run('self')"}, err: "too many nested script runs"},
+		{src: "run('other') exec(APPEND, 'b')", scripts: map[string]string{"other": "stop() exec(APPEND, 'a')"},
+			err: errScriptStopped.Error()},
+		{src: "exec(APPEND, 'a')\nsleep('x')", out: "a", err: "test:2: bad argument #1 to sleep"},
+		{src: "run('missing')", err: "test:1: unknown script missing"},
+		{src: "slevel('X')", err: "invalid S meter value X"},
+		{src: "freq(14.074) mode('usbd', 'fil1') pwr(10) cmd('vfo a')"},
+		{src: "cmd('foo')", err: "test:1: unknown command foo"},
+		{src: "if then", err: "test line:1"},
+	}
+	for _, tt := range tests {
+		out, err := runTestScript(t, tt.src, tt.scripts)
+		if tt.err == "" && err != nil {
+			t.Errorf("script %q error %v", tt.src, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("script %q error %v, want %q", tt.src, err, tt.err)
+		}
+		if out != tt.out {
+			t.Errorf("script %q output %q, want %q", tt.src, out, tt.out)
+		}
+	}
+}
+
+func TestScriptStop(t *testing.T) {
+	for _, src := range []string{"while true do sleep('1h') end", "while true do end"} {
+		proto, err := compileScript("test", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e scriptEngineStruct
+		r := &scriptRun{name: "test", stopChan: make(chan bool)}
+		finishedChan := make(chan error)
+		go func() {
+			finishedChan <- e.exec(proto, r)
+		}()
+		close(r.stopChan)
+
+		select {
+		case err := <-finishedChan:
+			if err != errScriptStopped {
+				t.Errorf("script %q got error %v, want %v", src, err, errScriptStopped)
+			}
+		case <-time.After(testWaitTimeout):
+			t.Fatalf("script %q has not been stopped", src)
+		}
+	}
+}
+
+func TestScriptThrottle(t *testing.T) {
+	c := useFakeClock(t)
+	proto, err := compileScript("test", "for i = 1, 3 do for j = 1, 100 do slevel('S1') end sleep(0) end "+
+		"for i = 0, 100 do slevel('S1') end")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e scriptEngineStruct
+	r := &scriptRun{name: "test", stopChan: make(chan bool)}
+	finishedChan := make(chan error)
+	go func() {
+		finishedChan <- e.exec(proto, r)
+	}()
+
+	// Only the last loop calls the functions more times than allowed without sleeping.
+	c.waitForTimer(t, c.now().Add(scriptThrottleInterval))
+	select {
+	case <-finishedChan:
+		t.Fatal("script has not been slowed down")
+	default:
+	}
+	c.advance(scriptThrottleInterval)
+	if err := <-finishedChan; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -43,7 +43,28 @@ type seqBufEntry struct {
 	data []byte
 }
 
-type requestRetransmitCallbackType func(r seqNumRange) error
+type requestRetransmitCallbackType func(r []seqNumRange) error
+
+// Missing packets are requested again with an exponentially growing interval, starting from twice the
+// roundtrip latency, until seqBufMaxRetransmitRequests is reached or the seqbuf gives up waiting for them.
+const seqBufMaxRetransmitRequests = 3
+const seqBufMinRetransmitRetryInterval = 10 * time.Millisecond
+
+// Weights of new samples in the smoothed inter-arrival interval and jitter, and in the smoothed gap fill time
+// and its deviation. The depth grows immediately, but shrinks with a small weight so a good link gets a lower
+// latency slowly, while a single late packet doesn't make the depth oscillate.
+const seqBufJitterWeight = 16
+const seqBufFillTimeWeight = 8
+const seqBufFillTimeDevWeight = 4
+const seqBufDepthShrinkWeight = 1024
+
+// A range of missing seqnums between the last returned entry and the most recently added entry.
+type seqBufGap struct {
+	r            seqNumRange
+	missingSince time.Time
+	requestedAt  time.Time
+	requests     int
+}
 
 type seqBuf struct {
 	length                    time.Duration
@@ -54,20 +75,26 @@ type seqBuf struct {
 	// Available entries coming out from the seqbuf will be sent to entryChan.
 	entryChan chan seqBufEntry
 
-	// If this is true then the seqBuf is locked, which means no entries will be sent to entryChan.
-	lockedByInvalidSeq bool
-	lockedAt           time.Time
-
 	// This is false until no packets have been sent to the entryChan.
 	alreadyReturnedFirstSeq bool
 	// The seqNum of the last packet sent to entryChan.
 	lastReturnedSeq seqNum
 
-	requestedRetransmit          bool
-	lastRequestedRetransmitRange seqNumRange
-
-	ignoreMissingPktsUntilEnabled bool
-	ignoreMissingPktsUntilSeq     seqNum
+	// No entries will be sent to entryChan while the first gap is right after the last returned entry, until
+	// the gap is filled or the seqbuf gives up waiting for it.
+	gaps []seqBufGap
+
+	// The seqbuf works as an adaptive jitter buffer: depth is how long it waits for a missing entry. It's
+	// adjusted between jitterBufferMin and jitterBufferMax based on the inter-arrival jitter, the time it takes
+	// to fill gaps (either by reordered or retransmitted packets) and the roundtrip latency.
+	depth           time.Duration
+	gotArrival      bool
+	lastArrivalSeq  seqNum
+	lastArrivalAt   time.Time
+	arrivalInterval time.Duration
+	jitter          time.Duration
+	fillTime        time.Duration
+	fillTimeDev     time.Duration
 
 	// Note that the most recently added entry is stored as the 0th entry.
 	entries []seqBufEntry
@@ -191,6 +218,8 @@ func (s *seqBuf) add(seq seqNum, data []byte) error {
 		return errors.New("seq out of range")
 	}
 
+	s.trackArrival(seq)
+
 	if len(s.entries) == 0 {
 		s.addToFront(seq, data)
 		return nil
@@ -226,51 +255,186 @@ func (s *seqBuf) add(seq seqNum, data []byte) error {
 	return nil
 }
 
-func (s *seqBuf) checkLockTimeout() (timeout bool, shouldRetryIn time.Duration) {
-	timeSinceLastInvalidSeq := time.Since(s.lockedAt)
-	lockDuration := s.length
-	if lockDuration < controlStreamLatency*2 {
-		lockDuration = controlStreamLatency * 2
+func (s *seqBuf) clampDepth() {
+	if jitterBufferMax > 0 && s.depth > jitterBufferMax {
+		s.depth = jitterBufferMax
+	}
+	if s.depth < jitterBufferMin {
+		s.depth = jitterBufferMin
 	}
-	if lockDuration > timeSinceLastInvalidSeq {
-		shouldRetryIn = lockDuration - timeSinceLastInvalidSeq
+}
+
+func (s *seqBuf) updateDepth() {
+	target := 4 * s.jitter
+	if t := s.fillTime + 4*s.fillTimeDev; t > target {
+		target = t
+	}
+	if t := controlStreamLatency * 2; t > target {
+		target = t
+	}
+
+	if target > s.depth {
+		s.depth = target
+	} else {
+		s.depth -= (s.depth - target) / seqBufDepthShrinkWeight
+	}
+	s.clampDepth()
+}
+
+func (s *seqBuf) addFillTimeSample(t time.Duration) {
+	if s.fillTime == 0 {
+		s.fillTime = t
+		s.fillTimeDev = t / 2
 		return
 	}
+	diff := t - s.fillTime
+	if diff < 0 {
+		diff = -diff
+	}
+	s.fillTimeDev += (diff - s.fillTimeDev) / seqBufFillTimeDevWeight
+	s.fillTime += (t - s.fillTime) / seqBufFillTimeWeight
+}
 
-	s.lockedByInvalidSeq = false
-	// log.Debug("lock timeout")
+// Updates the gap fill time if seq fills a gap, otherwise the inter-arrival jitter, like in RFC 3550 but
+// using the smoothed inter-arrival interval instead of sender timestamps.
+func (s *seqBuf) trackArrival(seq seqNum) {
+	now := clock.now()
+	for _, g := range s.gaps {
+		if s.compareSeq(seq, g.r[0]) != smaller && s.compareSeq(seq, g.r[1]) != larger {
+			s.addFillTimeSample(now.Sub(g.missingSince))
+			s.updateDepth()
+			return
+		}
+	}
 
-	if s.requestedRetransmit {
-		s.ignoreMissingPktsUntilSeq = s.lastRequestedRetransmitRange[1]
-		s.ignoreMissingPktsUntilEnabled = true
+	if s.gotArrival {
+		if s.compareSeq(seq, s.lastArrivalSeq) != larger {
+			return
+		}
+
+		steps := time.Duration(s.getDiff(seq, s.lastArrivalSeq))
+		interval := now.Sub(s.lastArrivalAt)
+		if s.arrivalInterval == 0 {
+			s.arrivalInterval = interval / steps
+		} else {
+			s.arrivalInterval += (interval/steps - s.arrivalInterval) / seqBufJitterWeight
+		}
+		d := interval - steps*s.arrivalInterval
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (d - s.jitter) / seqBufJitterWeight
+		s.updateDepth()
 	}
+	s.gotArrival = true
+	s.lastArrivalSeq = seq
+	s.lastArrivalAt = now
+}
 
-	return true, 0
+// Changes the length of a running seqbuf. The depth continues adapting from the new length.
+func (s *seqBuf) setLength(length time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.length = length
+	s.depth = length
+	s.clampDepth()
 }
 
-// Returns true if all entries from the requested retransmit range have been received.
-func (s *seqBuf) gotRetransmitRange() bool {
-	entryIdx := len(s.entries)
-	rangeSeq := s.lastRequestedRetransmitRange[0]
+func (s *seqBuf) getDepth() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.depth
+}
 
-	for {
-		entryIdx--
-		if entryIdx < 0 {
-			return false
+func (s *seqBuf) getRetransmitRetryInterval(requests int) time.Duration {
+	interval := controlStreamLatency * 2
+	if interval < seqBufMinRetransmitRetryInterval {
+		interval = seqBufMinRetransmitRetryInterval
+	}
+	return interval << (requests - 1)
+}
+
+// Updates the list of gaps. Gaps which were already known keep their retransmit request state, even if
+// they have been partially filled since.
+func (s *seqBuf) updateGaps() {
+	var gaps []seqBufGap
+	expectedSeq := s.lastReturnedSeq.inc(s.maxSeqNum)
+	oldGapIdx := 0
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		seq := s.entries[i].seq
+		if s.compareSeq(seq, s.lastReturnedSeq) != larger { // Out of order entry, it will be dropped.
+			continue
+		}
+
+		if seq != expectedSeq {
+			g := seqBufGap{
+				r:            seqNumRange{expectedSeq, seq.dec(s.maxSeqNum)},
+				missingSince: clock.now(),
+			}
+			for ; oldGapIdx < len(s.gaps); oldGapIdx++ {
+				o := s.gaps[oldGapIdx]
+				if s.compareSeq(g.r[0], o.r[1]) == larger {
+					continue
+				}
+				if s.compareSeq(g.r[0], o.r[0]) != smaller {
+					g.missingSince = o.missingSince
+					g.requestedAt = o.requestedAt
+					g.requests = o.requests
+				}
+				break
+			}
+			gaps = append(gaps, g)
+		}
+		expectedSeq = seq.inc(s.maxSeqNum)
+	}
+	s.gaps = gaps
+}
+
+// Requests retransmit of all gaps which are due in one request, and returns the time when the next
+// retransmit request will be due.
+func (s *seqBuf) requestRetransmits() (nextRequestIn time.Duration, err error) {
+	var ranges []seqNumRange
+	var requestedGaps []int
+	for i := range s.gaps {
+		g := &s.gaps[i]
+		if g.requests >= seqBufMaxRetransmitRequests || g.r.getDiff(s.maxSeqNum) > maxRetransmitRequestPacketCount {
+			continue
 		}
 
-		if s.entries[entryIdx].seq != rangeSeq {
-			// log.Debug("entry idx ", entryIdx, " seq #", s.entries[entryIdx].seq, " does not match ", rangeSeq)
-			// log.Debug(s.string())
-			return false
+		if g.requests > 0 {
+			if wait := s.getRetransmitRetryInterval(g.requests) - clock.since(g.requestedAt); wait > 0 {
+				if nextRequestIn == 0 || wait < nextRequestIn {
+					nextRequestIn = wait
+				}
+				continue
+			}
 		}
+		ranges = append(ranges, g.r)
+		requestedGaps = append(requestedGaps, i)
+	}
 
-		if rangeSeq == s.lastRequestedRetransmitRange[1] {
-			return true
+	if len(ranges) == 0 || s.requestRetransmitCallback == nil {
+		return
+	}
+	if err = s.requestRetransmitCallback(ranges); err != nil {
+		// The gaps are not counted as requested, so they are requested again with the shortest interval.
+		if wait := s.getRetransmitRetryInterval(1); nextRequestIn == 0 || wait < nextRequestIn {
+			nextRequestIn = wait
 		}
+		return
+	}
 
-		rangeSeq = rangeSeq.inc(s.maxSeqNum)
+	for _, i := range requestedGaps {
+		g := &s.gaps[i]
+		g.requestedAt = clock.now()
+		g.requests++
+		if g.requests < seqBufMaxRetransmitRequests {
+			if wait := s.getRetransmitRetryInterval(g.requests); nextRequestIn == 0 || wait < nextRequestIn {
+				nextRequestIn = wait
+			}
+		}
 	}
+	return
 }
 
 // shouldRetryIn is only filled when no entry is available, but there are entries in the seqbuf.
@@ -288,52 +452,32 @@ func (s *seqBuf) get() (e seqBufEntry, shouldRetryIn time.Duration, err error) {
 	e = s.entries[lastEntryIdx]
 
 	if s.alreadyReturnedFirstSeq {
-		if s.lockedByInvalidSeq {
-			if s.requestedRetransmit && s.gotRetransmitRange() {
-				s.lockedByInvalidSeq = false
-				// log.Debug("lock over")
-			} else {
-				var timeout bool
-				if timeout, shouldRetryIn = s.checkLockTimeout(); !timeout {
-					return
+		if s.compareSeq(e.seq, seqNum(s.lastReturnedSeq)) != larger {
+			// log.Debug("ignoring out of order seq ", e.seq)
+			s.entries = s.entries[:lastEntryIdx]
+			err = s.errOutOfOrder
+			return
+		}
+
+		s.updateGaps()
+		nextRequestIn, requestErr := s.requestRetransmits()
+
+		if len(s.gaps) > 0 && s.gaps[0].r[0] == s.lastReturnedSeq.inc(s.maxSeqNum) {
+			if wait := s.depth - clock.since(s.gaps[0].missingSince); wait > 0 {
+				// log.Debug("waiting for seq ", s.gaps[0].r[0])
+				shouldRetryIn = wait
+				if nextRequestIn > 0 && nextRequestIn < shouldRetryIn {
+					shouldRetryIn = nextRequestIn
 				}
-			}
-		} else {
-			if s.compareSeq(e.seq, seqNum(s.lastReturnedSeq)) != larger {
-				// log.Debug("ignoring out of order seq ", e.seq)
-				s.entries = s.entries[:lastEntryIdx]
-				err = s.errOutOfOrder
+				err = requestErr
 				return
 			}
+			// log.Debug("lock timeout, skipping seq ", s.gaps[0].r[0], "-", s.gaps[0].r[1])
+			s.gaps = s.gaps[1:]
 
-			if s.ignoreMissingPktsUntilEnabled {
-				if s.compareSeq(e.seq, s.ignoreMissingPktsUntilSeq) == larger {
-					// log.Debug("ignore over ", e.seq, " ", s.ignoreMissingPktsUntilSeq)
-					s.ignoreMissingPktsUntilEnabled = false
-				} //else {
-				// log.Debug("ignoring missing pkt, seq #", e.seq, " until ", s.ignoreMissingPktsUntilSeq)
-				//}
-			} else {
-				expectedNextSeq := s.lastReturnedSeq.inc(s.maxSeqNum)
-
-				if e.seq != expectedNextSeq {
-					// log.Debug("lock on, expected seq ", expectedNextSeq, " got ", e.seq)
-					s.lockedByInvalidSeq = true
-					s.lockedAt = time.Now()
-					s.requestedRetransmit = false
-					s.ignoreMissingPktsUntilEnabled = false
-					shouldRetryIn = s.length
-
-					if s.requestRetransmitCallback != nil {
-						s.lastRequestedRetransmitRange[0] = expectedNextSeq
-						s.lastRequestedRetransmitRange[1] = e.seq.dec(s.maxSeqNum)
-						if err = s.requestRetransmitCallback(s.lastRequestedRetransmitRange); err == nil {
-							s.requestedRetransmit = true
-						}
-					}
-					return
-				}
-			}
+			// Waiting longer next time, as the gap could not be filled in time.
+			s.depth += s.depth / 2
+			s.clampDepth()
 		}
 	}
 
@@ -349,9 +493,10 @@ func (s *seqBuf) watcher() {
 		s.watcherCloseDoneChan <- true
 	}()
 
-	entryAvailableTimer := time.NewTimer(0)
-	<-entryAvailableTimer.C
+	entryAvailableTimer := clock.newTimer(0)
+	<-entryAvailableTimer.c()
 	var entryAvailableTimerRunning bool
+	var entryAvailableAt time.Time
 
 	for {
 		retry := true
@@ -374,10 +519,21 @@ func (s *seqBuf) watcher() {
 			} else {
 				if err == s.errOutOfOrder {
 					retry = true
-				} else if !entryAvailableTimerRunning && t > 0 {
-					// An entry will be available later, waiting for it.
-					entryAvailableTimer.Reset(t)
-					entryAvailableTimerRunning = true
+				} else if t > 0 {
+					// An entry will be available later, waiting for it. The timer is rearmed if it's
+					// needed sooner than it would fire.
+					at := clock.now().Add(t)
+					if !entryAvailableTimerRunning || at.Before(entryAvailableAt) {
+						if entryAvailableTimerRunning && !entryAvailableTimer.stop() {
+							select {
+							case <-entryAvailableTimer.c():
+							default:
+							}
+						}
+						entryAvailableTimer.reset(t)
+						entryAvailableTimerRunning = true
+						entryAvailableAt = at
+					}
 				}
 			}
 		}
@@ -386,27 +542,37 @@ func (s *seqBuf) watcher() {
 		case <-s.watcherCloseNeededChan:
 			return
 		case <-s.entryAddedChan:
-		case <-entryAvailableTimer.C:
+		case <-entryAvailableTimer.c():
 			entryAvailableTimerRunning = false
 		}
 	}
 }
 
-// Setting a max. seqnum diff is optional. If it's 0 then the diff will be half of the maxSeqNum range.
-// Available entries coming out from the seqbuf will be sent to entryChan.
-func (s *seqBuf) init(length time.Duration, maxSeqNum, maxSeqNumDiff seqNum, entryChan chan seqBufEntry,
+// Sets up the seqbuf without starting the watcher, so entries can be fed with add() and taken out with get()
+// synchronously.
+func (s *seqBuf) setup(length time.Duration, maxSeqNum, maxSeqNumDiff seqNum, entryChan chan seqBufEntry,
 	requestRetransmitCallback requestRetransmitCallbackType) {
 	s.length = length
 	s.maxSeqNum = maxSeqNum
 	s.maxSeqNumDiff = maxSeqNumDiff
+	s.depth = length
+	s.clampDepth()
 	s.entryChan = entryChan
 	s.requestRetransmitCallback = requestRetransmitCallback
 
 	s.entryAddedChan = make(chan bool)
-	s.watcherCloseNeededChan = make(chan bool)
-	s.watcherCloseDoneChan = make(chan bool)
 
 	s.errOutOfOrder = errors.New("out of order pkt")
+}
+
+// Setting a max. seqnum diff is optional. If it's 0 then the diff will be half of the maxSeqNum range.
+// Available entries coming out from the seqbuf will be sent to entryChan.
+func (s *seqBuf) init(length time.Duration, maxSeqNum, maxSeqNumDiff seqNum, entryChan chan seqBufEntry,
+	requestRetransmitCallback requestRetransmitCallbackType) {
+	s.setup(length, maxSeqNum, maxSeqNumDiff, entryChan, requestRetransmitCallback)
+
+	s.watcherCloseNeededChan = make(chan bool)
+	s.watcherCloseDoneChan = make(chan bool)
 
 	go s.watcher()
 }
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testSeqBufLength = 100 * time.Millisecond
+
+// Packets are identified by their offset from the start seqnum, so they can be compared across the 0xffff
+// wraparound.
+type testSeqBufArrival struct {
+	off int
+	at  time.Duration
+}
+
+type testSeqBufResult struct {
+	returned  []int
+	requested [][2]int
+}
+
+// Feeds the arrivals to a seqbuf on a fake clock, and takes out entries with get() after every arrival and
+// whenever get() asks for a retry, until the seqbuf gets empty.
+func runTestSeqBuf(t testing.TB, start seqNum, arrivals []testSeqBufArrival) (res testSeqBufResult) {
+	t.Helper()
+
+	c := useFakeClock(t)
+	prevJitterBufferMin := jitterBufferMin
+	prevJitterBufferMax := jitterBufferMax
+	jitterBufferMin = testSeqBufLength
+	jitterBufferMax = 0
+	defer func() {
+		jitterBufferMin = prevJitterBufferMin
+		jitterBufferMax = prevJitterBufferMax
+	}()
+
+	getOff := func(seq seqNum) int {
+		return (int(seq) - int(start)) & 0xffff
+	}
+
+	var s seqBuf
+	s.setup(testSeqBufLength, 0xffff, 0, nil, func(r []seqNumRange) error {
+		for _, rr := range r {
+			res.requested = append(res.requested, [2]int{getOff(rr[0]), getOff(rr[1])})
+		}
+		return nil
+	})
+
+	drain := func() (retryIn time.Duration) {
+		for {
+			e, retryIn, err := s.get()
+			if err == s.errOutOfOrder {
+				continue
+			}
+			if err != nil || retryIn > 0 {
+				return retryIn
+			}
+			off := int(binary.LittleEndian.Uint32(e.data))
+			if getOff(e.seq) != off&0xffff {
+				t.Fatalf("got seq %d with the data of offset %d", e.seq, off)
+			}
+			res.returned = append(res.returned, off)
+		}
+	}
+
+	arrivals = append([]testSeqBufArrival(nil), arrivals...)
+	sort.SliceStable(arrivals, func(i, j int) bool {
+		return arrivals[i].at < arrivals[j].at
+	})
+
+	var now time.Duration
+	for i := 0; ; {
+		retryIn := drain()
+		if retryIn > 0 && (i == len(arrivals) || now+retryIn < arrivals[i].at) {
+			c.advance(retryIn)
+			now += retryIn
+			continue
+		}
+		if i == len(arrivals) {
+			break
+		}
+
+		c.advance(arrivals[i].at - now)
+		now = arrivals[i].at
+		d := make([]byte, 4)
+		binary.LittleEndian.PutUint32(d, uint32(arrivals[i].off))
+		if err := s.add(seqNum((int(start)+arrivals[i].off)&0xffff), d); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	}
+	return
+}
+
+// Converts the fuzz input to arrivals, one packet for every byte. Packets nominally arrive every 10ms. The
+// lowest 3 bits being 0 means the packet is lost, bit 3 duplicates it, and the upper 4 bits delay its arrival.
+// The delay is always shorter than the seqbuf length, so every packet arrives before its gap times out.
+func getTestSeqBufArrivals(d []byte) (arrivals []testSeqBufArrival) {
+	for i, b := range d {
+		if b&0x07 == 0 {
+			continue
+		}
+		a := testSeqBufArrival{
+			off: i,
+			at:  time.Duration(i)*10*time.Millisecond + time.Duration(b>>4)*3*time.Millisecond,
+		}
+		arrivals = append(arrivals, a)
+		if b&0x08 != 0 {
+			a.at += time.Duration(b&0x07) * 7 * time.Millisecond
+			arrivals = append(arrivals, a)
+		}
+	}
+	return
+}
+
+func checkTestSeqBufResult(t testing.TB, arrivals []testSeqBufArrival, res testSeqBufResult) {
+	t.Helper()
+
+	arrived := make(map[int]bool)
+	for _, a := range arrivals {
+		arrived[a.off] = true
+	}
+
+	for i, off := range res.returned {
+		if !arrived[off] {
+			t.Fatalf("returned offset %d which did not arrive", off)
+		}
+		if i > 0 && off <= res.returned[i-1] {
+			t.Fatalf("returned offset %d after %d", off, res.returned[i-1])
+		}
+	}
+	if len(res.returned) == 0 {
+		if len(arrivals) > 0 {
+			t.Fatal("nothing returned")
+		}
+		return
+	}
+
+	// Packets older than the first returned one are dropped, but all later ones arrive before they would time
+	// out, so they have to come out.
+	first := res.returned[0]
+	last := res.returned[len(res.returned)-1]
+	returned := make(map[int]bool)
+	for _, off := range res.returned {
+		returned[off] = true
+	}
+	for off := range arrived {
+		if off > first && !returned[off] {
+			t.Fatalf("offset %d arrived but was not returned", off)
+		}
+	}
+
+	requested := make(map[int]bool)
+	for _, r := range res.requested {
+		if r[1] < r[0] || r[1]-r[0] > maxRetransmitRequestPacketCount {
+			t.Fatalf("requested invalid range %v", r)
+		}
+		for off := r[0]; off <= r[1]; off++ {
+			if off <= first {
+				t.Fatalf("requested offset %d before the first returned offset %d", off, first)
+			}
+			requested[off] = true
+		}
+	}
+
+	// Every gap which is small enough has to be requested.
+	for off := first + 1; off < last; {
+		if arrived[off] {
+			off++
+			continue
+		}
+		gapEnd := off
+		for !arrived[gapEnd+1] {
+			gapEnd++
+		}
+		if gapEnd-off < maxRetransmitRequestPacketCount {
+			for o := off; o <= gapEnd; o++ {
+				if !requested[o] {
+					t.Fatalf("gap %d-%d was not requested, requests: %v", off, gapEnd, res.requested)
+				}
+			}
+		}
+		off = gapEnd + 1
+	}
+}
+
+func TestSeqBuf(t *testing.T) {
+	ms := time.Millisecond
+	inOrder := func(offs ...int) (arrivals []testSeqBufArrival) {
+		for i, off := range offs {
+			arrivals = append(arrivals, testSeqBufArrival{off: off, at: time.Duration(i) * 10 * ms})
+		}
+		return
+	}
+
+	tests := []struct {
+		name      string
+		start     seqNum
+		arrivals  []testSeqBufArrival
+		returned  []int
+		requested [][2]int
+	}{
+		{
+			name:     "in order",
+			arrivals: inOrder(0, 1, 2, 3),
+			returned: []int{0, 1, 2, 3},
+		},
+		{
+			name:     "wraparound",
+			start:    0xfffe,
+			arrivals: inOrder(0, 1, 2, 3),
+			returned: []int{0, 1, 2, 3},
+		},
+		{
+			name:      "reordered",
+			arrivals:  inOrder(0, 2, 1, 3),
+			returned:  []int{0, 1, 2, 3},
+			requested: [][2]int{{1, 1}},
+		},
+		{
+			name:      "reordered across wraparound",
+			start:     0xfffe,
+			arrivals:  inOrder(0, 2, 3, 1, 4),
+			returned:  []int{0, 1, 2, 3, 4},
+			requested: [][2]int{{1, 1}, {1, 1}},
+		},
+		{
+			name:     "duplicates",
+			arrivals: inOrder(0, 1, 1, 2, 0, 3, 3),
+			returned: []int{0, 1, 2, 3},
+		},
+		{
+			name:     "older than the first returned",
+			arrivals: inOrder(1, 0, 2),
+			returned: []int{1, 2},
+		},
+		{
+			name:      "gap filled by a retransmit",
+			arrivals:  append(inOrder(0, 1, 3, 4), testSeqBufArrival{off: 2, at: 50 * ms}),
+			returned:  []int{0, 1, 2, 3, 4},
+			requested: [][2]int{{2, 2}, {2, 2}},
+		},
+		{
+			name:      "lost packet across wraparound",
+			start:     0xfffe,
+			arrivals:  inOrder(0, 1, 3, 4),
+			returned:  []int{0, 1, 3, 4},
+			requested: [][2]int{{2, 2}, {2, 2}, {2, 2}},
+		},
+		{
+			name:      "multiple gaps requested at once",
+			arrivals:  inOrder(0, 2, 4, 7),
+			returned:  []int{0, 2, 4, 7},
+			requested: [][2]int{{1, 1}, {1, 1}, {3, 3}, {3, 3}, {5, 6}, {1, 1}, {5, 6}, {3, 3}, {5, 6}},
+		},
+		{
+			name:     "too large gap is not requested",
+			arrivals: inOrder(0, maxRetransmitRequestPacketCount+3),
+			returned: []int{0, maxRetransmitRequestPacketCount + 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := runTestSeqBuf(t, tt.start, tt.arrivals)
+			if !reflect.DeepEqual(res.returned, tt.returned) {
+				t.Errorf("returned %v, expected %v", res.returned, tt.returned)
+			}
+			if !reflect.DeepEqual(res.requested, tt.requested) {
+				t.Errorf("requested %v, expected %v", res.requested, tt.requested)
+			}
+			checkTestSeqBufResult(t, tt.arrivals, res)
+		})
+	}
+}
+
+func TestSeqBufRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		d := make([]byte, 1+rnd.Intn(256))
+		rnd.Read(d)
+		start := seqNum(rnd.Intn(0x10000))
+		arrivals := getTestSeqBufArrivals(d)
+		checkTestSeqBufResult(t, arrivals, runTestSeqBuf(t, start, arrivals))
+	}
+}
+
+func FuzzSeqBuf(f *testing.F) {
+	f.Add(uint16(0), []byte{0x01, 0x01, 0x01, 0x01})
+	f.Add(uint16(0xfffd), []byte{0x01, 0xf1, 0x01, 0x00, 0x19, 0x01, 0x00, 0x00, 0x01})
+	f.Add(uint16(0xfff0), []byte{0x11, 0x21, 0x31, 0x41, 0x51, 0x61, 0x71, 0x81, 0x91, 0xa1, 0xb1, 0xc1, 0xd1,
+		0xe1, 0xf1, 0xff, 0xef, 0xdf, 0xcf, 0xbf, 0xaf, 0x9f, 0x8f, 0x7f, 0x6f, 0x5f, 0x4f, 0x3f, 0x2f, 0x1f})
+
+	f.Fuzz(func(t *testing.T, start uint16, d []byte) {
+		if len(d) > 256 {
+			d = d[:256]
+		}
+		arrivals := getTestSeqBufArrivals(d)
+		checkTestSeqBufResult(t, arrivals, runTestSeqBuf(t, seqNum(start), arrivals))
+	})
+}
+
+// Starts a seqbuf with its watcher on the fake clock. Retransmit requests are sent to the returned channel.
+func startTestSeqBuf(t testing.TB) (s *seqBuf, entryChan chan seqBufEntry, requestChan chan []seqNumRange) {
+	prevJitterBufferMin := jitterBufferMin
+	jitterBufferMin = testSeqBufLength
+	t.Cleanup(func() {
+		jitterBufferMin = prevJitterBufferMin
+	})
+
+	entryChan = make(chan seqBufEntry)
+	requestChan = make(chan []seqNumRange, seqBufMaxRetransmitRequests)
+	s = &seqBuf{}
+	s.init(testSeqBufLength, 0xffff, 0, entryChan, func(r []seqNumRange) error {
+		requestChan <- r
+		return nil
+	})
+	t.Cleanup(s.deinit)
+	return
+}
+
+// The watcher misses notifications while it's not waiting for them, so it's notified until it reacts.
+func expectTestSeqBufEntry(t testing.TB, s *seqBuf, entryChan chan seqBufEntry, seq seqNum) {
+	t.Helper()
+	for deadline := time.Now().Add(testWaitTimeout); time.Now().Before(deadline); {
+		s.notifyWatcher()
+		select {
+		case e := <-entryChan:
+			if e.seq != seq {
+				t.Fatal("got seq ", e.seq, ", expected ", seq)
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatal("seq ", seq, " not returned")
+}
+
+func expectTestSeqBufRequest(t testing.TB, s *seqBuf, requestChan chan []seqNumRange, expected []seqNumRange) {
+	t.Helper()
+	for deadline := time.Now().Add(testWaitTimeout); time.Now().Before(deadline); {
+		s.notifyWatcher()
+		select {
+		case r := <-requestChan:
+			if !reflect.DeepEqual(r, expected) {
+				t.Fatal("requested ", r, ", expected ", expected)
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatal("no retransmit requested")
+}
+
+// The watcher gives up waiting for a missing entry after the seqbuf length, and requests its retransmit
+// meanwhile.
+func TestSeqBufLockTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	s, entryChan, requestChan := startTestSeqBuf(t)
+
+	if err := s.add(0xfffe, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	expectTestSeqBufEntry(t, s, entryChan, 0xfffe)
+
+	if err := s.add(0, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	lockedAt := c.now()
+	expectTestSeqBufRequest(t, s, requestChan, []seqNumRange{{0xffff, 0xffff}})
+
+	for i := 1; i < seqBufMaxRetransmitRequests; i++ {
+		retryIn := s.getRetransmitRetryInterval(i)
+		c.waitForTimer(t, c.now().Add(retryIn))
+		c.advance(retryIn)
+		expectTestSeqBufRequest(t, s, requestChan, []seqNumRange{{0xffff, 0xffff}})
+	}
+
+	timeoutAt := lockedAt.Add(testSeqBufLength)
+	c.waitForTimer(t, timeoutAt)
+	c.advance(timeoutAt.Sub(c.now()))
+	expectTestSeqBufEntry(t, s, entryChan, 0)
+}
+
+// A new gap needs a retransmit retry sooner than the watcher's timer would fire for the previous gap.
+func TestSeqBufWatcherRearm(t *testing.T) {
+	c := useFakeClock(t)
+	s, entryChan, requestChan := startTestSeqBuf(t)
+	retryIn := s.getRetransmitRetryInterval(1)
+
+	if err := s.add(0, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	expectTestSeqBufEntry(t, s, entryChan, 0)
+
+	if err := s.add(2, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	expectTestSeqBufRequest(t, s, requestChan, []seqNumRange{{1, 1}})
+	c.waitForTimer(t, c.now().Add(retryIn))
+	c.advance(retryIn)
+	expectTestSeqBufRequest(t, s, requestChan, []seqNumRange{{1, 1}})
+	c.waitForTimer(t, c.now().Add(s.getRetransmitRetryInterval(2)))
+
+	c.advance(retryIn / 2)
+	if err := s.add(4, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	expectTestSeqBufRequest(t, s, requestChan, []seqNumRange{{3, 3}})
+	c.waitForTimer(t, c.now().Add(retryIn))
+	c.advance(retryIn)
+	expectTestSeqBufRequest(t, s, requestChan, []seqNumRange{{3, 3}})
+}
+
+// Gaps are only counted as requested if the request could be sent.
+func TestSeqBufRetransmitRequestError(t *testing.T) {
+	c := useFakeClock(t)
+
+	var requests int
+	var s seqBuf
+	s.setup(testSeqBufLength, 0xffff, 0, nil, func(r []seqNumRange) error {
+		requests++
+		if requests <= 2 {
+			return errors.New("send failed")
+		}
+		return nil
+	})
+
+	for _, seq := range []seqNum{0, 2} {
+		if err := s.add(seq, []byte{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := s.get(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, retryIn, err := s.get()
+		if err == nil || retryIn != s.getRetransmitRetryInterval(1) {
+			t.Fatal("expected a failed request and a retry in ", s.getRetransmitRetryInterval(1), ", got ", err,
+				" and ", retryIn)
+		}
+		if s.gaps[0].requests != 0 {
+			t.Fatal("failed request counted")
+		}
+		c.advance(retryIn)
+	}
+
+	if _, _, err := s.get(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 || s.gaps[0].requests != 1 {
+		t.Fatal("got ", requests, " requests, ", s.gaps[0].requests, " counted, expected 3 and 1")
+	}
+}
+
+func TestSeqBufSetLength(t *testing.T) {
+	prevJitterBufferMin, prevJitterBufferMax := jitterBufferMin, jitterBufferMax
+	jitterBufferMin, jitterBufferMax = 50*time.Millisecond, 150*time.Millisecond
+	defer func() {
+		jitterBufferMin, jitterBufferMax = prevJitterBufferMin, prevJitterBufferMax
+	}()
+
+	var s seqBuf
+	s.setup(testSeqBufLength, 0xffff, 0, nil, nil)
+	for _, tt := range []struct{ length, depth time.Duration }{
+		{120 * time.Millisecond, 120 * time.Millisecond},
+		{time.Second, 150 * time.Millisecond},
+		{10 * time.Millisecond, 50 * time.Millisecond},
+	} {
+		s.setLength(tt.length)
+		if d := s.getDepth(); d != tt.depth {
+			t.Error("depth is ", d, " after setting length to ", tt.length, ", expected ", tt.depth)
+		}
+	}
+}
@@ -2,12 +2,10 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"time"
 )
 
 const maxSerialFrameLength = 80 // Max. frame length according to Hamlib.
-const serialRxSeqBufLength = 100 * time.Millisecond
 
 type serialStream struct {
 	common streamCommon
@@ -23,7 +21,7 @@ type serialStream struct {
 	readFromSerialPort struct {
 		buf          bytes.Buffer
 		frameStarted bool
-		frameTimeout *time.Timer
+		frameTimeout clockTimer
 	}
 
 	deinitNeededChan   chan bool
@@ -31,12 +29,8 @@ type serialStream struct {
 }
 
 func (s *serialStream) send(d []byte) error {
-	l := byte(len(d))
-	p := append([]byte{0x15 + l, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		byte(s.common.localSID >> 24), byte(s.common.localSID >> 16), byte(s.common.localSID >> 8), byte(s.common.localSID),
-		byte(s.common.remoteSID >> 24), byte(s.common.remoteSID >> 16), byte(s.common.remoteSID >> 8), byte(s.common.remoteSID),
-		0xc1, l, 0x00, byte(s.sendSeq >> 8), byte(s.sendSeq)}, d...)
-	if err := s.common.pkt0.sendTrackedPacket(&s.common, p); err != nil {
+	p := pktSerialData{pktHeader: newPktHeader(&s.common, pktTypeData, 0), sendSeq: s.sendSeq, data: d}
+	if err := s.common.sendTrackedPkt(&p); err != nil {
 		return err
 	}
 	s.sendSeq++
@@ -44,18 +38,8 @@ func (s *serialStream) send(d []byte) error {
 }
 
 func (s *serialStream) sendOpenClose(close bool) error {
-	var magic byte
-	if close {
-		magic = 0x00
-	} else {
-		magic = 0x05
-	}
-
-	p := []byte{0x16, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		byte(s.common.localSID >> 24), byte(s.common.localSID >> 16), byte(s.common.localSID >> 8), byte(s.common.localSID),
-		byte(s.common.remoteSID >> 24), byte(s.common.remoteSID >> 16), byte(s.common.remoteSID >> 8), byte(s.common.remoteSID),
-		0xc0, 0x01, 0x00, byte(s.sendSeq >> 8), byte(s.sendSeq), magic}
-	if err := s.common.pkt0.sendTrackedPacket(&s.common, p); err != nil {
+	p := pktSerialOpenClose{pktHeader: newPktHeader(&s.common, pktTypeData, 0), sendSeq: s.sendSeq, open: !close}
+	if err := s.common.sendTrackedPkt(&p); err != nil {
 		return err
 	}
 	s.sendSeq++
@@ -86,11 +70,12 @@ func (s *serialStream) handleRxSeqBufEntry(e seqBufEntry) {
 	s.lastReceivedSeq = gotSeq
 	s.receivedSerialData = true
 
-	if s.common.pkt0.isPkt0(e.data) {
+	// Idle packets are also added to the seqbuf.
+	var p pktSerialData
+	if p.UnmarshalBinary(e.data) != nil {
 		return
 	}
-
-	e.data = e.data[21:]
+	e.data = p.data
 
 	if !civControl.decode(e.data) {
 		return
@@ -104,15 +89,15 @@ func (s *serialStream) handleRxSeqBufEntry(e seqBufEntry) {
 	}
 }
 
-func (s *serialStream) handleSerialPacket(r []byte) error {
-	gotSeq := binary.LittleEndian.Uint16(r[6:8])
-	return s.rxSeqBuf.add(seqNum(gotSeq), r)
-}
-
-func (s *serialStream) handleRead(r []byte) error {
+func (s *serialStream) handleRead(r receivedPkt) error {
 	// We add both idle pkt0 and serial data to the seqbuf.
-	if s.common.pkt0.isIdlePkt0(r) || (len(r) >= 22 && r[16] == 0xc1 && r[0]-0x15 == r[17]) {
-		return s.handleSerialPacket(r)
+	switch p := r.pkt.(type) {
+	case *pktHeader:
+		if p.typ == pktTypeData {
+			return s.rxSeqBuf.add(seqNum(p.seq), r.raw)
+		}
+	case *pktSerialData:
+		return s.rxSeqBuf.add(seqNum(p.seq), r.raw)
 	}
 	return nil
 }
@@ -142,7 +127,7 @@ func (s *serialStream) gotDataForRadio(r []byte) {
 				// Found the second start byte.
 				s.readFromSerialPort.buf.WriteByte(r[0])
 				r = r[1:]
-				s.readFromSerialPort.frameTimeout.Reset(100 * time.Millisecond)
+				s.readFromSerialPort.frameTimeout.reset(100 * time.Millisecond)
 				s.readFromSerialPort.frameStarted = true
 			}
 		}
@@ -152,10 +137,10 @@ func (s *serialStream) gotDataForRadio(r []byte) {
 		s.readFromSerialPort.buf.WriteByte(b)
 		if b == 0xfc || b == 0xfd || s.readFromSerialPort.buf.Len() == maxSerialFrameLength {
 			if err := s.send(s.readFromSerialPort.buf.Bytes()); err != nil {
-				reportError(err)
+				s.common.reportError(err)
 			}
-			if !s.readFromSerialPort.frameTimeout.Stop() {
-				<-s.readFromSerialPort.frameTimeout.C
+			if !s.readFromSerialPort.frameTimeout.stop() {
+				<-s.readFromSerialPort.frameTimeout.c()
 			}
 			s.readFromSerialPort.buf.Reset()
 			s.readFromSerialPort.frameStarted = false
@@ -173,13 +158,13 @@ func (s *serialStream) loop() {
 
 			case r := <-s.common.readChan:
 				if err := s.handleRead(r); err != nil {
-					reportError(err)
+					s.common.reportError(err)
 				}
 			case e := <-s.rxSeqBufEntryChan:
 				s.handleRxSeqBufEntry(e)
 			case r := <-serialTCPSrv.fromClient:
 				s.gotDataForRadio(r)
-			case <-s.readFromSerialPort.frameTimeout.C:
+			case <-s.readFromSerialPort.frameTimeout.c():
 				s.readFromSerialPort.buf.Reset()
 				s.readFromSerialPort.frameStarted = false
 			case <-s.deinitNeededChan:
@@ -192,13 +177,13 @@ func (s *serialStream) loop() {
 			select {
 			case r := <-s.common.readChan:
 				if err := s.handleRead(r); err != nil {
-					reportError(err)
+					s.common.reportError(err)
 				}
 			case e := <-s.rxSeqBufEntryChan:
 				s.handleRxSeqBufEntry(e)
 			case r := <-serialTCPSrv.fromClient:
 				s.gotDataForRadio(r)
-			case <-s.readFromSerialPort.frameTimeout.C:
+			case <-s.readFromSerialPort.frameTimeout.c():
 				s.readFromSerialPort.buf.Reset()
 				s.readFromSerialPort.frameStarted = false
 			case <-s.deinitNeededChan:
@@ -238,16 +223,15 @@ func (s *serialStream) init(devName string) error {
 	log.Print("stream started")
 
 	s.rxSeqBufEntryChan = make(chan seqBufEntry)
-	s.rxSeqBuf.init(serialRxSeqBufLength, 0xffff, 0, s.rxSeqBufEntryChan, s.common.requestRetransmit)
+	s.rxSeqBuf.init(getRxSeqBufLength(), 0xffff, 0, s.rxSeqBufEntryChan, s.common.requestRetransmit)
 
 	s.deinitNeededChan = make(chan bool)
 	s.deinitFinishedChan = make(chan bool)
 
-	s.readFromSerialPort.frameTimeout = time.NewTimer(0)
-	<-s.readFromSerialPort.frameTimeout.C
+	s.readFromSerialPort.frameTimeout = clock.newTimer(0)
+	<-s.readFromSerialPort.frameTimeout.c()
 
 	civControl.deinit()
-	civControl = civControlStruct{}
 	if err := civControl.init(s); err != nil {
 		return err
 	}
@@ -10,6 +10,9 @@ import (
 	"github.com/mattn/go-isatty"
 )
 
+// This many netstat samples are kept for the sparklines.
+const statusLogHistoryLength = 60
+
 type statusLogData struct {
 	line1 string
 	line2 string
@@ -39,9 +42,38 @@ type statusLogData struct {
 	ts           string
 	split        string
 	splitMode    splitMode
+	scan         string
+	scope        string
+	vfoBActive   bool
+
+	// Numeric values of the meters above for drawing bar graphs.
+	sValue         int
+	swrValue       float64
+	vdValue        float64
+	txPowerPercent int
 
 	startTime time.Time
 	rttStr    string
+	rtt       int
+	jbStr     string
+
+	up             int
+	down           int
+	lost           int
+	lostGaps       int
+	retransmits    int
+	retransmitGaps int
+
+	reconnects      int
+	probeFailures   int
+	reconnectReason string
+	reconnectWait   time.Duration
+
+	// One sample is stored every second for the sparklines.
+	lastHistoryAt time.Time
+	upHistory     []int
+	downHistory   []int
+	rttHistory    []int
 
 	audioMonOn    bool
 	audioRecOn    bool
@@ -59,6 +91,7 @@ type statusLogStruct struct {
 		retransmitsColor *color.Color
 		lostColor        *color.Color
 		splitColor       *color.Color
+		scanColor        *color.Color
 
 		stateStr struct {
 			tx   string
@@ -86,6 +119,17 @@ func (s *statusLogStruct) reportRTTLatency(l time.Duration) {
 		return
 	}
 	s.data.rttStr = fmt.Sprint(l.Milliseconds())
+	s.data.rtt = int(l.Milliseconds())
+}
+
+func (s *statusLogStruct) reportJitterBufferDepth(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data == nil {
+		return
+	}
+	s.data.jbStr = fmt.Sprint(d.Milliseconds())
 }
 
 func (s *statusLogStruct) updateAudioStateStr() {
@@ -210,16 +254,18 @@ func (s *statusLogStruct) reportVd(voltage float64) {
 		return
 	}
 	s.data.vd = fmt.Sprintf("%.1fV", voltage)
+	s.data.vdValue = voltage
 }
 
-func (s *statusLogStruct) reportS(sValue string) {
+func (s *statusLogStruct) reportS(sValue int, sStr string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if s.data == nil {
 		return
 	}
-	s.data.s = sValue
+	s.data.s = sStr
+	s.data.sValue = sValue
 }
 
 func (s *statusLogStruct) reportOVF(ovf bool) {
@@ -240,6 +286,7 @@ func (s *statusLogStruct) reportSWR(swr float64) {
 		return
 	}
 	s.data.swr = fmt.Sprintf("%.1f", swr)
+	s.data.swrValue = swr
 }
 
 func (s *statusLogStruct) reportTS(ts uint) {
@@ -282,6 +329,7 @@ func (s *statusLogStruct) reportTxPower(percent int) {
 		return
 	}
 	s.data.txPower = fmt.Sprint(percent, "%")
+	s.data.txPowerPercent = percent
 }
 
 func (s *statusLogStruct) reportRFGain(percent int) {
@@ -329,6 +377,44 @@ func (s *statusLogStruct) reportSplit(mode splitMode, split string) {
 	}
 }
 
+func (s *statusLogStruct) reportScan(state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data == nil {
+		return
+	}
+	if state == "" {
+		s.data.scan = ""
+	} else {
+		s.data.scan = s.preGenerated.scanColor.Sprint(state)
+	}
+}
+
+func (s *statusLogStruct) reportScope(enabled bool, settings string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data == nil {
+		return
+	}
+	if enabled {
+		s.data.scope = settings
+	} else {
+		s.data.scope = ""
+	}
+}
+
+func (s *statusLogStruct) reportVFO(bActive bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data == nil {
+		return
+	}
+	s.data.vfoBActive = bActive
+}
+
 func (s *statusLogStruct) clearInternal() {
 	fmt.Printf("%c[2K", 27)
 }
@@ -337,13 +423,20 @@ func (s *statusLogStruct) print() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if s.isRealtimeInternal() {
+	if tui.isActive() {
+		tui.update(s.data)
+	} else if s.isRealtimeInternal() {
+		line3 := s.data.line3
+		if p := cmdPrompt.render(); p != "" {
+			line3 = p + "\r"
+		}
 		s.clearInternal()
 		fmt.Println(s.data.line1)
 		s.clearInternal()
 		fmt.Println(s.data.line2)
 		s.clearInternal()
-		fmt.Printf(s.data.line3+"%c[1A%c[1A", 27, 27)
+		fmt.Print(line3)
+		fmt.Printf("%c[1A%c[1A", 27, 27)
 	} else {
 		log.PrintStatusLog(s.data.line3)
 	}
@@ -447,27 +540,51 @@ func (s *statusLogStruct) update() {
 				s.data.subMode, s.data.subDataMode, s.data.subFilter)
 		}
 	}
+	var scanStr string
+	if s.data.scan != "" {
+		scanStr = " " + s.data.scan
+	}
 	var swrStr string
 	if (s.data.tune || s.data.ptt) && s.data.swr != "" {
 		swrStr = " SWR" + s.data.swr
 	}
 	s.data.line2 = fmt.Sprint(stateStr, " ", fmt.Sprintf("%.6f", float64(s.data.frequency)/1000000),
-		tsStr, modeStr, splitStr, vdStr, txPowerStr, swrStr)
+		tsStr, modeStr, splitStr, scanStr, vdStr, txPowerStr, swrStr)
+
+	up, down, lost, lostGaps, retransmits, retransmitGaps := netstat.get()
+	s.data.up = up
+	s.data.down = down
+	s.data.lost = lost
+	s.data.lostGaps = lostGaps
+	s.data.retransmits = retransmits
+	s.data.retransmitGaps = retransmitGaps
+	s.data.reconnects, s.data.probeFailures, s.data.reconnectReason, s.data.reconnectWait = reconnect.getMetrics()
+	if time.Since(s.data.lastHistoryAt) >= time.Second {
+		s.data.upHistory = s.appendHistory(s.data.upHistory, up)
+		s.data.downHistory = s.appendHistory(s.data.downHistory, down)
+		s.data.rttHistory = s.appendHistory(s.data.rttHistory, s.data.rtt)
+		s.data.lastHistoryAt = time.Now()
+	}
 
-	up, down, lost, retransmits := netstat.get()
 	lostStr := "0"
 	if lost > 0 {
-		lostStr = s.preGenerated.lostColor.Sprint(" ", lost, " ")
+		lostStr = s.preGenerated.lostColor.Sprint(" ", lost, "/", lostGaps, " ")
 	}
 	retransmitsStr := "0"
 	if retransmits > 0 {
-		retransmitsStr = s.preGenerated.retransmitsColor.Sprint(" ", retransmits, " ")
+		retransmitsStr = s.preGenerated.retransmitsColor.Sprint(" ", retransmits, "/", retransmitGaps, " ")
+	}
+
+	var reconnectsStr string
+	if s.data.reconnects > 0 || s.data.probeFailures > 0 {
+		reconnectsStr = fmt.Sprint(" reconn ", s.data.reconnects, "/", s.data.probeFailures, " ", s.data.reconnectReason)
 	}
 
 	s.data.line3 = fmt.Sprint("up ", s.padLeft(fmt.Sprint(time.Since(s.data.startTime).Round(time.Second)), 6),
-		" rtt ", s.padLeft(s.data.rttStr, 3), "ms up ",
+		" rtt ", s.padLeft(s.data.rttStr, 3), "ms jb ", s.padLeft(s.data.jbStr, 3), "ms up ",
 		s.padLeft(netstat.formatByteCount(up), 8), "/s down ",
-		s.padLeft(netstat.formatByteCount(down), 8), "/s retx ", retransmitsStr, "/1m lost ", lostStr, "/1m\r")
+		s.padLeft(netstat.formatByteCount(down), 8), "/s retx ", retransmitsStr, "/1m lost ", lostStr, "/1m",
+		reconnectsStr, "\r")
 
 	if s.isRealtimeInternal() {
 		t := time.Now().Format("2006-01-02T15:04:05.000Z0700")
@@ -477,6 +594,14 @@ func (s *statusLogStruct) update() {
 	}
 }
 
+func (s *statusLogStruct) appendHistory(h []int, v int) []int {
+	h = append(h, v)
+	if len(h) > statusLogHistoryLength {
+		h = h[len(h)-statusLogHistoryLength:]
+	}
+	return h
+}
+
 func (s *statusLogStruct) loop() {
 	for {
 		select {
@@ -498,7 +623,8 @@ func (s *statusLogStruct) isRealtime() bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	return s.ticker != nil && s.isRealtimeInternal()
+	// Log lines are not interleaved with the status bar while the terminal UI is active.
+	return s.ticker != nil && s.isRealtimeInternal() && !tui.isActive()
 }
 
 func (s *statusLogStruct) isActive() bool {
@@ -518,6 +644,7 @@ func (s *statusLogStruct) startPeriodicPrint() {
 		s:             "S0",
 		startTime:     time.Now(),
 		rttStr:        "?",
+		jbStr:         "?",
 		audioStateStr: s.preGenerated.audioStateStr.off,
 	}
 
@@ -537,7 +664,7 @@ func (s *statusLogStruct) stopPeriodicPrint() {
 	s.stopChan <- true
 	<-s.stopFinishedChan
 
-	if s.isRealtimeInternal() {
+	if s.isRealtimeInternal() && !tui.isActive() {
 		s.clearInternal()
 		fmt.Println()
 		s.clearInternal()
@@ -556,6 +683,7 @@ func (s *statusLogStruct) initIfNeeded() {
 		statusLogInterval = time.Second
 	} else {
 		keyboard.init()
+		tui.init()
 	}
 
 	c := color.New(color.FgHiWhite)
@@ -582,4 +710,5 @@ func (s *statusLogStruct) initIfNeeded() {
 	s.preGenerated.lostColor.Add(color.BgRed)
 
 	s.preGenerated.splitColor = color.New(color.FgHiMagenta)
+	s.preGenerated.scanColor = color.New(color.FgHiCyan)
 }
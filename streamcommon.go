@@ -2,35 +2,75 @@ package main
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const expectTimeoutDuration = time.Second
 const maxRetransmitRequestPacketCount = 10
 
+// Sending is retried in place this many times on transient errors.
+const sendRetryCount = 3
+const sendRetryInterval = 5 * time.Millisecond
+
+// Unreachable errors got on reads are only reported if they keep coming for this long, as a single ICMP
+// unreachable message can be caused by a temporary network condition.
+const readUnreachableErrorTimeout = time.Second
+
+// A received datagram and its typed form, as returned by demuxPkt(). The reader demuxes every datagram once,
+// and the streams get both forms on their readChan.
+type receivedPkt struct {
+	raw []byte
+	pkt interface{} // nil if the datagram is unknown.
+}
+
+var lastStreamInstance uint32
+var streamInstanceMutex sync.Mutex
+
 type streamCommon struct {
 	name                    string
 	conn                    *net.UDPConn
 	localSID                uint32
 	remoteSID               uint32
 	gotRemoteSID            bool
-	readChan                chan []byte
+	readChan                chan receivedPkt
 	readerCloseNeededChan   chan bool
 	readerCloseFinishedChan chan bool
+	deinitializing          bool
+	deinitializingMutex     sync.Mutex
+
+	// Every initialized stream gets a new instance number, so errors reported by a previous instance of a
+	// restarted stream can be told apart.
+	instance uint32
 
 	pkt0 pkt0Type
 	pkt7 pkt7Type
 }
 
 func (s *streamCommon) send(d []byte) error {
-	if _, err := s.conn.Write(d); err != nil {
-		return err
+	// There's no connection while replaying a capture.
+	if s.conn == nil {
+		return nil
+	}
+	for i := 0; ; i++ {
+		_, err := s.conn.Write(d)
+		if err == nil {
+			break
+		}
+		if i == sendRetryCount || !isTransientNetError(err) {
+			return err
+		}
+		log.Debug(s.name+"/retrying send: ", err)
+		<-clock.after(sendRetryInterval)
 	}
 	netstat.add(len(d), 0)
+	packetCapture.add(s, d, true)
 	return nil
 }
 
@@ -39,29 +79,88 @@ func (s *streamCommon) read() ([]byte, error) {
 	n, _, err := s.conn.ReadFromUDP(b)
 	if err == nil {
 		netstat.add(0, n)
+		packetCapture.add(s, b[:n], false)
 	}
 	return b[:n], err
 }
 
+// These errors are caused by a full socket buffer, so reading or sending can be retried.
+func isTransientReadError(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN)
+}
+
+// These errors are caused by an ICMP unreachable message got for a previous packet. They are temporary if the
+// network is, but they also happen if the radio has been rebooted or left the network.
+func isUnreachableNetError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
+
+// Sending is retried on these errors, so the session is not lost because of a temporary network condition.
+func isTransientNetError(err error) bool {
+	return isTransientReadError(err) || isUnreachableNetError(err)
+}
+
+// Errors of the control stream mean that the session is lost, so they cause a relogin. Errors of the serial
+// and audio streams only restart the stream they happened in.
+func (s *streamCommon) reportError(err error) {
+	if s.isDeinitializing() {
+		return
+	}
+	if s.name == "control" {
+		reportError(err)
+		return
+	}
+	reportStreamError(streamError{name: s.name, instance: s.instance}, err)
+}
+
+func (s *streamCommon) isDeinitializing() bool {
+	s.deinitializingMutex.Lock()
+	defer s.deinitializingMutex.Unlock()
+	return s.deinitializing
+}
+
 func (s *streamCommon) reader() {
+	var unreachableSince time.Time
 	for {
+		var rp receivedPkt
 		r, err := s.read()
 		if err != nil {
-			reportError(err)
-		} else if s.pkt7.isPkt7(r) {
-			if err := s.pkt7.handle(s, r); err != nil {
-				reportError(err)
+			switch {
+			case isTransientReadError(err):
+				log.Debug(s.name+"/read error: ", err)
+				continue
+			case isUnreachableNetError(err):
+				if unreachableSince.IsZero() {
+					unreachableSince = clock.now()
+				}
+				if clock.since(unreachableSince) < readUnreachableErrorTimeout {
+					log.Debug(s.name+"/read error: ", err)
+					continue
+				}
+				unreachableSince = time.Time{}
 			}
-			// Don't let pkt7 packets further downstream.
-			continue
-		} else if s.pkt0.isPkt0(r) {
-			if err := s.pkt0.handle(s, r); err != nil {
-				reportError(err)
+			s.reportError(err)
+		} else {
+			unreachableSince = time.Time{}
+			rp.raw = r
+			rp.pkt, _ = demuxPkt(r)
+			switch p := rp.pkt.(type) {
+			case *pktPing:
+				if err := s.pkt7.handle(s, p); err != nil {
+					s.reportError(err)
+				}
+				// Don't let pkt7 packets further downstream.
+				continue
+			case *pktRetransmitRequest:
+				if err := s.pkt0.handle(s, p); err != nil {
+					s.reportError(err)
+				}
 			}
 		}
 
 		select {
-		case s.readChan <- r:
+		case s.readChan <- rp:
 		case <-s.readerCloseNeededChan:
 			s.readerCloseFinishedChan <- true
 			return
@@ -71,11 +170,12 @@ func (s *streamCommon) reader() {
 
 func (s *streamCommon) tryReceivePacket(timeout time.Duration, packetLength, matchStartByte int, b []byte) []byte {
 	var r []byte
-	timer := time.NewTimer(timeout)
+	timer := clock.newTimer(timeout)
 	for {
 		select {
-		case r = <-s.readChan:
-		case <-timer.C:
+		case rp := <-s.readChan:
+			r = rp.raw
+		case <-timer.c():
 			return nil
 		}
 
@@ -89,22 +189,34 @@ func (s *streamCommon) tryReceivePacket(timeout time.Duration, packetLength, mat
 func (s *streamCommon) expect(packetLength int, b []byte) ([]byte, error) {
 	r := s.tryReceivePacket(expectTimeoutDuration, packetLength, 0, b)
 	if r == nil {
-		return nil, errors.New(s.name + "/expect timeout - the server did not answer, check if it's running")
+		return nil, fmt.Errorf("%s/expect %w - the server did not answer, check if it's running", s.name, errTimeout)
 	}
 	return r, nil
 }
 
-func (s *streamCommon) sendPkt3() error {
-	p := []byte{0x10, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00,
-		byte(s.localSID >> 24), byte(s.localSID >> 16), byte(s.localSID >> 8), byte(s.localSID),
-		byte(s.remoteSID >> 24), byte(s.remoteSID >> 16), byte(s.remoteSID >> 8), byte(s.remoteSID)}
-	if err := s.send(p); err != nil {
+// Sends the given packet twice, as the radio's software does it for untracked packets.
+func (s *streamCommon) sendPktTwice(p encoding.BinaryMarshaler) error {
+	d, err := p.MarshalBinary()
+	if err != nil {
 		return err
 	}
-	if err := s.send(p); err != nil {
+	if err := s.send(d); err != nil {
 		return err
 	}
-	return nil
+	return s.send(d)
+}
+
+func (s *streamCommon) sendTrackedPkt(p encoding.BinaryMarshaler) error {
+	d, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return s.pkt0.sendTrackedPacket(s, d)
+}
+
+func (s *streamCommon) sendPkt3() error {
+	h := newPktHeader(s, pktTypeAreYouThere, 0)
+	return s.sendPktTwice(&h)
 }
 
 func (s *streamCommon) waitForPkt4Answer() error {
@@ -114,22 +226,18 @@ func (s *streamCommon) waitForPkt4Answer() error {
 	if err != nil {
 		return err
 	}
-	s.remoteSID = binary.BigEndian.Uint32(r[8:12])
+	var h pktHeader
+	if err := h.UnmarshalBinary(r); err != nil {
+		return err
+	}
+	s.remoteSID = h.sentID
 	s.gotRemoteSID = true
 	return nil
 }
 
 func (s *streamCommon) sendPkt6() error {
-	p := []byte{0x10, 0x00, 0x00, 0x00, 0x06, 0x00, 0x01, 0x00,
-		byte(s.localSID >> 24), byte(s.localSID >> 16), byte(s.localSID >> 8), byte(s.localSID),
-		byte(s.remoteSID >> 24), byte(s.remoteSID >> 16), byte(s.remoteSID >> 8), byte(s.remoteSID)}
-	if err := s.send(p); err != nil {
-		return err
-	}
-	if err := s.send(p); err != nil {
-		return err
-	}
-	return nil
+	h := newPktHeader(s, pktTypeAreYouReady, 1)
+	return s.sendPktTwice(&h)
 }
 
 func (s *streamCommon) waitForPkt6Answer() error {
@@ -140,74 +248,42 @@ func (s *streamCommon) waitForPkt6Answer() error {
 }
 
 func (s *streamCommon) sendRetransmitRequest(seqNum uint16) error {
-	p := []byte{0x10, 0x00, 0x00, 0x00, 0x01, 0x00, byte(seqNum), byte(seqNum >> 8),
-		byte(s.localSID >> 24), byte(s.localSID >> 16), byte(s.localSID >> 8), byte(s.localSID),
-		byte(s.remoteSID >> 24), byte(s.remoteSID >> 16), byte(s.remoteSID >> 8), byte(s.remoteSID)}
-	if err := s.send(p); err != nil {
-		return err
-	}
-	if err := s.send(p); err != nil {
-		return err
-	}
-	return nil
+	p := pktRetransmitRequest{pktHeader: newPktHeader(s, pktTypeRetransmitRequest, seqNum)}
+	return s.sendPktTwice(&p)
 }
 
 func (s *streamCommon) sendRetransmitRequestForRanges(seqNumRanges []seqNumRange) error {
-	seqNumBytes := make([]byte, len(seqNumRanges)*4)
-	for i := 0; i < len(seqNumRanges); i++ {
-		seqNumBytes[i*2] = byte(seqNumRanges[i][0])
-		seqNumBytes[i*2+1] = byte(seqNumRanges[i][0] >> 8)
-		seqNumBytes[i*2+2] = byte(seqNumRanges[i][1])
-		seqNumBytes[i*2+3] = byte(seqNumRanges[i][1] >> 8)
-	}
-	p := append([]byte{0x18, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
-		byte(s.localSID >> 24), byte(s.localSID >> 16), byte(s.localSID >> 8), byte(s.localSID),
-		byte(s.remoteSID >> 24), byte(s.remoteSID >> 16), byte(s.remoteSID >> 8), byte(s.remoteSID)},
-		seqNumBytes...)
-	if err := s.send(p); err != nil {
-		return err
-	}
-	if err := s.send(p); err != nil {
-		return err
-	}
-	return nil
+	p := pktRetransmitRequest{pktHeader: newPktHeader(s, pktTypeRetransmitRequest, 0), ranges: seqNumRanges}
+	return s.sendPktTwice(&p)
 }
 
-func (s *streamCommon) requestRetransmit(r seqNumRange) error {
-	diff := r.getDiff(0xffff)
-
-	if diff > maxRetransmitRequestPacketCount {
-		return errors.New("retransmit range too large")
+// All ranges are requested in one packet, or with a single seqnum request if there's only one missing packet.
+func (s *streamCommon) requestRetransmit(ranges []seqNumRange) error {
+	for _, r := range ranges {
+		if r.getDiff(0xffff) > maxRetransmitRequestPacketCount {
+			return errors.New("retransmit range too large")
+		}
 	}
 
-	if diff == 0 {
-		log.Debug(s.name+"/requesting pkt #", r[0], " retransmit")
-		netstat.reportRetransmit(diff)
-		if err := s.sendRetransmitRequest(uint16(r[0])); err != nil {
-			return err
-		}
-	} else {
-		log.Debug(s.name+"/requesting pkt #", r[0], "-#", r[1], " retransmit")
-		netstat.reportRetransmit(diff)
-		if err := s.sendRetransmitRequestForRanges([]seqNumRange{r}); err != nil {
-			return err
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			log.Debug(s.name+"/requesting pkt #", r[0], " retransmit")
+		} else {
+			log.Debug(s.name+"/requesting pkt #", r[0], "-#", r[1], " retransmit")
 		}
+		netstat.reportRetransmitRequest(r.getDiff(0xffff) + 1)
 	}
-	return nil
+
+	if len(ranges) == 1 && ranges[0][0] == ranges[0][1] {
+		return s.sendRetransmitRequest(uint16(ranges[0][0]))
+	}
+	return s.sendRetransmitRequestForRanges(ranges)
 }
 
 func (s *streamCommon) sendDisconnect() error {
 	log.Print(s.name + "/disconnecting")
-	p := []byte{0x10, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00,
-		byte(s.localSID >> 24), byte(s.localSID >> 16), byte(s.localSID >> 8), byte(s.localSID),
-		byte(s.remoteSID >> 24), byte(s.remoteSID >> 16), byte(s.remoteSID >> 8), byte(s.remoteSID)}
-	if err := s.send(p); err != nil {
-		return err
-	}
-	if err := s.send(p); err != nil {
-		return err
-	}
-	return nil
+	h := newPktHeader(s, pktTypeDisconnect, 0)
+	return s.sendPktTwice(&h)
 }
 
 func (s *streamCommon) start() error {
@@ -225,6 +301,10 @@ func (s *streamCommon) start() error {
 
 func (s *streamCommon) init(name string, portNumber int) error {
 	s.name = name
+	streamInstanceMutex.Lock()
+	lastStreamInstance++
+	s.instance = lastStreamInstance
+	streamInstanceMutex.Unlock()
 	hostPort := fmt.Sprint(connectAddress, ":", portNumber)
 	log.Print(s.name+"/connecting to ", hostPort)
 	raddr, err := net.ResolveUDPAddr("udp", hostPort)
@@ -241,7 +321,7 @@ func (s *streamCommon) init(name string, portNumber int) error {
 	laddr := s.conn.LocalAddr().(*net.UDPAddr)
 	s.localSID = binary.BigEndian.Uint32(laddr.IP[len(laddr.IP)-4:])<<16 | uint32(laddr.Port&0xffff)
 
-	s.readChan = make(chan []byte)
+	s.readChan = make(chan receivedPkt)
 	s.readerCloseNeededChan = make(chan bool)
 	s.readerCloseFinishedChan = make(chan bool)
 	go s.reader()
@@ -249,6 +329,9 @@ func (s *streamCommon) init(name string, portNumber int) error {
 }
 
 func (s *streamCommon) deinit() {
+	s.deinitializingMutex.Lock()
+	s.deinitializing = true
+	s.deinitializingMutex.Unlock()
 	s.pkt0.stopPeriodicSend()
 	s.pkt7.stopPeriodicSend()
 	if s.gotRemoteSID && s.conn != nil {
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamCommonReader(t *testing.T) {
+	conn, radio := newTestStreamConn(t)
+	s := streamCommon{name: "serial", conn: conn}
+	s.readChan = make(chan receivedPkt)
+	s.readerCloseNeededChan = make(chan bool)
+	s.readerCloseFinishedChan = make(chan bool)
+	go s.reader()
+	defer s.deinit()
+
+	h := pktHeader{typ: pktTypeIAmHere, sentID: 1, rcvdID: 2}
+	serialData := &pktSerialData{pktHeader: pktHeader{seq: 5}, sendSeq: 5, data: []byte{254, 254, 224, 0xa4, 0xfb, 253}}
+	for _, p := range []interface {
+		MarshalBinary() ([]byte, error)
+	}{&h, serialData, nil} {
+		d := []byte{1, 2, 3}
+		if p != nil {
+			var err error
+			if d, err = p.MarshalBinary(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := radio.WriteTo(d, conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+
+		var r receivedPkt
+		select {
+		case r = <-s.readChan:
+		case <-time.After(testWaitTimeout):
+			t.Fatal("no packet has been read")
+		}
+		if !bytes.Equal(r.raw, d) {
+			t.Errorf("got raw packet %x, want %x", r.raw, d)
+		}
+		switch want := p.(type) {
+		case *pktHeader:
+			if got, ok := r.pkt.(*pktHeader); !ok || *got != *want {
+				t.Errorf("got packet %#v, want %#v", r.pkt, want)
+			}
+		case *pktSerialData:
+			if got, ok := r.pkt.(*pktSerialData); !ok || got.seq != want.seq || !bytes.Equal(got.data, want.data) {
+				t.Errorf("got packet %#v, want %#v", r.pkt, want)
+			}
+		default:
+			if r.pkt != nil {
+				t.Errorf("got packet %#v for an unknown datagram", r.pkt)
+			}
+		}
+	}
+}
+
+func TestStreamCommonReaderUnreachable(t *testing.T) {
+	c := useFakeClock(t)
+	logs := observeLog(t)
+
+	// Sending to a closed port makes the next read fail with an unreachable error.
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	conn, err := net.DialUDP("udp", nil, closed.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := streamCommon{name: "serial", conn: conn, instance: 1}
+	s.readChan = make(chan receivedPkt)
+	s.readerCloseNeededChan = make(chan bool)
+	s.readerCloseFinishedChan = make(chan bool)
+	for len(gotStreamErrChan) > 0 {
+		<-gotStreamErrChan
+	}
+	go s.reader()
+
+	sendToClosedPort := func() {
+		if _, err := conn.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendToClosedPort()
+	waitForLog(t, logs, "serial/read error")
+	select {
+	case e := <-gotStreamErrChan:
+		t.Fatal("a single unreachable error got reported: ", e)
+	default:
+	}
+
+	c.advance(readUnreachableErrorTimeout)
+	sendToClosedPort()
+	select {
+	case e := <-gotStreamErrChan:
+		if e.name != "serial" || e.instance != 1 {
+			t.Error("got stream error ", e)
+		}
+	case <-time.After(testWaitTimeout):
+		t.Fatal("persisting unreachable errors not reported")
+	}
+
+	s.readerCloseNeededChan <- true
+	<-s.readerCloseFinishedChan
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"sync"
+	"time"
+)
+
+// Time to wait after tuning to a step before reading the S meter and OVF.
+const sweepDwellTime = 300 * time.Millisecond
+const sweepReadTimeout = time.Second
+
+// The heatmap is scaled to be at least this wide.
+const sweepHeatmapMinWidth = 800
+const sweepHeatmapRowHeight = 2
+
+// The largest S value returned by the S meter decoder (S9+60).
+const sweepMaxSValue = 19
+
+type sweepResult struct {
+	sValue int // -1 if the read failed.
+	ovf    bool
+}
+
+type sweeperStruct struct {
+	mutex       sync.Mutex
+	running     bool
+	autoStarted bool
+
+	freqs []uint
+	rows  [][]sweepResult
+
+	// These are buffered, so a reply is kept if it arrives before the measurement starts waiting for it.
+	gotSChan   chan int
+	gotOVFChan chan bool
+
+	// These are closed (not written to) as the sweep loop can also stop by itself.
+	stopNeededChan   chan bool
+	stopFinishedChan chan bool
+}
+
+var sweeper sweeperStruct
+
+var errSweepStopped = errors.New("sweep stopped")
+
+func (s *sweeperStruct) isRunning() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.running
+}
+
+func (s *sweeperStruct) reportS(sValue int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return
+	}
+	// Non-blocking notify.
+	select {
+	case s.gotSChan <- sValue:
+	default:
+	}
+}
+
+func (s *sweeperStruct) reportOVF(ovf bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return
+	}
+	// Non-blocking notify.
+	select {
+	case s.gotOVFChan <- ovf:
+	default:
+	}
+}
+
+// Drops the replies which arrived after a previous measurement has timed out.
+func (s *sweeperStruct) drainReplies() {
+	for {
+		select {
+		case <-s.gotSChan:
+		case <-s.gotOVFChan:
+		default:
+			return
+		}
+	}
+}
+
+func (s *sweeperStruct) wait(d time.Duration) error {
+	select {
+	case <-clock.after(d):
+		return nil
+	case <-s.stopNeededChan:
+		return errSweepStopped
+	}
+}
+
+func (s *sweeperStruct) measure(f uint) (r sweepResult, err error) {
+	r.sValue = -1
+
+	civControl.state.mutex.Lock()
+	err = civControl.setMainVFOFreq(f)
+	civControl.state.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	if err = s.wait(sweepDwellTime); err != nil {
+		return
+	}
+
+	s.drainReplies()
+	civControl.state.mutex.Lock()
+	err = civControl.getS()
+	if err == nil {
+		err = civControl.getOVF()
+	}
+	civControl.state.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	var gotS, gotOVF bool
+	timeout := clock.newTimer(sweepReadTimeout)
+	defer timeout.stop()
+	for !gotS || !gotOVF {
+		select {
+		case r.sValue = <-s.gotSChan:
+			gotS = true
+		case r.ovf = <-s.gotOVFChan:
+			gotOVF = true
+		case <-timeout.c():
+			if !gotS {
+				r.sValue = -1
+			}
+			return r, errors.New("s meter read timeout")
+		case <-s.stopNeededChan:
+			return r, errSweepStopped
+		}
+	}
+	return
+}
+
+func (s *sweeperStruct) writeCSV(t time.Time, f uint, r sweepResult) {
+	if sweepCSVFile == "" || r.sValue < 0 {
+		return
+	}
+	file, err := os.OpenFile(sweepCSVFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("can't open sweep csv: ", err)
+		return
+	}
+	defer file.Close()
+
+	var ovf int
+	if r.ovf {
+		ovf = 1
+	}
+	if _, err := fmt.Fprintf(file, "%s,%d,%d,%s,%d\n", t.UTC().Format(time.RFC3339), f, r.sValue,
+		formatSValue(r.sValue), ovf); err != nil {
+		log.Error("can't write sweep csv: ", err)
+	}
+}
+
+// Maps the S value to a black-blue-green-yellow-red color scale.
+func (s *sweeperStruct) getColor(r sweepResult) color.RGBA {
+	if r.sValue < 0 {
+		return color.RGBA{R: 64, G: 64, B: 64, A: 255}
+	}
+	if r.ovf {
+		return color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	}
+
+	v := float64(r.sValue) / sweepMaxSValue
+	if v > 1 {
+		v = 1
+	}
+	switch {
+	case v < 0.25:
+		return color.RGBA{B: uint8(v / 0.25 * 255), A: 255}
+	case v < 0.5:
+		v = (v - 0.25) / 0.25
+		return color.RGBA{G: uint8(v * 255), B: uint8((1 - v) * 255), A: 255}
+	case v < 0.75:
+		v = (v - 0.5) / 0.25
+		return color.RGBA{R: uint8(v * 255), G: 255, A: 255}
+	default:
+		v = (v - 0.75) / 0.25
+		return color.RGBA{R: 255, G: uint8((1 - v) * 255), A: 255}
+	}
+}
+
+// Writes the heatmap of all sweeps, the frequency is on the X axis, each sweep is a new row.
+func (s *sweeperStruct) writePNG() {
+	if sweepPNGFile == "" || len(s.rows) == 0 {
+		return
+	}
+
+	cellWidth := sweepHeatmapMinWidth / len(s.freqs)
+	if cellWidth < 1 {
+		cellWidth = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, len(s.freqs)*cellWidth, len(s.rows)*sweepHeatmapRowHeight))
+	for y, row := range s.rows {
+		for x, r := range row {
+			c := s.getColor(r)
+			for py := y * sweepHeatmapRowHeight; py < (y+1)*sweepHeatmapRowHeight; py++ {
+				for px := x * cellWidth; px < (x+1)*cellWidth; px++ {
+					img.SetRGBA(px, py, c)
+				}
+			}
+		}
+	}
+
+	file, err := os.Create(sweepPNGFile)
+	if err != nil {
+		log.Error("can't create sweep png: ", err)
+		return
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		log.Error("can't write sweep png: ", err)
+	}
+}
+
+func (s *sweeperStruct) loop() {
+	defer func() {
+		s.mutex.Lock()
+		s.running = false
+		s.mutex.Unlock()
+
+		statusLog.reportScan("")
+		close(s.stopFinishedChan)
+	}()
+
+	statusLog.reportScan("SWEEP")
+
+	for {
+		startedAt := clock.now()
+		row := make([]sweepResult, len(s.freqs))
+		for i, f := range s.freqs {
+			r, err := s.measure(f)
+			if err == errSweepStopped {
+				log.Print("sweep stopped")
+				return
+			}
+			if err != nil {
+				log.Debug("can't measure ", formatFreqMHz(f), ": ", err)
+			}
+			s.writeCSV(clock.now(), f, r)
+			row[i] = r
+		}
+		s.rows = append(s.rows, row)
+		s.writePNG()
+		log.Print("sweep #", len(s.rows), " finished in ", clock.since(startedAt).Round(time.Second))
+
+		if sweepCount > 0 && len(s.rows) >= sweepCount {
+			log.Print("all sweeps finished")
+			return
+		}
+
+		if wait := sweepInterval - clock.since(startedAt); wait > 0 {
+			if err := s.wait(wait); err != nil {
+				log.Print("sweep stopped")
+				return
+			}
+		}
+	}
+}
+
+func (s *sweeperStruct) start() (err error) {
+	if scanner.isRunning() {
+		return errors.New("scan is running")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running {
+		return nil
+	}
+	if s.freqs, err = parseFreqList(sweepFreqs, sweepStep); err != nil {
+		return
+	}
+	s.rows = nil
+
+	s.gotSChan = make(chan int, 1)
+	s.gotOVFChan = make(chan bool, 1)
+	s.stopNeededChan = make(chan bool)
+	s.stopFinishedChan = make(chan bool)
+	s.running = true
+
+	log.Print("sweep started on ", len(s.freqs), " steps")
+	go s.loop()
+	return nil
+}
+
+// The sweep is started automatically on the first connection if sweep frequencies are given.
+func (s *sweeperStruct) startIfNeeded() {
+	if s.autoStarted || sweepFreqs == "" {
+		return
+	}
+	s.autoStarted = true
+
+	if err := s.start(); err != nil {
+		log.Error("can't start sweep: ", err)
+	}
+}
+
+func (s *sweeperStruct) stop() {
+	s.mutex.Lock()
+	if !s.running {
+		s.mutex.Unlock()
+		return
+	}
+	close(s.stopNeededChan)
+	s.mutex.Unlock()
+
+	<-s.stopFinishedChan
+}
+
+func (s *sweeperStruct) toggle() error {
+	if s.isRunning() {
+		s.stop()
+		return nil
+	}
+	return s.start()
+}
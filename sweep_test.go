@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestSweeper() *sweeperStruct {
+	return &sweeperStruct{
+		running:          true,
+		gotSChan:         make(chan int, 1),
+		gotOVFChan:       make(chan bool, 1),
+		stopNeededChan:   make(chan bool),
+		stopFinishedChan: make(chan bool),
+	}
+}
+
+// Lets the sweeper wait for the dwell time, then answers its S meter and OVF queries.
+func stepTestSweeper(t *testing.T, c *fakeClock, s *sweeperStruct, sValue int, ovf bool) {
+	t.Helper()
+	c.waitForTimer(t, c.now().Add(sweepDwellTime))
+	c.advance(sweepDwellTime)
+	c.waitForTimer(t, c.now().Add(sweepReadTimeout))
+	s.reportS(sValue)
+	s.reportOVF(ovf)
+}
+
+func TestSweeperReport(t *testing.T) {
+	s := newTestSweeper()
+
+	// Replies are kept until they are read.
+	s.reportS(5)
+	s.reportOVF(true)
+	if v := <-s.gotSChan; v != 5 {
+		t.Errorf("got S value %d, want 5", v)
+	}
+	if v := <-s.gotOVFChan; !v {
+		t.Error("got no OVF")
+	}
+
+	s.reportS(1)
+	s.reportOVF(true)
+	s.drainReplies()
+	select {
+	case <-s.gotSChan:
+		t.Error("S value has not been drained")
+	case <-s.gotOVFChan:
+		t.Error("OVF has not been drained")
+	default:
+	}
+
+	s.running = false
+	s.reportS(1)
+	select {
+	case <-s.gotSChan:
+		t.Error("S value reported while not running")
+	default:
+	}
+}
+
+func TestSweeperMeasure(t *testing.T) {
+	c := useFakeClock(t)
+	s := newTestSweeper()
+	type result struct {
+		r   sweepResult
+		err error
+	}
+	resultChan := make(chan result)
+	measure := func() {
+		r, err := s.measure(14074000)
+		resultChan <- result{r, err}
+	}
+
+	// Late replies of a previous measurement are dropped.
+	s.reportS(1)
+	s.reportOVF(false)
+	go measure()
+	stepTestSweeper(t, c, s, 7, true)
+	if res := <-resultChan; res.err != nil || res.r.sValue != 7 || !res.r.ovf {
+		t.Errorf("got %+v, %v, want S7 with OVF", res.r, res.err)
+	}
+
+	go measure()
+	c.waitForTimer(t, c.now().Add(sweepDwellTime))
+	c.advance(sweepDwellTime)
+	c.waitForTimer(t, c.now().Add(sweepReadTimeout))
+	s.reportS(3)
+	for deadline := time.Now().Add(testWaitTimeout); len(s.gotSChan) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	c.advance(sweepReadTimeout)
+	if res := <-resultChan; res.err == nil || res.r.sValue != 3 {
+		t.Errorf("got %+v, %v, want S3 with a timeout error", res.r, res.err)
+	}
+
+	go measure()
+	c.waitForTimer(t, c.now().Add(sweepDwellTime))
+	c.advance(sweepDwellTime)
+	c.waitForTimer(t, c.now().Add(sweepReadTimeout))
+	c.advance(sweepReadTimeout)
+	if res := <-resultChan; res.err == nil || res.r.sValue != -1 {
+		t.Errorf("got %+v, %v, want a failed read", res.r, res.err)
+	}
+
+	go measure()
+	c.waitForTimer(t, c.now().Add(sweepDwellTime))
+	close(s.stopNeededChan)
+	if res := <-resultChan; res.err != errSweepStopped {
+		t.Errorf("got error %v, want %v", res.err, errSweepStopped)
+	}
+}
+
+func TestSweeperLoop(t *testing.T) {
+	c := useFakeClock(t)
+	logs := observeLog(t)
+	prevSweepCount, prevSweepInterval := sweepCount, sweepInterval
+	sweepCount, sweepInterval = 2, time.Minute
+	defer func() {
+		sweepCount, sweepInterval = prevSweepCount, prevSweepInterval
+	}()
+
+	s := newTestSweeper()
+	s.freqs = []uint{14074000, 14075000}
+	go s.loop()
+
+	stepTestSweeper(t, c, s, 1, false)
+	stepTestSweeper(t, c, s, 9, true)
+	// The next sweep starts after the sweep interval.
+	c.waitForTimer(t, c.now().Add(sweepInterval-2*sweepDwellTime))
+	c.advance(sweepInterval - 2*sweepDwellTime)
+	stepTestSweeper(t, c, s, 2, false)
+	stepTestSweeper(t, c, s, 3, false)
+
+	select {
+	case <-s.stopFinishedChan:
+	case <-time.After(testWaitTimeout):
+		t.Fatal("sweep has not been finished")
+	}
+	if s.isRunning() {
+		t.Error("sweeper is still running")
+	}
+	want := [][]sweepResult{{{1, false}, {9, true}}, {{2, false}, {3, false}}}
+	if len(s.rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(s.rows), len(want))
+	}
+	for i := range want {
+		for j := range want[i] {
+			if s.rows[i][j] != want[i][j] {
+				t.Errorf("row %d step %d got %+v, want %+v", i, j, s.rows[i][j], want[i][j])
+			}
+		}
+	}
+	if countLogs(logs, "all sweeps finished") != 1 {
+		t.Error("finish has not been logged")
+	}
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Expert Electronics TCI (Transceiver Control Interface) protocol server. Commands are text messages
+// like "vfo:0,0,14074000;", audio is carried in binary messages with a 64 byte header.
+
+const tciSendQueueLength = 64
+
+// Binary stream types.
+const (
+	tciStreamIQ       = 0
+	tciStreamRxAudio  = 1
+	tciStreamTxAudio  = 2
+	tciStreamTxChrono = 3
+)
+
+// Binary stream sample types.
+const (
+	tciSampleInt16   = 0
+	tciSampleFloat32 = 3
+)
+
+const tciStreamHeaderSize = 64
+
+type tciMsg struct {
+	opcode byte
+	data   []byte
+}
+
+type tciClient struct {
+	ws        *wsConn
+	sendChan  chan tciMsg
+	closeChan chan bool
+
+	// These are protected by the tci mutex.
+	audioEnabled bool
+	sampleType   uint32
+	channels     uint32
+}
+
+type tciStruct struct {
+	listener net.Listener
+	server   *http.Server
+
+	mutex   sync.Mutex
+	clients map[*tciClient]bool
+
+	// The client which turned on PTT with TCI as the audio source, it gets the TX chrono packets.
+	txClient *tciClient
+	txBuf    bytes.Buffer
+
+	// The last reported radio state.
+	freq     uint
+	subFreq  uint
+	mode     string
+	dataMode bool
+	split    bool
+	ptt      bool
+	tune     bool
+
+	deinitNeededChan   chan bool
+	deinitFinishedChan chan bool
+}
+
+var tci tciStruct
+
+func tciGetModulation(mode string, dataMode bool) string {
+	switch mode {
+	case "LSB":
+		if dataMode {
+			return "digl"
+		}
+	case "USB":
+		if dataMode {
+			return "digu"
+		}
+	case "CW-R":
+		return "cw"
+	case "RTTY-R":
+		return "rtty"
+	case "FM":
+		return "nfm"
+	}
+	return strings.ToLower(mode)
+}
+
+func tciParseModulation(m string) (modeIdx int, dataMode bool) {
+	name := strings.ToUpper(m)
+	switch name {
+	case "DIGL":
+		name = "LSB"
+		dataMode = true
+	case "DIGU":
+		name = "USB"
+		dataMode = true
+	case "NFM":
+		name = "FM"
+	}
+	for i := range civOperatingModes {
+		if civOperatingModes[i].name == name {
+			return i, dataMode
+		}
+	}
+	return -1, false
+}
+
+// Returns an approximate signal strength in dBm, S9 is -73dBm.
+func tciGetSMeterDBm(sValue int) int {
+	if sValue <= 9 {
+		return -127 + sValue*6
+	}
+	return -73 + (sValue-9)*10
+}
+
+// Mutex must be held.
+func (s *tciStruct) send(c *tciClient, opcode byte, data []byte) {
+	// Non-blocking send, slow clients lose messages.
+	select {
+	case c.sendChan <- tciMsg{opcode: opcode, data: data}:
+	default:
+	}
+}
+
+// Mutex must be held.
+func (s *tciStruct) broadcast(cmd string) {
+	for c := range s.clients {
+		s.send(c, wsOpText, []byte(cmd))
+	}
+}
+
+// The report functions can be called with the civcontrol state mutex held.
+func (s *tciStruct) reportFrequency(freq uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if freq != s.freq {
+		s.freq = freq
+		s.broadcast(fmt.Sprint("dds:0,", freq, ";"))
+		s.broadcast(fmt.Sprint("vfo:0,0,", freq, ";"))
+	}
+}
+
+func (s *tciStruct) reportSubFrequency(freq uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if freq != s.subFreq {
+		s.subFreq = freq
+		s.broadcast(fmt.Sprint("vfo:0,1,", freq, ";"))
+	}
+}
+
+func (s *tciStruct) reportMode(mode string, dataMode bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if mode != s.mode || dataMode != s.dataMode {
+		s.mode = mode
+		s.dataMode = dataMode
+		s.broadcast("modulation:0," + tciGetModulation(mode, dataMode) + ";")
+	}
+}
+
+func (s *tciStruct) reportSplit(split bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if split != s.split {
+		s.split = split
+		s.broadcast(fmt.Sprint("split_enable:0,", split, ";"))
+	}
+}
+
+func (s *tciStruct) reportPTT(ptt, tune bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ptt != s.ptt {
+		s.ptt = ptt
+		s.broadcast(fmt.Sprint("trx:0,", ptt, ";"))
+		if !ptt {
+			s.txClient = nil
+			s.txBuf.Reset()
+		}
+	}
+	if tune != s.tune {
+		s.tune = tune
+		s.broadcast(fmt.Sprint("tune:0,", tune, ";"))
+	}
+}
+
+func (s *tciStruct) getStreamHeader(c *tciClient, streamType uint32, length int) []byte {
+	h := make([]byte, tciStreamHeaderSize)
+	binary.LittleEndian.PutUint32(h[4:], audioSampleRate)
+	binary.LittleEndian.PutUint32(h[8:], c.sampleType)
+	binary.LittleEndian.PutUint32(h[20:], uint32(length))
+	binary.LittleEndian.PutUint32(h[24:], streamType)
+	binary.LittleEndian.PutUint32(h[28:], c.channels)
+	return h
+}
+
+// Converts s16le mono PCM to the format requested by the client. Mutex must be held.
+func (s *tciStruct) encodeAudio(c *tciClient, d []byte) []byte {
+	samples := len(d) / 2
+	res := s.getStreamHeader(c, tciStreamRxAudio, samples*int(c.channels))
+	for i := 0; i < samples; i++ {
+		v := int16(binary.LittleEndian.Uint16(d[i*2:]))
+		for ch := uint32(0); ch < c.channels; ch++ {
+			if c.sampleType == tciSampleFloat32 {
+				var b [4]byte
+				binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(v)/32768))
+				res = append(res, b[:]...)
+			} else {
+				res = append(res, byte(v), byte(v>>8))
+			}
+		}
+	}
+	return res
+}
+
+// Converts the audio received from the client to s16le mono PCM, only the first channel is used.
+func (s *tciStruct) decodeAudio(d []byte) []byte {
+	if len(d) < tciStreamHeaderSize {
+		return nil
+	}
+	sampleType := binary.LittleEndian.Uint32(d[8:])
+	length := int(binary.LittleEndian.Uint32(d[20:]))
+	channels := int(binary.LittleEndian.Uint32(d[28:]))
+	if channels == 0 {
+		channels = 1
+	}
+	d = d[tciStreamHeaderSize:]
+
+	sampleSize := 2
+	if sampleType == tciSampleFloat32 {
+		sampleSize = 4
+	} else if sampleType != tciSampleInt16 {
+		return nil
+	}
+	if length*sampleSize > len(d) {
+		length = len(d) / sampleSize
+	}
+
+	var res []byte
+	for i := 0; i+channels <= length; i += channels {
+		var v int16
+		if sampleType == tciSampleFloat32 {
+			f := math.Float32frombits(binary.LittleEndian.Uint32(d[i*4:]))
+			v = int16(math.Max(-32768, math.Min(32767, float64(f)*32768)))
+		} else {
+			v = int16(binary.LittleEndian.Uint16(d[i*2:]))
+		}
+		res = append(res, byte(v), byte(v>>8))
+	}
+	return res
+}
+
+// Sends the received audio to the clients which started the audio stream.
+func (s *tciStruct) reportRxAudio(d []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for c := range s.clients {
+		if c.audioEnabled {
+			s.send(c, wsOpBinary, s.encodeAudio(c, d))
+		}
+	}
+}
+
+// Mutex must be held.
+func (s *tciStruct) getInitMsgs() []string {
+	return []string{
+		"protocol:ExpertSDR3,1.8;",
+		"device:IC-705;",
+		"receive_only:false;",
+		"trx_count:1;",
+		"channels_count:2;",
+		"vfo_limits:30000,470000000;",
+		"if_limits:-24000,24000;",
+		"modulations_list:am,lsb,usb,cw,nfm,wfm,rtty,dv,digl,digu;",
+		fmt.Sprint("audio_samplerate:", audioSampleRate, ";"),
+		fmt.Sprint("dds:0,", s.freq, ";"),
+		"if:0,0,0;",
+		fmt.Sprint("vfo:0,0,", s.freq, ";"),
+		fmt.Sprint("vfo:0,1,", s.subFreq, ";"),
+		"modulation:0," + tciGetModulation(s.mode, s.dataMode) + ";",
+		"rx_enable:0,true;",
+		fmt.Sprint("split_enable:0,", s.split, ";"),
+		fmt.Sprint("trx:0,", s.ptt, ";"),
+		fmt.Sprint("tune:0,", s.tune, ";"),
+		"ready;",
+	}
+}
+
+func (s *tciStruct) reply(c *tciClient, a ...interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.send(c, wsOpText, []byte(fmt.Sprint(a...)))
+}
+
+func (s *tciStruct) setFreq(sub bool, arg string) error {
+	f, err := strconv.ParseUint(arg, 10, 0)
+	if err != nil || f == 0 {
+		return fmt.Errorf("invalid frequency %s", arg)
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+	if sub {
+		return civControl.setSubVFOFreq(uint(f))
+	}
+	return civControl.setMainVFOFreq(uint(f))
+}
+
+func (s *tciStruct) setModulation(arg string) error {
+	modeIdx, dataMode := tciParseModulation(arg)
+	if modeIdx < 0 {
+		return fmt.Errorf("unknown modulation %s", arg)
+	}
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	filterCode := civFilters[civControl.state.filterIdx].code
+	if err := civControl.setOperatingModeAndFilter(civOperatingModes[modeIdx].code, filterCode); err != nil {
+		return err
+	}
+	return civControl.setDataModeAndFilter(dataMode, filterCode)
+}
+
+func (s *tciStruct) setPTT(c *tciClient, args []string) error {
+	enable := args[1] == "true"
+	s.mutex.Lock()
+	if enable && len(args) > 2 && args[2] == "tci" {
+		s.txClient = c
+		s.txBuf.Reset()
+	}
+	s.mutex.Unlock()
+
+	civControl.state.mutex.Lock()
+	defer civControl.state.mutex.Unlock()
+
+	if enable && setDataModeOnTx {
+		if err := civControl.setDataMode(true); err != nil {
+			log.Error("can't enable data mode: ", err)
+		}
+	}
+	return civControl.setPTT(enable)
+}
+
+func (s *tciStruct) setAudioFormat(c *tciClient, name string, arg string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch name {
+	case "audio_samplerate":
+		if arg != fmt.Sprint(audioSampleRate) {
+			s.send(c, wsOpText, []byte(fmt.Sprint("audio_samplerate:", audioSampleRate, ";")))
+			return fmt.Errorf("unsupported sample rate %s", arg)
+		}
+	case "audio_stream_sample_type":
+		switch arg {
+		case "int16":
+			c.sampleType = tciSampleInt16
+		case "float32":
+			c.sampleType = tciSampleFloat32
+		default:
+			return fmt.Errorf("unsupported sample type %s", arg)
+		}
+	case "audio_stream_channels":
+		switch arg {
+		case "1":
+			c.channels = 1
+		case "2":
+			c.channels = 2
+		default:
+			return fmt.Errorf("unsupported channel count %s", arg)
+		}
+	}
+	s.send(c, wsOpText, []byte(name+":"+arg+";"))
+	return nil
+}
+
+// Processes a single command like vfo:0,0,14074000 (without the ending semicolon).
+func (s *tciStruct) processCmd(c *tciClient, cmd string) error {
+	var args []string
+	name := strings.ToLower(cmd)
+	if i := strings.Index(name, ":"); i >= 0 {
+		args = strings.Split(name[i+1:], ",")
+		name = name[:i]
+	}
+
+	switch name {
+	case "dds":
+		if len(args) < 2 {
+			s.mutex.Lock()
+			freq := s.freq
+			s.mutex.Unlock()
+			s.reply(c, "dds:0,", freq, ";")
+			return nil
+		}
+		return s.setFreq(false, args[1])
+	case "vfo":
+		if len(args) < 2 {
+			return fmt.Errorf("missing arguments for %s", name)
+		}
+		sub := args[1] == "1"
+		if len(args) < 3 {
+			s.mutex.Lock()
+			freq := s.freq
+			if sub {
+				freq = s.subFreq
+			}
+			s.mutex.Unlock()
+			s.reply(c, "vfo:0,", args[1], ",", freq, ";")
+			return nil
+		}
+		return s.setFreq(sub, args[2])
+	case "if":
+		s.reply(c, "if:0,0,0;")
+	case "modulation":
+		if len(args) < 2 {
+			s.mutex.Lock()
+			m := tciGetModulation(s.mode, s.dataMode)
+			s.mutex.Unlock()
+			s.reply(c, "modulation:0,", m, ";")
+			return nil
+		}
+		return s.setModulation(args[1])
+	case "trx":
+		if len(args) < 2 {
+			s.mutex.Lock()
+			ptt := s.ptt
+			s.mutex.Unlock()
+			s.reply(c, "trx:0,", ptt, ";")
+			return nil
+		}
+		return s.setPTT(c, args)
+	case "tune":
+		if len(args) < 2 {
+			s.mutex.Lock()
+			tune := s.tune
+			s.mutex.Unlock()
+			s.reply(c, "tune:0,", tune, ";")
+			return nil
+		}
+		civControl.state.mutex.Lock()
+		defer civControl.state.mutex.Unlock()
+		return civControl.setTune(args[1] == "true")
+	case "split_enable":
+		if len(args) < 2 {
+			s.mutex.Lock()
+			split := s.split
+			s.mutex.Unlock()
+			s.reply(c, "split_enable:0,", split, ";")
+			return nil
+		}
+		civControl.state.mutex.Lock()
+		defer civControl.state.mutex.Unlock()
+		if args[1] == "true" {
+			return civControl.setSplit(splitModeOn)
+		}
+		return civControl.setSplit(splitModeOff)
+	case "drive":
+		civControl.state.mutex.Lock()
+		defer civControl.state.mutex.Unlock()
+		if len(args) < 2 {
+			s.reply(c, "drive:0,", civControl.state.pwrPercent, ";")
+			return nil
+		}
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 || v > 100 {
+			return fmt.Errorf("invalid drive %s", args[1])
+		}
+		return civControl.setPwr(v)
+	case "rx_smeter":
+		civControl.state.mutex.Lock()
+		sValue := civControl.state.sValue
+		civControl.state.mutex.Unlock()
+		s.reply(c, "rx_smeter:0,0,", tciGetSMeterDBm(sValue), ";")
+	case "audio_start", "audio_stop":
+		s.mutex.Lock()
+		c.audioEnabled = name == "audio_start"
+		s.mutex.Unlock()
+		s.reply(c, name, ":0;")
+	case "audio_samplerate", "audio_stream_sample_type", "audio_stream_channels":
+		if len(args) < 1 {
+			return fmt.Errorf("missing arguments for %s", name)
+		}
+		return s.setAudioFormat(c, name, args[0])
+	case "iq_start":
+		return fmt.Errorf("iq streams are not supported by the radio")
+	case "start", "stop", "iq_stop", "rx_enable", "spot", "spot_delete", "spot_clear":
+		// Ignoring these.
+	default:
+		log.Debug("tci: ignoring unknown command ", cmd)
+	}
+	return nil
+}
+
+func (s *tciStruct) handleTxAudio(c *tciClient, d []byte) {
+	if len(d) < tciStreamHeaderSize || binary.LittleEndian.Uint32(d[24:]) != tciStreamTxAudio {
+		return
+	}
+	pcm := s.decodeAudio(d)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if c != s.txClient {
+		return
+	}
+	s.txBuf.Write(pcm)
+	// Dropping the oldest audio if the client sends too much.
+	if extra := s.txBuf.Len() - audioFrameSize*10; extra > 0 {
+		s.txBuf.Next(extra)
+	}
+}
+
+func (s *tciStruct) clientWriteLoop(c *tciClient) {
+	for {
+		select {
+		case m := <-c.sendChan:
+			if err := c.ws.writeMessage(m.opcode, m.data); err != nil {
+				c.ws.Close()
+				return
+			}
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
+func (s *tciStruct) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		log.Error("tci: ", err)
+		return
+	}
+	log.Print("tci client ", r.RemoteAddr, " connected")
+
+	c := &tciClient{
+		ws:         ws,
+		sendChan:   make(chan tciMsg, tciSendQueueLength),
+		closeChan:  make(chan bool),
+		sampleType: tciSampleFloat32,
+		channels:   2,
+	}
+	s.mutex.Lock()
+	for _, m := range s.getInitMsgs() {
+		s.send(c, wsOpText, []byte(m))
+	}
+	s.clients[c] = true
+	s.mutex.Unlock()
+
+	go s.clientWriteLoop(c)
+
+	for {
+		opcode, d, err := ws.readMessage()
+		if err != nil {
+			break
+		}
+		if opcode == wsOpBinary {
+			s.handleTxAudio(c, d)
+			continue
+		}
+		for _, cmd := range strings.Split(string(d), ";") {
+			if cmd = strings.TrimSpace(cmd); cmd == "" {
+				continue
+			}
+			if err := s.processCmd(c, cmd); err != nil {
+				log.Error("tci ", cmd, " error: ", err)
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	delete(s.clients, c)
+	wasTxClient := c == s.txClient
+	if wasTxClient {
+		s.txClient = nil
+	}
+	s.mutex.Unlock()
+
+	close(c.closeChan)
+	ws.Close()
+	log.Print("tci client ", r.RemoteAddr, " disconnected")
+
+	if wasTxClient {
+		civControl.state.mutex.Lock()
+		if err := civControl.setPTT(false); err != nil {
+			log.Error("can't turn off ptt: ", err)
+		}
+		civControl.state.mutex.Unlock()
+	}
+}
+
+// Requests TX audio from the transmitting client in every audio frame period, and forwards it to the radio.
+func (s *tciStruct) txLoop() {
+	ticker := time.NewTicker(audioFrameLength)
+	defer ticker.Stop()
+
+	chronoSamples := audioFrameSize / audioSampleBytes
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.deinitNeededChan:
+			s.deinitFinishedChan <- true
+			return
+		}
+
+		var frame []byte
+		s.mutex.Lock()
+		if c := s.txClient; c != nil {
+			length := chronoSamples * int(c.channels)
+			sampleSize := 2
+			if c.sampleType == tciSampleFloat32 {
+				sampleSize = 4
+			}
+			s.send(c, wsOpBinary, append(s.getStreamHeader(c, tciStreamTxChrono, length),
+				make([]byte, length*sampleSize)...))
+
+			if s.txBuf.Len() >= audioFrameSize {
+				frame = make([]byte, audioFrameSize)
+				_, _ = s.txBuf.Read(frame)
+			}
+		}
+		s.mutex.Unlock()
+
+		if frame == nil {
+			continue
+		}
+		select {
+		case audio.rec <- frame:
+		case <-time.After(audioFrameLength):
+			// The audio stream is not running.
+		case <-s.deinitNeededChan:
+			s.deinitFinishedChan <- true
+			return
+		}
+	}
+}
+
+// Started once like the internal rigctld, so clients won't have issues with the server going down on reconnects.
+func (s *tciStruct) initIfNeeded() (err error) {
+	if s.listener != nil || tciPort == 0 {
+		return
+	}
+
+	s.listener, err = net.Listen("tcp", fmt.Sprint(":", tciPort))
+	if err != nil {
+		return
+	}
+
+	log.Print("starting tci server on tcp port ", tciPort)
+
+	s.mutex.Lock()
+	s.clients = make(map[*tciClient]bool)
+	s.mutex.Unlock()
+
+	s.server = &http.Server{Handler: s}
+	go func() {
+		_ = s.server.Serve(s.listener)
+	}()
+
+	s.deinitNeededChan = make(chan bool)
+	s.deinitFinishedChan = make(chan bool)
+	go s.txLoop()
+	return
+}
+
+func (s *tciStruct) deinit() {
+	if s.server != nil {
+		// Hijacked websocket connections are not closed by the server.
+		s.mutex.Lock()
+		for c := range s.clients {
+			c.ws.Close()
+		}
+		s.mutex.Unlock()
+		s.server.Close()
+	}
+
+	if s.deinitNeededChan != nil {
+		s.deinitNeededChan <- true
+		<-s.deinitFinishedChan
+	}
+}
@@ -0,0 +1,28 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+func getTermSize() (cols, rows int, err error) {
+	var ws struct {
+		row    uint16
+		col    uint16
+		xpixel uint16
+		ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.col), int(ws.row), nil
+}
+
+func notifyTermResize(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGWINCH)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+)
+
+// The terminal UI is only used if the terminal is at least this large, the status bar is used otherwise.
+const tuiMinCols = 80
+const tuiMinRows = 24
+
+const tuiLogLength = 1000
+const tuiScopeHistoryLength = 200
+const tuiHelpColumnWidth = 40
+const tuiSparklineWidth = 20
+
+// Full scale values of the bar graphs.
+const tuiSMeterMax = 19 // S9+60
+const tuiSWRMax = 3
+const tuiVdMax = 16
+
+var tuiSparklineChars = []rune("▁▂▃▄▅▆▇█")
+
+type tuiStruct struct {
+	mutex       sync.Mutex
+	initialized bool
+	active      bool
+	cols        int
+	rows        int
+	helpVisible bool
+
+	data     statusLogData
+	logLines []string
+	// Log lines before this index are already written to the console.
+	flushedLogLines int
+	// The newest line is the last one.
+	scopeLines []scopeLine
+
+	resizeChan chan os.Signal
+	scopeChan  chan scopeLine
+
+	barColor  *color.Color
+	paneColor *color.Color
+}
+
+var tui tuiStruct
+
+func (s *tuiStruct) isActive() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.active
+}
+
+// Returns the length of the string without ANSI color codes.
+func (s *tuiStruct) visibleLen(str string) (n int) {
+	inEscape := false
+	for _, r := range str {
+		switch {
+		case inEscape:
+			inEscape = r != 'm'
+		case r == 27:
+			inEscape = true
+		default:
+			n++
+		}
+	}
+	return
+}
+
+// Cuts or pads the string to the given visible width, ANSI color codes are kept.
+func (s *tuiStruct) fit(str string, width int) string {
+	var b strings.Builder
+	var n int
+	inEscape := false
+	hasEscape := false
+	for _, r := range str {
+		switch {
+		case inEscape:
+			inEscape = r != 'm'
+		case r == 27:
+			inEscape = true
+			hasEscape = true
+		case n == width:
+			continue
+		default:
+			n++
+		}
+		b.WriteRune(r)
+	}
+	if hasEscape {
+		// Resetting colors, so a cut color code won't affect the padding.
+		fmt.Fprintf(&b, "%c[0m", 27)
+	}
+	b.WriteString(strings.Repeat(" ", width-n))
+	return b.String()
+}
+
+func (s *tuiStruct) padLeft(str string, length int) string {
+	for len(str) < length {
+		str = " " + str
+	}
+	return str
+}
+
+func (s *tuiStruct) bar(v, max float64, width int) string {
+	n := int(v/max*float64(width) + 0.5)
+	if n < 0 {
+		n = 0
+	} else if n > width {
+		n = width
+	}
+	return strings.Repeat("█", n) + strings.Repeat("░", width-n)
+}
+
+func (s *tuiStruct) sparkline(h []int, width int) string {
+	if len(h) > width {
+		h = h[len(h)-width:]
+	}
+	var max int
+	for _, v := range h {
+		if v > max {
+			max = v
+		}
+	}
+	res := make([]rune, len(h))
+	for i, v := range h {
+		if max > 0 {
+			res[i] = tuiSparklineChars[v*(len(tuiSparklineChars)-1)/max]
+		} else {
+			res[i] = tuiSparklineChars[0]
+		}
+	}
+	return strings.Repeat(" ", width-len(h)) + string(res)
+}
+
+func (s *tuiStruct) paneTitle(title string) string {
+	title = "─ " + title + " "
+	n := s.cols - s.visibleLen(title)
+	if n < 0 {
+		n = 0
+	}
+	return s.paneColor.Sprint(title + strings.Repeat("─", n))
+}
+
+func (s *tuiStruct) renderVFORow(name string, active bool, f uint, mode, dataMode, filter string) string {
+	marker := " "
+	if active {
+		marker = "▶"
+	}
+	freqStr := "?"
+	if f != 0 {
+		freqStr = formatFreqMHz(f)
+	}
+	return fmt.Sprint(" ", marker, " VFO ", name, "  ", s.padLeft(freqStr, 11), "  ", mode, dataMode, " ", filter)
+}
+
+func (s *tuiStruct) renderStateRow() string {
+	d := &s.data
+
+	var parts []string
+	if d.tune {
+		parts = append(parts, statusLog.preGenerated.stateStr.tune)
+	} else if d.ptt {
+		parts = append(parts, statusLog.preGenerated.stateStr.tx)
+	} else {
+		parts = append(parts, statusLog.preGenerated.rxColor.Sprint("  RX   "))
+	}
+	parts = append(parts, d.audioStateStr)
+	for _, v := range []string{d.ts, d.split, d.scan, d.preamp, d.agc} {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if d.nr != "" {
+		if d.nrEnabled {
+			parts = append(parts, "NR"+d.nr)
+		} else {
+			parts = append(parts, "NR-")
+		}
+	}
+	if d.rfGain != "" {
+		parts = append(parts, "rfg "+d.rfGain)
+	}
+	if d.sql != "" {
+		parts = append(parts, "sql "+d.sql)
+	}
+	return " " + strings.Join(parts, " ")
+}
+
+func (s *tuiStruct) renderMeterRows() []string {
+	d := &s.data
+	width := s.cols - 20
+
+	sStr := d.s
+	if d.ovf {
+		sStr += " " + statusLog.preGenerated.ovf
+	}
+	return []string{
+		fmt.Sprintf(" %-4s [%s] %s", "S", s.bar(float64(d.sValue), tuiSMeterMax, width), sStr),
+		fmt.Sprintf(" %-4s [%s] %s", "SWR", s.bar(d.swrValue-1, tuiSWRMax-1, width), d.swr),
+		fmt.Sprintf(" %-4s [%s] %s", "Vd", s.bar(d.vdValue, tuiVdMax, width), d.vd),
+		fmt.Sprintf(" %-4s [%s] %s", "PWR", s.bar(float64(d.txPowerPercent), 100, width), d.txPower),
+	}
+}
+
+func (s *tuiStruct) renderScopeRows(height int) (rows []string) {
+	l := s.scopeLines[len(s.scopeLines)-1]
+	title := fmt.Sprint("scope ", formatFreqMHz(l.freqFrom), " - ", formatFreqMHz(l.freqTo), " MHz ", s.data.scope)
+	if l.outOfRange {
+		title += " " + statusLog.preGenerated.lostColor.Sprint(" OUT OF RANGE ")
+	}
+	rows = append(rows, s.paneTitle(title), l.renderSpectrum(s.cols))
+	for i := len(s.scopeLines) - 1; i >= 0 && len(rows) < height; i-- {
+		rows = append(rows, s.scopeLines[i].renderWaterfall(s.cols))
+	}
+	for len(rows) < height {
+		rows = append(rows, "")
+	}
+	return
+}
+
+func (s *tuiStruct) renderLogRows(height int) (rows []string) {
+	rows = append(rows, s.paneTitle("log"))
+	lines := s.logLines
+	if len(lines) > height-1 {
+		lines = lines[len(lines)-(height-1):]
+	}
+	rows = append(rows, lines...)
+	for len(rows) < height {
+		rows = append(rows, "")
+	}
+	return
+}
+
+func (s *tuiStruct) renderHelpRows(height int) (rows []string) {
+	rows = append(rows, s.paneTitle("hotkeys"))
+	help := keymap.getHelp()
+	columns := s.cols / tuiHelpColumnWidth
+	if columns < 1 {
+		columns = 1
+	}
+	for r := 0; r < height-1; r++ {
+		var row string
+		for c := 0; c < columns; c++ {
+			i := c*(height-1) + r
+			if i >= len(help) {
+				break
+			}
+			row += s.fit(fmt.Sprintf(" %-10s %s", help[i].keys, help[i].desc), tuiHelpColumnWidth)
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+func (s *tuiStruct) renderNetstatRows() []string {
+	d := &s.data
+
+	retransmitsStr := "0"
+	if d.retransmits > 0 {
+		retransmitsStr = statusLog.preGenerated.retransmitsColor.Sprint(" ", d.retransmits, "/", d.retransmitGaps, " ")
+	}
+	lostStr := "0"
+	if d.lost > 0 {
+		lostStr = statusLog.preGenerated.lostColor.Sprint(" ", d.lost, "/", d.lostGaps, " ")
+	}
+	rows := []string{
+		s.paneTitle("net"),
+		fmt.Sprint(" rtt  ", s.padLeft(d.rttStr, 8), "ms   ", s.sparkline(d.rttHistory, tuiSparklineWidth),
+			"  retx ", retransmitsStr, "/1m lost ", lostStr, "/1m jb ", d.jbStr, "ms"),
+		fmt.Sprint(" up   ", s.padLeft(netstat.formatByteCount(d.up), 8), "/s   ",
+			s.sparkline(d.upHistory, tuiSparklineWidth), "  down ", s.padLeft(netstat.formatByteCount(d.down), 8),
+			"/s ", s.sparkline(d.downHistory, tuiSparklineWidth)),
+	}
+	if d.reconnects > 0 || d.probeFailures > 0 {
+		rows = append(rows, fmt.Sprint(" reconnects ", d.reconnects, "  probe failures ", d.probeFailures,
+			"  last reason ", d.reconnectReason, "  waited ", d.reconnectWait.Round(time.Second)))
+	}
+	return rows
+}
+
+func (s *tuiStruct) render() (rows []string) {
+	d := &s.data
+
+	var uptimeStr string
+	if !d.startTime.IsZero() {
+		uptimeStr = fmt.Sprint("up ", time.Since(d.startTime).Round(time.Second))
+	}
+	rows = append(rows, s.barColor.Sprint(s.fit(fmt.Sprint(" kappanhang  ", connectAddress, "  ", uptimeStr), s.cols)))
+
+	var bottomRows []string
+	if !s.helpVisible {
+		bottomRows = s.renderNetstatRows()
+	}
+	if p := cmdPrompt.render(); p != "" {
+		bottomRows = append(bottomRows, p)
+	} else {
+		bottomRows = append(bottomRows, s.barColor.Sprint(s.fit(" ? help  Enter command  q quit", s.cols)))
+	}
+
+	// The help covers everything between the title and the bottom rows, as the bound keys may not fit elsewhere.
+	if s.helpVisible {
+		rows = append(rows, s.renderHelpRows(s.rows-len(rows)-len(bottomRows))...)
+		return append(rows, bottomRows...)
+	}
+
+	// The main frequency belongs to the active VFO.
+	if d.vfoBActive {
+		rows = append(rows, s.renderVFORow("A", false, d.subFrequency, d.subMode, d.subDataMode, d.subFilter),
+			s.renderVFORow("B", true, d.frequency, d.mode, d.dataMode, d.filter))
+	} else {
+		rows = append(rows, s.renderVFORow("A", true, d.frequency, d.mode, d.dataMode, d.filter),
+			s.renderVFORow("B", false, d.subFrequency, d.subMode, d.subDataMode, d.subFilter))
+	}
+	rows = append(rows, s.renderStateRow())
+	rows = append(rows, s.renderMeterRows()...)
+
+	height := s.rows - len(rows) - len(bottomRows)
+	var scopeHeight int
+	if d.scope != "" && len(s.scopeLines) > 0 {
+		scopeHeight = height / 2
+		rows = append(rows, s.renderScopeRows(scopeHeight)...)
+	}
+	rows = append(rows, s.renderLogRows(height-scopeHeight)...)
+	return append(rows, bottomRows...)
+}
+
+func (s *tuiStruct) draw() {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%c[H", 27)
+	for i, row := range s.render() {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(s.fit(row, s.cols))
+	}
+	fmt.Print(b.String())
+}
+
+func (s *tuiStruct) enter() {
+	// Switching to the alternate screen buffer and hiding the cursor.
+	fmt.Printf("%c[?1049h%c[?25l", 27, 27)
+}
+
+func (s *tuiStruct) leave() {
+	fmt.Printf("%c[?25h%c[?1049l", 27, 27)
+
+	// Log lines which were only displayed in the log pane are written to the console so they don't get lost.
+	for _, l := range s.logLines[s.flushedLogLines:] {
+		fmt.Println(l)
+	}
+	s.flushedLogLines = len(s.logLines)
+}
+
+func (s *tuiStruct) resize() {
+	var err error
+	s.cols, s.rows, err = getTermSize()
+	active := err == nil && s.cols >= tuiMinCols && s.rows >= tuiMinRows
+	if active && !s.active {
+		s.enter()
+	} else if !active && s.active {
+		s.leave()
+	}
+	s.active = active
+	if s.active {
+		s.draw()
+	}
+}
+
+func (s *tuiStruct) update(d *statusLogData) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data = *d
+	s.data.upHistory = append([]int(nil), d.upHistory...)
+	s.data.downHistory = append([]int(nil), d.downHistory...)
+	s.data.rttHistory = append([]int(nil), d.rttHistory...)
+	if s.active {
+		s.draw()
+	}
+}
+
+// Returns false if the terminal UI is not active, so the line should be written to the console.
+func (s *tuiStruct) addLogLine(l string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.active {
+		return false
+	}
+
+	s.logLines = append(s.logLines, strings.Split(strings.TrimRight(l, "\n"), "\n")...)
+	if len(s.logLines) > tuiLogLength {
+		n := len(s.logLines) - tuiLogLength
+		s.logLines = s.logLines[n:]
+		s.flushedLogLines -= n
+		if s.flushedLogLines < 0 {
+			s.flushedLogLines = 0
+		}
+	}
+	s.draw()
+	return true
+}
+
+func (s *tuiStruct) toggleHelp() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.helpVisible = !s.helpVisible
+	if s.active {
+		s.draw()
+	}
+}
+
+func (s *tuiStruct) loop() {
+	for {
+		select {
+		case <-s.resizeChan:
+			s.mutex.Lock()
+			s.resize()
+			s.mutex.Unlock()
+		case l := <-s.scopeChan:
+			s.mutex.Lock()
+			s.scopeLines = append(s.scopeLines, l)
+			if len(s.scopeLines) > tuiScopeHistoryLength {
+				s.scopeLines = s.scopeLines[len(s.scopeLines)-tuiScopeHistoryLength:]
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+func (s *tuiStruct) init() {
+	if disableTUI || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.initialized {
+		return
+	}
+	s.initialized = true
+
+	s.barColor = color.New(color.FgBlack)
+	s.barColor.Add(color.BgWhite)
+	s.paneColor = color.New(color.FgHiBlue)
+
+	s.resizeChan = make(chan os.Signal, 1)
+	notifyTermResize(s.resizeChan)
+	s.scopeChan = scope.subscribe()
+	s.resize()
+	go s.loop()
+}
+
+func (s *tuiStruct) deinit() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.initialized {
+		return
+	}
+	signal.Stop(s.resizeChan)
+	if s.active {
+		s.leave()
+		s.active = false
+	}
+}
@@ -2,11 +2,6 @@ package main
 
 import "time"
 
-// This value is sent to the transceiver and - according to my observations - it will use
-// this as it's RX buf length. Note that if it is set to larger than 500-600ms then audio TX
-// won't work (small radio memory?)
-const txSeqBufLength = 300 * time.Millisecond
-
 type txSeqBufEntry struct {
 	seq     seqNum
 	data    []byte
@@ -21,7 +16,7 @@ func (s *txSeqBufStruct) add(seq seqNum, p []byte) {
 	s.entries = append(s.entries, txSeqBufEntry{
 		seq:     seq,
 		data:    p,
-		addedAt: time.Now(),
+		addedAt: clock.now(),
 	})
 	s.purgeOldEntries()
 }
@@ -29,7 +24,8 @@ func (s *txSeqBufStruct) add(seq seqNum, p []byte) {
 func (s *txSeqBufStruct) purgeOldEntries() {
 	// We keep much more entries than the specified length of the TX seqbuf, so we can serve
 	// any requests coming from the server.
-	for len(s.entries) > 0 && time.Since(s.entries[0].addedAt) > txSeqBufLength*10 {
+	retention := getTxSeqBufLength() * 10
+	for len(s.entries) > 0 && clock.since(s.entries[0].addedAt) > retention {
 		s.entries = s.entries[1:]
 	}
 }
@@ -1,6 +1,14 @@
 package main
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
 
 // Checks if all bytes are zeros
 func isAllZero(s []byte) bool {
@@ -19,3 +27,108 @@ func parseNullTerminatedString(d []byte) (res string) {
 	}
 	return
 }
+
+// Parses a frequency given in MHz (like 7.074) to Hz.
+func parseFreqMHz(s string) (uint, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	f = math.Round(f * 1000000)
+	if f <= 0 || f > math.MaxUint32 {
+		return 0, errors.New("invalid frequency " + s)
+	}
+	return uint(f), nil
+}
+
+// Parses frequency offsets like "+1k", "-600k" or "+1.6M", offsets without a suffix are in Hz.
+func parseFreqOffset(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	mul := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mul = 1000
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		mul = 1000000
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round(v * mul)), nil
+}
+
+// Replaces the %Y, %m, %d, %H, %M and %S placeholders in the string with the given time.
+func expandTimeFormat(s string, t time.Time) string {
+	return strings.NewReplacer("%Y", t.Format("2006"), "%m", t.Format("01"), "%d", t.Format("02"),
+		"%H", t.Format("15"), "%M", t.Format("04"), "%S", t.Format("05")).Replace(s)
+}
+
+// Returns the rest of s after the first n whitespace separated fields, keeping its original spacing.
+func skipFields(s string, n int) string {
+	for ; n > 0; n-- {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		i := strings.IndexFunc(s, unicode.IsSpace)
+		if i < 0 {
+			return ""
+		}
+		s = s[i:]
+	}
+	return strings.TrimSpace(s)
+}
+
+func formatFreqMHz(f uint) string {
+	return fmt.Sprintf("%.6f", float64(f)/1000000)
+}
+
+// Frequency lists are limited to this many channels, so a small step on a wide range can't eat up the memory.
+const freqListMaxLen = 100000
+
+// Parses channel lists like "145.500,146.520" or ranges like "7.000-7.200" (in MHz).
+func parseFreqList(str string, step uint) (freqs []uint, err error) {
+	for _, c := range strings.Split(str, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		r := strings.Split(c, "-")
+		switch len(r) {
+		case 1:
+			var f uint
+			if f, err = parseFreqMHz(r[0]); err != nil {
+				return nil, err
+			}
+			if uint(len(freqs)) >= freqListMaxLen {
+				return nil, errors.New("too many frequencies")
+			}
+			freqs = append(freqs, f)
+		case 2:
+			var from, to uint
+			if from, err = parseFreqMHz(r[0]); err != nil {
+				return nil, err
+			}
+			if to, err = parseFreqMHz(r[1]); err != nil {
+				return nil, err
+			}
+			if step == 0 || to < from {
+				return nil, fmt.Errorf("invalid frequency range %s", c)
+			}
+			if (to-from)/step >= freqListMaxLen-uint(len(freqs)) {
+				return nil, fmt.Errorf("too many frequencies in range %s", c)
+			}
+			// Counting the steps, as f += step could wrap around near the maximum value.
+			for i := uint(0); i <= (to-from)/step; i++ {
+				freqs = append(freqs, from+i*step)
+			}
+		default:
+			return nil, fmt.Errorf("invalid frequency range %s", c)
+		}
+	}
+	if len(freqs) == 0 {
+		return nil, errors.New("no frequencies given")
+	}
+	return
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Reads the PCM data of a WAV file. Only the format used by the audio stream is supported
+// (48kHz, 16 bit, mono).
+func readWAVFile(path string) ([]byte, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) < 12 || string(d[0:4]) != "RIFF" || string(d[8:12]) != "WAVE" {
+		return nil, errors.New("not a wav file")
+	}
+
+	var gotFormat bool
+	for i := 12; i+8 <= len(d); {
+		id := string(d[i : i+4])
+		size := int(binary.LittleEndian.Uint32(d[i+4 : i+8]))
+		i += 8
+		if i+size > len(d) {
+			size = len(d) - i
+		}
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("invalid wav format chunk")
+			}
+			format := binary.LittleEndian.Uint16(d[i : i+2])
+			channels := binary.LittleEndian.Uint16(d[i+2 : i+4])
+			rate := binary.LittleEndian.Uint32(d[i+4 : i+8])
+			bits := binary.LittleEndian.Uint16(d[i+14 : i+16])
+			if format != 1 || channels != 1 || rate != audioSampleRate || bits != audioSampleBytes*8 {
+				return nil, fmt.Errorf("unsupported wav format (%d channels, %dHz, %d bits), only %dHz %d bit mono pcm is supported",
+					channels, rate, bits, audioSampleRate, audioSampleBytes*8)
+			}
+			gotFormat = true
+		case "data":
+			if !gotFormat {
+				return nil, errors.New("missing wav format chunk")
+			}
+			return d[i : i+size], nil
+		}
+		// Chunks are padded to even sizes.
+		i += size + size%2
+	}
+	return nil, errors.New("missing wav data chunk")
+}
+
+type wavWriter struct {
+	f        *os.File
+	dataSize int
+}
+
+func (w *wavWriter) writeHeader() error {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+w.dataSize))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], 1) // Mono
+	binary.LittleEndian.PutUint32(h[24:], audioSampleRate)
+	binary.LittleEndian.PutUint32(h[28:], audioSampleRate*audioSampleBytes)
+	binary.LittleEndian.PutUint16(h[32:], audioSampleBytes)
+	binary.LittleEndian.PutUint16(h[34:], audioSampleBytes*8)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(w.dataSize))
+	_, err := w.f.WriteAt(h, 0)
+	return err
+}
+
+// Creates a WAV file in the format used by the audio stream.
+func newWAVWriter(path string) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{f: f}
+	if err := w.writeHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wavWriter) Write(d []byte) (int, error) {
+	n, err := w.f.WriteAt(d, int64(44+w.dataSize))
+	w.dataSize += n
+	return n, err
+}
+
+// Updates the sizes in the header and closes the file.
+func (w *wavWriter) Close() error {
+	err := w.writeHeader()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
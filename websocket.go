@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A minimal RFC 6455 WebSocket server implementation, without extensions.
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+const wsMaxMessageSize = 1 << 20
+
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	writeMutex sync.Mutex
+}
+
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "websocket upgrade needed", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't upgrade connection", http.StatusInternalServerError)
+		return nil, errors.New("can't hijack http connection")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum([]byte(key + wsAcceptGUID))
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.r, h[:]); err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	opcode = h[0] & 0x0f
+
+	l := uint64(h[1] & 0x7f)
+	switch l {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		l = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		l = binary.BigEndian.Uint64(b[:])
+	}
+	if l > wsMaxMessageSize {
+		return false, 0, nil, errors.New("websocket frame is too large")
+	}
+
+	// Frames coming from clients are always masked.
+	var mask [4]byte
+	masked := h[1]&0x80 != 0
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, l)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Returns the next text or binary message, control frames are handled internally.
+func (c *wsConn) readMessage() (opcode byte, data []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := c.writeMessage(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			_ = c.writeMessage(wsOpClose, nil)
+			return 0, nil, io.EOF
+		case wsOpContinuation:
+			data = append(data, payload...)
+		default:
+			opcode = op
+			data = payload
+		}
+		if len(data) > wsMaxMessageSize {
+			return 0, nil, errors.New("websocket message is too large")
+		}
+		if fin {
+			return opcode, data, nil
+		}
+	}
+}
+
+func (c *wsConn) writeMessage(opcode byte, data []byte) error {
+	h := []byte{0x80 | opcode}
+	switch {
+	case len(data) < 126:
+		h = append(h, byte(len(data)))
+	case len(data) < 65536:
+		h = append(h, 126, byte(len(data)>>8), byte(len(data)))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(len(data)))
+		h = append(append(h, 127), b[:]...)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.conn.Write(append(h, data...))
+	return err
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}